@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes for monitoring plugins - nagios-plugins.org/doc/guidelines.html#AEN78
+const (
+	CHECK_OK = 0
+	CHECK_WARNING = 1
+	CHECK_CRITICAL = 2
+	CHECK_UNKNOWN = 3
+)
+
+// Names of the exit codes, for the first line of output
+var checkStateNames = []string { "OK", "WARNING", "CRITICAL", "UNKNOWN" }
+
+// A range of values that trigger an alert, in the format of monitoring plugins (e.g., '10', '10:', '~:10', '10:20' or '@10:20')
+// nagios-plugins.org/doc/guidelines.html#THRESHOLDFORMAT
+type CheckRange struct {
+	Text string
+	Start float64
+	End float64
+	Inside bool // Alert if inside the range, instead of outside it
+}
+
+// Parses a range, with an empty string being a range that never alerts
+func ParseCheckRange( text string ) ( checkRange *CheckRange, err error ) {
+	if ( text == "" ) { return nil, nil }
+
+	checkRange = &CheckRange { Text: text, Start: 0, End: math.Inf( 1 ) }
+	if strings.HasPrefix( text, "@" ) {
+		checkRange.Inside = true
+		text = text[ 1 : ]
+	}
+
+	// Just the end, with the start being zero
+	start, end, hasSeparator := strings.Cut( text, ":" )
+	if !hasSeparator { start, end = "0", start }
+
+	// Start, which can be negative infinity
+	if ( start == "~" ) {
+		checkRange.Start = math.Inf( -1 )
+	} else if ( start != "" ) {
+		checkRange.Start, err = strconv.ParseFloat( start, 64 )
+		if err != nil { return nil, fmt.Errorf( "invalid start of range '%s'", checkRange.Text ) }
+	}
+
+	// End, which is positive infinity if missing
+	if ( end != "" ) {
+		checkRange.End, err = strconv.ParseFloat( end, 64 )
+		if err != nil { return nil, fmt.Errorf( "invalid end of range '%s'", checkRange.Text ) }
+	}
+
+	if ( checkRange.Start > checkRange.End ) { return nil, fmt.Errorf( "start of range '%s' is greater than the end", checkRange.Text ) }
+
+	return checkRange, nil
+}
+
+// Checks if a value should trigger an alert
+func ( checkRange *CheckRange ) Alerts( value float64 ) bool {
+	if ( checkRange == nil ) { return false }
+
+	isInside := value >= checkRange.Start && value <= checkRange.End
+	return isInside == checkRange.Inside
+}
+
+// Gets the range as given, for perfdata
+func ( checkRange *CheckRange ) String() string {
+	if ( checkRange == nil ) { return "" }
+	return checkRange.Text
+}
+
+// The names of the values that are checked, as in their flags (e.g., '-line-voltage-warning')
+var checkValueNames = []string { "charge", "runtime", "load", "temperature", "line-voltage", "battery-age" }
+
+// A warning & critical range for a value in the configuration file, where nothing means it is inherited (e.g., from the top-level thresholds) & empty means it is not checked
+type CheckThreshold struct {
+	Warning *string `yaml:"warning"`
+	Critical *string `yaml:"critical"`
+
+	// The line it begins on in the configuration file, for pointing out invalid ranges
+	line int
+}
+
+// The ranges for each value in the configuration file, for every target or just one
+type CheckThresholds struct {
+	Charge CheckThreshold `yaml:"charge"`
+	Runtime CheckThreshold `yaml:"runtime"`
+	Load CheckThreshold `yaml:"load"`
+	Temperature CheckThreshold `yaml:"temperature"`
+	LineVoltage CheckThreshold `yaml:"line_voltage"`
+	BatteryAge CheckThreshold `yaml:"battery_age"`
+}
+
+// Gets the range for a value by its name & level (e.g., 'charge' & 'warning'), or nothing if it is inherited
+func ( thresholds *CheckThresholds ) Get( name string, level string ) *string {
+	if ( thresholds == nil ) { return nil }
+
+	structure := reflect.ValueOf( thresholds ).Elem()
+	for index := 0; index < structure.NumField(); index++ {
+		if ( structure.Type().Field( index ).Tag.Get( "yaml" ) != strings.ReplaceAll( name, "-", "_" ) ) { continue }
+
+		threshold := structure.Field( index ).Addr().Interface().( *CheckThreshold )
+		if ( level == "critical" ) { return threshold.Critical }
+		return threshold.Warning
+	}
+
+	return nil
+}
+
+// Checks all of the ranges that are set are valid
+func ( thresholds *CheckThresholds ) Validate() error {
+	structure := reflect.ValueOf( thresholds ).Elem()
+	for index := 0; index < structure.NumField(); index++ {
+		threshold := structure.Field( index ).Addr().Interface().( *CheckThreshold )
+
+		for level, text := range map[ string ]*string { "warning": threshold.Warning, "critical": threshold.Critical } {
+			if ( text == nil ) { continue }
+			if _, rangeError := ParseCheckRange( *text ); rangeError != nil { return fmt.Errorf( "line %d: Invalid %s range for %s: %s.", threshold.line, level, structure.Type().Field( index ).Tag.Get( "yaml" ), rangeError.Error() ) }
+		}
+	}
+
+	return nil
+}
+
+// A value of the status to check, with its thresholds
+type checkValue struct {
+	Label string
+	Unit string // Unit of measurement for perfdata, if there is a standard one
+	Value float64
+	Minimum string
+	Maximum string
+	Format string // For the summary
+	Warning *CheckRange
+	Critical *CheckRange
+}
+
+// Runs the check subcommand, giving the exit code
+func runCheck( arguments []string ) int {
+	flagSet := flag.NewFlagSet( "check", flag.ContinueOnError )
+
+	// Values of the command-line flags, and the defaults
+	flagConfig := flagSet.String( "config", "", "The path to the configuration file of the exporter, to check one of its targets with its thresholds." )
+	flagTarget := flagSet.String( "target", "", "The name of the target in the configuration file to check, defaults to the first." )
+	flagNisAddress := flagSet.String( "nis-address", "127.0.0.1", "The IPv4 address of the apcupsd Network Information Server." )
+	flagNisPort := flagSet.Int( "nis-port", 3551, "The port number of the apcupsd Network Information Server." )
+	flagTimeout := flagSet.Int( "timeout", 10, "The time in seconds to wait for the Network Information Server." )
+	flagSet.String( "charge-warning", "50:", "The range of battery charge percentages to warn for." )
+	flagSet.String( "charge-critical", "25:", "The range of battery charge percentages to be critical for." )
+	flagSet.String( "runtime-warning", "10:", "The range of remaining runtimes in minutes to warn for." )
+	flagSet.String( "runtime-critical", "5:", "The range of remaining runtimes in minutes to be critical for." )
+	flagSet.String( "load-warning", "80", "The range of load percentages to warn for." )
+	flagSet.String( "load-critical", "95", "The range of load percentages to be critical for." )
+	flagSet.String( "temperature-warning", "40", "The range of internal temperatures in Celsius to warn for." )
+	flagSet.String( "temperature-critical", "50", "The range of internal temperatures in Celsius to be critical for." )
+	flagSet.String( "line-voltage-warning", "", "The range of mains input voltages to warn for (e.g., 210:250). Not checked if empty." )
+	flagSet.String( "line-voltage-critical", "", "The range of mains input voltages to be critical for (e.g., 200:260). Not checked if empty." )
+	flagSet.String( "battery-age-warning", "1095", "The range of battery ages in days (since it was last replaced) to warn for." )
+	flagSet.String( "battery-age-critical", "", "The range of battery ages in days (since it was last replaced) to be critical for. Not checked if empty." )
+
+	// Set a custom help message
+	flagSet.Usage = func() {
+		fmt.Printf( "%s, v%s, by %s (%s).\n", PROJECT_NAME, PROJECT_VERSION, AUTHOR_NAME, AUTHOR_WEBSITE )
+		fmt.Printf( "\nChecks the UPS once, for Nagios, Icinga & other compatible monitoring systems.\nRanges are in the standard format of monitoring plugins, such as '10' (alert outside 0 to 10), '10:' (alert below 10), '~:10' (alert above 10), '10:20' (alert outside 10 to 20) or '@10:20' (alert inside 10 to 20).\nRanges given as flags take precedence over those of the target in the configuration file, which take precedence over the top-level thresholds.\n" )
+		fmt.Printf( "\nUsage: %s check [-h/-help] [-config <path>] [-target <name>] [-nis-address <IPv4 address>] [-nis-port <number>] [-timeout <seconds>] [-<value>-warning <range>] [-<value>-critical <range>]...\n", os.Args[ 0 ] )
+		flagSet.PrintDefaults()
+	}
+
+	// Anything wrong with how we were run is unknown, as the state of the UPS was never checked
+	if parseError := flagSet.Parse( arguments ); parseError != nil { return CHECK_UNKNOWN }
+	fail := func( message string ) int {
+		fmt.Printf( "UPS UNKNOWN - %s\n", message )
+		return CHECK_UNKNOWN
+	}
+
+	givenFlags := map[ string ]bool {}
+	flagSet.Visit( func( givenFlag *flag.Flag ) { givenFlags[ givenFlag.Name ] = true } )
+
+	nisAddress := net.ParseIP( *flagNisAddress )
+	if ( nisAddress == nil || nisAddress.To4() == nil ) { return fail( "Invalid IPv4 address for apcupsd's Network Information Server." ) }
+	if ( *flagNisPort <= 0 || *flagNisPort >= 65536 ) { return fail( "Invalid port number for apcupsd's Network Information Server." ) }
+	if ( *flagTimeout <= 0 ) { return fail( "Invalid timeout, must be greater than 0." ) }
+
+	// Use a target & its thresholds from the configuration file of the exporter, unless the flags say otherwise
+	var configuredThresholds, targetThresholds *CheckThresholds
+	if ( *flagConfig != "" ) {
+		configuration, parseError := ParseConfiguration( []string { "-config", *flagConfig } )
+		if parseError != nil { return fail( parseError.Error() ) }
+		if validateError := configuration.Validate(); validateError != nil { return fail( validateError.Error() ) }
+
+		target := configuration.nisTargets[ 0 ]
+		if ( *flagTarget != "" ) {
+			index := slices.IndexFunc( configuration.nisTargets, func( target NISTarget ) bool { return target.Name == *flagTarget } )
+			if ( index == -1 ) { return fail( fmt.Sprintf( "Unknown target '%s' in the configuration file.", *flagTarget ) ) }
+			target = configuration.nisTargets[ index ]
+		}
+
+		if !givenFlags[ "nis-address" ] { nisAddress = target.Address }
+		if !givenFlags[ "nis-port" ] { *flagNisPort = target.Port }
+		configuredThresholds, targetThresholds = &configuration.Thresholds, target.Thresholds
+	} else if ( *flagTarget != "" ) {
+		return fail( "A target can only be given with a configuration file." )
+	}
+
+	// Parse all the ranges, from the flags if given, otherwise the target, otherwise the top-level thresholds, otherwise the defaults of the flags
+	ranges := map[ string ]*CheckRange {}
+	for _, valueName := range checkValueNames {
+		for _, level := range []string { "warning", "critical" } {
+			name := fmt.Sprintf( "%s-%s", valueName, level )
+			text := flagSet.Lookup( name ).Value.String()
+			if !givenFlags[ name ] {
+				if configuredText := configuredThresholds.Get( valueName, level ); configuredText != nil { text = *configuredText }
+				if targetText := targetThresholds.Get( valueName, level ); targetText != nil { text = *targetText }
+			}
+
+			checkRange, rangeError := ParseCheckRange( text )
+			if rangeError != nil { return fail( fmt.Sprintf( "Invalid -%s: %s.", name, rangeError.Error() ) ) }
+			ranges[ name ] = checkRange
+		}
+	}
+
+	// Fetch the status, the same way as the exporter, giving up on the whole exchange (not just connecting) once the timeout passes
+	ctx, cancel := context.WithTimeout( context.Background(), time.Duration( *flagTimeout ) * time.Second )
+	defer cancel()
+	var networkInformationServer NetworkInformationServer
+	connectError := networkInformationServer.ConnectContext( ctx, nisAddress, *flagNisPort, *flagTimeout * 1000 )
+	if connectError != nil { return fail( fmt.Sprintf( "Failed to connect to the Network Information Server: %s", connectError.Error() ) ) }
+	defer networkInformationServer.Disconnect()
+	status, statusError := networkInformationServer.FetchStatus()
+	if statusError != nil { return fail( fmt.Sprintf( "Failed to fetch status from the Network Information Server: %s", statusError.Error() ) ) }
+
+	// Battery age, if the date it was replaced is known
+	batteryAgeDays := -1.0
+	if !status.UPS.Battery.LastReplacementDate.IsZero() { batteryAgeDays = math.Floor( time.Since( status.UPS.Battery.LastReplacementDate ).Hours() / 24 ) }
+
+	state, summary, perfdata := evaluateCheck( status, []checkValue {
+		{ "charge", "%", status.UPS.Battery.ChargePercent, "0", "100", "charge %.0f%%", ranges[ "charge-warning" ], ranges[ "charge-critical" ] },
+		{ "runtime", "", status.UPS.Battery.RemainingRuntimeMinutes, "0", "", "runtime %.1f minutes", ranges[ "runtime-warning" ], ranges[ "runtime-critical" ] },
+		{ "load", "%", status.UPS.LoadPercent, "0", "100", "load %.0f%%", ranges[ "load-warning" ], ranges[ "load-critical" ] },
+		{ "temperature", "", status.UPS.Temperature, "", "", "temperature %.1f°C", ranges[ "temperature-warning" ], ranges[ "temperature-critical" ] },
+		{ "line_voltage", "", status.UPS.LineVoltage, "0", "", "line %.1f V", ranges[ "line-voltage-warning" ], ranges[ "line-voltage-critical" ] },
+		{ "battery_age", "", batteryAgeDays, "0", "", "battery %.0f days old", ranges[ "battery-age-warning" ], ranges[ "battery-age-critical" ] },
+	} )
+
+	fmt.Printf( "UPS %s - %s | %s\n", checkStateNames[ state ], summary, perfdata )
+
+	return state
+}
+
+// Compares the status with the thresholds, giving the state, a summary & perfdata
+func evaluateCheck( status Status, values []checkValue ) ( state int, summary string, perfdata string ) {
+	var problems, details, perfdataParts []string
+
+	// The status flags of the UPS itself
+	upsName := getUPSName( status )
+	statusText := strings.TrimSpace( status.UPS.StatusText )
+	if ( hasStatusFlag( statusText, "COMMLOST" ) || hasStatusFlag( statusText, "LOWBATT" ) || hasStatusFlag( statusText, "SHUTTING" ) ) {
+		state = CHECK_CRITICAL
+	} else if ( hasStatusFlag( statusText, "ONBATT" ) || hasStatusFlag( statusText, "REPLACEBATT" ) || hasStatusFlag( statusText, "OVERLOAD" ) ) {
+		state = CHECK_WARNING
+	}
+	if ( state != CHECK_OK ) { problems = append( problems, fmt.Sprintf( "status %s", statusText ) ) }
+
+	// Each value, skipping any the UPS does not report
+	for _, value := range values {
+		if ( value.Value < 0 ) { continue }
+
+		description := fmt.Sprintf( value.Format, value.Value )
+		if value.Critical.Alerts( value.Value ) {
+			state = CHECK_CRITICAL
+			problems = append( problems, fmt.Sprintf( "%s (critical %s)", description, value.Critical ) )
+		} else if value.Warning.Alerts( value.Value ) {
+			state = max( state, CHECK_WARNING )
+			problems = append( problems, fmt.Sprintf( "%s (warning %s)", description, value.Warning ) )
+		} else {
+			details = append( details, description )
+		}
+
+		// 'label'=value[UOM];[warn];[crit];[min];[max]
+		perfdataParts = append( perfdataParts, strings.TrimRight( fmt.Sprintf( "%s=%s%s;%s;%s;%s;%s", value.Label, strconv.FormatFloat( value.Value, 'f', -1, 64 ), value.Unit, value.Warning, value.Critical, value.Minimum, value.Maximum ), ";" ) )
+	}
+
+	// Problems first, so they are seen even if the output is truncated
+	summary = fmt.Sprintf( "%s is %s", upsName, statusText )
+	if ( len( problems ) > 0 ) { summary += ": " + strings.Join( problems, ", " ) }
+	if ( len( details ) > 0 ) { summary += "; " + strings.Join( details, ", " ) }
+
+	return state, summary, strings.Join( perfdataParts, " " )
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseCheckRange( t *testing.T ) {
+	for _, test := range []struct {
+		text string
+		start float64
+		end float64
+		inside bool
+	} {
+		{ "10", 0, 10, false },
+		{ "10:", 10, math.Inf( 1 ), false },
+		{ "~:10", math.Inf( -1 ), 10, false },
+		{ "10:20", 10, 20, false },
+		{ "@10:20", 10, 20, true },
+		{ "-5:5", -5, 5, false },
+	} {
+		checkRange, err := ParseCheckRange( test.text )
+		if err != nil { t.Errorf( "%q: unexpected error %v", test.text, err ); continue }
+		if ( checkRange.Start != test.start || checkRange.End != test.end || checkRange.Inside != test.inside ) { t.Errorf( "%q: unexpected range %+v", test.text, checkRange ) }
+		if ( checkRange.String() != test.text ) { t.Errorf( "%q: expected to be given as is, got %q", test.text, checkRange.String() ) }
+	}
+
+	// An empty range never alerts
+	if checkRange, err := ParseCheckRange( "" ); ( checkRange != nil || err != nil || checkRange.Alerts( 1000 ) ) { t.Errorf( "expected no range for an empty string, got %+v & %v", checkRange, err ) }
+
+	for _, text := range []string { "abc", "10:abc", "~:abc", "20:10" } {
+		if _, err := ParseCheckRange( text ); err == nil { t.Errorf( "%q: expected an error", text ) }
+	}
+}
+
+func TestCheckRangeAlerts( t *testing.T ) {
+	for _, test := range []struct {
+		text string
+		value float64
+		alerts bool
+	} {
+		// Outside 0 to 10
+		{ "10", -1, true },
+		{ "10", 0, false },
+		{ "10", 10, false },
+		{ "10", 10.5, true },
+
+		// Below 10
+		{ "10:", 9.9, true },
+		{ "10:", 10, false },
+		{ "10:", 1e9, false },
+
+		// Above 10
+		{ "~:10", -1e9, false },
+		{ "~:10", 10, false },
+		{ "~:10", 11, true },
+
+		// Outside 10 to 20
+		{ "10:20", 9, true },
+		{ "10:20", 15, false },
+		{ "10:20", 21, true },
+
+		// Inside 10 to 20, including the ends
+		{ "@10:20", 9, false },
+		{ "@10:20", 10, true },
+		{ "@10:20", 20, true },
+		{ "@10:20", 21, false },
+	} {
+		checkRange, _ := ParseCheckRange( test.text )
+		if ( checkRange.Alerts( test.value ) != test.alerts ) { t.Errorf( "%q with %v: expected alerting to be %v", test.text, test.value, test.alerts ) }
+	}
+}
+
+// Parses a range that is known to be valid
+func mustParseCheckRange( t *testing.T, text string ) *CheckRange {
+	t.Helper()
+
+	checkRange, err := ParseCheckRange( text )
+	if err != nil { t.Fatal( err ) }
+
+	return checkRange
+}
+
+func TestEvaluateCheck( t *testing.T ) {
+	for _, test := range []struct {
+		statusText string
+		charge float64
+		load float64
+		state int
+		summary string
+	} {
+		{ "ONLINE", 100, 20, CHECK_OK, "rack1 is ONLINE; charge 100%, load 20%" },
+		{ "ONLINE", 40, 20, CHECK_WARNING, "rack1 is ONLINE: charge 40% (warning 50:); load 20%" },
+		{ "ONLINE", 100, 96, CHECK_CRITICAL, "rack1 is ONLINE: load 96% (critical 95); charge 100%" },
+		{ "ONLINE", 40, 96, CHECK_CRITICAL, "rack1 is ONLINE: charge 40% (warning 50:), load 96% (critical 95)" },
+		{ "ONBATT", 100, 20, CHECK_WARNING, "rack1 is ONBATT: status ONBATT; charge 100%, load 20%" },
+		{ "ONBATT LOWBATT", 100, 20, CHECK_CRITICAL, "rack1 is ONBATT LOWBATT: status ONBATT LOWBATT; charge 100%, load 20%" },
+		{ "COMMLOST", 100, 20, CHECK_CRITICAL, "rack1 is COMMLOST: status COMMLOST; charge 100%, load 20%" },
+	} {
+		status := Status { Target: "rack1" }
+		status.UPS.StatusText = test.statusText
+
+		state, summary, perfdata := evaluateCheck( status, []checkValue {
+			{ "charge", "%", test.charge, "0", "100", "charge %.0f%%", mustParseCheckRange( t, "50:" ), mustParseCheckRange( t, "25:" ) },
+			{ "load", "%", test.load, "0", "100", "load %.0f%%", mustParseCheckRange( t, "80" ), mustParseCheckRange( t, "95" ) },
+			{ "battery_age", "", -1, "0", "", "battery %.0f days old", mustParseCheckRange( t, "1095" ), nil }, // Not reported by the UPS
+		} )
+		if ( state != test.state || summary != test.summary ) { t.Errorf( "%s with charge %v & load %v: unexpected %s - %s", test.statusText, test.charge, test.load, checkStateNames[ state ], summary ) }
+
+		expectedPerfdata := "charge=" + strconv.FormatFloat( test.charge, 'f', -1, 64 ) + "%;50:;25:;0;100 load=" + strconv.FormatFloat( test.load, 'f', -1, 64 ) + "%;80;95;0;100"
+		if ( perfdata != expectedPerfdata ) { t.Errorf( "expected perfdata %q, got %q", expectedPerfdata, perfdata ) }
+	}
+}
+
+func TestCheckTimesOutOnStalledServer( t *testing.T ) {
+
+	// Accepts connections but never responds to them
+	listener, listenError := net.Listen( "tcp4", "127.0.0.1:0" )
+	if listenError != nil { t.Fatal( listenError ) }
+	defer listener.Close()
+	go func() {
+		for {
+			connection, acceptError := listener.Accept()
+			if acceptError != nil { return }
+			defer connection.Close()
+		}
+	}()
+
+	startedAt := time.Now()
+	port := strconv.Itoa( listener.Addr().( *net.TCPAddr ).Port )
+	if state := runCheck( []string { "-nis-port", port, "-timeout", "1" } ); ( state != CHECK_UNKNOWN ) { t.Errorf( "expected an unknown state, got %s", checkStateNames[ state ] ) }
+	if elapsed := time.Since( startedAt ); ( elapsed > 3 * time.Second ) { t.Errorf( "expected to give up after the timeout, took %s", elapsed ) }
+}
+
+func TestEvaluateCheckNamesUPS( t *testing.T ) {
+	for _, test := range []struct {
+		target string
+		name string
+		serialNumber string
+		expected string
+	} {
+		{ "rack1", "Server Room", "3B1234X56789", "rack1 is ONLINE" },
+		{ "", "Server Room", "3B1234X56789", "Server Room is ONLINE" }, // Not made safe for MQTT topics
+		{ "", "", "3B1234X56789", "3B1234X56789 is ONLINE" },
+		{ "", "", "", "ups is ONLINE" },
+	} {
+		status := Status { Target: test.target }
+		status.UPS.Name, status.UPS.SerialNumber, status.UPS.StatusText = test.name, test.serialNumber, "ONLINE"
+
+		if _, summary, _ := evaluateCheck( status, nil ); ( summary != test.expected ) { t.Errorf( "expected %q, got %q", test.expected, summary ) }
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// A Network Information Server to collect statuses from
+type NISTarget struct {
+
+	// What the target is called, which is added to its metrics as the 'ups' label, or empty if it is the only target
+	Name string
+
+	// Where the server is listening
+	Address net.IP
+	Port int
+
+	// Extra constant labels for the metrics of just this target
+	Labels map[ string ]string
+
+	// The ranges for the check subcommand from the configuration file, or nothing if the target is from the flags
+	Thresholds *CheckThresholds
+
+}
+
+// Gets where the server is listening, for display purposes
+func ( target NISTarget ) String() string {
+	return fmt.Sprintf( "%s:%d", target.Address, target.Port )
+}
+
+// Creates a key that changes whenever any of the settings of the target do
+func ( target NISTarget ) key() string {
+	return createTargetKey( target.Name, target.Address.String(), target.Port, target.Labels )
+}
+
+// Structure to collect statuses from one Network Information Server, keeping everything derived from them apart from the other targets
+type Collector struct {
+	NISTarget
+
+	// Every setting the collector was created with, so it is kept across reloads if none of them changed
+	key string
+
+	// The metrics about the UPS, in a registry of their own so they are removed along with the target
+	registry *prometheus.Registry
+	metrics *Metrics
+
+	// When the daemon last got data from the UPS (as unix milliseconds), or zero if unknown
+	timestamp atomic.Int64
+
+	// Whether statuses are being fetched, for the readiness endpoint
+	Health HealthTracker
+
+	// State carried between statuses
+	outages OutageTracker
+	energy EnergyMeter
+	events EventDetector
+
+}
+
+// How the metrics of every collector are named & labelled, which is only set at startup as changing it requires a restart
+type MetricsSettings struct {
+	Namespace string
+	ConstantLabels map[ string ]string
+	Schema string
+}
+
+// Guards the collectors, as the configuration can be reloaded while they are in use
+var collectorsMutex sync.RWMutex
+
+// The collector for each target in the configuration, and how their metrics are named & labelled
+var collectors []*Collector
+var collectorMetricsSettings MetricsSettings
+
+// Creates a collector for a target, with its metrics registered & reset
+func NewCollector( target NISTarget, settings MetricsSettings ) *Collector {
+	collector := &Collector {
+		NISTarget: target,
+		key: target.key(),
+		registry: prometheus.NewRegistry(),
+	}
+
+	// Label the metrics with the target, so they can be told apart from those of the other targets
+	labels := prometheus.Labels {}
+	for name, value := range settings.ConstantLabels { labels[ name ] = value }
+	for name, value := range target.Labels { labels[ name ] = value }
+	if ( target.Name != "" ) { labels[ "ups" ] = target.Name }
+
+	collector.metrics = NewMetrics( collector.registry, settings.Namespace, labels, settings.Schema )
+	collector.metrics.Reset()
+
+	// Power events are named after the target, even if the first status could not be fetched
+	collector.events.previousStatus.Target = target.Name
+
+	return collector
+}
+
+// Sets the time the daemon last got data from the UPS, for timestamping the metrics
+func ( collector *Collector ) setTimestamp( date time.Time ) {
+	if date.IsZero() {
+		collector.timestamp.Store( 0 )
+	} else {
+		collector.timestamp.Store( date.UnixMilli() )
+	}
+}
+
+// Gets a copy of the collectors, so they can be used without holding the lock
+func getCollectors() []*Collector {
+	collectorsMutex.RLock()
+	defer collectorsMutex.RUnlock()
+
+	return append( []*Collector {}, collectors... )
+}
+
+// Gets the collector for a target by its name, or nothing if there is no such target
+func getCollector( name string ) *Collector {
+	for _, collector := range getCollectors() {
+		if ( collector.Name == name ) { return collector }
+	}
+
+	return nil
+}
+
+// Starts collecting from the targets in a validated configuration, keeping the collectors (and so the metrics) of any targets that did not change
+// NOTE: The outage debounce & energy gap are applied by the background metrics collection, as it is the only user of them
+func applyCollectors( configuration *Configuration ) {
+	maximumFetchAge := time.Duration( configuration.ReadyMaximumFetchAge ) * time.Second
+	if ( configuration.ReadyMaximumFetchAge == 0 ) { maximumFetchAge = 3 * time.Duration( configuration.MetricsInterval ) * time.Second }
+	maximumDataAge := time.Duration( configuration.ReadyMaximumDataAge ) * time.Second
+
+	collectorsMutex.Lock()
+	defer collectorsMutex.Unlock()
+
+	existingCollectors := map[ string ]*Collector {}
+	for _, collector := range collectors { existingCollectors[ collector.key ] = collector }
+
+	var nextCollectors []*Collector
+	for _, target := range configuration.nisTargets {
+		collector, exists := existingCollectors[ target.key() ]
+		if exists {
+			delete( existingCollectors, collector.key )
+		} else {
+			collector = NewCollector( target, collectorMetricsSettings )
+			if ( len( collectors ) > 0 ) { slog.Info( "Started collecting from a target", "target", target.String(), "name", target.Name ) }
+		}
+
+		collector.Health.Configure( target.String(), maximumFetchAge, maximumDataAge )
+
+		nextCollectors = append( nextCollectors, collector )
+	}
+
+	// Those left over are no longer in the configuration, so their metrics go with them
+	for _, collector := range existingCollectors {
+		slog.Info( "Stopped collecting from a target", "target", collector.NISTarget.String(), "name", collector.Name )
+	}
+
+	collectors = nextCollectors
+}
+
+/*************************************/
+
+// Gathers the metrics of every collector, which can change whenever the configuration is reloaded
+type CollectorsGatherer struct {
+
+	// Whether to stamp each sample with the time the daemon last got data from the UPS, instead of the scrape time
+	Timestamped bool
+
+}
+
+// Gathers the metrics from every collector, merging those with the same name
+func ( gatherer CollectorsGatherer ) Gather() ( families []*dto.MetricFamily, err error ) {
+	gatherers := prometheus.Gatherers {}
+	for _, collector := range getCollectors() {
+		if gatherer.Timestamped {
+			gatherers = append( gatherers, TimestampedGatherer { Gatherer: collector.registry, Timestamp: &collector.timestamp } )
+		} else {
+			gatherers = append( gatherers, collector.registry )
+		}
+	}
+
+	return gatherers.Gather()
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// The configuration of the exporter, from a YAML file, environment variables & command-line flags
+// NOTE: The keys in the file are the names of the flags with underscores, pluralised for those that can be given multiple times
+// NOTE: The targets, outputs & notifiers are lists of blocks in the file, and their flags are shortcuts that replace them
+type Configuration struct {
+	ConfigFile string `yaml:"-" flag:"config"`
+	NisAddress string `yaml:"-" flag:"nis-address"`
+	NisPort int `yaml:"-" flag:"nis-port"`
+	MetricsAddress string `yaml:"metrics_address" flag:"metrics-address"`
+	MetricsPort int `yaml:"metrics_port" flag:"metrics-port"`
+	MetricsSocket string `yaml:"metrics_socket" flag:"metrics-socket"`
+	MetricsPath string `yaml:"metrics_path" flag:"metrics-path"`
+	MetricsInterval int `yaml:"metrics_interval" flag:"metrics-interval"`
+	OutageDebounce int `yaml:"outage_debounce" flag:"outage-debounce"`
+	MetricsNamespace string `yaml:"metrics_namespace" flag:"metrics-namespace"`
+	MetricsLabels repeatableFlag `yaml:"metrics_labels" flag:"metrics-label"`
+	MetricsInclude string `yaml:"metrics_include" flag:"metrics-include"`
+	MetricsExclude string `yaml:"metrics_exclude" flag:"metrics-exclude"`
+	MetricsSchema string `yaml:"metrics_schema" flag:"metrics-schema"`
+	MetricsTimestamps bool `yaml:"metrics_timestamps" flag:"metrics-timestamps"`
+	Outputs repeatableFlag `yaml:"-" flag:"output"`
+	PushJob string `yaml:"-" flag:"push-job"`
+	PushLabels repeatableFlag `yaml:"-" flag:"push-label"`
+	PushUsername string `yaml:"-" flag:"push-username"`
+	PushPassword string `yaml:"-" flag:"push-password"`
+	PushAttempts int `yaml:"-" flag:"push-attempts"`
+	RemoteWriteLabels repeatableFlag `yaml:"-" flag:"remote-write-label"`
+	RemoteWriteUsername string `yaml:"-" flag:"remote-write-username"`
+	RemoteWritePassword string `yaml:"-" flag:"remote-write-password"`
+	RemoteWriteBatchSize int `yaml:"-" flag:"remote-write-batch-size"`
+	RemoteWriteQueueSize int `yaml:"-" flag:"remote-write-queue-size"`
+	InfluxOrganisation string `yaml:"-" flag:"influxdb-org"`
+	InfluxBucket string `yaml:"-" flag:"influxdb-bucket"`
+	InfluxToken string `yaml:"-" flag:"influxdb-token"`
+	InfluxBatchSize int `yaml:"-" flag:"influxdb-batch-size"`
+	MQTTTopic string `yaml:"-" flag:"mqtt-topic"`
+	MQTTClientID string `yaml:"-" flag:"mqtt-client-id"`
+	MQTTUsername string `yaml:"-" flag:"mqtt-username"`
+	MQTTPassword string `yaml:"-" flag:"mqtt-password"`
+	MQTTDiscoveryPrefix string `yaml:"-" flag:"mqtt-discovery-prefix"`
+	OTLPHeaders repeatableFlag `yaml:"-" flag:"otlp-header"`
+	MetricsDisable bool `yaml:"metrics_disable" flag:"metrics-disable"`
+	Webhooks repeatableFlag `yaml:"-" flag:"webhook"`
+	WebhookTemplate string `yaml:"-" flag:"webhook-template"`
+	WebhookAttempts int `yaml:"-" flag:"webhook-attempts"`
+	WebhookDedupe int `yaml:"-" flag:"webhook-dedupe"`
+	SMTPAddress string `yaml:"-" flag:"smtp-address"`
+	SMTPTLS string `yaml:"-" flag:"smtp-tls"`
+	SMTPUsername string `yaml:"-" flag:"smtp-username"`
+	SMTPPassword string `yaml:"-" flag:"smtp-password"`
+	EmailFrom string `yaml:"-" flag:"email-from"`
+	EmailTo repeatableFlag `yaml:"-" flag:"email-to"`
+	EmailInterval int `yaml:"-" flag:"email-interval"`
+	EventLogs repeatableFlag `yaml:"-" flag:"event-log"`
+	EventLogMaximumSize int `yaml:"-" flag:"event-log-max-size"`
+	EventLogMaximumFiles int `yaml:"-" flag:"event-log-max-files"`
+	HistoryPath string `yaml:"history_path" flag:"history-path"`
+	HistoryRetention int `yaml:"history_retention" flag:"history-retention"`
+	HistoryDownsampledRetention int `yaml:"history_downsampled_retention" flag:"history-downsampled-retention"`
+	HistoryDownsampleInterval int `yaml:"history_downsample_interval" flag:"history-downsample-interval"`
+	Once bool `yaml:"once" flag:"once"`
+	DashboardDisable bool `yaml:"dashboard_disable" flag:"dashboard-disable"`
+	DashboardHistory int `yaml:"dashboard_history" flag:"dashboard-history"`
+	WebConfigFile string `yaml:"web_config_file" flag:"web-config-file"`
+	ReadyMaximumFetchAge int `yaml:"ready_max_fetch_age" flag:"ready-max-fetch-age"`
+	ReadyMaximumDataAge int `yaml:"ready_max_data_age" flag:"ready-max-data-age"`
+	NUTAddress string `yaml:"nut_address" flag:"nut-address"`
+	NUTPort int `yaml:"nut_port" flag:"nut-port"`
+	NUTUPSName string `yaml:"nut_ups_name" flag:"nut-ups-name"`
+	NUTUsers repeatableFlag `yaml:"nut_users" flag:"nut-user"`
+	LogLevel string `yaml:"log_level" flag:"log-level"`
+	LogFormat string `yaml:"log_format" flag:"log-format"`
+
+	// Only in the configuration file
+	NISTargets []NISTargetConfiguration `yaml:"targets"`
+	Thresholds CheckThresholds `yaml:"thresholds"`
+	OutputConfigurations []OutputConfiguration `yaml:"outputs"`
+	NotifierConfigurations []NotifierConfiguration `yaml:"notifiers"`
+
+	// Where each value was set, by the name of its flag, for pointing out invalid values
+	sources map[ string ]string
+
+	// The flags that were given or set by environment variables, as those for the targets, outputs & notifiers replace the blocks in the file
+	overridden map[ string ]bool
+
+	// Parsed from the above when validated
+	nisAddress net.IP
+	nisTargets []NISTarget
+	metricsAddress net.IP
+	metricsConstantLabels map[ string ]string
+	metricsInclude *regexp.Regexp
+	metricsExclude *regexp.Regexp
+	nutAddress net.IP
+	nutUsers map[ string ]string
+	logLevel slog.Level
+}
+
+// Creates a configuration with the defaults
+func NewConfiguration() *Configuration {
+	return &Configuration {
+		NisAddress: "127.0.0.1",
+		NisPort: 3551,
+		MetricsAddress: "127.0.0.1",
+		MetricsPort: 5000,
+		MetricsPath: "/metrics",
+		MetricsInterval: 15, // Default Prometheus scrape interval
+		OutageDebounce: 30,
+		MetricsNamespace: "ups",
+		MetricsSchema: METRICS_SCHEMA_V1,
+		PushJob: "apc_ups_exporter",
+		PushAttempts: 3,
+		RemoteWriteBatchSize: 500,
+		RemoteWriteQueueSize: 100000,
+		InfluxBatchSize: 1,
+		MQTTTopic: "apcups",
+		MQTTDiscoveryPrefix: "homeassistant",
+		WebhookAttempts: 3,
+		WebhookDedupe: 300,
+		SMTPTLS: SMTP_TLS_STARTTLS,
+		EmailInterval: 300,
+		EventLogMaximumSize: 10,
+		EventLogMaximumFiles: 5,
+		HistoryRetention: 7,
+		HistoryDownsampledRetention: 365,
+		HistoryDownsampleInterval: 300,
+		DashboardHistory: 360,
+		ReadyMaximumDataAge: 300,
+		NUTPort: 3493,
+		NUTUPSName: "ups",
+		LogLevel: "info",
+		LogFormat: LOG_FORMAT_TEXT,
+	}
+}
+
+// Creates the command-line flags, which set the values in the configuration
+func newFlagSet( configuration *Configuration ) *flag.FlagSet {
+	flagSet := flag.NewFlagSet( os.Args[ 0 ], flag.ContinueOnError )
+
+	// Setup the command-line flags
+	flagSet.StringVar( &configuration.ConfigFile, "config", configuration.ConfigFile, "The path to a YAML configuration file, which the other flags & environment variables take precedence over." )
+	flagSet.StringVar( &configuration.NisAddress, "nis-address", configuration.NisAddress, "The IPv4 address of the apcupsd Network Information Server." )
+	flagSet.IntVar( &configuration.NisPort, "nis-port", configuration.NisPort, "The port number of the apcupsd Network Information Server." )
+	flagSet.StringVar( &configuration.MetricsAddress, "metrics-address", configuration.MetricsAddress, "The IPv4 address to listen on for the Prometheus HTTP metrics server." )
+	flagSet.IntVar( &configuration.MetricsPort, "metrics-port", configuration.MetricsPort, "The port number to listen on for the Prometheus HTTP metrics server." )
+	flagSet.StringVar( &configuration.MetricsSocket, "metrics-socket", configuration.MetricsSocket, "The path to a Unix domain socket to also listen on for the Prometheus HTTP metrics server." )
+	flagSet.StringVar( &configuration.MetricsPath, "metrics-path", configuration.MetricsPath, "The full HTTP path to the metrics page." )
+	flagSet.IntVar( &configuration.MetricsInterval, "metrics-interval", configuration.MetricsInterval, "The time in seconds to wait between collecting metrics." )
+	flagSet.IntVar( &configuration.OutageDebounce, "outage-debounce", configuration.OutageDebounce, "The time in seconds that mains power must be restored for before an outage is considered over." )
+	flagSet.StringVar( &configuration.MetricsNamespace, "metrics-namespace", configuration.MetricsNamespace, "The prefix for the name of all metrics." )
+	flagSet.Var( &configuration.MetricsLabels, "metrics-label", "A constant label to add to all metrics, as name=value. Can be given multiple times." )
+	flagSet.StringVar( &configuration.MetricsInclude, "metrics-include", configuration.MetricsInclude, "A regular expression for the names of metrics to include, all are included if empty." )
+	flagSet.StringVar( &configuration.MetricsExclude, "metrics-exclude", configuration.MetricsExclude, "A regular expression for the names of metrics to exclude, none are excluded if empty." )
+	flagSet.BoolVar( &configuration.MetricsTimestamps, "metrics-timestamps", configuration.MetricsTimestamps, "Timestamp the metrics with when the daemon last got data from the UPS, instead of the scrape time." )
+	flagSet.StringVar( &configuration.MetricsSchema, "metrics-schema", configuration.MetricsSchema, "The version of the metric names to export, either v1 (original), v2 (base units) or both." )
+	flagSet.Var( &configuration.Outputs, "output", "An output to send metrics to after every collection, as type:target (e.g., pushgateway:http://127.0.0.1:9091). Can be given multiple times." )
+	flagSet.StringVar( &configuration.PushJob, "push-job", configuration.PushJob, "The job name to group metrics by on the Pushgateway." )
+	flagSet.Var( &configuration.PushLabels, "push-label", "An extra label to group metrics by on the Pushgateway, as name=value. Can be given multiple times." )
+	flagSet.StringVar( &configuration.PushUsername, "push-username", configuration.PushUsername, "The username for HTTP basic authentication with the Pushgateway." )
+	flagSet.StringVar( &configuration.PushPassword, "push-password", configuration.PushPassword, "The password for HTTP basic authentication with the Pushgateway." )
+	flagSet.IntVar( &configuration.PushAttempts, "push-attempts", configuration.PushAttempts, "The number of times to try pushing to the Pushgateway before waiting for the next collection." )
+	flagSet.Var( &configuration.RemoteWriteLabels, "remote-write-label", "An extra label to add to all samples sent to the remote write endpoint, as name=value. Can be given multiple times." )
+	flagSet.StringVar( &configuration.RemoteWriteUsername, "remote-write-username", configuration.RemoteWriteUsername, "The username for HTTP basic authentication with the remote write endpoint." )
+	flagSet.StringVar( &configuration.RemoteWritePassword, "remote-write-password", configuration.RemoteWritePassword, "The password for HTTP basic authentication with the remote write endpoint." )
+	flagSet.IntVar( &configuration.RemoteWriteBatchSize, "remote-write-batch-size", configuration.RemoteWriteBatchSize, "The maximum number of samples to send to the remote write endpoint in one request." )
+	flagSet.IntVar( &configuration.RemoteWriteQueueSize, "remote-write-queue-size", configuration.RemoteWriteQueueSize, "The maximum number of samples to hold while the remote write endpoint is unreachable, the oldest are dropped after this." )
+	flagSet.StringVar( &configuration.InfluxOrganisation, "influxdb-org", configuration.InfluxOrganisation, "The organisation to write to in InfluxDB." )
+	flagSet.StringVar( &configuration.InfluxBucket, "influxdb-bucket", configuration.InfluxBucket, "The bucket to write to in InfluxDB." )
+	flagSet.StringVar( &configuration.InfluxToken, "influxdb-token", configuration.InfluxToken, "The API token for authentication with InfluxDB." )
+	flagSet.IntVar( &configuration.InfluxBatchSize, "influxdb-batch-size", configuration.InfluxBatchSize, "The number of collections to wait for before writing them all to InfluxDB at once." )
+	flagSet.StringVar( &configuration.MQTTTopic, "mqtt-topic", configuration.MQTTTopic, "The first level of every topic published to the MQTT broker." )
+	flagSet.StringVar( &configuration.MQTTClientID, "mqtt-client-id", configuration.MQTTClientID, "The client identifier for the MQTT broker, defaults to one based on the hostname." )
+	flagSet.StringVar( &configuration.MQTTUsername, "mqtt-username", configuration.MQTTUsername, "The username for authentication with the MQTT broker." )
+	flagSet.StringVar( &configuration.MQTTPassword, "mqtt-password", configuration.MQTTPassword, "The password for authentication with the MQTT broker." )
+	flagSet.StringVar( &configuration.MQTTDiscoveryPrefix, "mqtt-discovery-prefix", configuration.MQTTDiscoveryPrefix, "The topic prefix for Home Assistant MQTT discovery, or empty to disable it." )
+	flagSet.Var( &configuration.OTLPHeaders, "otlp-header", "A header to send with every export to the OTLP endpoint, as name=value (e.g., for authentication). Can be given multiple times." )
+	flagSet.BoolVar( &configuration.MetricsDisable, "metrics-disable", configuration.MetricsDisable, "Do not serve the metrics page, for when metrics are only sent to outputs." )
+	flagSet.Var( &configuration.Webhooks, "webhook", "A webhook to notify of power events, as preset:url where the preset is slack, discord, teams or json. Can be given multiple times." )
+	flagSet.StringVar( &configuration.WebhookTemplate, "webhook-template", configuration.WebhookTemplate, "The path to a Go template file for the message sent to webhooks, defaults to a one-line summary." )
+	flagSet.IntVar( &configuration.WebhookAttempts, "webhook-attempts", configuration.WebhookAttempts, "The number of times to try sending a notification to a webhook before giving up." )
+	flagSet.IntVar( &configuration.WebhookDedupe, "webhook-dedupe", configuration.WebhookDedupe, "The time in seconds to not send the same power event to a webhook again." )
+	flagSet.StringVar( &configuration.SMTPAddress, "smtp-address", configuration.SMTPAddress, "The address of the SMTP server to send power events through by email, as host:port. Disabled if empty." )
+	flagSet.StringVar( &configuration.SMTPTLS, "smtp-tls", configuration.SMTPTLS, "How to secure the connection to the SMTP server, either starttls, tls or none." )
+	flagSet.StringVar( &configuration.SMTPUsername, "smtp-username", configuration.SMTPUsername, "The username for authentication with the SMTP server." )
+	flagSet.StringVar( &configuration.SMTPPassword, "smtp-password", configuration.SMTPPassword, "The password for authentication with the SMTP server." )
+	flagSet.StringVar( &configuration.EmailFrom, "email-from", configuration.EmailFrom, "The address to send emails from." )
+	flagSet.Var( &configuration.EmailTo, "email-to", "An address to send emails to. Can be given multiple times." )
+	flagSet.IntVar( &configuration.EmailInterval, "email-interval", configuration.EmailInterval, "The minimum time in seconds between emails, any events in between are sent together afterwards." )
+	flagSet.Var( &configuration.EventLogs, "event-log", "Where to log power events, as syslog:<udp|tcp|unix URL>, journald[:<socket path>] or file:<path>. Can be given multiple times." )
+	flagSet.IntVar( &configuration.EventLogMaximumSize, "event-log-max-size", configuration.EventLogMaximumSize, "The size in MiB at which event log files are rotated." )
+	flagSet.IntVar( &configuration.EventLogMaximumFiles, "event-log-max-files", configuration.EventLogMaximumFiles, "The number of rotated event log files to keep." )
+	flagSet.StringVar( &configuration.HistoryPath, "history-path", configuration.HistoryPath, "The directory to store the history of every status in, for the history API. Disabled if empty." )
+	flagSet.IntVar( &configuration.HistoryRetention, "history-retention", configuration.HistoryRetention, "The number of days to keep every status in the history for." )
+	flagSet.IntVar( &configuration.HistoryDownsampledRetention, "history-downsampled-retention", configuration.HistoryDownsampledRetention, "The number of days to keep averages of the statuses in the history for." )
+	flagSet.IntVar( &configuration.HistoryDownsampleInterval, "history-downsample-interval", configuration.HistoryDownsampleInterval, "The time in seconds that each average in the history covers." )
+	flagSet.BoolVar( &configuration.Once, "once", configuration.Once, "Collect metrics once, send them to the outputs, then exit (e.g., for running from a systemd timer)." )
+	flagSet.BoolVar( &configuration.DashboardDisable, "dashboard-disable", configuration.DashboardDisable, "Do not serve the status dashboard on the root path." )
+	flagSet.IntVar( &configuration.DashboardHistory, "dashboard-history", configuration.DashboardHistory, "The number of minutes of history to show on the charts of the dashboard, which is held in memory." )
+	flagSet.StringVar( &configuration.WebConfigFile, "web-config-file", configuration.WebConfigFile, "The path to a web configuration file for TLS & basic authentication on the metrics server, in the Prometheus exporter toolkit format." )
+	flagSet.IntVar( &configuration.ReadyMaximumFetchAge, "ready-max-fetch-age", configuration.ReadyMaximumFetchAge, "The time in seconds since the last successful fetch from the Network Information Server before the exporter is no longer ready, or 0 for three collection intervals." )
+	flagSet.IntVar( &configuration.ReadyMaximumDataAge, "ready-max-data-age", configuration.ReadyMaximumDataAge, "The time in seconds since the daemon last got data from the UPS before the exporter is no longer ready, or 0 to not check." )
+	flagSet.StringVar( &configuration.NUTAddress, "nut-address", configuration.NUTAddress, "The IPv4 address to listen on for the Network UPS Tools server, or empty to not run it." )
+	flagSet.IntVar( &configuration.NUTPort, "nut-port", configuration.NUTPort, "The port number to listen on for the Network UPS Tools server." )
+	flagSet.StringVar( &configuration.NUTUPSName, "nut-ups-name", configuration.NUTUPSName, "The name of the UPS for Network UPS Tools clients." )
+	flagSet.Var( &configuration.NUTUsers, "nut-user", "A username & password that can log in to the Network UPS Tools server, including as a primary (e.g., monuser=secret). Can be given multiple times." )
+	flagSet.StringVar( &configuration.LogLevel, "log-level", configuration.LogLevel, "The minimum level of logs to write, either debug, info, warn or error." )
+	flagSet.StringVar( &configuration.LogFormat, "log-format", configuration.LogFormat, "The format to write logs in, either text or json." )
+
+	// Set a custom help message
+	flagSet.Usage = func() {
+		fmt.Printf( "%s, v%s, by %s (%s).\n", PROJECT_NAME, PROJECT_VERSION, AUTHOR_NAME, AUTHOR_WEBSITE )
+		fmt.Printf( "\nUsage: %s [-h/-help] [-config <path>] [-nis-address <IPv4 address>] [-nis-port <number>] [-metrics-address <IPv4 address>] [-metrics-port <number>] [-metrics-socket <path>] [-metrics-path <string>] [-metrics-interval <seconds>] [-outage-debounce <seconds>] [-metrics-namespace <string>] [-metrics-label <name=value>]... [-metrics-include <regex>] [-metrics-exclude <regex>] [-metrics-schema <v1|v2|both>] [-metrics-timestamps] [-output <type:target>]... [-push-job <string>] [-push-label <name=value>]... [-push-username <string>] [-push-password <string>] [-push-attempts <number>] [-remote-write-label <name=value>]... [-remote-write-username <string>] [-remote-write-password <string>] [-remote-write-batch-size <number>] [-remote-write-queue-size <number>] [-influxdb-org <string>] [-influxdb-bucket <string>] [-influxdb-token <string>] [-influxdb-batch-size <number>] [-mqtt-topic <string>] [-mqtt-client-id <string>] [-mqtt-username <string>] [-mqtt-password <string>] [-mqtt-discovery-prefix <string>] [-otlp-header <name=value>]... [-metrics-disable] [-webhook <preset:url>]... [-webhook-template <path>] [-webhook-attempts <number>] [-webhook-dedupe <seconds>] [-smtp-address <host:port>] [-smtp-tls <starttls|tls|none>] [-smtp-username <string>] [-smtp-password <string>] [-email-from <address>] [-email-to <address>]... [-email-interval <seconds>] [-event-log <type[:target]>]... [-event-log-max-size <MiB>] [-event-log-max-files <number>] [-history-path <directory>] [-history-retention <days>] [-history-downsampled-retention <days>] [-history-downsample-interval <seconds>] [-once] [-dashboard-disable] [-dashboard-history <minutes>] [-web-config-file <path>] [-ready-max-fetch-age <seconds>] [-ready-max-data-age <seconds>] [-nut-address <IPv4 address>] [-nut-port <number>] [-nut-ups-name <string>] [-nut-user <name=password>]... [-log-level <debug|info|warn|error>] [-log-format <text|json>]\n", os.Args[ 0 ] )
+
+		fmt.Printf( "       %s check [-h/-help] [flags]... (run with -help for its flags)\n", os.Args[ 0 ] )
+		fmt.Printf( "       %s healthcheck [-h/-help] [flags]... (run with -help for its flags)\n", os.Args[ 0 ] )
+
+		flagSet.PrintDefaults()
+
+		os.Exit( 1 ) // By default it exits with code 2
+	}
+
+	return flagSet
+}
+
+// Gets the configuration from the defaults, then the configuration file, then environment variables, then the command-line flags
+// NOTE: Flags that can be given multiple times replace the values from the file & environment variables, rather than adding to them
+func ParseConfiguration( arguments []string ) ( *Configuration, error ) {
+
+	// Find the configuration file & which flags were given, the usage is shown if they are wrong
+	flagSet := newFlagSet( NewConfiguration() )
+	if parseError := flagSet.Parse( arguments ); parseError != nil { return nil, parseError }
+	givenFlags := map[ string ]bool {}
+	flagSet.Visit( func( givenFlag *flag.Flag ) { givenFlags[ givenFlag.Name ] = true } )
+	configFile := flagSet.Lookup( "config" ).Value.String()
+	if environmentValue, isSet := os.LookupEnv( getEnvironmentVariableName( "config" ) ); ( isSet && !givenFlags[ "config" ] ) { configFile = environmentValue }
+
+	// Start again from the defaults, so everything is layered in the right order
+	configuration := NewConfiguration()
+	configuration.ConfigFile = configFile
+	configuration.sources = map[ string ]string {}
+	configuration.overridden = map[ string ]bool {}
+	flagSet = newFlagSet( configuration )
+
+	if ( configFile != "" ) {
+		loadError := configuration.loadFile( configFile )
+		if loadError != nil { return nil, loadError }
+	}
+
+	environmentError := configuration.loadEnvironmentVariables( flagSet )
+	if environmentError != nil { return nil, environmentError }
+
+	// Clear what the flags that can be given multiple times will replace, then parse the flags again over everything else
+	for _, setting := range configuration.getSettings() {
+		if !givenFlags[ setting.flagName ] { continue }
+
+		if ( setting.field.Type() == reflect.TypeOf( repeatableFlag {} ) ) { setting.field.Set( reflect.Zero( setting.field.Type() ) ) }
+		delete( configuration.sources, setting.flagName )
+		configuration.overridden[ setting.flagName ] = true
+	}
+	if parseError := flagSet.Parse( arguments ); parseError != nil { return nil, parseError }
+
+	return configuration, nil
+}
+
+// Creates an error for an invalid value, saying where it was set if that was not a flag (e.g., the line in the configuration file)
+func ( configuration *Configuration ) invalidSetting( flagName string, message string ) error {
+	source, isKnown := configuration.sources[ flagName ]
+	if !isKnown { return errors.New( message ) }
+
+	return fmt.Errorf( "%s: %s", source, message )
+}
+
+// Checks the values are valid, and parses those that need it
+// NOTE: Anything specific to an output or notifier is checked by getTargetSpecs()
+func ( configuration *Configuration ) Validate() error {
+
+	// Require a valid IP address & port number for the Prometheus HTTP metrics server
+	configuration.metricsAddress = net.ParseIP( configuration.MetricsAddress )
+	if ( configuration.MetricsAddress == "" || configuration.metricsAddress == nil || configuration.metricsAddress.To4() == nil ) { return configuration.invalidSetting( "metrics-address", "Invalid listening IPv4 address for the Prometheus HTTP metrics server." ) }
+	if ( configuration.MetricsPort <= 0 || configuration.MetricsPort >= 65536 ) { return configuration.invalidSetting( "metrics-port", "Invalid listening port number for the Prometheus HTTP metrics server." ) }
+
+	// Require the path of the Unix domain socket to fit in the socket address, if there is one
+	if ( len( configuration.MetricsSocket ) >= UNIX_SOCKET_PATH_MAXIMUM_LENGTH ) { return configuration.invalidSetting( "metrics-socket", fmt.Sprintf( "Invalid path for the Unix domain socket, must be shorter than %d characters.", UNIX_SOCKET_PATH_MAXIMUM_LENGTH ) ) }
+
+	// Require a valid HTTP path for the metrics page
+	if ( configuration.MetricsPath == "" || configuration.MetricsPath[ 0 : 1 ] != "/" || configuration.MetricsPath[ 1 : ] == "/" ) { return configuration.invalidSetting( "metrics-path", "Invalid path for the metrics page, must have a leading slash and no trailing slash." ) }
+
+	// Require a valid interval for collecting metrics
+	if ( configuration.MetricsInterval <= 0 ) { return configuration.invalidSetting( "metrics-interval", "Invalid interval to wait between collecting metrics, must be greater than 0." ) }
+
+	// Require a valid debounce duration for outages
+	if ( configuration.OutageDebounce < 0 ) { return configuration.invalidSetting( "outage-debounce", "Invalid outage debounce duration, must be 0 or greater." ) }
+
+	// Require a valid namespace for the metrics
+	if ( !metricNamePattern.MatchString( configuration.MetricsNamespace ) ) { return configuration.invalidSetting( "metrics-namespace", "Invalid namespace for the metrics, must only contain letters, digits, underscores & colons, and not start with a digit." ) }
+
+	// Require valid constant labels for the metrics
+	var labelsError error
+	configuration.metricsConstantLabels, labelsError = parseLabelFlags( configuration.MetricsLabels )
+	if labelsError != nil { return configuration.invalidSetting( "metrics-label", fmt.Sprintf( "Invalid constant label for the metrics: %s", labelsError.Error() ) ) }
+
+	// Require valid targets, either the one from the flags or those in the configuration file
+	targetsError := configuration.validateTargets()
+	if targetsError != nil { return targetsError }
+
+	// Require valid thresholds for the check subcommand
+	if thresholdsError := configuration.Thresholds.Validate(); thresholdsError != nil { return fmt.Errorf( "%s: %s", configuration.ConfigFile, thresholdsError.Error() ) }
+
+	// Require valid regular expressions for filtering the metrics
+	var includeError, excludeError error
+	configuration.metricsInclude, includeError = CompileMetricFilter( configuration.MetricsInclude )
+	if includeError != nil { return configuration.invalidSetting( "metrics-include", fmt.Sprintf( "Invalid regular expression for metrics to include: %s", includeError.Error() ) ) }
+	configuration.metricsExclude, excludeError = CompileMetricFilter( configuration.MetricsExclude )
+	if excludeError != nil { return configuration.invalidSetting( "metrics-exclude", fmt.Sprintf( "Invalid regular expression for metrics to exclude: %s", excludeError.Error() ) ) }
+
+	// Require a valid schema version for the metrics
+	if ( configuration.MetricsSchema != METRICS_SCHEMA_V1 && configuration.MetricsSchema != METRICS_SCHEMA_V2 && configuration.MetricsSchema != METRICS_SCHEMA_BOTH ) { return configuration.invalidSetting( "metrics-schema", "Invalid schema for the metrics, must be v1, v2 or both." ) }
+
+	// Require a valid history, if enabled
+	if ( configuration.HistoryPath != "" ) {
+		if ( configuration.HistoryRetention < 1 ) { return configuration.invalidSetting( "history-retention", "Invalid retention for the history, must be at least 1 day." ) }
+		if ( configuration.HistoryDownsampledRetention < 1 ) { return configuration.invalidSetting( "history-downsampled-retention", "Invalid retention for the history, must be at least 1 day." ) }
+		if ( configuration.HistoryDownsampleInterval < configuration.MetricsInterval ) { return configuration.invalidSetting( "history-downsample-interval", "Invalid downsample interval for the history, must be at least the collection interval." ) }
+	}
+
+	// Require valid settings for the metrics server
+	if ( configuration.ReadyMaximumFetchAge < 0 ) { return configuration.invalidSetting( "ready-max-fetch-age", "Invalid maximum age for readiness, must not be negative." ) }
+	if ( configuration.ReadyMaximumDataAge < 0 ) { return configuration.invalidSetting( "ready-max-data-age", "Invalid maximum age for readiness, must not be negative." ) }
+	if ( configuration.DashboardHistory < 1 ) { return configuration.invalidSetting( "dashboard-history", "Invalid history for the dashboard, must be at least 1 minute." ) }
+
+	// Require valid settings for the Network UPS Tools server, if it is enabled
+	if ( configuration.NUTAddress != "" ) {
+		configuration.nutAddress = net.ParseIP( configuration.NUTAddress )
+		if ( configuration.nutAddress == nil || configuration.nutAddress.To4() == nil ) { return configuration.invalidSetting( "nut-address", "Invalid listening IPv4 address for the Network UPS Tools server." ) }
+	}
+	if ( configuration.NUTPort <= 0 || configuration.NUTPort >= 65536 ) { return configuration.invalidSetting( "nut-port", "Invalid listening port number for the Network UPS Tools server." ) }
+	if ( configuration.NUTUPSName == "" || strings.ContainsAny( configuration.NUTUPSName, " \t\"\\@" ) ) { return configuration.invalidSetting( "nut-ups-name", "Invalid name of the UPS for Network UPS Tools clients, must not be empty or contain spaces, quotes, backslashes or at signs." ) }
+	configuration.nutUsers = map[ string ]string {}
+	for _, user := range configuration.NUTUsers {
+		name, password, hasSeparator := strings.Cut( user, "=" )
+		if ( !hasSeparator || name == "" || password == "" ) { return configuration.invalidSetting( "nut-user", fmt.Sprintf( "Invalid user '%s' for the Network UPS Tools server, must be name=password.", name ) ) }
+		configuration.nutUsers[ name ] = password
+	}
+
+	// Require a valid level & format for logs
+	var levelError error
+	configuration.logLevel, levelError = parseLogLevel( configuration.LogLevel )
+	if levelError != nil { return configuration.invalidSetting( "log-level", "Invalid level for logs, must be debug, info, warn or error." ) }
+	if ( configuration.LogFormat != LOG_FORMAT_TEXT && configuration.LogFormat != LOG_FORMAT_JSON ) { return configuration.invalidSetting( "log-format", "Invalid format for logs, must be text or json." ) }
+
+	return nil
+
+}
+
+// The names of targets, which are also used for the label on their metrics, the name of their UPS for NUT clients & the directory of their history
+var nisTargetNamePattern = regexp.MustCompile( `^[A-Za-z0-9][A-Za-z0-9_.-]*$` )
+
+// Checks the targets are valid, and parses them
+// NOTE: The flags for the Network Information Server are a shortcut for a single target without a name, which replaces those in the file
+func ( configuration *Configuration ) validateTargets() error {
+	configuration.nisTargets = nil
+
+	// Just the one target from the flags (or their defaults)
+	if ( len( configuration.NISTargets ) == 0 || configuration.overridden[ "nis-address" ] || configuration.overridden[ "nis-port" ] ) {
+		configuration.nisAddress = net.ParseIP( configuration.NisAddress )
+		if ( configuration.NisAddress == "" || configuration.nisAddress == nil || configuration.nisAddress.To4() == nil ) { return configuration.invalidSetting( "nis-address", "Invalid IPv4 address for apcupsd's Network Information Server." ) }
+		if ( configuration.NisPort <= 0 || configuration.NisPort >= 65536 ) { return configuration.invalidSetting( "nis-port", "Invalid port number for apcupsd's Network Information Server." ) }
+
+		configuration.nisTargets = []NISTarget { { Address: configuration.nisAddress, Port: configuration.NisPort } }
+		return nil
+	}
+
+	// The targets in the file, which must have names to tell them apart if there are more than one
+	names := map[ string ]bool {}
+	for index := range configuration.NISTargets {
+		targetConfiguration := &configuration.NISTargets[ index ]
+		invalid := func( message string ) error { return fmt.Errorf( "%s: line %d: %s", configuration.ConfigFile, targetConfiguration.line, message ) }
+
+		if ( targetConfiguration.Name == "" && len( configuration.NISTargets ) > 1 ) { return invalid( "Missing the name of the target, which is required when there are more than one." ) }
+		if ( targetConfiguration.Name != "" && !nisTargetNamePattern.MatchString( targetConfiguration.Name ) ) { return invalid( "Invalid name for the target, must start with a letter or digit & only contain letters, digits, underscores, hyphens & dots." ) }
+		if names[ targetConfiguration.Name ] { return invalid( fmt.Sprintf( "Duplicate target '%s'.", targetConfiguration.Name ) ) }
+		names[ targetConfiguration.Name ] = true
+
+		address := net.ParseIP( targetConfiguration.Address )
+		if ( address == nil || address.To4() == nil ) { return invalid( "Invalid IPv4 address for apcupsd's Network Information Server." ) }
+		if ( targetConfiguration.Port <= 0 || targetConfiguration.Port >= 65536 ) { return invalid( "Invalid port number for apcupsd's Network Information Server." ) }
+
+		// Labels cannot replace those on all metrics, or the one that tells the targets apart
+		labels, labelsError := parseLabelFlags( targetConfiguration.Labels )
+		if labelsError != nil { return invalid( fmt.Sprintf( "Invalid label for the target: %s", labelsError.Error() ) ) }
+		for name := range labels {
+			if ( name == "ups" ) { return invalid( "Invalid label 'ups' for the target, it is used to tell the targets apart." ) }
+			if _, isConstant := configuration.metricsConstantLabels[ name ]; isConstant { return invalid( fmt.Sprintf( "Invalid label '%s' for the target, it is already on all metrics.", name ) ) }
+		}
+
+		if thresholdsError := targetConfiguration.Thresholds.Validate(); thresholdsError != nil { return fmt.Errorf( "%s: %s", configuration.ConfigFile, thresholdsError.Error() ) }
+
+		configuration.nisTargets = append( configuration.nisTargets, NISTarget {
+			Name: targetConfiguration.Name,
+			Address: address,
+			Port: targetConfiguration.Port,
+			Labels: labels,
+			Thresholds: &targetConfiguration.Thresholds,
+		} )
+	}
+
+	// The targets are told apart by a label, which cannot be a constant one
+	if _, isConstant := configuration.metricsConstantLabels[ "ups" ]; ( isConstant && configuration.nisTargets[ 0 ].Name != "" ) {
+		return configuration.invalidSetting( "metrics-label", "Invalid constant label 'ups' for the metrics, it is used to tell the targets apart." )
+	}
+
+	return nil
+}
+
+/*************************************/
+
+// The configuration in use, which is replaced when it is reloaded
+var currentConfiguration atomic.Pointer[ Configuration ]
+
+// Starts using a validated configuration for everything that can change while running, including which targets are collected from
+func applyConfiguration( configuration *Configuration ) {
+	logLevel.Set( configuration.logLevel )
+	applyCollectors( configuration )
+
+	currentConfiguration.Store( configuration )
+}
+
+// Gets the flags that changed but only take effect after a restart, as they are used to setup the metrics page, history, dashboard & NUT server
+func getRestartRequiredChanges( previous *Configuration, next *Configuration ) ( flagNames []string ) {
+	settings := [][ 3 ]any {
+		{ "metrics-address", previous.MetricsAddress, next.MetricsAddress },
+		{ "metrics-port", previous.MetricsPort, next.MetricsPort },
+		{ "metrics-socket", previous.MetricsSocket, next.MetricsSocket },
+		{ "metrics-path", previous.MetricsPath, next.MetricsPath },
+		{ "metrics-namespace", previous.MetricsNamespace, next.MetricsNamespace },
+		{ "metrics-label", previous.MetricsLabels, next.MetricsLabels },
+		{ "metrics-include", previous.MetricsInclude, next.MetricsInclude },
+		{ "metrics-exclude", previous.MetricsExclude, next.MetricsExclude },
+		{ "metrics-schema", previous.MetricsSchema, next.MetricsSchema },
+		{ "metrics-timestamps", previous.MetricsTimestamps, next.MetricsTimestamps },
+		{ "metrics-disable", previous.MetricsDisable, next.MetricsDisable },
+		{ "history-path", previous.HistoryPath, next.HistoryPath },
+		{ "history-retention", previous.HistoryRetention, next.HistoryRetention },
+		{ "history-downsampled-retention", previous.HistoryDownsampledRetention, next.HistoryDownsampledRetention },
+		{ "history-downsample-interval", previous.HistoryDownsampleInterval, next.HistoryDownsampleInterval },
+		{ "dashboard-disable", previous.DashboardDisable, next.DashboardDisable },
+		{ "dashboard-history", previous.DashboardHistory, next.DashboardHistory },
+		{ "log-format", previous.LogFormat, next.LogFormat },
+		{ "nut-address", previous.NUTAddress, next.NUTAddress },
+		{ "nut-port", previous.NUTPort, next.NUTPort },
+		{ "nut-ups-name", previous.NUTUPSName, next.NUTUPSName },
+		{ "nut-user", previous.NUTUsers, next.NUTUsers },
+		{ "web-config-file", previous.WebConfigFile, next.WebConfigFile }, // Changes to the file itself are picked up without a reload
+	}
+
+	for _, setting := range settings {
+		if ( fmt.Sprint( setting[ 1 ] ) != fmt.Sprint( setting[ 2 ] ) ) { flagNames = append( flagNames, setting[ 0 ].( string ) ) }
+	}
+
+	return flagNames
+}
+
+// Keeps the constant labels & filters of the metrics that are in effect, as the outputs must match the metrics page & the collectors, which only use them from startup
+func ( configuration *Configuration ) keepMetricsLabelsAndFilters( previous *Configuration ) {
+	configuration.MetricsLabels = previous.MetricsLabels
+	configuration.MetricsInclude = previous.MetricsInclude
+	configuration.MetricsExclude = previous.MetricsExclude
+}
+
+// Reads the configuration again & starts using it, keeping the current one if anything is wrong with it
+func reloadConfiguration() error {
+	configuration, parseError := ParseConfiguration( os.Args[ 1 : ] )
+	if parseError != nil { return parseError }
+
+	// NOTE: The changes that need a restart are found before those in effect are kept
+	previous := currentConfiguration.Load()
+	restartRequiredChanges := getRestartRequiredChanges( previous, configuration )
+	configuration.keepMetricsLabelsAndFilters( previous )
+
+	validateError := configuration.Validate()
+	if validateError != nil { return validateError }
+
+	specs, specsError := getTargetSpecs( configuration )
+	if specsError != nil { return specsError }
+
+	if ( len( restartRequiredChanges ) > 0 ) {
+		slog.Warn( "Some changes will not take effect until the exporter is restarted", "settings", strings.Join( restartRequiredChanges, ", " ) )
+	}
+
+	applyError := applyTargets( specs )
+	if applyError != nil { return applyError }
+
+	applyConfiguration( configuration )
+
+	return nil
+}
+
+// Runs in the background to reload the configuration whenever a hangup signal is received, until the context is cancelled
+func reloadOnHangup( ctx context.Context ) {
+	hangups := make( chan os.Signal, 1 )
+	signal.Notify( hangups, syscall.SIGHUP )
+	defer signal.Stop( hangups )
+
+	for {
+		select {
+			case <-ctx.Done(): return
+			case <-hangups:
+		}
+
+		slog.Info( "Reloading the configuration" )
+		reloadError := reloadConfiguration()
+		if reloadError != nil {
+			slog.Error( "Failed to reload the configuration, still using the previous one", "error", reloadError )
+			continue
+		}
+
+		slog.Info( "Reloaded the configuration" )
+	}
+}
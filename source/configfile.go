@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The prefix for environment variables that override the configuration (e.g., 'APC_UPS_EXPORTER_NIS_ADDRESS')
+const ENVIRONMENT_VARIABLE_PREFIX = "APC_UPS_EXPORTER_"
+
+// References to environment variables in the configuration file (e.g., '${SMTP_PASSWORD}'), with '$${' for a literal '${'
+var environmentVariableReferencePattern = regexp.MustCompile( `\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}` )
+
+// A value in the configuration, with the flag & key in the configuration file that set it
+type configurationSetting struct {
+	field reflect.Value
+	flagName string
+	key string
+}
+
+// Gets every value in the configuration that can be set
+func ( configuration *Configuration ) getSettings() ( settings []configurationSetting ) {
+	structure := reflect.ValueOf( configuration ).Elem()
+	for index := 0; index < structure.NumField(); index++ {
+		field := structure.Type().Field( index )
+		flagName := field.Tag.Get( "flag" )
+		if ( flagName == "" ) { continue }
+
+		settings = append( settings, configurationSetting {
+			field: structure.Field( index ),
+			flagName: flagName,
+			key: field.Tag.Get( "yaml" ),
+		} )
+	}
+
+	return settings
+}
+
+// Gets every value that is only in the configuration file (e.g., the list of targets), which are named after their key instead of a flag
+func ( configuration *Configuration ) getFileSections() ( sections []configurationSetting ) {
+	structure := reflect.ValueOf( configuration ).Elem()
+	for index := 0; index < structure.NumField(); index++ {
+		field := structure.Type().Field( index )
+		key := field.Tag.Get( "yaml" )
+		if ( key == "" || key == "-" || field.Tag.Get( "flag" ) != "" ) { continue }
+
+		sections = append( sections, configurationSetting {
+			field: structure.Field( index ),
+			flagName: key,
+			key: key,
+		} )
+	}
+
+	return sections
+}
+
+// Gets the name of the environment variable that overrides the flag (e.g., 'APC_UPS_EXPORTER_METRICS_PORT' for 'metrics-port')
+func getEnvironmentVariableName( flagName string ) string {
+	return ENVIRONMENT_VARIABLE_PREFIX + strings.ToUpper( strings.ReplaceAll( flagName, "-", "_" ) )
+}
+
+// Sets values from the YAML configuration file, rejecting anything unknown
+func ( configuration *Configuration ) loadFile( path string ) error {
+	content, readError := os.ReadFile( path )
+	if readError != nil { return fmt.Errorf( "Failed to read the configuration file: %s", readError.Error() ) }
+
+	var document yaml.Node
+	parseError := yaml.Unmarshal( content, &document )
+	if parseError != nil { return fmt.Errorf( "%s: %s", path, strings.TrimPrefix( parseError.Error(), "yaml: " ) ) }
+	if ( len( document.Content ) == 0 ) { return nil } // Empty, so just use the defaults
+
+	root := document.Content[ 0 ]
+	if ( root.Kind != yaml.MappingNode ) { return fmt.Errorf( "%s: line %d: The configuration file must be a mapping of settings to values.", path, root.Line ) }
+
+	settingsByKey := map[ string ]configurationSetting {}
+	for _, setting := range append( configuration.getSettings(), configuration.getFileSections()... ) {
+		if ( setting.key != "-" ) { settingsByKey[ setting.key ] = setting }
+	}
+
+	// Keys & values are pairs of nodes
+	firstLines := map[ string ]int {}
+	for index := 0; index + 1 < len( root.Content ); index += 2 {
+		keyNode, valueNode := root.Content[ index ], root.Content[ index + 1 ]
+
+		setting, isKnown := settingsByKey[ keyNode.Value ]
+		if !isKnown { return fmt.Errorf( "%s: line %d: Unknown setting '%s'.", path, keyNode.Line, keyNode.Value ) }
+		if firstLine, isDuplicate := firstLines[ keyNode.Value ]; isDuplicate { return fmt.Errorf( "%s: line %d: Duplicate setting '%s', it is already set on line %d.", path, keyNode.Line, keyNode.Value, firstLine ) }
+		firstLines[ keyNode.Value ] = keyNode.Line
+
+		expandError := expandEnvironmentVariables( valueNode )
+		if expandError != nil { return fmt.Errorf( "%s: %s", path, expandError.Error() ) }
+
+		decodeError := valueNode.Decode( setting.field.Addr().Interface() )
+		if decodeError != nil {
+			var typeError *yaml.TypeError
+			if errors.As( decodeError, &typeError ) { return fmt.Errorf( "%s: %s", path, strings.Join( typeError.Errors, ", " ) ) }
+			return fmt.Errorf( "%s: %s", path, decodeError.Error() ) // Already says which line, as it is from decoding a block or list
+		}
+
+		configuration.sources[ setting.flagName ] = fmt.Sprintf( "%s: line %d", path, keyNode.Line )
+	}
+
+	return nil
+}
+
+// Replaces references to environment variables in all the values within the node, failing if any are not set
+func expandEnvironmentVariables( node *yaml.Node ) ( err error ) {
+	if ( node.Kind == yaml.ScalarNode ) {
+		if !strings.Contains( node.Value, "${" ) { return nil }
+
+		node.Value = environmentVariableReferencePattern.ReplaceAllStringFunc( node.Value, func( reference string ) string {
+			if strings.HasPrefix( reference, "$$" ) { return reference[ 1 : ] }
+
+			name := environmentVariableReferencePattern.FindStringSubmatch( reference )[ 1 ]
+			value, isSet := os.LookupEnv( name )
+			if ( !isSet && err == nil ) { err = fmt.Errorf( "line %d: The environment variable '%s' is not set.", node.Line, name ) }
+
+			return value
+		} )
+
+		// Work out the type again from the new value (e.g., a number), unless it was quoted
+		if ( node.Style & ( yaml.SingleQuotedStyle | yaml.DoubleQuotedStyle | yaml.LiteralStyle | yaml.FoldedStyle ) == 0 ) { node.Tag = "" }
+
+		return err
+	}
+
+	for _, child := range node.Content {
+		if expandError := expandEnvironmentVariables( child ); expandError != nil { return expandError }
+	}
+
+	return nil
+}
+
+// Sets values from environment variables, which use the names of the flags (e.g., 'APC_UPS_EXPORTER_NIS_PORT' for 'nis-port')
+// NOTE: Flags that can be given multiple times take a comma-separated list, which replaces any values from the configuration file
+func ( configuration *Configuration ) loadEnvironmentVariables( flagSet *flag.FlagSet ) error {
+	for _, setting := range configuration.getSettings() {
+		if ( setting.flagName == "config" ) { continue } // Already used to find the file
+
+		name := getEnvironmentVariableName( setting.flagName )
+		value, isSet := os.LookupEnv( name )
+		if !isSet { continue }
+
+		values := []string { value }
+		if ( setting.field.Type() == reflect.TypeOf( repeatableFlag {} ) ) {
+			setting.field.Set( reflect.Zero( setting.field.Type() ) )
+			values = nil
+			for _, item := range strings.Split( value, "," ) {
+				if item = strings.TrimSpace( item ); ( item != "" ) { values = append( values, item ) }
+			}
+		}
+
+		for _, item := range values {
+			if setError := flagSet.Set( setting.flagName, item ); setError != nil { return fmt.Errorf( "Invalid value for the environment variable %s: %s", name, setError.Error() ) }
+		}
+
+		configuration.sources[ setting.flagName ] = fmt.Sprintf( "environment variable %s", name )
+		configuration.overridden[ setting.flagName ] = true
+	}
+
+	return nil
+}
+
+// Sets the values from the configuration file, which can be a single value, a list, or a mapping of names to values (e.g., for labels)
+func ( values *repeatableFlag ) UnmarshalYAML( node *yaml.Node ) error {
+	switch node.Kind {
+		case yaml.ScalarNode: {
+			if ( node.ShortTag() == "!!null" ) { *values = nil; return nil }
+			*values = repeatableFlag { node.Value }
+		}
+
+		case yaml.SequenceNode: {
+			var items []string
+			if decodeError := node.Decode( &items ); decodeError != nil { return decodeError }
+			*values = items
+		}
+
+		// Ordered as they are in the file
+		case yaml.MappingNode: {
+			*values = nil
+			for index := 0; index + 1 < len( node.Content ); index += 2 {
+				keyNode, valueNode := node.Content[ index ], node.Content[ index + 1 ]
+				if ( keyNode.Kind != yaml.ScalarNode || valueNode.Kind != yaml.ScalarNode ) { return fmt.Errorf( "line %d: names & values must be text", keyNode.Line ) }
+				*values = append( *values, fmt.Sprintf( "%s=%s", keyNode.Value, valueNode.Value ) )
+			}
+		}
+
+		default: return fmt.Errorf( "line %d: must be a value, a list or a mapping", node.Line )
+	}
+
+	return nil
+}
+
+/*************************************/
+
+// A Network Information Server in the configuration file
+type NISTargetConfiguration struct {
+	Name string `yaml:"name"`
+	Address string `yaml:"address"`
+	Port int `yaml:"port"`
+	Labels repeatableFlag `yaml:"labels"`
+	Thresholds CheckThresholds `yaml:"thresholds"`
+
+	// The line it begins on in the configuration file, for pointing out invalid values
+	line int
+}
+
+// An output in the configuration file, with settings that depend on its type (e.g., only a Pushgateway has a job)
+// NOTE: The types are the same as for the output flag, and each setting says which types it is for
+type OutputConfiguration struct {
+	Type string `yaml:"type"`
+	URL string `yaml:"url" types:"pushgateway,remote-write,influxdb,mqtt,otlp-grpc,otlp-http"`
+	Path string `yaml:"path" types:"influxdb-file,textfile"`
+	Job string `yaml:"job" types:"pushgateway"`
+	Labels repeatableFlag `yaml:"labels" types:"pushgateway,remote-write"`
+	Username string `yaml:"username" types:"pushgateway,remote-write,mqtt"`
+	Password string `yaml:"password" types:"pushgateway,remote-write,mqtt"`
+	Attempts int `yaml:"attempts" types:"pushgateway"`
+	BatchSize int `yaml:"batch_size" types:"remote-write,influxdb"`
+	QueueSize int `yaml:"queue_size" types:"remote-write"`
+	Organisation string `yaml:"org" types:"influxdb"`
+	Bucket string `yaml:"bucket" types:"influxdb"`
+	Token string `yaml:"token" types:"influxdb"`
+	Topic string `yaml:"topic" types:"mqtt"`
+	ClientID string `yaml:"client_id" types:"mqtt"`
+	DiscoveryPrefix string `yaml:"discovery_prefix" types:"mqtt"`
+	Headers repeatableFlag `yaml:"headers" types:"otlp-grpc,otlp-http"`
+
+	// The line it begins on in the configuration file, or zero if it is from the output flag
+	line int
+}
+
+// A notifier in the configuration file, with settings that depend on its type
+type NotifierConfiguration struct {
+	Type string `yaml:"type"`
+	Preset string `yaml:"preset" types:"webhook"`
+	URL string `yaml:"url" types:"webhook,syslog"`
+	Template string `yaml:"template" types:"webhook"`
+	Attempts int `yaml:"attempts" types:"webhook"`
+	Dedupe int `yaml:"dedupe" types:"webhook"`
+	SMTPAddress string `yaml:"smtp_address" types:"email"`
+	SMTPTLS string `yaml:"smtp_tls" types:"email"`
+	SMTPUsername string `yaml:"smtp_username" types:"email"`
+	SMTPPassword string `yaml:"smtp_password" types:"email"`
+	From string `yaml:"from" types:"email"`
+	To repeatableFlag `yaml:"to" types:"email"`
+	Interval int `yaml:"interval" types:"email"`
+	Socket string `yaml:"socket" types:"journald"`
+	Path string `yaml:"path" types:"file"`
+	MaximumSize int `yaml:"max_size" types:"file"`
+	MaximumFiles int `yaml:"max_files" types:"file"`
+
+	// The line it begins on in the configuration file, or zero if it is from the notifier flags
+	line int
+}
+
+// Checks that a mapping in the configuration file only has the keys of the structure it is decoded into, once each
+// NOTE: Settings that are only for some types (e.g., of output) are rejected for any other type
+func checkKeys( node *yaml.Node, structure any, kind string ) error {
+	if ( node.Kind != yaml.MappingNode ) { return fmt.Errorf( "line %d: must be a mapping of settings to values", node.Line ) }
+
+	structureType := reflect.TypeOf( structure )
+	fields := map[ string ]reflect.StructField {}
+	for index := 0; index < structureType.NumField(); index++ {
+		field := structureType.Field( index )
+		if key := field.Tag.Get( "yaml" ); ( key != "" && key != "-" ) { fields[ key ] = field }
+	}
+
+	firstLines := map[ string ]int {}
+	for index := 0; index + 1 < len( node.Content ); index += 2 {
+		keyNode := node.Content[ index ]
+
+		field, isKnown := fields[ keyNode.Value ]
+		if !isKnown { return fmt.Errorf( "line %d: Unknown setting '%s'.", keyNode.Line, keyNode.Value ) }
+		if firstLine, isDuplicate := firstLines[ keyNode.Value ]; isDuplicate { return fmt.Errorf( "line %d: Duplicate setting '%s', it is already set on line %d.", keyNode.Line, keyNode.Value, firstLine ) }
+		firstLines[ keyNode.Value ] = keyNode.Line
+
+		if types := field.Tag.Get( "types" ); ( types != "" && !slices.Contains( strings.Split( types, "," ), kind ) ) {
+			return fmt.Errorf( "line %d: Unknown setting '%s' for the %s type.", keyNode.Line, keyNode.Value, kind )
+		}
+	}
+
+	return nil
+}
+
+// Gets the type of an output or notifier from its mapping in the configuration file, as the other settings depend on it
+func getTypeKey( node *yaml.Node ) ( kind string, err error ) {
+	for index := 0; ( node.Kind == yaml.MappingNode && index + 1 < len( node.Content ) ); index += 2 {
+		if ( node.Content[ index ].Value == "type" && node.Content[ index + 1 ].Value != "" ) { return node.Content[ index + 1 ].Value, nil }
+	}
+
+	return "", fmt.Errorf( "line %d: Missing the type.", node.Line )
+}
+
+// Sets a target from the configuration file, starting from the default port
+func ( target *NISTargetConfiguration ) UnmarshalYAML( node *yaml.Node ) error {
+	if checkError := checkKeys( node, *target, "" ); checkError != nil { return checkError }
+
+	type plain NISTargetConfiguration // Without this method, so it is not called again
+	*target = NISTargetConfiguration { Port: NewConfiguration().NisPort, line: node.Line }
+	return node.Decode( ( *plain )( target ) )
+}
+
+// The types of outputs & notifiers that can be in the configuration file
+var outputTypes = []string { "pushgateway", "remote-write", "influxdb", "influxdb-file", "mqtt", "textfile", "otlp-grpc", "otlp-http" }
+var notifierTypes = []string { "webhook", "email", "syslog", "journald", "file" }
+
+// Sets an output from the configuration file, starting from the defaults of the output flags
+func ( output *OutputConfiguration ) UnmarshalYAML( node *yaml.Node ) error {
+	kind, typeError := getTypeKey( node )
+	if typeError != nil { return typeError }
+	if !slices.Contains( outputTypes, kind ) { return fmt.Errorf( "line %d: Unknown output type '%s', must be one of %s.", node.Line, kind, strings.Join( outputTypes, ", " ) ) }
+	if checkError := checkKeys( node, *output, kind ); checkError != nil { return checkError }
+
+	defaults := NewConfiguration()
+	type plain OutputConfiguration
+	*output = OutputConfiguration {
+		Job: defaults.PushJob,
+		Attempts: defaults.PushAttempts,
+		QueueSize: defaults.RemoteWriteQueueSize,
+		Topic: defaults.MQTTTopic,
+		DiscoveryPrefix: defaults.MQTTDiscoveryPrefix,
+		line: node.Line,
+	}
+	if ( kind == "influxdb" ) { output.BatchSize = defaults.InfluxBatchSize } else { output.BatchSize = defaults.RemoteWriteBatchSize }
+	return node.Decode( ( *plain )( output ) )
+}
+
+// Sets a notifier from the configuration file, starting from the defaults of the notifier flags
+func ( notifier *NotifierConfiguration ) UnmarshalYAML( node *yaml.Node ) error {
+	kind, typeError := getTypeKey( node )
+	if typeError != nil { return typeError }
+	if !slices.Contains( notifierTypes, kind ) { return fmt.Errorf( "line %d: Unknown notifier type '%s', must be one of %s.", node.Line, kind, strings.Join( notifierTypes, ", " ) ) }
+	if checkError := checkKeys( node, *notifier, kind ); checkError != nil { return checkError }
+
+	defaults := NewConfiguration()
+	type plain NotifierConfiguration
+	*notifier = NotifierConfiguration {
+		Attempts: defaults.WebhookAttempts,
+		Dedupe: defaults.WebhookDedupe,
+		SMTPTLS: defaults.SMTPTLS,
+		Interval: defaults.EmailInterval,
+		MaximumSize: defaults.EventLogMaximumSize,
+		MaximumFiles: defaults.EventLogMaximumFiles,
+		line: node.Line,
+	}
+	return node.Decode( ( *plain )( notifier ) )
+}
+
+// Sets the thresholds from the configuration file
+func ( thresholds *CheckThresholds ) UnmarshalYAML( node *yaml.Node ) error {
+	if checkError := checkKeys( node, *thresholds, "" ); checkError != nil { return checkError }
+
+	type plain CheckThresholds
+	return node.Decode( ( *plain )( thresholds ) )
+}
+
+// Sets a warning & critical range from the configuration file
+func ( threshold *CheckThreshold ) UnmarshalYAML( node *yaml.Node ) error {
+	if checkError := checkKeys( node, *threshold, "" ); checkError != nil { return checkError }
+
+	type plain CheckThreshold
+	*threshold = CheckThreshold { line: node.Line }
+	return node.Decode( ( *plain )( threshold ) )
+}
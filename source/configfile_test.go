@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Writes a configuration file to a temporary directory, giving its path
+func writeTestConfigurationFile( t *testing.T, content string ) string {
+	t.Helper()
+
+	path := filepath.Join( t.TempDir(), "config.yml" )
+	if writeError := os.WriteFile( path, []byte( content ), 0644 ); writeError != nil { t.Fatal( writeError ) }
+
+	return path
+}
+
+// Parses & validates a configuration file with any extra flags, including the settings of the outputs & notifiers
+func parseTestConfiguration( t *testing.T, content string, arguments ...string ) ( *Configuration, []targetSpec, error ) {
+	t.Helper()
+
+	configuration, parseError := ParseConfiguration( append( []string { "-config", writeTestConfigurationFile( t, content ) }, arguments... ) )
+	if parseError != nil { return nil, nil, parseError }
+	if validateError := configuration.Validate(); validateError != nil { return nil, nil, validateError }
+
+	specs, specsError := getTargetSpecs( configuration )
+	return configuration, specs, specsError
+}
+
+func TestConfigurationFileBlocks( t *testing.T ) {
+	configuration, specs, err := parseTestConfiguration( t, `
+metrics_labels: { site: london }
+targets:
+  - name: rack1
+    address: 192.168.0.5
+    labels: { room: a }
+    thresholds:
+      load: { warning: "70" }
+  - name: rack2
+    address: 192.168.0.6
+    port: 3552
+thresholds:
+  charge: { critical: "30:" }
+outputs:
+  - type: pushgateway
+    url: http://127.0.0.1:9091
+    labels: { instance: nas }
+  - type: influxdb
+    url: http://127.0.0.1:8086
+    org: home
+    bucket: ups
+notifiers:
+  - type: webhook
+    preset: json
+    url: http://127.0.0.1:8080/hook
+  - type: file
+    path: /tmp/events.log
+    max_files: 2
+` )
+	if err != nil { t.Fatal( err ) }
+
+	// Targets, with the default port & their own labels
+	if ( len( configuration.nisTargets ) != 2 ) { t.Fatalf( "expected 2 targets, got %d", len( configuration.nisTargets ) ) }
+	if target := configuration.nisTargets[ 0 ]; ( target.Name != "rack1" || target.String() != "192.168.0.5:3551" || target.Labels[ "room" ] != "a" ) { t.Errorf( "unexpected first target %+v", target ) }
+	if target := configuration.nisTargets[ 1 ]; ( target.Name != "rack2" || target.String() != "192.168.0.6:3552" ) { t.Errorf( "unexpected second target %+v", target ) }
+
+	// Thresholds, from the target then the top level
+	if warning := configuration.nisTargets[ 0 ].Thresholds.Get( "load", "warning" ); ( warning == nil || *warning != "70" ) { t.Errorf( "unexpected load warning for the target %v", warning ) }
+	if critical := configuration.Thresholds.Get( "charge", "critical" ); ( critical == nil || *critical != "30:" ) { t.Errorf( "unexpected charge critical %v", critical ) }
+
+	// Outputs & notifiers, with the defaults of their flags
+	outputs, _ := configuration.getOutputConfigurations()
+	if ( len( outputs ) != 2 || outputs[ 0 ].Job != "apc_ups_exporter" || outputs[ 0 ].Attempts != 3 || outputs[ 1 ].BatchSize != 1 ) { t.Errorf( "unexpected outputs %+v", outputs ) }
+	notifiers, _ := configuration.getNotifierConfigurations()
+	if ( len( notifiers ) != 2 || notifiers[ 0 ].Attempts != 3 || notifiers[ 1 ].MaximumSize != 10 || notifiers[ 1 ].MaximumFiles != 2 ) { t.Errorf( "unexpected notifiers %+v", notifiers ) }
+	if ( len( specs ) != 4 ) { t.Errorf( "expected 4 outputs & notifiers, got %d", len( specs ) ) }
+}
+
+func TestConfigurationFlagsReplaceBlocks( t *testing.T ) {
+	content := `
+targets:
+  - name: rack1
+    address: 192.168.0.5
+outputs:
+  - type: textfile
+    path: /tmp/ups.prom
+notifiers:
+  - type: webhook
+    preset: json
+    url: http://127.0.0.1:8080/hook
+  - type: file
+    path: /tmp/events.log
+`
+	configuration, _, err := parseTestConfiguration( t, content, "-nis-port", "3552", "-output", "pushgateway:http://127.0.0.1:9091", "-push-job", "nas", "-event-log", "journald" )
+	if err != nil { t.Fatal( err ) }
+
+	if ( len( configuration.nisTargets ) != 1 || configuration.nisTargets[ 0 ].Name != "" || configuration.nisTargets[ 0 ].String() != "127.0.0.1:3552" ) { t.Errorf( "unexpected targets %+v", configuration.nisTargets ) }
+
+	outputs, _ := configuration.getOutputConfigurations()
+	if ( len( outputs ) != 1 || outputs[ 0 ].Type != "pushgateway" || outputs[ 0 ].Job != "nas" ) { t.Errorf( "unexpected outputs %+v", outputs ) }
+
+	// The webhook in the file is kept, as only the event logs were replaced
+	notifiers, _ := configuration.getNotifierConfigurations()
+	if ( len( notifiers ) != 2 || notifiers[ 0 ].Type != "webhook" || notifiers[ 1 ].Type != "journald" ) { t.Errorf( "unexpected notifiers %+v", notifiers ) }
+}
+
+func TestConfigurationFileBlockErrors( t *testing.T ) {
+	for _, test := range []struct {
+		content string
+		expected string
+	} {
+		{ "targets: [ { address: 127.0.0.1 }, { name: b, address: 127.0.0.1 } ]", "line 1: Missing the name of the target" },
+		{ "targets: [ { name: a, address: 127.0.0.1 }, { name: a, address: 127.0.0.1 } ]", "Duplicate target 'a'" },
+		{ "targets: [ { name: .., address: 127.0.0.1 } ]", "Invalid name for the target" },
+		{ "targets: [ { name: a, address: 127.0.0.1, labels: { ups: b } } ]", "Invalid label 'ups'" },
+		{ "targets: [ { name: a, address: 127.0.0.1, colour: red } ]", "Unknown setting 'colour'" },
+		{ "outputs: [ { url: http://127.0.0.1 } ]", "Missing the type" },
+		{ "outputs: [ { type: carrier-pigeon } ]", "Unknown output type 'carrier-pigeon'" },
+		{ "outputs: [ { type: textfile, url: http://127.0.0.1 } ]", "Unknown setting 'url' for the textfile type" },
+		{ "outputs:\n  - type: textfile\n    path: /tmp/ups.txt", "line 2: Invalid path for the textfile collector" },
+		{ "notifiers:\n  - type: email\n    smtp_address: smtp.example.com:587", "line 2: The addresses to send emails from & to are required" },
+		{ "notifiers: [ { type: webhook, url: http://127.0.0.1, url: http://127.0.0.2 } ]", "Duplicate setting 'url'" },
+		{ "thresholds: { load: { warning: abc } }", "Invalid warning range for load" },
+		{ "metrics_labels: { site: london }\noutputs:\n  - type: remote-write\n    url: http://127.0.0.1\n    labels: { site: paris }", "line 3: Invalid extra label 'site' for the remote write endpoint" },
+		{ "targets: [ { name: a, address: 127.0.0.1, labels: { room: a } } ]\noutputs: [ { type: remote-write, url: http://127.0.0.1, labels: { room: b } } ]", "Invalid extra label 'room'" },
+		{ "targets: [ { name: a, address: 127.0.0.1 } ]\noutputs: [ { type: remote-write, url: http://127.0.0.1, labels: { ups: b } } ]", "Invalid extra label 'ups'" },
+	} {
+		_, _, err := parseTestConfiguration( t, test.content )
+		if ( err == nil || !strings.Contains( err.Error(), test.expected ) ) { t.Errorf( "expected error containing %q for %q, got %v", test.expected, test.content, err ) }
+	}
+}
+
+func TestReloadKeepsMetricsLabelsAndFilters( t *testing.T ) {
+	keepTestTargets( t )
+	previousArguments, previousConfiguration, previousCollectors := os.Args, currentConfiguration.Load(), getCollectors()
+	t.Cleanup( func() {
+		applyTargets( nil )
+		os.Args = previousArguments
+		currentConfiguration.Store( previousConfiguration )
+		collectorsMutex.Lock()
+		collectors = previousCollectors
+		collectorsMutex.Unlock()
+	} )
+
+	path := writeTestConfigurationFile( t, "metrics_include: ups_battery_.*" )
+	os.Args = []string { "apc-ups-exporter", "-config", path }
+	configuration, _, err := parseTestConfiguration( t, "metrics_include: ups_battery_.*" )
+	if err != nil { t.Fatal( err ) }
+	applyConfiguration( configuration )
+
+	// The new constant label is not on the metrics until a restart, so the remote write endpoint can still add it
+	os.WriteFile( path, []byte( "metrics_include: ups_line_.*\nmetrics_labels: { site: london }\noutputs: [ { type: remote-write, url: http://127.0.0.1, labels: { site: paris } } ]" ), 0644 )
+	if reloadError := reloadConfiguration(); reloadError != nil { t.Fatal( reloadError ) }
+
+	reloaded := currentConfiguration.Load()
+	if ( reloaded.MetricsInclude != "ups_battery_.*" || reloaded.metricsInclude.MatchString( "ups_line_voltage_volts" ) || !reloaded.metricsInclude.MatchString( "ups_battery_charge_percent" ) ) { t.Errorf( "expected the filter in effect to be kept, got %q", reloaded.MetricsInclude ) }
+	if ( len( reloaded.metricsConstantLabels ) != 0 ) { t.Errorf( "expected the constant labels in effect to be kept, got %v", reloaded.metricsConstantLabels ) }
+	if ( len( getOutputs() ) != 1 ) { t.Errorf( "expected the remote write endpoint to be created, got %d outputs", len( getOutputs() ) ) }
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The page itself, which fetches everything else from the dashboard API
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// The most recent power events to show
+const DASHBOARD_EVENT_COUNT = 25
+
+// The most samples to hold for the charts of each UPS, no matter how short the collection interval is
+const DASHBOARD_MAXIMUM_SAMPLES = 2000
+
+// A lightweight page showing the state of each UPS, with charts of recent history & the latest power events
+// Everything is held in memory, so the charts start empty when the exporter starts
+type Dashboard struct {
+
+	// How far back the charts go, and where to link to the metrics page
+	HistoryDuration time.Duration
+	MetricsPath string
+
+	// Each UPS by name, in the order they were first seen, and the latest power events, newest first
+	mutex sync.Mutex
+	upses map[ string ]*dashboardUPS
+	upsNames []string
+	events []PowerEventRecord
+}
+
+// The latest status of a UPS & its recent values, stored in columns as that is how the charts use them
+type dashboardUPS struct {
+	Status Status
+	Times []int64 // Unix seconds
+	Charge []float64
+	Runtime []float64
+	Load []float64
+	LineVoltage []float64
+	Temperature []float64
+}
+
+// Creates an empty dashboard
+func NewDashboard( historyDuration time.Duration, metricsPath string ) *Dashboard {
+	return &Dashboard {
+		HistoryDuration: historyDuration,
+		MetricsPath: metricsPath,
+		upses: map[ string ]*dashboardUPS {},
+		events: []PowerEventRecord {},
+	}
+}
+
+// Gets a short name for display purposes
+func ( dashboard *Dashboard ) Name() string {
+	return "dashboard"
+}
+
+// Stores the status as the latest for its UPS, and adds its values to the charts
+func ( dashboard *Dashboard ) Publish( status Status ) error {
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+
+	name := getUPSName( status )
+	ups, exists := dashboard.upses[ name ]
+	if !exists {
+		ups = &dashboardUPS {}
+		dashboard.upses[ name ] = ups
+		dashboard.upsNames = append( dashboard.upsNames, name )
+	}
+
+	// Skip duplicates, such as when the daemon has not polled the UPS since last time
+	sampleTime := status.Date
+	if sampleTime.IsZero() { sampleTime = time.Now() }
+	ups.Status = status
+	if ( len( ups.Times ) > 0 && ups.Times[ len( ups.Times ) - 1 ] >= sampleTime.Unix() ) { return nil }
+
+	ups.Times = append( ups.Times, sampleTime.Unix() )
+	ups.Charge = append( ups.Charge, status.UPS.Battery.ChargePercent )
+	ups.Runtime = append( ups.Runtime, status.UPS.Battery.RemainingRuntimeMinutes )
+	ups.Load = append( ups.Load, status.UPS.LoadPercent )
+	ups.LineVoltage = append( ups.LineVoltage, status.UPS.LineVoltage )
+	ups.Temperature = append( ups.Temperature, status.UPS.Temperature )
+
+	// Drop samples that are too old, or beyond the limit
+	cutoff := sampleTime.Add( -dashboard.HistoryDuration ).Unix()
+	dropCount := 0
+	for ( dropCount < len( ups.Times ) && ( ups.Times[ dropCount ] < cutoff || len( ups.Times ) - dropCount > DASHBOARD_MAXIMUM_SAMPLES ) ) { dropCount++ }
+	if ( dropCount > 0 ) {
+		ups.Times = ups.Times[ dropCount : ]
+		ups.Charge = ups.Charge[ dropCount : ]
+		ups.Runtime = ups.Runtime[ dropCount : ]
+		ups.Load = ups.Load[ dropCount : ]
+		ups.LineVoltage = ups.LineVoltage[ dropCount : ]
+		ups.Temperature = ups.Temperature[ dropCount : ]
+	}
+
+	return nil
+}
+
+// Adds the event to the top of the latest power events
+func ( dashboard *Dashboard ) Notify( event PowerEvent ) error {
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+
+	dashboard.events = append( []PowerEventRecord { event.Record( event.Summary() ) }, dashboard.events... )
+	if ( len( dashboard.events ) > DASHBOARD_EVENT_COUNT ) { dashboard.events = dashboard.events[ : DASHBOARD_EVENT_COUNT ] }
+
+	return nil
+}
+
+// Nothing to do, as nothing is stored
+func ( dashboard *Dashboard ) Close() error {
+	return nil
+}
+
+// Serves the page, which is registered on the root path so anything else is not found
+func ( dashboard *Dashboard ) ServeHTTP( response http.ResponseWriter, request *http.Request ) {
+	if ( request.URL.Path != "/" ) {
+		http.NotFound( response, request )
+		return
+	}
+
+	response.Header().Set( "Content-Type", "text/html; charset=utf-8" )
+	response.Header().Set( "Cache-Control", "no-cache" )
+	response.Write( dashboardPage )
+}
+
+// Serves everything on the page as JSON
+func ( dashboard *Dashboard ) ServeData( response http.ResponseWriter, request *http.Request ) {
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+
+	upses := []map[ string ]any {}
+	for _, name := range dashboard.upsNames {
+		ups := dashboard.upses[ name ]
+		status := ups.Status
+
+		// Age of the battery, if the date it was replaced is known
+		var batteryAgeDays *float64
+		if !status.UPS.Battery.LastReplacementDate.IsZero() {
+			days := math.Floor( time.Since( status.UPS.Battery.LastReplacementDate ).Hours() / 24 )
+			batteryAgeDays = &days
+		}
+
+		var loadWatts *float64
+		if value, ok := calculateLoadWatts( status ); ok { loadWatts = &value }
+
+		upses = append( upses, map[ string ]any {
+			"name": name,
+			"model": status.UPS.ModelName,
+			"serial": status.UPS.SerialNumber,
+			"host": status.Daemon.SystemName,
+			"updated": status.Date,
+			"status": strings.TrimSpace( status.UPS.StatusText ),
+			"on_battery": hasStatusFlag( status.UPS.StatusText, "ONBATT" ),
+			"battery_charge_percent": dashboardValue( status.UPS.Battery.ChargePercent ),
+			"battery_remaining_runtime_minutes": dashboardValue( status.UPS.Battery.RemainingRuntimeMinutes ),
+			"battery_voltage": dashboardValue( status.UPS.Battery.OutputVoltage ),
+			"battery_age_days": batteryAgeDays,
+			"load_percent": dashboardValue( status.UPS.LoadPercent ),
+			"load_watts": loadWatts,
+			"line_voltage": dashboardValue( status.UPS.LineVoltage ),
+			"output_voltage": dashboardModelValue( status.UPS.OutputVoltage ),
+			"temperature": dashboardModelValue( status.UPS.Temperature ),
+			"last_transfer_reason": status.Daemon.Battery.Transfer.LastReason,
+			"history": map[ string ]any {
+				"time": ups.Times,
+				"battery_charge_percent": dashboardValues( ups.Charge ),
+				"battery_remaining_runtime_minutes": dashboardValues( ups.Runtime ),
+				"load_percent": dashboardValues( ups.Load ),
+				"line_voltage": dashboardValues( ups.LineVoltage ),
+				"temperature": dashboardModelValues( ups.Temperature ),
+			},
+		} )
+	}
+
+	response.Header().Set( "Content-Type", "application/json" )
+	response.Header().Set( "Cache-Control", "no-cache" )
+	json.NewEncoder( response ).Encode( map[ string ]any {
+		"version": PROJECT_VERSION,
+		"metrics_path": dashboard.MetricsPath,
+		"history_seconds": dashboard.HistoryDuration.Seconds(),
+		"upses": upses,
+		"events": dashboard.events,
+	} )
+}
+
+// Gets a value for the page, or nothing if the UPS does not report it
+func dashboardValue( value float64 ) *float64 {
+	if ( value < 0 ) { return nil }
+	return &value
+}
+
+// Gets values for the charts, with gaps where the UPS did not report them
+func dashboardValues( values []float64 ) []*float64 {
+	result := make( []*float64, len( values ) )
+	for index, value := range values { result[ index ] = dashboardValue( value ) }
+	return result
+}
+
+// Gets a value that only some models report, which is zero for the rest
+func dashboardModelValue( value float64 ) *float64 {
+	if ( value == 0 ) { return nil }
+	return dashboardValue( value )
+}
+
+// Gets values for the charts that only some models report, with gaps where they are zero
+func dashboardModelValues( values []float64 ) []*float64 {
+	result := make( []*float64, len( values ) )
+	for index, value := range values { result[ index ] = dashboardModelValue( value ) }
+	return result
+}
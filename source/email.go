@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How to secure the connection to the SMTP server
+const (
+	SMTP_TLS_STARTTLS = "starttls" // Upgrade a plain connection, usually on port 587
+	SMTP_TLS_IMPLICIT = "tls" // Connect with TLS from the start, usually on port 465
+	SMTP_TLS_NONE = "none" // Only for trusted local relays
+)
+
+// Sends an email about each power event through an SMTP server, at most once per interval so a flapping mains supply does not flood inboxes
+// Events that arrive too soon after the last email are held, then sent together in one email once the interval has passed
+type EmailNotifier struct {
+	address string // host:port
+	tlsMode string
+	username string
+	password string
+	from string
+	to []string
+
+	// The shortest time between two emails
+	MinimumInterval time.Duration
+
+	// How long to wait before trying again after the first failed attempt to send an email, and after the first time all the attempts failed
+	retryDelay time.Duration
+	rescheduleDelay time.Duration
+
+	// When the last email was sent, the events waiting for the interval to pass (or to be sent again), and how many times in a row sending them failed
+	// NOTE: This is never held while sending, so events can be held while the SMTP server is slow
+	pendingMutex sync.Mutex
+	lastSentAt time.Time
+	pending []PowerEvent
+	flushScheduled bool
+	isSending bool
+	consecutiveFailures int
+	isClosed bool
+
+	// Held while sending, so only one email is sent at a time
+	sendMutex sync.Mutex
+}
+
+// Creates a notifier for an SMTP server
+func NewEmailNotifier( address string, tlsMode string, username string, password string, from string, to []string, minimumInterval time.Duration ) ( *EmailNotifier, error ) {
+	if _, _, splitError := net.SplitHostPort( address ); splitError != nil { return nil, splitError }
+
+	switch tlsMode {
+		case SMTP_TLS_STARTTLS, SMTP_TLS_IMPLICIT, SMTP_TLS_NONE:
+		default: return nil, fmt.Errorf( "unknown TLS mode '%s', must be one of starttls, tls or none", tlsMode )
+	}
+
+	return &EmailNotifier {
+		address: address,
+		tlsMode: tlsMode,
+		username: username,
+		password: password,
+		from: from,
+		to: to,
+
+		MinimumInterval: minimumInterval,
+		retryDelay: 2 * time.Second,
+		rescheduleDelay: time.Minute,
+	}, nil
+}
+
+// Gets a short name for display purposes
+func ( notifier *EmailNotifier ) Name() string {
+	return "SMTP server"
+}
+
+// Sends an email about the event, or holds it until the interval has passed since the last email
+func ( notifier *EmailNotifier ) Notify( event PowerEvent ) error {
+	notifier.pendingMutex.Lock()
+	notifier.pending = append( notifier.pending, event )
+
+	// Hold the event if an email was sent too recently (or is being sent, or waiting to be sent again), and make sure it gets sent later
+	waitDuration := notifier.MinimumInterval - time.Since( notifier.lastSentAt )
+	if ( waitDuration > 0 || notifier.flushScheduled || notifier.isSending ) {
+		notifier.scheduleFlush( waitDuration )
+		notifier.pendingMutex.Unlock()
+
+		slog.Debug( "Holding power event to email later", "kind", event.Kind, "duration", waitDuration.Round( time.Second ) )
+		return nil
+	}
+	notifier.pendingMutex.Unlock()
+
+	return notifier.flush( false )
+}
+
+// Sends the held events in the background after a while, unless that is already scheduled
+// NOTE: The caller must hold the pending mutex
+func ( notifier *EmailNotifier ) scheduleFlush( delay time.Duration ) {
+	if ( notifier.flushScheduled || notifier.isClosed ) { return }
+
+	notifier.flushScheduled = true
+	time.AfterFunc( max( delay, 0 ), notifier.flushInBackground )
+}
+
+// Sends the held events once the interval has passed
+func ( notifier *EmailNotifier ) flushInBackground() {
+	notifier.pendingMutex.Lock()
+	notifier.flushScheduled = false
+	pendingCount := len( notifier.pending )
+	notifier.pendingMutex.Unlock()
+	if ( pendingCount == 0 ) { return }
+
+	flushError := notifier.flush( false )
+	if flushError != nil {
+		slog.Error( "Failed to send held power events by email", "count", pendingCount, "error", flushError )
+		return
+	}
+
+	slog.Debug( "Sent held power events by email", "count", pendingCount )
+}
+
+// Sends any held events straight away, rather than waiting for the interval to pass
+func ( notifier *EmailNotifier ) Close() error {
+	notifier.pendingMutex.Lock()
+	notifier.isClosed = true
+	pendingCount := len( notifier.pending )
+	notifier.pendingMutex.Unlock()
+	if ( pendingCount == 0 ) { return nil }
+
+	return notifier.flush( true )
+}
+
+// Sends all the pending events in one email, holding them to be sent again later if it fails
+// Unless forced, nothing is sent if another email was sent within the interval while waiting for it to finish
+func ( notifier *EmailNotifier ) flush( isForced bool ) error {
+	notifier.sendMutex.Lock()
+	defer notifier.sendMutex.Unlock()
+
+	// Take the pending events, so more can be held while sending
+	notifier.pendingMutex.Lock()
+	waitDuration := notifier.MinimumInterval - time.Since( notifier.lastSentAt )
+	if ( waitDuration > 0 && !isForced ) {
+		notifier.scheduleFlush( waitDuration )
+		notifier.pendingMutex.Unlock()
+		return nil
+	}
+	events := notifier.pending
+	notifier.pending = nil
+	notifier.isSending = ( len( events ) > 0 )
+	notifier.pendingMutex.Unlock()
+	if ( len( events ) == 0 ) { return nil }
+
+	message := formatEmailMessage( notifier.from, notifier.to, events )
+	sendError := retryWithBackoff( 3, notifier.retryDelay, func() error { return notifier.send( message ) } )
+
+	notifier.pendingMutex.Lock()
+	defer notifier.pendingMutex.Unlock()
+	notifier.isSending = false
+
+	// Put the events back before any that arrived since, and try again later, waiting twice as long each time up to an hour
+	if sendError != nil {
+		notifier.pending = append( events, notifier.pending... )
+		notifier.consecutiveFailures++
+		notifier.scheduleFlush( min( notifier.rescheduleDelay << min( notifier.consecutiveFailures - 1, 10 ), time.Hour ) )
+		return sendError
+	}
+
+	notifier.lastSentAt = time.Now()
+	notifier.consecutiveFailures = 0
+	if ( len( notifier.pending ) > 0 ) { notifier.scheduleFlush( notifier.MinimumInterval ) }
+
+	return nil
+}
+
+// Delivers a message to the SMTP server
+func ( notifier *EmailNotifier ) send( message []byte ) error {
+	host, _, _ := net.SplitHostPort( notifier.address )
+	tlsConfig := &tls.Config { ServerName: host }
+
+	// Connect, with TLS from the start if needed
+	var connection net.Conn
+	var connectError error
+	dialer := &net.Dialer { Timeout: 10 * time.Second }
+	if ( notifier.tlsMode == SMTP_TLS_IMPLICIT ) {
+		connection, connectError = tls.DialWithDialer( dialer, "tcp", notifier.address, tlsConfig )
+	} else {
+		connection, connectError = dialer.Dial( "tcp", notifier.address )
+	}
+	if connectError != nil { return connectError }
+	connection.SetDeadline( time.Now().Add( 30 * time.Second ) )
+
+	client, clientError := smtp.NewClient( connection, host )
+	if clientError != nil {
+		connection.Close()
+		return clientError
+	}
+	defer client.Close()
+
+	// Upgrade the connection, refusing to continue without it so credentials are never sent in the clear
+	if ( notifier.tlsMode == SMTP_TLS_STARTTLS ) {
+		if supported, _ := client.Extension( "STARTTLS" ); !supported { return fmt.Errorf( "server does not support STARTTLS" ) }
+		if tlsError := client.StartTLS( tlsConfig ); tlsError != nil { return tlsError }
+	}
+
+	// Authenticate, if we have credentials
+	if ( notifier.username != "" ) {
+		if authError := client.Auth( smtp.PlainAuth( "", notifier.username, notifier.password, host ) ); authError != nil { return authError }
+	}
+
+	// Send the message to every recipient
+	if mailError := client.Mail( notifier.from ); mailError != nil { return mailError }
+	for _, recipient := range notifier.to {
+		if recipientError := client.Rcpt( recipient ); recipientError != nil { return recipientError }
+	}
+	writer, dataError := client.Data()
+	if dataError != nil { return dataError }
+	if _, writeError := writer.Write( message ); writeError != nil { return writeError }
+	if closeError := writer.Close(); closeError != nil { return closeError }
+
+	return client.Quit()
+}
+
+// Formats an email about one or more events, with a summary of the latest status
+func formatEmailMessage( from string, to []string, events []PowerEvent ) []byte {
+	latest := events[ len( events ) - 1 ]
+
+	// Subject is the latest event, mentioning any others
+	subject := fmt.Sprintf( "[%s] %s", latest.UPSName(), latest.Title() )
+	if ( len( events ) == 2 ) { subject += " (and 1 earlier event)" }
+	if ( len( events ) > 2 ) { subject = fmt.Sprintf( "%s (and %d earlier events)", subject, len( events ) - 1 ) }
+
+	var body strings.Builder
+
+	// Every event, oldest first
+	for _, event := range events {
+		fmt.Fprintf( &body, "%s  %s (status was %s, now %s)\r\n", event.Time.Local().Format( "2006-01-02 15:04:05" ), event.Title(), orDefault( event.PreviousStatusText, "unknown" ), orDefault( strings.TrimSpace( event.Status.UPS.StatusText ), "unknown" ) )
+	}
+
+	// The relevant values from the latest status
+	status := latest.Status
+	fmt.Fprintf( &body, "\r\nLatest status of the UPS:\r\n\r\n" )
+	for _, line := range [][ 2 ]string {
+		{ "UPS", fmt.Sprintf( "%s (%s, serial %s)", latest.UPSName(), orDefault( status.UPS.ModelName, "unknown model" ), orDefault( status.UPS.SerialNumber, "unknown" ) ) },
+		{ "Status", orDefault( strings.TrimSpace( status.UPS.StatusText ), "unknown" ) },
+		{ "Battery charge", formatEmailValue( status.UPS.Battery.ChargePercent, "%.0f%%" ) },
+		{ "Runtime remaining", formatEmailValue( status.UPS.Battery.RemainingRuntimeMinutes, "%.1f minutes" ) },
+		{ "Load", formatEmailValue( status.UPS.LoadPercent, "%.0f%%" ) },
+		{ "Line voltage", formatEmailValue( status.UPS.LineVoltage, "%.1f V" ) },
+		{ "Time on battery", formatEmailValue( status.Daemon.Battery.TimeSpent.Current, "%.0f seconds" ) },
+		{ "Last transfer reason", orDefault( status.Daemon.Battery.Transfer.LastReason, "unknown" ) },
+		{ "Reported by", orDefault( status.Daemon.SystemName, "unknown" ) },
+	} {
+		fmt.Fprintf( &body, "%-22s%s\r\n", line[ 0 ] + ":", line[ 1 ] )
+	}
+	fmt.Fprintf( &body, "\r\n-- \r\nSent by %s v%s\r\n", PROJECT_NAME, PROJECT_VERSION )
+
+	// Headers, then the body
+	var message strings.Builder
+	fmt.Fprintf( &message, "From: %s\r\n", from )
+	fmt.Fprintf( &message, "To: %s\r\n", strings.Join( to, ", " ) )
+	fmt.Fprintf( &message, "Subject: %s\r\n", mime.QEncoding.Encode( "utf-8", subject ) )
+	fmt.Fprintf( &message, "Date: %s\r\n", time.Now().Format( time.RFC1123Z ) )
+	fmt.Fprintf( &message, "Message-ID: <%s@apc-ups-exporter>\r\n", latest.ID )
+	fmt.Fprintf( &message, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" )
+	message.WriteString( body.String() )
+
+	return []byte( message.String() )
+}
+
+// Formats a value for an email, unless the UPS does not report it
+func formatEmailValue( value float64, format string ) string {
+	if ( value < 0 ) { return "unknown" }
+	return fmt.Sprintf( format, value )
+}
+
+// Gets a string, or a default if it is empty
+func orDefault( value string, defaultValue string ) string {
+	if ( value == "" ) { return defaultValue }
+	return value
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// An SMTP server that records the subject of every email, refusing them while failing & holding them while blocked
+type testSMTPServer struct {
+	listener net.Listener
+	isFailing atomic.Bool
+	isBlocked chan struct {} // Closed to unblock
+
+	mutex sync.Mutex
+	subjects []string
+}
+
+// Starts an SMTP server on the loopback interface
+func startTestSMTPServer( t *testing.T ) *testSMTPServer {
+	t.Helper()
+
+	listener, listenError := net.Listen( "tcp4", "127.0.0.1:0" )
+	if listenError != nil { t.Fatal( listenError ) }
+	server := &testSMTPServer { listener: listener, isBlocked: make( chan struct {} ) }
+	close( server.isBlocked )
+	t.Cleanup( func() { listener.Close() } )
+
+	go func() {
+		for {
+			connection, acceptError := listener.Accept()
+			if acceptError != nil { return }
+			go server.serve( connection )
+		}
+	}()
+
+	return server
+}
+
+// Holds a conversation with a client, just enough for net/smtp
+func ( server *testSMTPServer ) serve( connection net.Conn ) {
+	defer connection.Close()
+	reader := bufio.NewReader( connection )
+	reply := func( line string ) { connection.Write( []byte( line + "\r\n" ) ) }
+
+	reply( "220 localhost ESMTP" )
+	for {
+		line, readError := reader.ReadString( '\n' )
+		if readError != nil { return }
+		command := strings.ToUpper( strings.Fields( line + " " )[ 0 ] )
+
+		switch command {
+			case "EHLO", "HELO", "RCPT": reply( "250 OK" )
+			case "MAIL":
+				if server.isFailing.Load() { reply( "451 Try again later" ); continue }
+				reply( "250 OK" )
+			case "DATA":
+				reply( "354 Go ahead" )
+				subject := ""
+				for {
+					dataLine, dataError := reader.ReadString( '\n' )
+					if dataError != nil { return }
+					if ( dataLine == ".\r\n" ) { break }
+					if strings.HasPrefix( dataLine, "Subject: " ) { subject = strings.TrimSpace( strings.TrimPrefix( dataLine, "Subject: " ) ) }
+				}
+
+				<-server.isBlocked
+				server.mutex.Lock()
+				server.subjects = append( server.subjects, subject )
+				server.mutex.Unlock()
+				reply( "250 Queued" )
+			case "QUIT":
+				reply( "221 Bye" )
+				return
+			default: reply( "502 Not implemented" )
+		}
+	}
+}
+
+// Gets the subjects of the emails received so far
+func ( server *testSMTPServer ) getSubjects() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return append( []string {}, server.subjects... )
+}
+
+// Waits for a number of emails to be received, giving their subjects
+func ( server *testSMTPServer ) waitForSubjects( t *testing.T, count int, timeout time.Duration ) []string {
+	t.Helper()
+
+	for deadline := time.Now().Add( timeout ); time.Now().Before( deadline ); time.Sleep( 10 * time.Millisecond ) {
+		if subjects := server.getSubjects(); ( len( subjects ) >= count ) { return subjects }
+	}
+
+	t.Fatalf( "expected %d emails, got %v", count, server.getSubjects() )
+	return nil
+}
+
+// Creates a notifier for the server that retries quickly
+func newTestEmailNotifier( t *testing.T, server *testSMTPServer, minimumInterval time.Duration ) *EmailNotifier {
+	t.Helper()
+
+	notifier, err := NewEmailNotifier( server.listener.Addr().String(), SMTP_TLS_NONE, "", "", "ups@example.com", []string { "admin@example.com" }, minimumInterval )
+	if err != nil { t.Fatal( err ) }
+	notifier.retryDelay = 10 * time.Millisecond
+	notifier.rescheduleDelay = 100 * time.Millisecond
+
+	return notifier
+}
+
+// Creates an event for a UPS
+func newTestPowerEvent( kind string ) PowerEvent {
+	event := PowerEvent { ID: kind, Kind: kind, Time: time.Now() }
+	event.Status.UPS.Name = "ups1"
+
+	return event
+}
+
+func TestEmailHoldsEventsWithinInterval( t *testing.T ) {
+	server := startTestSMTPServer( t )
+	notifier := newTestEmailNotifier( t, server, 300 * time.Millisecond )
+
+	for _, kind := range []string { EVENT_ON_BATTERY, EVENT_ON_LINE, EVENT_ON_BATTERY } {
+		if notifyError := notifier.Notify( newTestPowerEvent( kind ) ); notifyError != nil { t.Fatal( notifyError ) }
+	}
+
+	// The first straight away, then the others together once the interval has passed
+	if subjects := server.getSubjects(); ( len( subjects ) != 1 || subjects[ 0 ] != "[ups1] Running on battery" ) { t.Errorf( "expected the first event to be sent straight away, got %v", subjects ) }
+	subjects := server.waitForSubjects( t, 2, 2 * time.Second )
+	if ( len( subjects ) != 2 || subjects[ 1 ] != "[ups1] Running on battery (and 1 earlier event)" ) { t.Errorf( "expected the held events in one email, got %v", subjects ) }
+}
+
+func TestEmailRetriesFailedFlushLater( t *testing.T ) {
+	server := startTestSMTPServer( t )
+	server.isFailing.Store( true )
+	notifier := newTestEmailNotifier( t, server, 0 )
+
+	if notifyError := notifier.Notify( newTestPowerEvent( EVENT_ON_BATTERY ) ); notifyError == nil { t.Fatal( "expected sending to fail" ) }
+
+	// Held along with the failed one, rather than sent on its own
+	if notifyError := notifier.Notify( newTestPowerEvent( EVENT_LOW_BATTERY ) ); notifyError != nil { t.Fatal( notifyError ) }
+
+	server.isFailing.Store( false )
+	subjects := server.waitForSubjects( t, 1, 2 * time.Second )
+	if ( subjects[ 0 ] != "[ups1] Battery is low (and 1 earlier event)" ) { t.Errorf( "expected both events to be sent once the server recovers, got %v", subjects ) }
+}
+
+func TestEmailNotifyDoesNotWaitForSending( t *testing.T ) {
+	server := startTestSMTPServer( t )
+	server.isBlocked = make( chan struct {} )
+	notifier := newTestEmailNotifier( t, server, 0 )
+
+	go notifier.Notify( newTestPowerEvent( EVENT_ON_BATTERY ) )
+	time.Sleep( 100 * time.Millisecond )
+
+	// Held while the first is being sent
+	startedAt := time.Now()
+	if notifyError := notifier.Notify( newTestPowerEvent( EVENT_ON_LINE ) ); notifyError != nil { t.Fatal( notifyError ) }
+	if elapsed := time.Since( startedAt ); ( elapsed > 50 * time.Millisecond ) { t.Errorf( "expected not to wait for the SMTP server, took %s", elapsed ) }
+
+	close( server.isBlocked )
+	subjects := server.waitForSubjects( t, 2, 2 * time.Second )
+	if ( subjects[ 1 ] != "[ups1] Mains power restored" ) { t.Errorf( "expected the held event to be sent afterwards, got %v", subjects ) }
+}
+
+func TestEmailCloseSendsHeldEvents( t *testing.T ) {
+	server := startTestSMTPServer( t )
+	notifier := newTestEmailNotifier( t, server, time.Hour )
+
+	notifier.Notify( newTestPowerEvent( EVENT_ON_BATTERY ) )
+	notifier.Notify( newTestPowerEvent( EVENT_ON_LINE ) )
+	if closeError := notifier.Close(); closeError != nil { t.Fatal( closeError ) }
+
+	if subjects := server.getSubjects(); ( len( subjects ) != 2 || subjects[ 1 ] != "[ups1] Mains power restored" ) { t.Errorf( "expected the held event to be sent on closing, got %v", subjects ) }
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+)
+
+// Structure to integrate the load of the UPS into energy consumed over time
+type EnergyMeter struct {
+
+	// The longest gap between two statuses that is still integrated, anything longer is skipped
+	MaximumGap time.Duration
+
+	// The previous sample
+	lastSampleAt time.Time
+	lastLoadWatts float64
+
+}
+
+// Calculates the current load in watts from the load percentage & nominal power, if both are known
+func calculateLoadWatts( status Status ) ( watts float64, ok bool ) {
+	if ( status.UPS.LoadPercent < 0 || status.UPS.Expect.PowerOutputWattage <= 0 ) { return 0, false }
+	return status.UPS.LoadPercent / 100 * status.UPS.Expect.PowerOutputWattage, true
+}
+
+// Calculates the current load in volt-amps from the load percentage & nominal apparent power, if both are known
+func calculateLoadVoltAmps( status Status ) ( voltAmps float64, ok bool ) {
+	if ( status.UPS.LoadPercent < 0 || status.UPS.Expect.PowerOutputVoltAmps <= 0 ) { return 0, false }
+	return status.UPS.LoadPercent / 100 * status.UPS.Expect.PowerOutputVoltAmps, true
+}
+
+// Updates the meter with the latest status, adding the energy consumed since the previous status to the metrics
+func ( meter *EnergyMeter ) Update( status Status, metrics *Metrics ) {
+
+	// Forget the previous sample if the load is unknown, so we never integrate across it
+	watts, ok := calculateLoadWatts( status )
+	if !ok {
+		meter.lastSampleAt = time.Time{}
+		return
+	}
+
+	// Get when this status is from
+	now := statusTime( status )
+
+	// Integrate using the average of both samples, but only if the gap is sensible
+	// NOTE: The daemon can return the same sample twice if it polls the UPS slower than we do, which is a gap of zero
+	if !meter.lastSampleAt.IsZero() {
+		gap := now.Sub( meter.lastSampleAt )
+		if ( gap <= 0 ) { return }
+
+		if ( meter.MaximumGap <= 0 || gap <= meter.MaximumGap ) {
+			averageWatts := ( meter.lastLoadWatts + watts ) / 2
+			metrics.EnergyConsumedKilowattHours.Add( averageWatts * gap.Hours() / 1000 )
+			metrics.V2EnergyConsumedJoulesTotal.Add( averageWatts * gap.Seconds() )
+		}
+	}
+
+	// Remember this sample for next time
+	meter.lastSampleAt = now
+	meter.lastLoadWatts = watts
+
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEnergyMeter( t *testing.T ) {
+	metrics := newTestMetrics()
+	meter := &EnergyMeter { MaximumGap: 10 * time.Minute }
+	start := time.Date( 2024, 3, 1, 12, 0, 0, 0, time.UTC )
+
+	for index, test := range []struct {
+		offset time.Duration
+		loadPercent float64
+		expectedJoules float64
+	} {
+		{ 0, 40, 0 },
+
+		// The average of 400 & 600 watts for a minute
+		{ time.Minute, 60, 30000 },
+
+		// The same sample again, or one from before it, adds nothing
+		{ time.Minute, 60, 30000 },
+		{ 30 * time.Second, 80, 30000 },
+
+		// 600 watts for five minutes
+		{ 6 * time.Minute, 60, 210000 },
+
+		// Longer than the maximum gap is skipped, but counted from afterwards
+		{ 20 * time.Minute, 20, 210000 },
+		{ 21 * time.Minute, 40, 228000 },
+
+		// Unknown load is never integrated across
+		{ 22 * time.Minute, -1, 228000 },
+		{ 23 * time.Minute, 40, 228000 },
+		{ 24 * time.Minute, 40, 252000 },
+	} {
+		status := Status { Date: start.Add( test.offset ) }
+		status.UPS.LoadPercent, status.UPS.Expect.PowerOutputWattage = test.loadPercent, 1000
+		meter.Update( status, metrics )
+
+		if joules := testutil.ToFloat64( metrics.V2EnergyConsumedJoulesTotal ); ( math.Abs( joules - test.expectedJoules ) > 1e-6 ) { t.Errorf( "%d: expected %v joules, got %v", index, test.expectedJoules, joules ) }
+		if kilowattHours := testutil.ToFloat64( metrics.EnergyConsumedKilowattHours ); ( math.Abs( kilowattHours - test.expectedJoules / 3600000 ) > 1e-9 ) { t.Errorf( "%d: expected %v kWh, got %v", index, test.expectedJoules / 3600000, kilowattHours ) }
+	}
+}
+
+func TestEnergyMeterWithoutNominalPower( t *testing.T ) {
+	metrics := newTestMetrics()
+	meter := &EnergyMeter {}
+	start := time.Date( 2024, 3, 1, 12, 0, 0, 0, time.UTC )
+
+	// Without a maximum gap everything is integrated, unless the UPS does not report its nominal power
+	for index, wattage := range []float64 { 1000, 0, 1000, 1000 } {
+		status := Status { Date: start.Add( time.Duration( index ) * time.Hour ) }
+		status.UPS.LoadPercent, status.UPS.Expect.PowerOutputWattage = 50, wattage
+		meter.Update( status, metrics )
+	}
+
+	if kilowattHours := testutil.ToFloat64( metrics.EnergyConsumedKilowattHours ); ( kilowattHours != 0.5 ) { t.Errorf( "expected 0.5 kWh, got %v", kilowattHours ) }
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The syslog severity of each kind of power event - datatracker.ietf.org/doc/html/rfc5424#section-6.2.1
+var powerEventSeverities = map[ string ]int {
+	EVENT_ON_BATTERY: 4, // Warning
+	EVENT_ON_LINE: 5, // Notice
+	EVENT_LOW_BATTERY: 2, // Critical
+	EVENT_REPLACE_BATTERY: 4, // Warning
+	EVENT_COMMUNICATION_LOST: 3, // Error
+	EVENT_COMMUNICATION_RESTORED: 5, // Notice
+	EVENT_SHUTDOWN_PENDING: 2, // Critical
+	EVENT_NIS_UNREACHABLE: 3, // Error
+	EVENT_NIS_REACHABLE: 5, // Notice
+}
+
+// The identifier of this program in the logs
+const EVENT_LOG_IDENTIFIER = "apc-ups-exporter"
+
+// Gets the syslog severity of a power event, defaulting to informational
+func getPowerEventSeverity( kind string ) int {
+	severity, ok := powerEventSeverities[ kind ]
+	if !ok { return 6 }
+	return severity
+}
+
+// Gets the structured values of a power event as name & value pairs, in a stable order
+func getPowerEventFields( event PowerEvent ) [][ 2 ]string {
+	record := event.Record( "" )
+
+	fields := [][ 2 ]string {
+		{ "event_id", record.ID },
+		{ "event", record.Kind },
+		{ "ups_name", record.UPS.Name },
+		{ "ups_model", record.UPS.Model },
+		{ "ups_serial", record.UPS.Serial },
+		{ "previous_status", record.PreviousStatus },
+		{ "status", record.Status },
+		{ "battery_charge_percent", strconv.FormatFloat( record.BatteryChargePercent, 'f', -1, 64 ) },
+		{ "battery_runtime_minutes", strconv.FormatFloat( record.BatteryRemainingRuntimeMinutes, 'f', -1, 64 ) },
+		{ "load_percent", strconv.FormatFloat( record.LoadPercent, 'f', -1, 64 ) },
+		{ "last_transfer_reason", record.LastTransferReason },
+	}
+	if ( record.Detail != "" ) { fields = append( fields, [ 2 ]string { "detail", record.Detail } ) }
+
+	return fields
+}
+
+/*************************************/
+
+// Escapes parameter values in structured data - datatracker.ietf.org/doc/html/rfc5424#section-6.3.3
+var syslogParameterEscaper = strings.NewReplacer( "\\", "\\\\", "\"", "\\\"", "]", "\\]" )
+
+// Writes each power event as an RFC 5424 syslog message, with the values as structured data
+type SyslogEventLog struct {
+	network string // udp, tcp, unixgram or unix
+	address string
+	hostname string
+
+	// The connection, which is reopened after a failure, and whether it is a stream that needs framing
+	connectionMutex sync.Mutex
+	connection net.Conn
+	isStream bool
+}
+
+// Creates an event log for a syslog server, given as a URL (e.g., 'udp://127.0.0.1:514', 'tcp://logs.example.com:601' or 'unix:///dev/log')
+func NewSyslogEventLog( target string ) ( *SyslogEventLog, error ) {
+	parsedURL, parseError := url.Parse( target )
+	if parseError != nil { return nil, parseError }
+
+	eventLog := &SyslogEventLog {}
+	eventLog.hostname, _ = os.Hostname()
+	if ( eventLog.hostname == "" ) { eventLog.hostname = "-" }
+
+	switch parsedURL.Scheme {
+		case "udp", "tcp": {
+			if _, _, splitError := net.SplitHostPort( parsedURL.Host ); splitError != nil { return nil, splitError }
+			eventLog.network = parsedURL.Scheme
+			eventLog.address = parsedURL.Host
+		}
+
+		// Local sockets are usually datagram sockets, such as /dev/log
+		case "unix": {
+			if ( parsedURL.Path == "" ) { return nil, fmt.Errorf( "missing path to the socket" ) }
+			eventLog.network = "unixgram"
+			eventLog.address = parsedURL.Path
+		}
+
+		default: return nil, fmt.Errorf( "unknown scheme '%s', must be udp, tcp or unix", parsedURL.Scheme )
+	}
+
+	return eventLog, nil
+}
+
+// Gets a short name for display purposes
+func ( eventLog *SyslogEventLog ) Name() string {
+	return "syslog event log"
+}
+
+// Sends the event to the syslog server, reconnecting if needed
+func ( eventLog *SyslogEventLog ) Notify( event PowerEvent ) error {
+	eventLog.connectionMutex.Lock()
+	defer eventLog.connectionMutex.Unlock()
+
+	message := eventLog.format( event )
+
+	return retryWithBackoff( 2, time.Second, func() error {
+
+		// Connect if we are not already, falling back to a stream socket if the local socket is not a datagram socket
+		if ( eventLog.connection == nil ) {
+			network := eventLog.network
+			connection, connectError := net.DialTimeout( network, eventLog.address, 5 * time.Second )
+			if ( connectError != nil && network == "unixgram" ) {
+				network = "unix"
+				connection, connectError = net.DialTimeout( network, eventLog.address, 5 * time.Second )
+			}
+			if connectError != nil { return connectError }
+
+			eventLog.connection = connection
+			eventLog.isStream = ( network == "tcp" || network == "unix" )
+		}
+
+		// Frame messages with their length on stream sockets - datatracker.ietf.org/doc/html/rfc6587#section-3.4.1
+		frame := message
+		if eventLog.isStream { frame = fmt.Sprintf( "%d %s", len( message ), message ) }
+
+		eventLog.connection.SetWriteDeadline( time.Now().Add( 5 * time.Second ) )
+		_, writeError := eventLog.connection.Write( []byte( frame ) )
+		if writeError != nil {
+			eventLog.connection.Close()
+			eventLog.connection = nil
+		}
+
+		return writeError
+
+	} )
+}
+
+// Closes the connection to the syslog server, if there is one
+func ( eventLog *SyslogEventLog ) Close() error {
+	eventLog.connectionMutex.Lock()
+	defer eventLog.connectionMutex.Unlock()
+
+	if ( eventLog.connection == nil ) { return nil }
+
+	closeError := eventLog.connection.Close()
+	eventLog.connection = nil
+
+	return closeError
+}
+
+// Formats the event as an RFC 5424 message - datatracker.ietf.org/doc/html/rfc5424#section-6
+func ( eventLog *SyslogEventLog ) format( event PowerEvent ) string {
+	priority := 3 * 8 + getPowerEventSeverity( event.Kind ) // Daemon facility
+
+	// Structured data, using the enterprise number reserved for documentation
+	var structuredData strings.Builder
+	structuredData.WriteString( "[ups@32473" )
+	for _, field := range getPowerEventFields( event ) {
+		fmt.Fprintf( &structuredData, " %s=\"%s\"", field[ 0 ], syslogParameterEscaper.Replace( field[ 1 ] ) )
+	}
+	structuredData.WriteString( "]" )
+
+	return fmt.Sprintf( "<%d>1 %s %s %s %d %s %s %s", priority, event.Time.UTC().Format( time.RFC3339Nano ), eventLog.hostname, EVENT_LOG_IDENTIFIER, os.Getpid(), event.Kind, structuredData.String(), event.Summary() )
+}
+
+/*************************************/
+
+// The socket that journald listens on for its native protocol
+const JOURNALD_SOCKET_PATH = "/run/systemd/journal/socket"
+
+// Writes each power event to the systemd journal through its native protocol, with the values as journal fields
+type JournaldEventLog struct {
+	address *net.UnixAddr
+}
+
+// Creates an event log for the systemd journal, optionally on a different socket
+func NewJournaldEventLog( socketPath string ) *JournaldEventLog {
+	if ( socketPath == "" ) { socketPath = JOURNALD_SOCKET_PATH }
+	return &JournaldEventLog { address: &net.UnixAddr { Name: socketPath, Net: "unixgram" } }
+}
+
+// Gets a short name for display purposes
+func ( eventLog *JournaldEventLog ) Name() string {
+	return "journald event log"
+}
+
+// Sends the event to the journal as one datagram - systemd.io/JOURNAL_NATIVE_PROTOCOL/
+func ( eventLog *JournaldEventLog ) Notify( event PowerEvent ) error {
+	var entry []byte
+
+	// Adds a field, using the binary form if the value spans multiple lines
+	addField := func( name string, value string ) {
+		if !strings.Contains( value, "\n" ) {
+			entry = fmt.Appendf( entry, "%s=%s\n", name, value )
+			return
+		}
+
+		entry = fmt.Appendf( entry, "%s\n", name )
+		entry = append( entry, byte( len( value ) ), byte( len( value ) >> 8 ), byte( len( value ) >> 16 ), byte( len( value ) >> 24 ), 0, 0, 0, 0 )
+		entry = append( entry, value... )
+		entry = append( entry, '\n' )
+	}
+
+	addField( "MESSAGE", event.Summary() )
+	addField( "PRIORITY", strconv.Itoa( getPowerEventSeverity( event.Kind ) ) )
+	addField( "SYSLOG_IDENTIFIER", EVENT_LOG_IDENTIFIER )
+	addField( "SYSLOG_FACILITY", "3" )
+	for _, field := range getPowerEventFields( event ) {
+		addField( "UPS_" + strings.ToUpper( strings.TrimPrefix( field[ 0 ], "ups_" ) ), field[ 1 ] )
+	}
+
+	connection, connectError := net.DialUnix( "unixgram", nil, eventLog.address )
+	if connectError != nil { return connectError }
+	defer connection.Close()
+
+	_, writeError := connection.Write( entry )
+	return writeError
+}
+
+/*************************************/
+
+// Appends each power event as a line of JSON to a file, which is rotated once it gets too big
+type FileEventLog struct {
+	path string
+
+	// The size at which the file is rotated, and how many rotated files to keep
+	MaximumSize int64
+	MaximumFiles int
+
+	fileMutex sync.Mutex
+}
+
+// Creates an event log for a file, checking that it can be written to
+func NewFileEventLog( path string, maximumSize int64, maximumFiles int ) ( *FileEventLog, error ) {
+	file, openError := os.OpenFile( path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644 )
+	if openError != nil { return nil, openError }
+	file.Close()
+
+	return &FileEventLog { path: path, MaximumSize: maximumSize, MaximumFiles: maximumFiles }, nil
+}
+
+// Gets a short name for display purposes
+func ( eventLog *FileEventLog ) Name() string {
+	return "file event log"
+}
+
+// Appends the event to the file, rotating it first if it is too big
+func ( eventLog *FileEventLog ) Notify( event PowerEvent ) error {
+	eventLog.fileMutex.Lock()
+	defer eventLog.fileMutex.Unlock()
+
+	line, encodeError := json.Marshal( event.Record( event.Summary() ) )
+	if encodeError != nil { return encodeError }
+
+	// Rotate the file if this line would take it over the limit
+	if information, statError := os.Stat( eventLog.path ); statError == nil && eventLog.MaximumSize > 0 && information.Size() + int64( len( line ) ) + 1 > eventLog.MaximumSize {
+		rotateError := eventLog.rotate()
+		if rotateError != nil { return fmt.Errorf( "rotate: %w", rotateError ) }
+	}
+
+	file, openError := os.OpenFile( eventLog.path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644 )
+	if openError != nil { return openError }
+	defer file.Close()
+
+	_, writeError := file.Write( append( line, '\n' ) )
+	return writeError
+}
+
+// Shifts the rotated files along (e.g., 'events.jsonl.1' to 'events.jsonl.2'), dropping the oldest, then moves the current file to be the first
+func ( eventLog *FileEventLog ) rotate() error {
+	if ( eventLog.MaximumFiles < 1 ) { return os.Remove( eventLog.path ) }
+
+	os.Remove( fmt.Sprintf( "%s.%d", eventLog.path, eventLog.MaximumFiles ) )
+	for number := eventLog.MaximumFiles - 1; number >= 1; number-- {
+		renameError := os.Rename( fmt.Sprintf( "%s.%d", eventLog.path, number ), fmt.Sprintf( "%s.%d", eventLog.path, number + 1 ) )
+		if ( renameError != nil && !os.IsNotExist( renameError ) ) { return renameError }
+	}
+
+	return os.Rename( eventLog.path, eventLog.path + ".1" )
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Creates a power event with a status & detail, at a fixed time
+func newTestEventLogEvent( kind string, detail string ) PowerEvent {
+	event := newTestPowerEvent( kind )
+	event.Time = time.Date( 2024, 3, 1, 12, 30, 0, 500000000, time.UTC )
+	event.PreviousStatusText, event.Detail = "ONLINE", detail
+	event.Status.UPS.StatusText, event.Status.UPS.Battery.ChargePercent, event.Status.UPS.Battery.RemainingRuntimeMinutes, event.Status.UPS.LoadPercent = "ONBATT", 97, 40.5, 25
+
+	return event
+}
+
+func TestSyslogEventLogFormat( t *testing.T ) {
+	eventLog := &SyslogEventLog { hostname: "server" }
+
+	message := eventLog.format( newTestEventLogEvent( EVENT_ON_BATTERY, `"quoted" \ [bracketed]` ) )
+	expected := fmt.Sprintf( "<28>1 2024-03-01T12:30:00.5Z server apc-ups-exporter %d on_battery [ups@32473 event_id=\"on_battery\" event=\"on_battery\" ups_name=\"ups1\" ups_model=\"\" ups_serial=\"\" previous_status=\"ONLINE\" status=\"ONBATT\" battery_charge_percent=\"97\" battery_runtime_minutes=\"40.5\" load_percent=\"25\" last_transfer_reason=\"\" detail=\"\\\"quoted\\\" \\\\ [bracketed\\]\"] ", os.Getpid() )
+	if !strings.HasPrefix( message, expected ) { t.Errorf( "expected %q to start with %q", message, expected ) }
+
+	// Parameter names must be at most 32 printable characters, without any that delimit them - datatracker.ietf.org/doc/html/rfc5424#section-6.3.3
+	for _, field := range getPowerEventFields( newTestEventLogEvent( EVENT_ON_BATTERY, "detail" ) ) {
+		if ( len( field[ 0 ] ) > 32 || strings.ContainsAny( field[ 0 ], "= ]\"" ) ) { t.Errorf( "invalid parameter name %q", field[ 0 ] ) }
+	}
+}
+
+func TestSyslogEventLogFraming( t *testing.T ) {
+	listener, listenError := net.Listen( "tcp", "127.0.0.1:0" )
+	if listenError != nil { t.Fatal( listenError ) }
+	defer listener.Close()
+
+	eventLog, createError := NewSyslogEventLog( "tcp://" + listener.Addr().String() )
+	if createError != nil { t.Fatal( createError ) }
+	defer eventLog.Close()
+
+	// Messages on a stream are each prefixed with their length
+	for _, kind := range []string { EVENT_ON_BATTERY, EVENT_ON_LINE } {
+		if notifyError := eventLog.Notify( newTestEventLogEvent( kind, "" ) ); notifyError != nil { t.Fatal( notifyError ) }
+	}
+
+	connection, acceptError := listener.Accept()
+	if acceptError != nil { t.Fatal( acceptError ) }
+	defer connection.Close()
+	connection.SetReadDeadline( time.Now().Add( 2 * time.Second ) )
+	reader := bufio.NewReader( connection )
+
+	for _, kind := range []string { EVENT_ON_BATTERY, EVENT_ON_LINE } {
+		var length int
+		if _, scanError := fmt.Fscanf( reader, "%d ", &length ); scanError != nil { t.Fatal( scanError ) }
+		message := make( []byte, length )
+		if _, readError := io.ReadFull( reader, message ); readError != nil { t.Fatal( readError ) }
+
+		expected := eventLog.format( newTestEventLogEvent( kind, "" ) )
+		if ( string( message ) != expected ) { t.Errorf( "expected %q, got %q", expected, message ) }
+	}
+}
+
+func TestJournaldEventLog( t *testing.T ) {
+	if ( runtime.GOOS == "windows" ) { t.Skip( "datagram Unix domain sockets are not supported" ) }
+
+	socketPath := filepath.Join( t.TempDir(), "journal.sock" )
+	connection, listenError := net.ListenUnixgram( "unixgram", &net.UnixAddr { Name: socketPath, Net: "unixgram" } )
+	if listenError != nil { t.Fatal( listenError ) }
+	defer connection.Close()
+
+	event := newTestEventLogEvent( EVENT_NIS_UNREACHABLE, "dial tcp: connection refused\nretrying" )
+	if notifyError := NewJournaldEventLog( socketPath ).Notify( event ); notifyError != nil { t.Fatal( notifyError ) }
+
+	buffer := make( []byte, 65536 )
+	connection.SetReadDeadline( time.Now().Add( 2 * time.Second ) )
+	length, readError := connection.Read( buffer )
+	if readError != nil { t.Fatal( readError ) }
+
+	// Parse the fields, which are either 'NAME=value' lines, or the name on a line then the length as 64-bit little endian before the value
+	fields := map[ string ]string {}
+	entry := buffer[ : length ]
+	for len( entry ) > 0 {
+		lineEnd := strings.IndexByte( string( entry ), '\n' )
+		if ( lineEnd < 0 ) { t.Fatalf( "expected each field to end with a new line, got %q", entry ) }
+		line := string( entry[ : lineEnd ] )
+		entry = entry[ lineEnd + 1 : ]
+
+		if name, value, isText := strings.Cut( line, "=" ); isText {
+			fields[ name ] = value
+			continue
+		}
+
+		if ( len( entry ) < 8 ) { t.Fatalf( "expected the length of %s", line ) }
+		valueLength := int( binary.LittleEndian.Uint64( entry ) )
+		if ( len( entry ) < 8 + valueLength + 1 || entry[ 8 + valueLength ] != '\n' ) { t.Fatalf( "expected %d bytes then a new line for %s, got %q", valueLength, line, entry[ 8 : ] ) }
+		fields[ line ] = string( entry[ 8 : 8 + valueLength ] )
+		entry = entry[ 8 + valueLength + 1 : ]
+	}
+
+	for name, expected := range map[ string ]string {
+		"MESSAGE": event.Summary(),
+		"PRIORITY": "3",
+		"SYSLOG_IDENTIFIER": "apc-ups-exporter",
+		"SYSLOG_FACILITY": "3",
+		"UPS_EVENT": "nis_unreachable",
+		"UPS_NAME": "ups1",
+		"UPS_BATTERY_RUNTIME_MINUTES": "40.5",
+		"UPS_DETAIL": "dial tcp: connection refused\nretrying",
+	} {
+		if ( fields[ name ] != expected ) { t.Errorf( "expected %s to be %q, got %q", name, expected, fields[ name ] ) }
+	}
+}
+
+func TestFileEventLogRotation( t *testing.T ) {
+	path := filepath.Join( t.TempDir(), "events.jsonl" )
+
+	// Room for one line in each file, keeping two rotated files
+	event := newTestEventLogEvent( EVENT_ON_BATTERY, "" )
+	event.ID = "1"
+	line, _ := json.Marshal( event.Record( event.Summary() ) )
+	eventLog, createError := NewFileEventLog( path, int64( len( line ) + 1 ), 2 )
+	if createError != nil { t.Fatal( createError ) }
+
+	for _, id := range []string { "1", "2", "3", "4" } {
+		event := newTestEventLogEvent( EVENT_ON_BATTERY, "" )
+		event.ID = id
+		if notifyError := eventLog.Notify( event ); notifyError != nil { t.Fatal( notifyError ) }
+	}
+
+	// The newest in the file, the older ones shifted along, and the oldest dropped
+	for _, test := range []struct {
+		path string
+		expectedID string
+	} {
+		{ path, "4" },
+		{ path + ".1", "3" },
+		{ path + ".2", "2" },
+	} {
+		contents, readError := os.ReadFile( test.path )
+		if readError != nil { t.Fatal( readError ) }
+
+		var record PowerEventRecord
+		if decodeError := json.Unmarshal( contents, &record ); decodeError != nil { t.Fatalf( "%s: %v", test.path, decodeError ) }
+		if ( record.ID != test.expectedID || record.Message == "" ) { t.Errorf( "%s: expected event %s, got %+v", test.path, test.expectedID, record ) }
+	}
+	if _, statError := os.Stat( path + ".3" ); !os.IsNotExist( statError ) { t.Errorf( "expected only 2 rotated files to be kept, got %v", statError ) }
+}
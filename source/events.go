@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The kinds of power event
+const (
+	EVENT_ON_BATTERY = "on_battery"
+	EVENT_ON_LINE = "on_line"
+	EVENT_LOW_BATTERY = "low_battery"
+	EVENT_REPLACE_BATTERY = "replace_battery"
+	EVENT_COMMUNICATION_LOST = "communication_lost"
+	EVENT_COMMUNICATION_RESTORED = "communication_restored"
+	EVENT_SHUTDOWN_PENDING = "shutdown_pending"
+	EVENT_NIS_UNREACHABLE = "nis_unreachable"
+	EVENT_NIS_REACHABLE = "nis_reachable"
+)
+
+// Human-readable titles for each kind of power event
+var powerEventTitles = map[ string ]string {
+	EVENT_ON_BATTERY: "Running on battery",
+	EVENT_ON_LINE: "Mains power restored",
+	EVENT_LOW_BATTERY: "Battery is low",
+	EVENT_REPLACE_BATTERY: "Battery needs replacing",
+	EVENT_COMMUNICATION_LOST: "Communication with the UPS lost",
+	EVENT_COMMUNICATION_RESTORED: "Communication with the UPS restored",
+	EVENT_SHUTDOWN_PENDING: "Shutdown pending",
+	EVENT_NIS_UNREACHABLE: "Network Information Server unreachable",
+	EVENT_NIS_REACHABLE: "Network Information Server reachable again",
+}
+
+// A change in the state of the UPS, found by comparing successive statuses
+type PowerEvent struct {
+	ID string // Unique to this event, so receivers can discard retried duplicates
+	Kind string
+	Time time.Time
+
+	// The status text before the change, and the full status after it
+	PreviousStatusText string
+	Status Status
+
+	// Extra information, such as why the daemon could not be reached
+	Detail string
+}
+
+// A power event flattened for encoding as JSON, with the most relevant status values
+type PowerEventRecord struct {
+	ID string `json:"id"`
+	Kind string `json:"kind"`
+	Title string `json:"title"`
+	Message string `json:"message"`
+	Time time.Time `json:"time"`
+
+	UPS struct {
+		Name string `json:"name"`
+		Model string `json:"model"`
+		Serial string `json:"serial"`
+	} `json:"ups"`
+
+	PreviousStatus string `json:"previous_status"`
+	Status string `json:"status"`
+	BatteryChargePercent float64 `json:"battery_charge_percent"`
+	BatteryRemainingRuntimeMinutes float64 `json:"battery_remaining_runtime_minutes"`
+	LoadPercent float64 `json:"load_percent"`
+	LastTransferReason string `json:"last_transfer_reason"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Gets the human-readable title for the kind of event
+func ( event PowerEvent ) Title() string {
+	title, ok := powerEventTitles[ event.Kind ]
+	if !ok { return event.Kind }
+	return title
+}
+
+// Gets the name of the UPS for display purposes, the same as everywhere else
+func ( event PowerEvent ) UPSName() string {
+	return getUPSName( event.Status )
+}
+
+// Gets a one-line description of the event, with the key values of the status
+func ( event PowerEvent ) Summary() string {
+	if ( event.Detail != "" ) { return fmt.Sprintf( "%s: %s (%s).", event.UPSName(), event.Title(), event.Detail ) }
+	return fmt.Sprintf( "%s: %s (status %s, battery %.0f%%, %.0f minutes remaining, load %.0f%%).", event.UPSName(), event.Title(), strings.TrimSpace( event.Status.UPS.StatusText ), event.Status.UPS.Battery.ChargePercent, event.Status.UPS.Battery.RemainingRuntimeMinutes, event.Status.UPS.LoadPercent )
+}
+
+// Flattens the event for encoding as JSON, with the given message
+func ( event PowerEvent ) Record( message string ) ( record PowerEventRecord ) {
+	record.ID = event.ID
+	record.Kind = event.Kind
+	record.Title = event.Title()
+	record.Message = message
+	record.Time = event.Time
+
+	record.UPS.Name = event.Status.UPS.Name
+	record.UPS.Model = event.Status.UPS.ModelName
+	record.UPS.Serial = event.Status.UPS.SerialNumber
+
+	record.PreviousStatus = event.PreviousStatusText
+	record.Status = strings.TrimSpace( event.Status.UPS.StatusText )
+	record.BatteryChargePercent = event.Status.UPS.Battery.ChargePercent
+	record.BatteryRemainingRuntimeMinutes = event.Status.UPS.Battery.RemainingRuntimeMinutes
+	record.LoadPercent = event.Status.UPS.LoadPercent
+	record.LastTransferReason = event.Status.Daemon.Battery.Transfer.LastReason
+	record.Detail = event.Detail
+
+	return record
+}
+
+/*************************************/
+
+// Structure to find power events by comparing each status with the previous one
+type EventDetector struct {
+	hasPrevious bool
+	previousStatus Status
+	previousStatusText string
+	previousShutdownPending bool
+
+	// Whether the daemon could not be reached for the latest status
+	nisUnreachable bool
+}
+
+// Checks if a status text contains a flag (e.g., 'LOWBATT' in 'ONBATT LOWBATT')
+func hasStatusFlag( statusText string, flag string ) bool {
+	for _, field := range strings.Fields( statusText ) {
+		if field == flag { return true }
+	}
+
+	return false
+}
+
+// Checks if the daemon is shutting down the system, or will as soon as it reaches one of its configured limits
+func isShutdownPending( status Status ) bool {
+	if ( hasStatusFlag( status.UPS.StatusText, "SHUTTING" ) || status.UPS.StatusFlag & 0x200 != 0 ) { return true } // UPS_shutdown in apcupsd's statflag.h
+	if !isOnBattery( status.UPS.StatusText ) { return false }
+
+	configuration := status.Daemon.Configuration
+	if ( configuration.MinimumBatteryChargePercent > 0 && status.UPS.Battery.ChargePercent >= 0 && status.UPS.Battery.ChargePercent <= configuration.MinimumBatteryChargePercent ) { return true }
+	if ( configuration.MinimumBatteryRemainingRuntimeMinutes > 0 && status.UPS.Battery.RemainingRuntimeMinutes >= 0 && status.UPS.Battery.RemainingRuntimeMinutes <= configuration.MinimumBatteryRemainingRuntimeMinutes ) { return true }
+
+	return false
+}
+
+// Compares the status with the previous one, giving any events in between
+// NOTE: The first status is only remembered, as there is nothing to compare it with
+func ( detector *EventDetector ) Detect( status Status ) ( events []PowerEvent ) {
+	previousStatusText := detector.previousStatusText
+	hadPrevious := detector.hasPrevious
+	previousShutdownPending := detector.previousShutdownPending
+	shutdownPending := isShutdownPending( status )
+
+	detector.hasPrevious = true
+	detector.previousStatus = status
+	detector.previousStatusText = strings.TrimSpace( status.UPS.StatusText )
+	detector.previousShutdownPending = shutdownPending
+
+	// The daemon is back, even if this is the first status
+	var kinds []string
+	if detector.nisUnreachable {
+		detector.nisUnreachable = false
+		kinds = append( kinds, EVENT_NIS_REACHABLE )
+	}
+
+	if !hadPrevious { return detector.createEvents( kinds, previousStatusText, status, statusTime( status ) ) }
+
+	// Checks if a flag was just raised or lowered
+	raised := func( flag string ) bool { return !hasStatusFlag( previousStatusText, flag ) && hasStatusFlag( status.UPS.StatusText, flag ) }
+	lowered := func( flag string ) bool { return hasStatusFlag( previousStatusText, flag ) && !hasStatusFlag( status.UPS.StatusText, flag ) }
+
+	// Find the changes, in order of importance
+	if raised( "COMMLOST" ) { kinds = append( kinds, EVENT_COMMUNICATION_LOST ) }
+	if lowered( "COMMLOST" ) { kinds = append( kinds, EVENT_COMMUNICATION_RESTORED ) }
+	if raised( "ONBATT" ) { kinds = append( kinds, EVENT_ON_BATTERY ) }
+	if ( lowered( "ONBATT" ) && hasStatusFlag( status.UPS.StatusText, "ONLINE" ) ) { kinds = append( kinds, EVENT_ON_LINE ) }
+	if raised( "LOWBATT" ) { kinds = append( kinds, EVENT_LOW_BATTERY ) }
+	if ( shutdownPending && !previousShutdownPending ) { kinds = append( kinds, EVENT_SHUTDOWN_PENDING ) }
+	if raised( "REPLACEBATT" ) { kinds = append( kinds, EVENT_REPLACE_BATTERY ) }
+
+	return detector.createEvents( kinds, previousStatusText, status, statusTime( status ) )
+}
+
+// Gives an event the first time the daemon cannot be reached, with the last known status for the identity of the UPS
+func ( detector *EventDetector ) Unreachable( reason error ) ( events []PowerEvent ) {
+	if detector.nisUnreachable { return nil }
+	detector.nisUnreachable = true
+
+	events = detector.createEvents( []string { EVENT_NIS_UNREACHABLE }, detector.previousStatusText, detector.previousStatus, time.Now() )
+	events[ 0 ].Detail = reason.Error()
+
+	return events
+}
+
+// Creates an event of each kind for the status
+func ( detector *EventDetector ) createEvents( kinds []string, previousStatusText string, status Status, now time.Time ) ( events []PowerEvent ) {
+	for _, kind := range kinds {
+		events = append( events, PowerEvent {
+			ID: fmt.Sprintf( "%s-%s-%d", url.QueryEscape( getUPSName( status ) ), kind, now.UnixNano() ), // Escaped, as it is also used for the Message-ID of emails
+			Kind: kind,
+			Time: now,
+			PreviousStatusText: previousStatusText,
+			Status: status,
+		} )
+	}
+
+	return events
+}
+
+/*************************************/
+
+// Something that is told about power events, such as a webhook
+type Notifier interface {
+
+	// Gets a short name for display purposes
+	Name() string
+
+	// Sends a notification about the event
+	Notify( event PowerEvent ) error
+
+}
+
+// The notifiers used by the background metrics collection
+// NOTE: This is replaced when the configuration is reloaded, so use getNotifiers() instead
+var notifiers []Notifier
+
+// Events waiting to be sent to the notifiers, so slow notifiers never hold up collection
+var notificationQueue = make( chan PowerEvent, 100 )
+
+// How long to wait for queued events to be sent when shutting down
+const NOTIFICATIONS_SHUTDOWN_TIMEOUT = 30 * time.Second
+
+// Closed once the queue has been closed & everything in it has been sent
+var notificationsFinished = make( chan struct{} )
+
+// Gets the current notifiers
+func getNotifiers() []Notifier {
+	targetsMutex.RLock()
+	defer targetsMutex.RUnlock()
+
+	return notifiers
+}
+
+// Gets the current notifiers for sending an event, which are not closed by a reload until the function that is given is called
+func useNotifiers() ( currentNotifiers []Notifier, release func() ) {
+	targetsMutex.RLock()
+	defer targetsMutex.RUnlock()
+
+	inUse := targetsInUse
+	inUse.Add( 1 )
+	return notifiers, inUse.Done
+}
+
+// Queues events to be sent to all of the notifiers
+func notifyOfEvents( events []PowerEvent ) {
+	for _, event := range events {
+		slog.Info( "Detected power event", "kind", event.Kind, "ups", event.UPSName(), "summary", event.Summary() )
+		if ( len( getNotifiers() ) == 0 ) { continue }
+
+		select {
+			case notificationQueue <- event:
+			default: slog.Warn( "Too many power events are waiting to be sent, dropping one", "kind", event.Kind )
+		}
+	}
+}
+
+// Runs in the background to send queued events to all of the notifiers, in order
+func sendNotificationsInBackground() {
+	defer close( notificationsFinished )
+
+	for event := range notificationQueue {
+		currentNotifiers, release := useNotifiers()
+		for _, notifier := range currentNotifiers {
+			notifyError := notifier.Notify( event )
+			if notifyError != nil {
+				slog.Error( "Failed to send power event", "notifier", notifier.Name(), "kind", event.Kind, "error", notifyError )
+				continue
+			}
+
+			slog.Debug( "Sent power event", "notifier", notifier.Name(), "kind", event.Kind )
+		}
+		release()
+	}
+}
+
+// Sends anything still held by the notifiers (e.g., emails waiting for the interval) & closes them, giving how many failed
+// NOTE: Notifiers that are also outputs are left to closeOutputs()
+func closeNotifiers() ( failedCount int ) {
+	for _, notifier := range getNotifiers() {
+		if _, isOutput := notifier.( Output ); isOutput { continue }
+
+		closer, isCloser := notifier.( io.Closer )
+		if !isCloser { continue }
+
+		closeError := closer.Close()
+		if closeError != nil {
+			slog.Error( "Failed to close notifier", "notifier", notifier.Name(), "error", closeError )
+			failedCount++
+		}
+	}
+
+	return failedCount
+}
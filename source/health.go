@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Structure to follow whether statuses are being fetched, for the readiness endpoint
+type HealthTracker struct {
+
+	// The Network Information Server being fetched from
+	Target string
+
+	// How long since the last successful fetch before we are no longer ready
+	MaximumFetchAge time.Duration
+
+	// How long since the daemon last got data from the UPS before we are no longer ready, or zero to not check
+	MaximumDataAge time.Duration
+
+	// The latest fetches
+	mutex sync.Mutex
+	lastSuccessAt time.Time
+	lastFailureAt time.Time
+	lastError string
+	lastDataAt time.Time
+	consecutiveFailures int
+
+}
+
+// Changes what is being fetched from & how recent it must be, such as when the configuration is reloaded
+func ( tracker *HealthTracker ) Configure( target string, maximumFetchAge time.Duration, maximumDataAge time.Duration ) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.Target = target
+	tracker.MaximumFetchAge = maximumFetchAge
+	tracker.MaximumDataAge = maximumDataAge
+}
+
+// Records a successful fetch
+func ( tracker *HealthTracker ) Succeeded( status Status ) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.lastSuccessAt = time.Now()
+	tracker.lastDataAt = status.Date
+	tracker.consecutiveFailures = 0
+}
+
+// Records a failed fetch
+func ( tracker *HealthTracker ) Failed( err error ) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.lastFailureAt = time.Now()
+	tracker.lastError = err.Error()
+	tracker.consecutiveFailures++
+}
+
+// Checks if the latest status is recent enough to be served, giving the reason if not
+func ( tracker *HealthTracker ) Ready() ( isReady bool, reason string ) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if tracker.lastSuccessAt.IsZero() {
+		if ( tracker.lastError != "" ) { return false, fmt.Sprintf( "no successful fetch yet, last error: %s", tracker.lastError ) }
+		return false, "no successful fetch yet"
+	}
+
+	if fetchAge := time.Since( tracker.lastSuccessAt ); fetchAge > tracker.MaximumFetchAge {
+		return false, fmt.Sprintf( "last successful fetch was %s ago, last error: %s", fetchAge.Round( time.Second ), tracker.lastError )
+	}
+
+	if ( tracker.MaximumDataAge > 0 && !tracker.lastDataAt.IsZero() ) {
+		if dataAge := time.Since( tracker.lastDataAt ); dataAge > tracker.MaximumDataAge { return false, fmt.Sprintf( "the daemon last got data from the UPS %s ago", dataAge.Round( time.Second ) ) }
+	}
+
+	return true, ""
+}
+
+// Always responds OK, as being able to respond at all means the process is alive
+func serveLiveness( response http.ResponseWriter, request *http.Request ) {
+	response.Header().Set( "Content-Type", "text/plain; charset=utf-8" )
+	response.Header().Set( "Cache-Control", "no-cache" )
+	fmt.Fprintln( response, "OK" )
+}
+
+// Describes the latest fetches for the readiness endpoint, including whether the latest status is recent enough
+func ( tracker *HealthTracker ) Describe() ( isReady bool, target map[ string ]any ) {
+	isReady, reason := tracker.Ready()
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	target = map[ string ]any {
+		"target": tracker.Target,
+		"ready": isReady,
+		"consecutive_failures": tracker.consecutiveFailures,
+	}
+	if ( reason != "" ) { target[ "reason" ] = reason }
+	if !tracker.lastSuccessAt.IsZero() { target[ "last_success" ] = tracker.lastSuccessAt.UTC() }
+	if !tracker.lastFailureAt.IsZero() { target[ "last_failure" ] = tracker.lastFailureAt.UTC() }
+	if !tracker.lastDataAt.IsZero() { target[ "last_data" ] = tracker.lastDataAt.UTC() }
+	if ( tracker.lastError != "" ) { target[ "last_error" ] = tracker.lastError }
+
+	return isReady, target
+}
+
+// Responds OK if the latest status of every target is recent enough, or Service Unavailable with the reasons if not
+func serveReadiness( response http.ResponseWriter, request *http.Request ) {
+	isReady := true
+	targets := []map[ string ]any {}
+	for _, collector := range getCollectors() {
+		isTargetReady, target := collector.Health.Describe()
+		if ( collector.Name != "" ) { target[ "name" ] = collector.Name }
+
+		isReady = isReady && isTargetReady
+		targets = append( targets, target )
+	}
+
+	statusText := "ready"
+	response.Header().Set( "Content-Type", "application/json" )
+	response.Header().Set( "Cache-Control", "no-cache" )
+	if !isReady {
+		statusText = "not ready"
+		response.WriteHeader( http.StatusServiceUnavailable )
+	}
+
+	json.NewEncoder( response ).Encode( map[ string ]any {
+		"status": statusText,
+		"targets": targets,
+	} )
+}
+
+/*************************************/
+
+// Runs the healthcheck subcommand, which asks a running exporter if it is ready (e.g., for Docker, as the image has no curl), giving the exit code
+func runHealthcheck( arguments []string ) int {
+	flagSet := flag.NewFlagSet( "healthcheck", flag.ContinueOnError )
+
+	// Values of the command-line flags, and the defaults
+	flagURL := flagSet.String( "url", "", "The URL of the readiness (or liveness) endpoint of the exporter. Defaults to the readiness endpoint on the address, port & scheme the exporter would use with the same configuration file & environment variables." )
+	flagConfig := flagSet.String( "config", "", "The path to the configuration file of the exporter, for the default URL. Defaults to the APC_UPS_EXPORTER_CONFIG environment variable." )
+	flagTimeout := flagSet.Int( "timeout", 5, "The time in seconds to wait for the exporter." )
+	flagUsername := flagSet.String( "username", "", "The username for basic authentication, if the web configuration file requires it." )
+	flagPassword := flagSet.String( "password", "", "The password for basic authentication, if the web configuration file requires it." )
+	flagInsecure := flagSet.Bool( "insecure", false, "Do not verify the certificate of the exporter, for when it is only valid for another hostname." )
+
+	// Set a custom help message
+	flagSet.Usage = func() {
+		fmt.Printf( "%s, v%s, by %s (%s).\n", PROJECT_NAME, PROJECT_VERSION, AUTHOR_NAME, AUTHOR_WEBSITE )
+		fmt.Printf( "\nChecks if a running exporter is ready, exiting with 0 if so or 1 if not.\n" )
+		fmt.Printf( "\nUsage: %s healthcheck [-h/-help] [-url <URL>] [-config <path>] [-timeout <seconds>] [-username <string>] [-password <string>] [-insecure]\n", os.Args[ 0 ] )
+		flagSet.PrintDefaults()
+	}
+
+	if parseError := flagSet.Parse( arguments ); parseError != nil { return 1 }
+	if ( *flagURL == "" ) {
+		defaultURL, urlError := getHealthcheckURL( *flagConfig )
+		if urlError != nil {
+			fmt.Fprintf( os.Stderr, "Failed to find the exporter from its configuration: %s\n", urlError.Error() )
+			return 1
+		}
+		*flagURL = defaultURL
+	}
+	if !isHTTPURL( *flagURL ) {
+		fmt.Fprintln( os.Stderr, "Invalid URL, must be an absolute HTTP or HTTPS URL." )
+		return 1
+	}
+
+	client := &http.Client {
+		Timeout: time.Duration( *flagTimeout ) * time.Second,
+		Transport: &http.Transport { TLSClientConfig: &tls.Config { InsecureSkipVerify: *flagInsecure } },
+	}
+
+	request, requestError := http.NewRequest( http.MethodGet, *flagURL, nil )
+	if requestError != nil {
+		fmt.Fprintf( os.Stderr, "Failed to create request: %s\n", requestError.Error() )
+		return 1
+	}
+	if ( *flagUsername != "" ) { request.SetBasicAuth( *flagUsername, *flagPassword ) }
+
+	response, responseError := client.Do( request )
+	if responseError != nil {
+		fmt.Fprintf( os.Stderr, "Failed to reach the exporter: %s\n", responseError.Error() )
+		return 1
+	}
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll( io.LimitReader( response.Body, 4096 ) )
+	fmt.Printf( "%s %s", response.Status, body )
+	if ( response.StatusCode != http.StatusOK ) { return 1 }
+
+	return 0
+}
+
+// Gets the URL of the readiness endpoint from the configuration the exporter would have, with the same configuration file & environment variables
+func getHealthcheckURL( configFile string ) ( string, error ) {
+	var arguments []string
+	if ( configFile != "" ) { arguments = []string { "-config", configFile } }
+	configuration, parseError := ParseConfiguration( arguments )
+	if parseError != nil { return "", parseError }
+
+	// HTTPS if the web configuration file enables TLS
+	scheme := "http"
+	if ( configuration.WebConfigFile != "" ) {
+		webConfig, loadError := LoadWebConfig( configuration.WebConfigFile )
+		if loadError != nil { return "", fmt.Errorf( "invalid web configuration file: %w", loadError ) }
+		if ( webConfig.TLSServerConfig != nil ) { scheme = "https" }
+	}
+
+	// Listening on every interface includes the loopback one
+	address := net.ParseIP( configuration.MetricsAddress )
+	if ( address == nil || address.IsUnspecified() ) { address = net.IPv4( 127, 0, 0, 1 ) }
+
+	return fmt.Sprintf( "%s://%s/readyz", scheme, net.JoinHostPort( address.String(), strconv.Itoa( configuration.MetricsPort ) ) ), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGetHealthcheckURL( t *testing.T ) {
+	t.Setenv( "APC_UPS_EXPORTER_CONFIG", "" )
+
+	// The defaults of the exporter
+	if url, err := getHealthcheckURL( "" ); ( err != nil || url != "http://127.0.0.1:5000/readyz" ) { t.Errorf( "unexpected default URL %q & error %v", url, err ) }
+
+	// Listening on every interface, with the port from an environment variable
+	t.Setenv( "APC_UPS_EXPORTER_METRICS_ADDRESS", "0.0.0.0" )
+	t.Setenv( "APC_UPS_EXPORTER_METRICS_PORT", "9162" )
+	if url, err := getHealthcheckURL( "" ); ( err != nil || url != "http://127.0.0.1:9162/readyz" ) { t.Errorf( "unexpected URL from the environment %q & error %v", url, err ) }
+
+	// From the configuration file, given by an environment variable, with TLS enabled by the web configuration file
+	webConfigPath := writeTestWebConfig( t, "tls_server_config: { cert_file: server.crt, key_file: server.key }" )
+	os.Unsetenv( "APC_UPS_EXPORTER_METRICS_ADDRESS" )
+	os.Unsetenv( "APC_UPS_EXPORTER_METRICS_PORT" )
+	t.Setenv( "APC_UPS_EXPORTER_CONFIG", writeTestConfigurationFile( t, "metrics_address: 192.168.0.2\nmetrics_port: 9100\nweb_config_file: " + webConfigPath ) )
+	if url, err := getHealthcheckURL( "" ); ( err != nil || url != "https://192.168.0.2:9100/readyz" ) { t.Errorf( "unexpected URL from the configuration file %q & error %v", url, err ) }
+
+	// The flag takes precedence over the environment variable
+	if url, err := getHealthcheckURL( writeTestConfigurationFile( t, "metrics_port: 9101" ) ); ( err != nil || url != "http://127.0.0.1:9101/readyz" ) { t.Errorf( "unexpected URL from the flag %q & error %v", url, err ) }
+
+	// An invalid web configuration file is not guessed around
+	t.Setenv( "APC_UPS_EXPORTER_CONFIG", writeTestConfigurationFile( t, "web_config_file: /nonexistent/web.yml" ) )
+	if _, err := getHealthcheckURL( "" ); err == nil { t.Error( "expected an invalid web configuration file to fail" ) }
+}
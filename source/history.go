@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The first line of every history file, followed by a line of comma-separated field names
+const HISTORY_FILE_MAGIC = "APCUPSHISTORY1"
+
+// The most points a single query can return, the same as Prometheus
+const HISTORY_MAXIMUM_POINTS = 11000
+
+// A single stored status, as the values of each field in the order of the file it came from
+// Values the UPS does not report are stored as NaN
+type historyRecord struct {
+	Time int64 // Unix milliseconds
+	Values []float64
+}
+
+// A single point in the result of a query
+type HistoryPoint struct {
+	Time time.Time
+	Value float64
+}
+
+// Gets the values to store for a status, which are all the numeric fields plus a few derived ones
+func getHistoryFields( status Status ) []NumericField {
+	fields := status.NumericFields()
+
+	// Whether the UPS is on battery, for finding when it last drained
+	onBattery := 0.0
+	if isOnBattery( status.UPS.StatusText ) { onBattery = 1 }
+	fields = append( fields, NumericField { "on_battery", onBattery }, NumericField { "status_flag", float64( status.UPS.StatusFlag ) } )
+
+	// The load in watts, if it can be calculated
+	loadWatts, ok := calculateLoadWatts( status )
+	if !ok { loadWatts = -1 }
+	fields = append( fields, NumericField { "load_watts", loadWatts } )
+
+	return fields
+}
+
+// Gets the names of all the fields that are stored
+func getHistoryFieldNames() ( names []string ) {
+	for _, field := range getHistoryFields( Status {} ) { names = append( names, field.Name ) }
+	return names
+}
+
+/*************************************/
+
+// Stores every status in compact append-only files, with the raw statuses kept for a short while & averages over a longer interval kept for much longer
+// Each record is the time as a 64-bit integer followed by every field as a 32-bit float, so a year of 5 minute averages is roughly 12 MiB
+type HistoryStore struct {
+	rawPath string
+	downsampledPath string
+	fieldNames []string
+
+	// How long to keep raw statuses & averages for, and how long each average covers
+	RawRetention time.Duration
+	DownsampledRetention time.Duration
+	DownsampleInterval time.Duration
+
+	// Held while writing or compacting the files, but not while reading them, as a query over a long time range can take a while
+	mutex sync.Mutex
+
+	// The files being appended to, and when they were last compacted
+	rawFile *os.File
+	downsampledFile *os.File
+	compactedAt time.Time
+
+	// The times of the oldest & latest raw statuses, as anything older must come from the averages
+	oldestRawTime int64
+	latestRawTime int64
+
+	// The average currently being built
+	bucketStart int64
+	bucketSums []float64
+	bucketCounts []int
+}
+
+// Opens the history in a directory, creating it if needed & removing anything older than the retention
+func NewHistoryStore( directory string, rawRetention time.Duration, downsampledRetention time.Duration, downsampleInterval time.Duration ) ( *HistoryStore, error ) {
+	makeError := os.MkdirAll( directory, 0755 )
+	if makeError != nil { return nil, makeError }
+
+	store := &HistoryStore {
+		rawPath: filepath.Join( directory, "history.raw" ),
+		downsampledPath: filepath.Join( directory, "history.downsampled" ),
+		fieldNames: getHistoryFieldNames(),
+
+		RawRetention: rawRetention,
+		DownsampledRetention: downsampledRetention,
+		DownsampleInterval: downsampleInterval,
+	}
+	store.bucketSums = make( []float64, len( store.fieldNames ) )
+	store.bucketCounts = make( []int, len( store.fieldNames ) )
+
+	// Compact both files, which also upgrades them if the fields have changed since they were written
+	compactError := store.compact()
+	if compactError != nil { return nil, compactError }
+
+	// Average any raw statuses since the last average, such as from before a restart
+	var latestAverage int64
+	readError := readHistoryFile( store.downsampledPath, store.fieldNames, func( record historyRecord ) { latestAverage = record.Time } )
+	if readError != nil { return nil, readError }
+	var averageError error
+	readError = readHistoryFile( store.rawPath, store.fieldNames, func( record historyRecord ) {
+		if ( averageError == nil && record.Time >= latestAverage + store.DownsampleInterval.Milliseconds() ) { averageError = store.addToAverage( record ) }
+	} )
+	if readError != nil { return nil, readError }
+	if averageError != nil {
+		store.Close()
+		return nil, fmt.Errorf( "write %s: %w", store.downsampledPath, averageError )
+	}
+
+	return store, nil
+}
+
+// Gets a short name for display purposes
+func ( store *HistoryStore ) Name() string {
+	return "history"
+}
+
+// Stores the status, finishing the current average if it has moved on to the next interval
+func ( store *HistoryStore ) Publish( status Status ) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// Convert the status to a record, with unknown values as NaN
+	record := historyRecord { Time: statusTime( status ).UnixMilli() }
+	for _, field := range getHistoryFields( status ) {
+		value := field.Value
+		if ( value < 0 && field.Name != "status_flag" ) { value = math.NaN() }
+		record.Values = append( record.Values, value )
+	}
+
+	// Skip statuses we already have, as the daemon repeats them if it polls the UPS slower than we do
+	if ( record.Time <= store.latestRawTime ) { return nil }
+
+	// Reopen the files if compacting them could not
+	openError := store.reopen()
+	if openError != nil { return openError }
+
+	writeError := writeHistoryRecord( store.rawFile, record )
+	if writeError != nil { return writeError }
+	if ( store.oldestRawTime == 0 ) { store.oldestRawTime = record.Time }
+	store.latestRawTime = record.Time
+
+	averageError := store.addToAverage( record )
+	if averageError != nil { return averageError }
+
+	// Remove old records every so often
+	if ( time.Since( store.compactedAt ) >= time.Hour ) { return store.compact() }
+
+	return nil
+}
+
+// Closes the files
+// NOTE: The current average is not written, as it is rebuilt from the raw statuses when the history is next opened
+func ( store *HistoryStore ) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var closeErrors []error
+	for _, file := range []*os.File { store.rawFile, store.downsampledFile } {
+		if ( file != nil ) { closeErrors = append( closeErrors, file.Close() ) }
+	}
+
+	return errors.Join( closeErrors... )
+}
+
+// Adds a record to the current average, writing the average out first if the record belongs to a later interval
+func ( store *HistoryStore ) addToAverage( record historyRecord ) error {
+	interval := store.DownsampleInterval.Milliseconds()
+	bucketStart := record.Time - ( record.Time % interval )
+
+	// Finish the current average
+	if ( bucketStart != store.bucketStart ) {
+		average := historyRecord { Time: store.bucketStart, Values: make( []float64, len( store.fieldNames ) ) }
+		hasValues := false
+		for index := range store.fieldNames {
+			average.Values[ index ] = math.NaN()
+			if ( store.bucketCounts[ index ] > 0 ) {
+				average.Values[ index ] = store.bucketSums[ index ] / float64( store.bucketCounts[ index ] )
+				hasValues = true
+			}
+
+			store.bucketSums[ index ] = 0
+			store.bucketCounts[ index ] = 0
+		}
+
+		if ( hasValues && store.downsampledFile != nil ) {
+			writeError := writeHistoryRecord( store.downsampledFile, average )
+			if writeError != nil { return writeError }
+		}
+
+		store.bucketStart = bucketStart
+	}
+
+	// Add to the sums, skipping unknown values
+	for index, value := range record.Values {
+		if math.IsNaN( value ) { continue }
+		store.bucketSums[ index ] += value
+		store.bucketCounts[ index ]++
+	}
+
+	return nil
+}
+
+// Rewrites both files without anything older than their retention, then reopens them for appending
+// NOTE: If anything fails the file being compacted is left as it was, and is appended to as before
+func ( store *HistoryStore ) compact() error {
+	now := time.Now()
+	store.compactedAt = now // Even if it fails, so it is not tried again for every status
+
+	for _, file := range []struct {
+		path string
+		retention time.Duration
+		handle **os.File
+	} {
+		{ store.rawPath, store.RawRetention, &store.rawFile },
+		{ store.downsampledPath, store.DownsampledRetention, &store.downsampledFile },
+	} {
+
+		// Keep only the records within the retention, in the current field order
+		cutoff := now.Add( -file.retention ).UnixMilli()
+		var kept []historyRecord
+		readError := readHistoryFile( file.path, store.fieldNames, func( record historyRecord ) {
+			if ( record.Time >= cutoff ) { kept = append( kept, record ) }
+		} )
+		if readError != nil { return fmt.Errorf( "read %s: %w", file.path, readError ) }
+
+		// Write them to a temporary file, so the original is never left half-written
+		temporaryPath := file.path + ".tmp"
+		writeError := writeHistoryFile( temporaryPath, store.fieldNames, kept )
+		if writeError != nil {
+			os.Remove( temporaryPath )
+			return fmt.Errorf( "write %s: %w", temporaryPath, writeError )
+		}
+
+		// Replace the original, which must be closed first as Windows cannot replace an open file
+		if ( *file.handle != nil ) { ( *file.handle ).Close() }
+		*file.handle = nil
+		renameError := os.Rename( temporaryPath, file.path )
+		if renameError != nil { os.Remove( temporaryPath ) }
+
+		// Reopen whichever file is now in place for appending
+		handle, openError := openHistoryFile( file.path )
+		if ( renameError != nil || openError != nil ) { return errors.Join( renameError, openError ) }
+		*file.handle = handle
+
+		if ( file.path == store.rawPath ) {
+			store.oldestRawTime, store.latestRawTime = 0, 0
+			if ( len( kept ) > 0 ) { store.oldestRawTime, store.latestRawTime = kept[ 0 ].Time, kept[ len( kept ) - 1 ].Time }
+		}
+	}
+
+	return nil
+}
+
+// Opens any of the files that are not open for appending, such as if compacting them failed part way
+func ( store *HistoryStore ) reopen() error {
+	for _, file := range []struct {
+		path string
+		handle **os.File
+	} {
+		{ store.rawPath, &store.rawFile },
+		{ store.downsampledPath, &store.downsampledFile },
+	} {
+		if ( *file.handle != nil ) { continue }
+
+		handle, openError := openHistoryFile( file.path )
+		if openError != nil { return openError }
+		*file.handle = handle
+	}
+
+	return nil
+}
+
+// Gets the values of a field between two times, averaged over each step if the step is not zero
+// Raw statuses are used where they are still kept, and the stored averages before that
+func ( store *HistoryStore ) Query( field string, from time.Time, to time.Time, step time.Duration ) ( points []HistoryPoint, err error ) {
+	fieldIndex := slices.Index( store.fieldNames, field )
+	if ( fieldIndex < 0 ) { return nil, fmt.Errorf( "unknown field '%s'", field ) }
+
+	// The files are only ever appended to or atomically replaced, so they are read without holding the lock
+	// NOTE: A partially appended record at the end of a file is ignored
+	fromMilliseconds, toMilliseconds := from.UnixMilli(), to.UnixMilli()
+	collect := func( points *[]HistoryPoint, record historyRecord ) {
+		if ( record.Time < fromMilliseconds || record.Time > toMilliseconds || math.IsNaN( record.Values[ fieldIndex ] ) ) { return }
+		*points = append( *points, HistoryPoint { Time: time.UnixMilli( record.Time ), Value: record.Values[ fieldIndex ] } )
+	}
+
+	// The raw statuses first, so the averages are only used from before the oldest one that was actually read, even if either file changed in between
+	var rawPoints []HistoryPoint
+	oldestRawTime := int64( math.MaxInt64 )
+	readError := readHistoryFile( store.rawPath, store.fieldNames, func( record historyRecord ) {
+		oldestRawTime = min( oldestRawTime, record.Time )
+		collect( &rawPoints, record )
+	} )
+	if readError != nil { return nil, readError }
+	readError = readHistoryFile( store.downsampledPath, store.fieldNames, func( record historyRecord ) {
+		if ( record.Time < oldestRawTime ) { collect( &points, record ) }
+	} )
+	if readError != nil { return nil, readError }
+	points = append( points, rawPoints... )
+
+	if ( step <= 0 ) { return points, nil }
+
+	// Average the points within each step
+	var averaged []HistoryPoint
+	var sum float64
+	var count int
+	stepMilliseconds := step.Milliseconds()
+	for index, point := range points {
+		stepStart := point.Time.UnixMilli() - ( point.Time.UnixMilli() - fromMilliseconds ) % stepMilliseconds
+		sum += point.Value
+		count++
+
+		if ( index == len( points ) - 1 || points[ index + 1 ].Time.UnixMilli() >= stepStart + stepMilliseconds ) {
+			averaged = append( averaged, HistoryPoint { Time: time.UnixMilli( stepStart ), Value: sum / float64( count ) } )
+			sum, count = 0, 0
+		}
+	}
+
+	return averaged, nil
+}
+
+/*************************************/
+
+// Stores the history of each target apart, in a directory named after it (or the directory itself for a target without a name)
+// NOTE: Each store is opened when its target is first used, so targets added by reloading the configuration get one too
+type HistoryStores struct {
+	directory string
+	rawRetention time.Duration
+	downsampledRetention time.Duration
+	downsampleInterval time.Duration
+
+	// The store of each target that has been used, by its name
+	mutex sync.Mutex
+	stores map[ string ]*HistoryStore
+}
+
+// Creates the history for every target in a directory, opening the store of the target without a name straight away so any problems are found at startup
+func NewHistoryStores( directory string, rawRetention time.Duration, downsampledRetention time.Duration, downsampleInterval time.Duration ) ( *HistoryStores, error ) {
+	stores := &HistoryStores {
+		directory: directory,
+		rawRetention: rawRetention,
+		downsampledRetention: downsampledRetention,
+		downsampleInterval: downsampleInterval,
+		stores: map[ string ]*HistoryStore {},
+	}
+
+	_, openError := stores.get( "" )
+	if openError != nil { return nil, openError }
+
+	return stores, nil
+}
+
+// Gets a short name for display purposes
+func ( stores *HistoryStores ) Name() string {
+	return "history"
+}
+
+// Stores the status in the history of its target
+func ( stores *HistoryStores ) Publish( status Status ) error {
+	store, openError := stores.get( status.Target )
+	if openError != nil { return openError }
+
+	return store.Publish( status )
+}
+
+// Closes the files of every target
+func ( stores *HistoryStores ) Close() error {
+	stores.mutex.Lock()
+	defer stores.mutex.Unlock()
+
+	var closeErrors []error
+	for _, store := range stores.stores { closeErrors = append( closeErrors, store.Close() ) }
+
+	return errors.Join( closeErrors... )
+}
+
+// Serves the history of the target in the 'target' parameter, or of the target without a name if it is not given
+func ( stores *HistoryStores ) ServeHTTP( response http.ResponseWriter, request *http.Request ) {
+	target := request.URL.Query().Get( "target" )
+	if ( target != "" && getCollector( target ) == nil ) {
+		response.Header().Set( "Content-Type", "application/json" )
+		response.WriteHeader( http.StatusNotFound )
+		json.NewEncoder( response ).Encode( map[ string ]any { "status": "error", "error": fmt.Sprintf( "unknown target '%s'", target ) } )
+		return
+	}
+
+	store, openError := stores.get( target )
+	if openError != nil {
+		http.Error( response, openError.Error(), http.StatusInternalServerError )
+		return
+	}
+
+	store.ServeHTTP( response, request )
+}
+
+// Gets the store of a target, opening it if it is not already
+// NOTE: Target names are checked to be safe as directory names when the configuration is validated
+func ( stores *HistoryStores ) get( target string ) ( *HistoryStore, error ) {
+	stores.mutex.Lock()
+	defer stores.mutex.Unlock()
+
+	if store, isOpen := stores.stores[ target ]; isOpen { return store, nil }
+
+	store, openError := NewHistoryStore( filepath.Join( stores.directory, target ), stores.rawRetention, stores.downsampledRetention, stores.downsampleInterval )
+	if openError != nil { return nil, fmt.Errorf( "open history for target '%s': %w", target, openError ) }
+	stores.stores[ target ] = store
+
+	return store, nil
+}
+
+/*************************************/
+
+// Reads every complete record in a history file, mapping its fields to the given order (NaN for any it does not have)
+// A missing file has no records, and a partially written record at the end is ignored
+func readHistoryFile( path string, fieldNames []string, callback func( record historyRecord ) ) error {
+	file, openError := os.Open( path )
+	if errors.Is( openError, os.ErrNotExist ) { return nil }
+	if openError != nil { return openError }
+	defer file.Close()
+	reader := bufio.NewReader( file )
+
+	// Check the header
+	magic, magicError := reader.ReadString( '\n' )
+	if ( magicError == io.EOF ) { return nil }
+	if ( magicError != nil || strings.TrimSpace( magic ) != HISTORY_FILE_MAGIC ) { return fmt.Errorf( "not a history file" ) }
+	header, headerError := reader.ReadString( '\n' )
+	if headerError != nil { return fmt.Errorf( "missing field names" ) }
+	fileFieldNames := strings.Split( strings.TrimSpace( header ), "," )
+
+	// Work out where each field of the file goes
+	mapping := make( []int, len( fileFieldNames ) )
+	for index, name := range fileFieldNames { mapping[ index ] = slices.Index( fieldNames, name ) }
+
+	// Read the records
+	buffer := make( []byte, 8 + 4 * len( fileFieldNames ) )
+	for {
+		_, readError := io.ReadFull( reader, buffer )
+		if ( readError == io.EOF || readError == io.ErrUnexpectedEOF ) { return nil }
+		if readError != nil { return readError }
+
+		record := historyRecord { Time: int64( binary.BigEndian.Uint64( buffer ) ), Values: make( []float64, len( fieldNames ) ) }
+		for index := range record.Values { record.Values[ index ] = math.NaN() }
+		for index, destination := range mapping {
+			if ( destination < 0 ) { continue }
+			record.Values[ destination ] = float64( math.Float32frombits( binary.BigEndian.Uint32( buffer[ 8 + 4 * index : ] ) ) )
+		}
+
+		callback( record )
+	}
+}
+
+// Writes a new history file with the given records, syncing it to disk so it can safely replace another
+func writeHistoryFile( path string, fieldNames []string, records []historyRecord ) error {
+	file, createError := os.Create( path )
+	if createError != nil { return createError }
+	defer file.Close()
+	writer := bufio.NewWriter( file )
+
+	_, writeError := fmt.Fprintf( writer, "%s\n%s\n", HISTORY_FILE_MAGIC, strings.Join( fieldNames, "," ) )
+	if writeError != nil { return writeError }
+	for _, record := range records {
+		_, writeError = writer.Write( encodeHistoryRecord( record ) )
+		if writeError != nil { return writeError }
+	}
+
+	flushError := writer.Flush()
+	if flushError != nil { return flushError }
+	syncError := file.Sync()
+	if syncError != nil { return syncError }
+
+	return file.Close()
+}
+
+// Opens a history file for appending
+func openHistoryFile( path string ) ( *os.File, error ) {
+	return os.OpenFile( path, os.O_WRONLY | os.O_APPEND, 0644 )
+}
+
+// Appends a record to an open history file
+func writeHistoryRecord( file *os.File, record historyRecord ) error {
+	_, writeError := file.Write( encodeHistoryRecord( record ) )
+	return writeError
+}
+
+// Encodes a record as its time followed by each value
+func encodeHistoryRecord( record historyRecord ) []byte {
+	encoded := binary.BigEndian.AppendUint64( make( []byte, 0, 8 + 4 * len( record.Values ) ), uint64( record.Time ) )
+	for _, value := range record.Values { encoded = binary.BigEndian.AppendUint32( encoded, math.Float32bits( float32( value ) ) ) }
+	return encoded
+}
+
+/*************************************/
+
+// Serves the history as JSON, such as '/api/v1/history?field=load_percent&from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z&step=1h'
+// The times can be RFC 3339 or Unix seconds, and default to the last day. The step can be a duration or seconds, and defaults to every stored value.
+func ( store *HistoryStore ) ServeHTTP( response http.ResponseWriter, request *http.Request ) {
+	query := request.URL.Query()
+
+	// Responds with an error message
+	respondWithError := func( statusCode int, message string ) {
+		response.Header().Set( "Content-Type", "application/json" )
+		response.WriteHeader( statusCode )
+		json.NewEncoder( response ).Encode( map[ string ]any { "status": "error", "error": message, "fields": store.fieldNames } )
+	}
+
+	// Parse the parameters
+	field := query.Get( "field" )
+	if ( field == "" ) { respondWithError( http.StatusBadRequest, "missing field" ); return }
+	to, toError := parseHistoryTime( query.Get( "to" ), time.Now() )
+	if toError != nil { respondWithError( http.StatusBadRequest, "invalid to time" ); return }
+	from, fromError := parseHistoryTime( query.Get( "from" ), to.Add( -24 * time.Hour ) )
+	if ( fromError != nil || from.After( to ) ) { respondWithError( http.StatusBadRequest, "invalid from time" ); return }
+	step, stepError := parseHistoryStep( query.Get( "step" ) )
+	if stepError != nil { respondWithError( http.StatusBadRequest, "invalid step" ); return }
+	if ( step > 0 && to.Sub( from ) / step > HISTORY_MAXIMUM_POINTS ) { respondWithError( http.StatusBadRequest, "too many points, use a larger step" ); return }
+
+	// Run the query
+	points, queryError := store.Query( field, from, to, step )
+	if queryError != nil { respondWithError( http.StatusBadRequest, queryError.Error() ); return }
+	if ( len( points ) > HISTORY_MAXIMUM_POINTS ) { respondWithError( http.StatusBadRequest, "too many points, use a step or a shorter time range" ); return }
+
+	// Respond with pairs of Unix seconds & values, like Prometheus
+	values := make( [][ 2 ]float64, 0, len( points ) )
+	for _, point := range points { values = append( values, [ 2 ]float64 { float64( point.Time.UnixMilli() ) / 1000, point.Value } ) }
+	response.Header().Set( "Content-Type", "application/json" )
+	json.NewEncoder( response ).Encode( map[ string ]any {
+		"status": "success",
+		"field": field,
+		"from": from.UTC(),
+		"to": to.UTC(),
+		"step": step.Seconds(),
+		"values": values,
+	} )
+}
+
+// Parses a time as RFC 3339 or Unix seconds, or gives the default if it is empty
+func parseHistoryTime( value string, defaultTime time.Time ) ( time.Time, error ) {
+	if ( value == "" ) { return defaultTime, nil }
+
+	if seconds, parseError := strconv.ParseFloat( value, 64 ); parseError == nil {
+		return time.UnixMilli( int64( seconds * 1000 ) ), nil
+	}
+
+	return time.Parse( time.RFC3339, value )
+}
+
+// Parses a step as a duration (e.g., '5m') or seconds, with zero meaning every stored value
+func parseHistoryStep( value string ) ( time.Duration, error ) {
+	if ( value == "" ) { return 0, nil }
+
+	if seconds, parseError := strconv.ParseFloat( value, 64 ); parseError == nil {
+		if ( seconds < 0 ) { return 0, fmt.Errorf( "negative step" ) }
+		return time.Duration( seconds * float64( time.Second ) ), nil
+	}
+
+	step, parseError := time.ParseDuration( value )
+	if ( parseError == nil && step < 0 ) { return 0, fmt.Errorf( "negative step" ) }
+	return step, parseError
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryRecordEncoding( t *testing.T ) {
+	path := filepath.Join( t.TempDir(), "history.raw" )
+	records := []historyRecord {
+		{ Time: 1700000000000, Values: []float64 { 1.5, math.NaN(), 230 } },
+		{ Time: 1700000060000, Values: []float64 { 0.1, 2, -3 } },
+	}
+	if writeError := writeHistoryFile( path, []string { "a", "b", "c" }, records ); writeError != nil { t.Fatal( writeError ) }
+
+	// A record that was only partially appended
+	file, _ := os.OpenFile( path, os.O_WRONLY | os.O_APPEND, 0644 )
+	file.Write( encodeHistoryRecord( records[ 0 ] )[ : 10 ] )
+	file.Close()
+
+	// Read back in another order, with a field the file does not have
+	var read []historyRecord
+	if readError := readHistoryFile( path, []string { "c", "a", "d" }, func( record historyRecord ) { read = append( read, record ) } ); readError != nil { t.Fatal( readError ) }
+	if ( len( read ) != 2 ) { t.Fatalf( "expected 2 complete records, got %d", len( read ) ) }
+	if ( read[ 0 ].Time != records[ 0 ].Time || read[ 1 ].Time != records[ 1 ].Time ) { t.Errorf( "unexpected times %d & %d", read[ 0 ].Time, read[ 1 ].Time ) }
+	if ( read[ 0 ].Values[ 0 ] != 230 || read[ 0 ].Values[ 1 ] != 1.5 || !math.IsNaN( read[ 0 ].Values[ 2 ] ) ) { t.Errorf( "unexpected values %v", read[ 0 ].Values ) }
+	if ( read[ 1 ].Values[ 0 ] != -3 || read[ 1 ].Values[ 1 ] != float64( float32( 0.1 ) ) ) { t.Errorf( "expected values to be stored as 32-bit floats, got %v", read[ 1 ].Values ) }
+
+	// Anything else is rejected
+	os.WriteFile( path, []byte( "NOTAHISTORYFILE\n" ), 0644 )
+	if readError := readHistoryFile( path, []string { "a" }, func( historyRecord ) {} ); readError == nil { t.Error( "expected a file without the magic to be rejected" ) }
+
+	// A missing file has no records
+	if readError := readHistoryFile( filepath.Join( t.TempDir(), "missing" ), []string { "a" }, func( historyRecord ) { t.Error( "unexpected record" ) } ); readError != nil { t.Error( readError ) }
+}
+
+// Opens a history in a temporary directory with statuses every minute from a time, the load of each being the number of minutes since that time
+// The raw statuses are kept for an hour, and averaged every 5 minutes
+func newTestHistoryStore( t *testing.T, start time.Time, minutes int ) ( store *HistoryStore, directory string ) {
+	t.Helper()
+
+	directory = t.TempDir()
+	store, openError := NewHistoryStore( directory, time.Hour, 30 * 24 * time.Hour, 5 * time.Minute )
+	if openError != nil { t.Fatal( openError ) }
+	t.Cleanup( func() { store.Close() } )
+
+	for minute := 0; minute < minutes; minute++ {
+		status := Status { Date: start.Add( time.Duration( minute ) * time.Minute ) }
+		status.UPS.LoadPercent = float64( minute )
+		if publishError := store.Publish( status ); publishError != nil { t.Fatal( publishError ) }
+	}
+
+	return store, directory
+}
+
+func TestHistoryDownsampling( t *testing.T ) {
+	start := time.Now().Add( -2 * time.Hour ).Truncate( 5 * time.Minute )
+	store, directory := newTestHistoryStore( t, start, 120 )
+
+	// Reopen it, which removes the raw statuses older than an hour
+	store.Close()
+	store, openError := NewHistoryStore( directory, time.Hour, 30 * 24 * time.Hour, 5 * time.Minute )
+	if openError != nil { t.Fatal( openError ) }
+	defer store.Close()
+
+	points, queryError := store.Query( "load_percent", start, time.Now(), 0 )
+	if queryError != nil { t.Fatal( queryError ) }
+
+	// Averages of every 5 minutes before the oldest raw status, then every status
+	oldestRaw := time.UnixMilli( store.oldestRawTime )
+	if ( oldestRaw.Before( time.Now().Add( -time.Hour - time.Minute ) ) ) { t.Errorf( "expected raw statuses older than an hour to be removed, oldest is %s", oldestRaw ) }
+	averages := 0
+	for index, point := range points {
+		if point.Time.Before( oldestRaw ) {
+			averages++
+			if ( point.Time != start.Add( time.Duration( index ) * 5 * time.Minute ) || point.Value != float64( index * 5 + 2 ) ) { t.Errorf( "unexpected average %d at %s of %v", index, point.Time, point.Value ) }
+		} else if ( point.Value != point.Time.Sub( start ).Minutes() ) {
+			t.Errorf( "unexpected raw status at %s of %v", point.Time, point.Value )
+		}
+	}
+	if ( averages < 11 ) { t.Errorf( "expected averages for the first hour, got %d", averages ) }
+	if ( len( points ) == 0 || !points[ 0 ].Time.Equal( start ) || points[ len( points ) - 1 ].Value != 119 ) { t.Errorf( "expected points from the start to the latest status, got %v", points ) }
+}
+
+func TestHistoryStepAveraging( t *testing.T ) {
+	start := time.Now().Add( -time.Hour ).Truncate( 5 * time.Minute )
+	store, _ := newTestHistoryStore( t, start, 40 )
+
+	points, queryError := store.Query( "load_percent", start.Add( 10 * time.Minute ), start.Add( 39 * time.Minute ), 10 * time.Minute )
+	if queryError != nil { t.Fatal( queryError ) }
+
+	expected := []HistoryPoint {
+		{ start.Add( 10 * time.Minute ), 14.5 },
+		{ start.Add( 20 * time.Minute ), 24.5 },
+		{ start.Add( 30 * time.Minute ), 34.5 },
+	}
+	if ( len( points ) != len( expected ) ) { t.Fatalf( "expected %d points, got %v", len( expected ), points ) }
+	for index, point := range points {
+		if ( !point.Time.Equal( expected[ index ].Time ) || point.Value != expected[ index ].Value ) { t.Errorf( "expected %v, got %v", expected[ index ], point ) }
+	}
+
+	if _, queryError := store.Query( "colour", start, time.Now(), 0 ); queryError == nil { t.Error( "expected an unknown field to be rejected" ) }
+}
+
+func TestHistoryQueryWhilePublishing( t *testing.T ) {
+	start := time.Now().Add( -time.Hour ).Truncate( 5 * time.Minute )
+	store, _ := newTestHistoryStore( t, start, 0 )
+
+	// Publish while querying, as the files are read without holding the lock
+	published := make( chan error )
+	go func() {
+		for minute := 0; minute < 50; minute++ {
+			status := Status { Date: start.Add( time.Duration( minute ) * time.Minute ) }
+			status.UPS.LoadPercent = float64( minute )
+			if publishError := store.Publish( status ); publishError != nil { published <- publishError; return }
+		}
+		published <- nil
+	}()
+
+	for isPublishing := true; isPublishing; {
+		select {
+			case publishError := <-published:
+				if publishError != nil { t.Fatal( publishError ) }
+				isPublishing = false
+			default:
+		}
+
+		// Each point is either a status or an average of those not read yet, in order & never both
+		points, queryError := store.Query( "load_percent", start, time.Now(), 0 )
+		if queryError != nil { t.Fatal( queryError ) }
+		for index, point := range points {
+			minutes := point.Time.Sub( start ).Minutes()
+			if ( point.Value != minutes && point.Value != minutes + 2 ) { t.Fatalf( "unexpected point at %v minutes of %v", minutes, point.Value ) }
+			if ( index > 0 && !point.Time.After( points[ index - 1 ].Time ) ) { t.Fatalf( "expected the points in order, got %v", points ) }
+		}
+	}
+
+	points, _ := store.Query( "load_percent", start, time.Now(), 0 )
+	if ( len( points ) != 50 ) { t.Errorf( "expected 50 points, got %d", len( points ) ) }
+}
+
+func TestHistoryCompactionFailureKeepsFiles( t *testing.T ) {
+	start := time.Now().Add( -time.Hour ).Truncate( 5 * time.Minute )
+	store, directory := newTestHistoryStore( t, start, 10 )
+
+	// The temporary file cannot be created where there is a directory
+	os.Mkdir( filepath.Join( directory, "history.raw.tmp" ), 0755 )
+	if compactError := store.compact(); compactError == nil { t.Fatal( "expected compacting to fail" ) }
+
+	// Still appended to
+	status := Status { Date: start.Add( 10 * time.Minute ) }
+	status.UPS.LoadPercent = 10
+	if publishError := store.Publish( status ); publishError != nil { t.Fatal( publishError ) }
+	points, _ := store.Query( "load_percent", start, time.Now(), 0 )
+	if ( len( points ) != 11 || points[ 10 ].Value != 10 ) { t.Errorf( "expected the status to be stored after compacting failed, got %v", points ) }
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Escapes measurement names, tag keys & tag values - docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/#special-characters
+var influxTagEscaper = strings.NewReplacer( ",", "\\,", "=", "\\=", " ", "\\ " )
+
+// Escapes string field values
+var influxStringEscaper = strings.NewReplacer( "\\", "\\\\", "\"", "\\\"" )
+
+// Formats a status as a single line of the InfluxDB line protocol, tagged with the identity of the UPS & the target it came from
+func FormatInfluxLine( status Status ) string {
+	var line strings.Builder
+
+	// Measurement & tags, skipping any that are empty as InfluxDB does not allow that
+	line.WriteString( "ups" )
+	for _, tag := range [][ 2 ]string { { "model", status.UPS.ModelName }, { "serial", status.UPS.SerialNumber }, { "target", status.Target }, { "ups", status.UPS.Name } } {
+		if ( tag[ 1 ] == "" ) { continue }
+		fmt.Fprintf( &line, ",%s=%s", tag[ 0 ], influxTagEscaper.Replace( tag[ 1 ] ) )
+	}
+
+	// Status as text & number
+	fmt.Fprintf( &line, " status=\"%s\",status_flag=%di", influxStringEscaper.Replace( status.UPS.StatusText ), status.UPS.StatusFlag )
+
+	// Numeric fields
+	for _, field := range status.NumericFields() {
+		fmt.Fprintf( &line, ",%s=%s", field.Name, strconv.FormatFloat( field.Value, 'f', -1, 64 ) )
+	}
+
+	// Timestamp, as nanoseconds
+	fmt.Fprintf( &line, " %d", statusTime( status ).UnixNano() )
+
+	return line.String()
+}
+
+// Writes each status to InfluxDB through the version 2 HTTP API, in batches
+type InfluxOutput struct {
+	writeURL string
+	token string
+	client *http.Client
+
+	// How many lines to wait for before writing, and the most to hold while InfluxDB is unreachable
+	BatchSize int
+	BufferCapacity int
+
+	// The most time to spend on every attempt at writing together, so a slow or failing InfluxDB cannot stall collection for longer than its interval
+	Timeout time.Duration
+
+	// Lines waiting to be written
+	pending []string
+}
+
+// Creates an output for the InfluxDB version 2 HTTP API
+func NewInfluxOutput( serverURL string, organisation string, bucket string, token string, batchSize int, timeout time.Duration ) ( *InfluxOutput, error ) {
+
+	// Build the full URL for the write endpoint
+	writeURL, parseError := url.Parse( serverURL )
+	if parseError != nil { return nil, parseError }
+	writeURL = writeURL.JoinPath( "api", "v2", "write" )
+	writeURL.RawQuery = url.Values {
+		"org": { organisation },
+		"bucket": { bucket },
+		"precision": { "ns" },
+	}.Encode()
+
+	return &InfluxOutput {
+		writeURL: writeURL.String(),
+		token: token,
+		client: &http.Client { Timeout: 10 * time.Second },
+
+		BatchSize: batchSize,
+		BufferCapacity: batchSize * 1000,
+		Timeout: timeout,
+	}, nil
+
+}
+
+// Gets a short name for display purposes
+func ( output *InfluxOutput ) Name() string {
+	return "InfluxDB"
+}
+
+// Adds the status to the batch, and writes the batch if it is full
+func ( output *InfluxOutput ) Publish( status Status ) error {
+
+	// Add to the batch, dropping the oldest lines if InfluxDB has been unreachable for too long
+	output.pending = append( output.pending, FormatInfluxLine( status ) )
+	if ( len( output.pending ) > output.BufferCapacity ) { output.pending = output.pending[ len( output.pending ) - output.BufferCapacity : ] }
+
+	// Wait until the batch is full
+	if ( len( output.pending ) < output.BatchSize ) { return nil }
+
+	return output.flush()
+
+}
+
+// Writes anything left in the batch
+func ( output *InfluxOutput ) Close() error {
+	if ( len( output.pending ) == 0 ) { return nil }
+	return output.flush()
+}
+
+// Writes all the pending lines in one request, keeping them for next time if it fails or the timeout passes
+func ( output *InfluxOutput ) flush() error {
+	ctx, cancel := context.WithTimeout( context.Background(), output.Timeout )
+	defer cancel()
+
+	writeError := retryWithBackoffContext( ctx, 3, time.Second, func( ctx context.Context ) error {
+
+		// Create the request
+		request, requestError := http.NewRequestWithContext( ctx, http.MethodPost, output.writeURL, strings.NewReader( strings.Join( output.pending, "\n" ) + "\n" ) )
+		if requestError != nil { return requestError }
+		request.Header.Set( "Content-Type", "text/plain; charset=utf-8" )
+		if ( output.token != "" ) { request.Header.Set( "Authorization", "Token " + output.token ) }
+
+		// Send the request
+		response, responseError := output.client.Do( request )
+		if responseError != nil { return responseError }
+		defer response.Body.Close()
+
+		// InfluxDB responds with no content if it was all written
+		if ( response.StatusCode < 200 || response.StatusCode >= 300 ) {
+			responseBody, _ := io.ReadAll( io.LimitReader( response.Body, 512 ) )
+			return fmt.Errorf( "%s: %s", response.Status, bytes.TrimSpace( responseBody ) )
+		}
+
+		return nil
+
+	} )
+	if writeError != nil { return fmt.Errorf( "write %d lines to InfluxDB: %w", len( output.pending ), writeError ) }
+
+	output.pending = nil
+
+	return nil
+}
+
+// Writes each status in the InfluxDB line protocol to a file, or the standard output stream
+type InfluxFileOutput struct {
+	writer io.Writer
+	file *os.File
+}
+
+// Creates an output for a file, which is appended to, or the standard output stream if the path is a hyphen
+func NewInfluxFileOutput( path string ) ( *InfluxFileOutput, error ) {
+	if ( path == "-" ) { return &InfluxFileOutput { writer: os.Stdout }, nil }
+
+	file, openError := os.OpenFile( path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644 )
+	if openError != nil { return nil, openError }
+
+	return &InfluxFileOutput { writer: file, file: file }, nil
+}
+
+// Gets a short name for display purposes
+func ( output *InfluxFileOutput ) Name() string {
+	return "InfluxDB line protocol file"
+}
+
+// Writes the status as a line
+func ( output *InfluxFileOutput ) Publish( status Status ) error {
+	_, writeError := fmt.Fprintln( output.writer, FormatInfluxLine( status ) )
+	return writeError
+}
+
+// Closes the file, if it is not the standard output stream
+func ( output *InfluxFileOutput ) Close() error {
+	if ( output.file == nil ) { return nil }
+	return output.file.Close()
+}
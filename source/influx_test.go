@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFormatInfluxLine( t *testing.T ) {
+	for _, test := range []struct {
+		modelName string
+		target string
+		upsName string
+		statusText string
+		expected string
+	} {
+		{ "Back-UPS XS 850G2", "rack1", "ups", "ONLINE", `ups,model=Back-UPS\ XS\ 850G2,target=rack1,ups=ups status="ONLINE",` },
+		{ "Smart-UPS", "a,b=c", "rack 1", "ONBATT", `ups,model=Smart-UPS,target=a\,b\=c,ups=rack\ 1 status="ONBATT",` },
+		{ "", "", "ups", `say "hi" \ bye`, `ups,ups=ups status="say \"hi\" \\ bye",` }, // Empty tags are skipped
+	} {
+		status := Status { Target: test.target, Date: time.Unix( 1700000000, 5 ) }
+		status.UPS.ModelName, status.UPS.Name, status.UPS.StatusText = test.modelName, test.upsName, test.statusText
+
+		line := FormatInfluxLine( status )
+		if !strings.HasPrefix( line, test.expected ) { t.Errorf( "expected %q to start with %q", line, test.expected ) }
+		if !strings.HasSuffix( line, " 1700000000000000005" ) { t.Errorf( "expected %q to end with the time in nanoseconds", line ) }
+		if strings.Contains( line, "\n" ) { t.Errorf( "expected a single line, got %q", line ) }
+	}
+}
+
+// An InfluxDB server that responds with each of the status codes in turn (then no content), keeping the body of every request
+type testInfluxServer struct {
+	server *httptest.Server
+
+	mutex sync.Mutex
+	statusCodes []int
+	bodies []string
+}
+
+// Starts an InfluxDB server
+func startTestInfluxServer( t *testing.T, statusCodes ...int ) *testInfluxServer {
+	t.Helper()
+
+	influx := &testInfluxServer { statusCodes: statusCodes }
+	influx.server = httptest.NewServer( http.HandlerFunc( func( response http.ResponseWriter, request *http.Request ) {
+		body, _ := io.ReadAll( request.Body )
+
+		influx.mutex.Lock()
+		defer influx.mutex.Unlock()
+
+		influx.bodies = append( influx.bodies, string( body ) )
+		if ( len( influx.statusCodes ) > 0 ) {
+			http.Error( response, http.StatusText( influx.statusCodes[ 0 ] ), influx.statusCodes[ 0 ] )
+			influx.statusCodes = influx.statusCodes[ 1 : ]
+			return
+		}
+		response.WriteHeader( http.StatusNoContent )
+	} ) )
+	t.Cleanup( influx.server.Close )
+
+	return influx
+}
+
+// Gets the bodies of the requests received so far
+func ( influx *testInfluxServer ) getBodies() []string {
+	influx.mutex.Lock()
+	defer influx.mutex.Unlock()
+
+	return append( []string {}, influx.bodies... )
+}
+
+func TestInfluxKeepsLinesAfterFailedWrite( t *testing.T ) {
+	influx := startTestInfluxServer( t, http.StatusServiceUnavailable )
+	output, createError := NewInfluxOutput( influx.server.URL, "home", "ups", "secret", 1, 200 * time.Millisecond )
+	if createError != nil { t.Fatal( createError ) }
+
+	// Gives up once the timeout has passed, rather than waiting to try again
+	first := Status { Target: "rack1", Date: time.Unix( 1700000000, 0 ) }
+	startedAt := time.Now()
+	if publishError := output.Publish( first ); ( publishError == nil || !strings.Contains( publishError.Error(), "write 1 lines to InfluxDB: 503 Service Unavailable" ) ) { t.Errorf( "expected the write to fail, got %v", publishError ) }
+	if elapsed := time.Since( startedAt ); ( elapsed > time.Second ) { t.Errorf( "expected to give up once the timeout had passed, took %s", elapsed ) }
+	if ( len( output.pending ) != 1 ) { t.Fatalf( "expected the line to be kept, got %d lines", len( output.pending ) ) }
+
+	// Written with the next line once InfluxDB is back
+	second := Status { Target: "rack1", Date: time.Unix( 1700000060, 0 ) }
+	if publishError := output.Publish( second ); publishError != nil { t.Fatal( publishError ) }
+	if ( len( output.pending ) != 0 ) { t.Errorf( "expected no lines left, got %d", len( output.pending ) ) }
+
+	bodies := influx.getBodies()
+	if ( len( bodies ) != 2 ) { t.Fatalf( "expected 2 requests, got %d", len( bodies ) ) }
+	expected := FormatInfluxLine( first ) + "\n" + FormatInfluxLine( second ) + "\n"
+	if ( bodies[ 1 ] != expected ) { t.Errorf( "expected %q, got %q", expected, bodies[ 1 ] ) }
+}
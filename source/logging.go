@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// The formats that logs can be written in
+const (
+	LOG_FORMAT_TEXT = "text" // key=value pairs, for reading in a terminal
+	LOG_FORMAT_JSON = "json" // One object per line, for log collectors
+)
+
+// The minimum level of logs to write, which can be changed when the configuration is reloaded
+var logLevel = new( slog.LevelVar )
+
+// Gets the level of logs from its name (e.g., 'debug' or 'warn')
+func parseLogLevel( name string ) ( level slog.Level, err error ) {
+	switch strings.ToLower( name ) {
+		case "debug": return slog.LevelDebug, nil
+		case "info": return slog.LevelInfo, nil
+		case "warn", "warning": return slog.LevelWarn, nil
+		case "error": return slog.LevelError, nil
+		default: return slog.LevelInfo, fmt.Errorf( "unknown log level '%s'", name )
+	}
+}
+
+// Writes logs to the standard error stream in the format, as the standard output stream can be used by outputs
+func setupLogging( format string ) {
+	options := &slog.HandlerOptions { Level: logLevel }
+
+	var handler slog.Handler = slog.NewTextHandler( os.Stderr, options )
+	if ( format == LOG_FORMAT_JSON ) { handler = slog.NewJSONHandler( os.Stderr, options ) }
+
+	slog.SetDefault( slog.New( handler ) )
+}
+
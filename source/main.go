@@ -1,11 +1,19 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Metadata
@@ -20,150 +28,377 @@ const (
 // Entry-point
 func main() {
 
-	// Values of the command-line flags, and the defaults
-	flagNisAddress := "127.0.0.1"
-	flagNisPort := 3551
-	flagMetricsAddress := "127.0.0.1"
-	flagMetricsPort := 5000
-	flagMetricsPath := "/metrics"
-	flagMetricsInterval := 15 // Default Prometheus scrape interval
-
-	// Setup the command-line flags
-	flag.StringVar( &flagNisAddress, "nis-address", flagNisAddress, "The IPv4 address of the apcupsd Network Information Server." )
-	flag.IntVar( &flagNisPort, "nis-port", flagNisPort, "The port number of the apcupsd Network Information Server." )
-	flag.StringVar( &flagMetricsAddress, "metrics-address", flagMetricsAddress, "The IPv4 address to listen on for the Prometheus HTTP metrics server." )
-	flag.IntVar( &flagMetricsPort, "metrics-port", flagMetricsPort, "The port number to listen on for the Prometheus HTTP metrics server." )
-	flag.StringVar( &flagMetricsPath, "metrics-path", flagMetricsPath, "The full HTTP path to the metrics page." )
-	flag.IntVar( &flagMetricsInterval, "metrics-interval", flagMetricsInterval, "The time in seconds to wait between collecting metrics." )
-
-	// Set a custom help message
-	flag.Usage = func() {
-		fmt.Printf( "%s, v%s, by %s (%s).\n", PROJECT_NAME, PROJECT_VERSION, AUTHOR_NAME, AUTHOR_WEBSITE )
-		fmt.Printf( "\nUsage: %s [-h/-help] [-nis-address <IPv4 address>] [-nis-port <number>] [-metrics-address <IPv4 address>] [-metrics-port <number>] [-metrics-path <string>] [-metrics-interval <seconds>]\n", os.Args[ 0 ] )
-
-		flag.PrintDefaults()
-
-		os.Exit( 1 ) // By default it exits with code 2
+	// Run a subcommand instead, if one was given
+	if ( len( os.Args ) > 1 && os.Args[ 1 ] == "check" ) { os.Exit( runCheck( os.Args[ 2 : ] ) ) }
+	if ( len( os.Args ) > 1 && os.Args[ 1 ] == "healthcheck" ) { os.Exit( runHealthcheck( os.Args[ 2 : ] ) ) }
+
+	// Load the configuration file, environment variables & command-line flags
+	// NOTE: Invalid flags have already been shown with the usage
+	configuration, parseError := ParseConfiguration( os.Args[ 1 : ] )
+	if parseError != nil { exitWithErrorMessage( parseError.Error() ) }
+
+	// Write logs in the configured format, the level is set once the configuration has been checked
+	setupLogging( configuration.LogFormat )
+
+	// Check the configuration
+	validateError := configuration.Validate()
+	if validateError != nil { exitWithErrorMessage( validateError.Error() ) }
+	logLevel.Set( configuration.logLevel )
+
+	// Display the configuration
+	var nisTargets []string
+	for _, target := range configuration.nisTargets { nisTargets = append( nisTargets, target.String() ) }
+	slog.Info( "Starting", "version", PROJECT_VERSION, "config", configuration.ConfigFile, "targets", strings.Join( nisTargets, ", " ) )
+
+	// Name & label the metrics of every target the same way, until the exporter is restarted
+	// NOTE: The metrics are created & reset along with the collector for each target, once the configuration is applied
+	collectorMetricsSettings = MetricsSettings {
+		Namespace: configuration.MetricsNamespace,
+		ConstantLabels: configuration.metricsConstantLabels,
+		Schema: configuration.MetricsSchema,
 	}
 
-	// Parse the command-line flags
-	flag.Parse()
+	// Setup the outputs & notifiers, which are changed when the configuration is reloaded
+	targetSpecs, targetSpecsError := getTargetSpecs( configuration )
+	if targetSpecsError != nil { exitWithErrorMessage( targetSpecsError.Error() ) }
+	applyTargetsError := applyTargets( targetSpecs )
+	if applyTargetsError != nil { exitWithErrorMessage( applyTargetsError.Error() ) }
 
-	// Require a valid IP address for the Network Information Server
-	nisAddress := net.ParseIP( flagNisAddress )
-	if ( flagNisAddress == "" || nisAddress == nil || nisAddress.To4() == nil ) { exitWithErrorMessage( "Invalid IPv4 address for apcupsd's Network Information Server." ) }
+	// Setup the history, which is stored like an output & served alongside the metrics page
+	if ( configuration.HistoryPath != "" ) {
+		historyStores, historyError := NewHistoryStores( configuration.HistoryPath, time.Duration( configuration.HistoryRetention ) * 24 * time.Hour, time.Duration( configuration.HistoryDownsampledRetention ) * 24 * time.Hour, time.Duration( configuration.HistoryDownsampleInterval ) * time.Second )
+		if historyError != nil { exitWithErrorMessage( fmt.Sprintf( "Failed to open the history: %s", historyError.Error() ) ) }
+		addPermanentTarget( historyStores, nil )
+		http.Handle( "/api/v1/history", historyStores )
 
-	// Require a valid port number for the Network Information Server
-	if ( flagNisPort <= 0 || flagNisPort >= 65536 ) { exitWithErrorMessage( "Invalid port number for apcupsd's Network Information Server." ) }
+		slog.Info( "Storing the history of every status", "path", configuration.HistoryPath )
+	}
 
-	// Require a valid IP address for the Prometheus HTTP metrics server
-	metricsAddress := net.ParseIP( flagMetricsAddress )
-	if ( flagMetricsAddress == "" || metricsAddress == nil || metricsAddress.To4() == nil ) { exitWithErrorMessage( "Invalid listening IPv4 address for the Prometheus HTTP metrics server." ) }
+	// Load the web configuration file, which is checked again for changes while serving
+	var webConfig *WebConfigServer
+	metricsScheme := "http"
+	if ( configuration.WebConfigFile != "" ) {
+		var webConfigError error
+		webConfig, webConfigError = NewWebConfigServer( configuration.WebConfigFile )
+		if webConfigError != nil { exitWithErrorMessage( fmt.Sprintf( "Invalid web configuration file: %s", webConfigError.Error() ) ) }
+		if webConfig.IsTLS() { metricsScheme = "https" }
+	}
 
-	// Require a valid port number for the Prometheus HTTP metrics server
-	if ( flagMetricsPort <= 0 || flagMetricsPort >= 65536 ) { exitWithErrorMessage( "Invalid listening port number for the Prometheus HTTP metrics server." ) }
+	// Listen on the sockets from systemd, or the configured address & port with the Unix domain socket if there is one
+	var listeners []net.Listener
+	if ( !configuration.MetricsDisable && !configuration.Once ) {
+		var listenError error
+		listeners, listenError = ListenForMetrics( configuration.metricsAddress, configuration.MetricsPort, configuration.MetricsSocket )
+		if listenError != nil { exitWithErrorMessage( fmt.Sprintf( "Failed to listen for the metrics page: %s", listenError.Error() ) ) }
+	}
 
-	// Require a valid HTTP path for the metrics page
-	if ( flagMetricsPath == "" || flagMetricsPath[ 0 : 1 ] != "/" || flagMetricsPath[ 1 : ] == "/" ) { exitWithErrorMessage( "Invalid path for the metrics page, must have a leading slash and no trailing slash." ) }
+	// Shows where something is being served on each of the sockets
+	logServing := func( message string, path string ) {
+		for _, listener := range listeners {
+			if ( listener.Addr().Network() == "unix" ) {
+				slog.Info( message, "socket", listener.Addr().String(), "path", path )
+			} else {
+				slog.Info( message, "url", fmt.Sprintf( "%s://%s%s", metricsScheme, listener.Addr().String(), path ) )
+			}
+		}
+	}
 
-	// Require a valid interval for collecting metrics
-	if ( flagMetricsInterval <= 0 ) { exitWithErrorMessage( "Invalid interval to wait between collecting metrics, must be greater than 0." ) }
+	// Start using the configuration, which also creates the collector for each target
+	applyConfiguration( configuration )
 
-	// Display the configuration
-	fmt.Printf( "The configured Network Information Server is: %s:%d.\n\n", nisAddress, flagNisPort )
+	// Setup the health endpoints for orchestrators
+	if ( !configuration.MetricsDisable && !configuration.Once ) {
+		http.HandleFunc( "/healthz", serveLiveness )
+		http.HandleFunc( "/readyz", serveReadiness )
+	}
 
-	// Reset all metrics
-	fmt.Println( "Resetting all metrics..." )
-	ResetMetrics()
+	// Setup the live stream, which is fed like an output & a notifier, and served alongside the metrics page
+	if ( !configuration.MetricsDisable && !configuration.Once ) {
+		statusStream := NewStatusStream( STREAM_HEARTBEAT_INTERVAL )
+		addPermanentTarget( statusStream, statusStream )
+		http.Handle( "/api/v1/stream", statusStream )
+	}
+
+	// Setup the dashboard, unless the metrics page is already on the root path
+	if ( !configuration.MetricsDisable && !configuration.Once && !configuration.DashboardDisable && configuration.MetricsPath != "/" ) {
+		dashboard := NewDashboard( time.Duration( configuration.DashboardHistory ) * time.Minute, configuration.MetricsPath )
+		addPermanentTarget( dashboard, dashboard )
+		http.Handle( "/", dashboard )
+		http.HandleFunc( "/api/v1/dashboard", dashboard.ServeData )
+
+		logServing( "Serving the dashboard", "/" )
+	}
+
+	// Emulate a Network UPS Tools server, which is fed like an output
+	if ( configuration.NUTAddress != "" && !configuration.Once ) {
+		nutServer, nutError := NewNUTServer( configuration.nutAddress, configuration.NUTPort, configuration.NUTUPSName, configuration.nutUsers )
+		if nutError != nil { exitWithErrorMessage( fmt.Sprintf( "Failed to listen for the Network UPS Tools server: %s", nutError.Error() ) ) }
+		addPermanentTarget( nutServer, nil )
+
+		slog.Info( "Serving the Network UPS Tools server", "address", fmt.Sprintf( "%s:%d", configuration.NUTAddress, configuration.NUTPort ), "ups", strings.Join( nutServer.getUPSNames(), ", " ) )
+	}
+
+	// Collect metrics just once for the outputs, failing if anything went wrong
+	if configuration.Once {
+		if ( len( getOutputs() ) == 0 ) { exitWithErrorMessage( "Collecting metrics once requires at least one output." ) }
+
+		collectors := getCollectors()
+		results := collectFromTargets( context.Background(), configuration, collectors )
+		for index, result := range results {
+			if result.err != nil { exitWithErrorMessage( fmt.Sprintf( "Failed to fetch status from the Network Information Server at %s: %s", collectors[ index ].NISTarget.String(), result.err.Error() ) ) }
+		}
+
+		statuses := []Status {}
+		for _, result := range results { statuses = append( statuses, result.status ) }
+		failedCount := publishToOutputs( statuses )
+		failedCount += closeOutputs()
+		if ( failedCount > 0 ) { exitWithErrorMessage( "Failed to send metrics to all of the outputs." ) }
+
+		return
+	}
+
+	// Without the metrics page there is nothing else to serve, so there must be somewhere for the metrics to go
+	if ( configuration.MetricsDisable && len( getOutputs() ) == 0 ) { exitWithErrorMessage( "The metrics page cannot be disabled without any outputs." ) }
+
+	// Shutdown gracefully when asked to stop, and reload the configuration when asked to
+	ctx, stopSignals := signal.NotifyContext( context.Background(), os.Interrupt, syscall.SIGTERM )
+	defer stopSignals()
+	go reloadOnHangup( ctx )
+
+	// Start sending power events in the background
+	go sendNotificationsInBackground()
+
+	// Keep systemd's watchdog happy while metrics are being collected, if it is enabled
+	go systemdNotifier.WatchOverCollection( ctx )
 
 	// Start collecting metrics in the background
-	fmt.Println( "Starting background metrics collection..." )
-	go collectMetricsInBackground( flagMetricsInterval, nisAddress, flagNisPort )
+	slog.Info( "Starting background metrics collection", "interval", time.Duration( configuration.MetricsInterval ) * time.Second )
+	collectionFinished := make( chan struct{} )
+	go func() {
+		defer close( collectionFinished )
+		collectMetricsInBackground( ctx )
+	}()
+
+	if configuration.MetricsDisable {
+
+		// Just collect metrics for the outputs until asked to stop
+		slog.Info( "Not serving the metrics page, as it is disabled" )
+		<-ctx.Done()
+
+	} else {
+
+		// Combine the metrics about each UPS with the metrics about the exporter, timestamping the former if configured
+		gatherer := FilteredGatherer {
+			Gatherer: prometheus.Gatherers { prometheus.DefaultGatherer, CollectorsGatherer { Timestamped: configuration.MetricsTimestamps } },
+			Include: configuration.metricsInclude,
+			Exclude: configuration.metricsExclude,
+		}
+
+		// Serve the metrics page until asked to stop
+		logServing( "Serving the metrics page", configuration.MetricsPath )
+		serveError := ServeMetrics( ctx, listeners, configuration.MetricsPath, gatherer, webConfig )
+		if ( serveError != nil && ctx.Err() == nil ) { exitWithErrorMessage( fmt.Sprintf( "Failed to serve the metrics page: %s", serveError.Error() ) ) }
+		if serveError != nil { slog.Warn( "Failed to finish serving requests in progress", "error", serveError ) }
 
-	// Serve the metrics page
-	fmt.Printf( "Serving metrics page at http://%s:%d%s...\n", flagMetricsAddress, flagMetricsPort, flagMetricsPath )
-	ServeMetrics( metricsAddress, flagMetricsPort, flagMetricsPath )
+	}
+
+	// Wait for any fetch in progress to be cancelled, then send the power events still queued
+	slog.Info( "Shutting down" )
+	systemdNotifier.Stopping()
+	<-collectionFinished
+	close( notificationQueue )
+	select {
+		case <-notificationsFinished:
+		case <-time.After( NOTIFICATIONS_SHUTDOWN_TIMEOUT ): slog.Warn( "Gave up waiting for power events to be sent" )
+	}
+
+	// Send anything still pending to the outputs & notifiers
+	failedCount := closeOutputs()
+	failedCount += closeNotifiers()
+	if ( failedCount > 0 ) { exitWithErrorMessage( "Failed to send everything still pending to all of the outputs & notifiers." ) }
+
+	slog.Info( "Shutdown complete" )
 
 }
 
-// Runs in the background to periodically collect metrics
-func collectMetricsInBackground( interval int, nisAddress net.IP, nisPort int ) {
+// Runs in the background to periodically collect metrics, until the context is cancelled
+func collectMetricsInBackground( ctx context.Context ) {
 
-	// Loop forever...
+	// Loop until asked to stop...
 	for {
+		systemdNotifier.CollectionStarted()
+
+		// Use the latest configuration & targets, as they may have been reloaded
+		configuration := currentConfiguration.Load()
+		collectors := getCollectors()
+
+		// Update metric values, trying again next time for any daemons that cannot be reached
+		results := collectFromTargets( ctx, configuration, collectors )
+		if ( ctx.Err() != nil ) { return } // The fetches were cancelled, so they did not really fail
+		statuses := []Status {}
+		for index, result := range results {
+			collector, status, updateError := collectors[ index ], result.status, result.err
+			if updateError != nil {
+				slog.Error( "Failed to fetch status from the Network Information Server", "target", collector.NISTarget.String(), "stage", getFetchStage( updateError ), "duration", result.duration, "error", updateError )
+				collector.Health.Failed( updateError )
+				notifyOfEvents( collector.events.Unreachable( updateError ) )
+				continue
+			}
+
+			slog.Debug( "Fetched status from the Network Information Server", "target", collector.NISTarget.String(), "duration", result.duration, "ups", status.UPS.Name, "status", status.UPS.StatusText )
+			collector.Health.Succeeded( status )
+			systemdNotifier.Ready( status )
+			statuses = append( statuses, status )
+
+			// Notify of any power events since the last collection
+			notifyOfEvents( collector.events.Detect( status ) )
+
+		}
+
+		// Send them to any outputs
+		publishToOutputs( statuses )
+
+		// Wait the collection interval, unless asked to stop
+		systemdNotifier.CollectionFinished()
+		slog.Debug( "Waiting for the next collection", "interval", time.Duration( configuration.MetricsInterval ) * time.Second )
+		select {
+			case <-ctx.Done(): return
+			case <-time.After( time.Duration( configuration.MetricsInterval ) * time.Second ):
+		}
+
+	}
+
+}
+
+// The result of fetching the status from one target
+type collectionResult struct {
+	status Status
+	err error
+	duration time.Duration
+}
+
+// Fetches the latest status from every target at once, so a slow target does not hold up the others, giving the results in the same order
+// NOTE: Anything else done with the statuses is left to the caller, as the outputs & notifiers are not safe to use from many goroutines at once
+func collectFromTargets( ctx context.Context, configuration *Configuration, collectors []*Collector ) ( results []collectionResult ) {
+	results = make( []collectionResult, len( collectors ) )
 
-		// Update metric values
-		updateMetrics( nisAddress, nisPort )
+	var waitGroup sync.WaitGroup
+	for index, collector := range collectors {
+		collector.outages.DebounceDuration = time.Duration( configuration.OutageDebounce ) * time.Second
+		collector.energy.MaximumGap = time.Duration( configuration.MetricsInterval * 3 ) * time.Second // Do not integrate energy across gaps of more than a few missed collections
 
-		// Wait the collection interval
-		fmt.Printf( " Waiting %d seconds for next collection...\n", interval )
-		time.Sleep( time.Duration( interval ) * time.Second )
+		waitGroup.Add( 1 )
+		go func() {
+			defer waitGroup.Done()
 
+			startedAt := time.Now()
+			results[ index ].status, results[ index ].err = updateMetrics( ctx, collector )
+			results[ index ].duration = time.Since( startedAt )
+		}()
 	}
+	waitGroup.Wait()
 
+	return results
 }
 
-// Updates the metrics with the latest status from the NIS
-func updateMetrics( nisAddress net.IP, nisPort int ) {
+// Updates the metrics of a target with the latest status from its NIS
+func updateMetrics( ctx context.Context, collector *Collector ) ( status Status, err error ) {
 
 	// Create an empty structure
 	var networkInformationServer NetworkInformationServer
 
+	// Give up on the whole fetch if it takes too long, not just on connecting
+	fetchContext, cancelFetch := context.WithTimeout( ctx, NIS_FETCH_TIMEOUT )
+	defer cancelFetch()
+
 	// Connect to the server
-	connectError := networkInformationServer.Connect( nisAddress, nisPort, 5000 )
-	if connectError != nil { exitWithErrorMessage( connectError.Error() ) }
+	connectError := networkInformationServer.ConnectContext( fetchContext, collector.Address, collector.Port, 5000 )
+	if connectError != nil { return status, &FetchError { Stage: FETCH_STAGE_CONNECT, Err: connectError } }
 	defer networkInformationServer.Disconnect()
-	fmt.Println( "\nConnected to the Network Information Server." )
 
 	// Fetch the status from the server
 	status, statusError := networkInformationServer.FetchStatus()
-	if statusError != nil { exitWithErrorMessage( statusError.Error() ) }
-	fmt.Println( " Fetched status from the Network Information Server." )
+	if statusError != nil { return status, statusError }
+	status.Target = collector.Name
+
+	// Remember when the daemon got this status from the UPS
+	collector.setTimestamp( status.Date )
+
+	// Update the metrics of this target only
+	metrics := collector.metrics
 
 	// Update status metric
 	switch status.UPS.StatusText {
-		case "ONLINE": metricStatus.Set( 1 )
-		case "ONBATT": metricStatus.Set( 2 )
-		default: metricStatus.Set( -1 )
+		case "ONLINE": metrics.Status.Set( 1 )
+		case "ONBATT": metrics.Status.Set( 2 )
+		default: metrics.Status.Set( -1 )
 	}
-	fmt.Println( "  Updated the status metric." )
+	slog.Debug( "Updated the status metric" )
 
 	// Update temperature metric
-	metricTemperature.Set( status.UPS.Temperature )
-	fmt.Println( "  Updated the temperature metric." )
+	metrics.Temperature.Set( status.UPS.Temperature )
+	slog.Debug( "Updated the temperature metric" )
 
 	// Update power metrics
-	metricPowerInputExpectVoltage.Set( status.UPS.Expect.MainsInputVoltage )
-	metricPowerOutputWattage.Set( status.UPS.Expect.PowerOutputWattage )
-	metricPowerLineVoltage.Set( status.UPS.LineVoltage )
-	metricPowerMaximumLineVoltage.Set( status.UPS.MaximumLineVoltage )
-	metricPowerMinimumLineVoltage.Set( status.UPS.MinimumLineVoltage )
-	metricPowerLineFrequency.Set( status.UPS.LineFrequency )
-	metricPowerOutputVoltage.Set( status.UPS.OutputVoltage )
-	metricPowerLoadPercent.Set( status.UPS.LoadPercent )
-	fmt.Println( "  Updated the power metrics." )
+	metrics.PowerInputExpectVoltage.Set( status.UPS.Expect.MainsInputVoltage )
+	metrics.PowerOutputWattage.Set( status.UPS.Expect.PowerOutputWattage )
+	metrics.PowerLineVoltage.Set( status.UPS.LineVoltage )
+	metrics.PowerMaximumLineVoltage.Set( status.UPS.MaximumLineVoltage )
+	metrics.PowerMinimumLineVoltage.Set( status.UPS.MinimumLineVoltage )
+	metrics.PowerLineFrequency.Set( status.UPS.LineFrequency )
+	metrics.PowerOutputVoltage.Set( status.UPS.OutputVoltage )
+	metrics.PowerLoadPercent.Set( status.UPS.LoadPercent )
+	if loadWatts, ok := calculateLoadWatts( status ); ok { metrics.PowerLoadWatts.Set( loadWatts ) }
+	if loadVoltAmps, ok := calculateLoadVoltAmps( status ); ok { metrics.SetPowerLoadVoltAmps( loadVoltAmps ) }
+	metrics.V2PowerInputNominalVolts.Set( status.UPS.Expect.MainsInputVoltage )
+	metrics.V2PowerOutputNominalWatts.Set( status.UPS.Expect.PowerOutputWattage )
+	metrics.V2PowerLineVolts.Set( status.UPS.LineVoltage )
+	metrics.V2PowerLineMaximumVolts.Set( status.UPS.MaximumLineVoltage )
+	metrics.V2PowerLineMinimumVolts.Set( status.UPS.MinimumLineVoltage )
+	metrics.V2PowerOutputVolts.Set( status.UPS.OutputVoltage )
+	metrics.V2PowerLoadRatio.Set( status.UPS.LoadPercent / 100 )
+	slog.Debug( "Updated the power metrics" )
+
+	// Update energy metrics
+	collector.energy.Update( status, metrics )
+	slog.Debug( "Updated the energy metrics" )
 
 	// Update battery metrics
-	metricBatteryExpectVoltage.Set( status.UPS.Expect.BatteryOutputVoltage )
-	metricBatteryActualVoltage.Set( status.UPS.Battery.OutputVoltage )
-	metricBatteryTimeSpentLatestSeconds.Set( status.Daemon.Battery.TimeSpent.Current )
-	metricBatteryTimeSpentTotalSeconds.Set( status.Daemon.Battery.TimeSpent.Total )
-	metricBatteryRemainingChargePercent.Set( status.UPS.Battery.ChargePercent )
-	metricBatteryRemainingTimeMinutes.Set( status.UPS.Battery.RemainingRuntimeMinutes )
-	metricBatteryLowThreshold.Set( status.UPS.Battery.LowBatterySignalThreshold )
-	metricBatteryCount.Set( status.UPS.Battery.ExternalCount )
-	fmt.Println( "  Updated the battery metrics." )
+	metrics.BatteryExpectVoltage.Set( status.UPS.Expect.BatteryOutputVoltage )
+	metrics.BatteryActualVoltage.Set( status.UPS.Battery.OutputVoltage )
+	metrics.BatteryTimeSpentLatestSeconds.Set( status.Daemon.Battery.TimeSpent.Current )
+	metrics.BatteryTimeSpentTotalSeconds.Set( status.Daemon.Battery.TimeSpent.Total )
+	metrics.BatteryRemainingChargePercent.Set( status.UPS.Battery.ChargePercent )
+	metrics.BatteryRemainingTimeMinutes.Set( status.UPS.Battery.RemainingRuntimeMinutes )
+	metrics.BatteryLowThreshold.Set( status.UPS.Battery.LowBatterySignalThreshold )
+	metrics.BatteryCount.Set( status.UPS.Battery.ExternalCount )
+	metrics.V2BatteryNominalVolts.Set( status.UPS.Expect.BatteryOutputVoltage )
+	metrics.V2BatteryVolts.Set( status.UPS.Battery.OutputVoltage )
+	metrics.V2BatteryTimeSpentSecondsTotal.Set( status.Daemon.Battery.TimeSpent.Total )
+	metrics.V2BatteryChargeRatio.Set( status.UPS.Battery.ChargePercent / 100 )
+	metrics.V2BatteryRuntimeRemainingSeconds.Set( status.UPS.Battery.RemainingRuntimeMinutes * 60 )
+	metrics.V2BatteryLowThresholdSeconds.Set( status.UPS.Battery.LowBatterySignalThreshold * 60 )
+	metrics.V2BatteryExternalPacks.Set( status.UPS.Battery.ExternalCount )
+	slog.Debug( "Updated the battery metrics" )
 
 	// Update daemon metrics
-	metricDaemonRemainingChargePercent.Set( status.Daemon.Configuration.MinimumBatteryChargePercent )
-	metricDaemonRemainingTimeMinutes.Set( status.Daemon.Configuration.MinimumBatteryRemainingRuntimeMinutes )
-	metricDaemonTimeoutMinutes.Set( status.Daemon.Configuration.MaximumTimeoutMinutes )
-	metricDaemonTransferCount.Set( status.Daemon.Battery.Transfer.Total )
-	metricDaemonStartTimestamp.Set( float64( status.Daemon.StartupTime.Unix() ) )
-	fmt.Println( "  Updated the daemon metrics." )
-
-	// Disconnect message for clarity, this is actually done by the defer statement
-	fmt.Println( " Disconnected from the Network Information Server." )
+	metrics.DaemonRemainingChargePercent.Set( status.Daemon.Configuration.MinimumBatteryChargePercent )
+	metrics.DaemonRemainingTimeMinutes.Set( status.Daemon.Configuration.MinimumBatteryRemainingRuntimeMinutes )
+	timeoutMinutes := status.Daemon.Configuration.MaximumTimeoutSeconds
+	if ( timeoutMinutes > 0 ) { timeoutMinutes /= 60 } // Unless it is unknown
+	metrics.DaemonTimeoutMinutes.Set( timeoutMinutes )
+	metrics.DaemonTransferCount.Set( status.Daemon.Battery.Transfer.Total )
+	metrics.DaemonStartTimestamp.Set( float64( status.Daemon.StartupTime.Unix() ) )
+	metrics.V2DaemonShutdownChargeRatio.Set( status.Daemon.Configuration.MinimumBatteryChargePercent / 100 )
+	metrics.V2DaemonShutdownRuntimeSeconds.Set( status.Daemon.Configuration.MinimumBatteryRemainingRuntimeMinutes * 60 )
+	metrics.V2DaemonShutdownTimeoutSeconds.Set( status.Daemon.Configuration.MaximumTimeoutSeconds )
+	metrics.V2DaemonTransfersTotal.Set( status.Daemon.Battery.Transfer.Total )
+	metrics.V2DaemonStartTimestampSeconds.Set( float64( status.Daemon.StartupTime.Unix() ) )
+	slog.Debug( "Updated the daemon metrics" )
+
+	// Update outage metrics
+	collector.outages.Update( status, metrics )
+	slog.Debug( "Updated the outage metrics" )
 
 	/*
 	// Daemon
@@ -234,10 +469,13 @@ func updateMetrics( nisAddress net.IP, nisPort int ) {
 	fmt.Printf( "Last Self-Test Result: '%s'\n", status.SelfTestResult )
 	*/
 
+	// Give the status to the caller, for sending to any outputs
+	return status, nil
+
 }
 
-// Displays a message to the standard error stream & exits with a failure status code
+// Logs a message as an error & exits with a failure status code
 func exitWithErrorMessage( message string ) {
-	fmt.Fprintln( os.Stderr, message )
+	slog.Error( message )
 	os.Exit( 1 )
 }
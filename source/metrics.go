@@ -1,28 +1,108 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 )
 
-// Create the metrics
-var (
+// Versions of the metric schema, the first uses the original names & the second uses base units
+const (
+	METRICS_SCHEMA_V1 = "v1"
+	METRICS_SCHEMA_V2 = "v2"
+	METRICS_SCHEMA_BOTH = "both"
+)
+
+// How long to wait for requests in progress to finish when shutting down
+const METRICS_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// The metrics about one UPS, each kept in its own registry so they can be added & removed as targets change
+type Metrics struct {
+	Status prometheus.Gauge
+	Temperature prometheus.Gauge
+
+	PowerInputExpectVoltage prometheus.Gauge
+	PowerOutputWattage prometheus.Gauge
+	PowerLineVoltage prometheus.Gauge
+	PowerMaximumLineVoltage prometheus.Gauge
+	PowerMinimumLineVoltage prometheus.Gauge
+	PowerLineFrequency prometheus.Gauge
+	PowerOutputVoltage prometheus.Gauge
+	PowerLoadPercent prometheus.Gauge
+	PowerLoadWatts prometheus.Gauge
+	PowerLoadVoltAmps prometheus.Gauge
+
+	BatteryExpectVoltage prometheus.Gauge
+	BatteryActualVoltage prometheus.Gauge
+	BatteryTimeSpentLatestSeconds prometheus.Gauge
+	BatteryTimeSpentTotalSeconds prometheus.Gauge
+	BatteryRemainingChargePercent prometheus.Gauge
+	BatteryRemainingTimeMinutes prometheus.Gauge
+	BatteryLowThreshold prometheus.Gauge
+	BatteryCount prometheus.Gauge
+
+	DaemonRemainingChargePercent prometheus.Gauge
+	DaemonRemainingTimeMinutes prometheus.Gauge
+	DaemonTimeoutMinutes prometheus.Gauge
+	DaemonTransferCount prometheus.Gauge
+	DaemonStartTimestamp prometheus.Gauge
+
+	EnergyConsumedKilowattHours prometheus.Counter
+
+	OutageCount prometheus.Counter
+	OutageDurationSeconds prometheus.Histogram
+	OutageChargeUsedPercent prometheus.Histogram
+	OutageDeepestChargePercent prometheus.Gauge
+	OutageInProgress prometheus.Gauge
+
+	// The registerer with any constant labels, for metrics that are registered later
+	registerer prometheus.Registerer
+	powerLoadVoltAmpsRegister sync.Once
+
+	// The metrics that are only in the version 2 schema
+	MetricsV2
+}
+
+// Creates the metrics under a namespace in a registry, with constant labels on all of them
+// NOTE: Metrics from a schema that is not in use are still created so they can be updated, but they are never registered
+func NewMetrics( registry *prometheus.Registry, namespace string, constantLabels prometheus.Labels, schema string ) *Metrics {
+	metrics := &Metrics {}
+
+	// Wrap the registry to add the constant labels
+	metrics.registerer = prometheus.WrapRegistererWith( constantLabels, registry )
+
+	// Metrics that are the same in both schemas are always registered
+	factory := promauto.With( metrics.registerer )
+
+	// Metrics that differ between schemas are only registered if that schema is in use
+	v1Factory := promauto.With( nil )
+	v2Factory := promauto.With( nil )
+	if ( schema == METRICS_SCHEMA_V1 || schema == METRICS_SCHEMA_BOTH ) { v1Factory = factory }
+	if ( schema == METRICS_SCHEMA_V2 || schema == METRICS_SCHEMA_BOTH ) { v2Factory = factory }
 
 	// Status (as number) - STATUS
-	metricStatus = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.Status = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Name: "status",
 		Help: "The current status.",
 	} )
 
 	// Current internal temperature (as celsius) - ITEMP - SmartUPS X 3000
-	metricTemperature = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.Temperature = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Name: "temperature_celsius",
 		Help: "The current internal temperature of the UPS.",
 	} )
@@ -30,130 +110,147 @@ var (
 	/*************************************/
 
 	// Expected power input (as voltage) - NOMPOWER
-	metricPowerInputExpectVoltage = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.PowerInputExpectVoltage = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "power",
 		Name: "input_expect_voltage",
 		Help: "The expected input voltage.",
 	} )
 
 	// Maximum power output (as wattage) - NOMPOWER
-	metricPowerOutputWattage = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.PowerOutputWattage = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "power",
 		Name: "output_maximum_wattage",
 		Help: "The maximum power the UPS can output.",
 	} )
 
 	// Current line voltage (as voltage) - LINEV
-	metricPowerLineVoltage = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.PowerLineVoltage = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "power",
 		Name: "line_voltage",
 		Help: "The current line voltage as returned by the UPS.",
 	} )
 
 	// Maximum line voltage (as voltage) - MAXLINEV - SmartUPS X 3000
-	metricPowerMaximumLineVoltage = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.PowerMaximumLineVoltage = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "power",
 		Name: "line_maximum_voltage",
 		Help: "The maximum line voltage as returned by the UPS.",
 	} )
 
 	// Minimum line voltage (as voltage) - MINLINEV - SmartUPS X 3000
-	metricPowerMinimumLineVoltage = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.PowerMinimumLineVoltage = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "power",
 		Name: "line_minimum_voltage",
 		Help: "The minimum line voltage as returned by the UPS.",
 	} )
 
 	// Current line frequency (as hertz) - LINEFREQ - SmartUPS X 3000
-	metricPowerLineFrequency = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.PowerLineFrequency = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "power",
 		Name: "line_frequency_hertz",
 		Help: "The current line frequency as returned by the UPS.",
 	} )
 
 	// Current output voltage (as voltage) - OUTPUTV - SmartUPS X 3000
-	metricPowerOutputVoltage = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.PowerOutputVoltage = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "power",
 		Name: "output_voltage",
 		Help: "The current output voltage as returned by the UPS.",
 	} )
 
 	// Current load capacity (as percentage) - LOADPCT
-	metricPowerLoadPercent = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.PowerLoadPercent = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "power",
 		Name: "load_percent",
 		Help: "The current load capacity as estimated by the UPS, as a percentage.",
 	} )
 
+	// Current load (as wattage) - LOADPCT & NOMPOWER
+	metrics.PowerLoadWatts = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "power",
+		Name: "load_watts",
+		Help: "The current load in watts, derived from the load capacity & maximum power output.",
+	} )
+
+	// Current load (as volt-amps) - LOADPCT & NOMAPNT
+	// NOTE: This is only registered once the UPS reports its maximum apparent power, as not all models do
+	metrics.PowerLoadVoltAmps = prometheus.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "power",
+		Name: "load_voltamps",
+		Help: "The current load in volt-amps, derived from the load capacity & maximum apparent power output.",
+	} )
+
 	/*************************************/
 
 	// Expected power output of the battery (as voltage) - NOMBATTV
-	metricBatteryExpectVoltage = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.BatteryExpectVoltage = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "battery",
 		Name: "output_expect_voltage",
 		Help: "The expected output voltage of the battery.",
 	} )
 
 	// Actual power output of the battery (as voltage) - BATTV
-	metricBatteryActualVoltage = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.BatteryActualVoltage = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "battery",
 		Name: "output_actual_voltage",
 		Help: "The actual output voltage of the battery.",
 	} )
 
 	// Latest time spent on battery (in seconds) - TONBATT
-	metricBatteryTimeSpentLatestSeconds = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.BatteryTimeSpentLatestSeconds = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "battery",
 		Name: "time_spent_latest_seconds",
 		Help: "The latest time spent on battery.",
 	} )
 
 	// Total time spent on battery (in seconds) - CUMONBATT
-	metricBatteryTimeSpentTotalSeconds = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.BatteryTimeSpentTotalSeconds = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "battery",
 		Name: "time_spent_total_seconds",
 		Help: "The total time spent on battery.",
 	} )
 
 	// Remaining charge of the battery (as percentage) - BCHARGE
-	metricBatteryRemainingChargePercent = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.BatteryRemainingChargePercent = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "battery",
 		Name: "remaining_charge_percent",
 		Help: "The remaining charge on the battery, as a percentage.",
 	} )
 
 	// Remaining time of the battery (in minutes) - TIMELEFT
-	metricBatteryRemainingTimeMinutes = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.BatteryRemainingTimeMinutes = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "battery",
 		Name: "remaining_time_minutes",
 		Help: "The remaining runtime left on the battery as estimated by the UPS, in minutes.",
 	} )
 
 	// Low battery threshold (in minutes) - DLOWBATT - SmartUPS X 3000
-	metricBatteryLowThreshold = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.BatteryLowThreshold = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "battery",
 		Name: "low_threshold_minutes",
 		Help: "The low battery threshold, in minutes.",
 	} )
 
 	// Number of external batteries - EXTBATTS - SmartUPS X 3000
-	metricBatteryCount = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.BatteryCount = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "battery",
 		Name: "count",
 		Help: "The number of external batteries in the UPS.",
@@ -162,92 +259,283 @@ var (
 	/*************************************/
 
 	// Configured minimum battery charge (as percentage) - MBATTCHG
-	metricDaemonRemainingChargePercent = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.DaemonRemainingChargePercent = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "daemon",
 		Name: "remaining_charge_percent",
 		Help: "The configured minimum remaining charge on the battery to trigger a system shutdown, as a percentage.",
 	} )
 
 	// Configured minimum battery remaining time (in minutes) - MINTIMEL
-	metricDaemonRemainingTimeMinutes = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.DaemonRemainingTimeMinutes = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "daemon",
 		Name: "remaining_time_minutes",
 		Help: "The configured minimum remaining runtime left on the battery to trigger a system shutdown, in minutes.",
 	} )
 
 	// Configured maximum timeout (in minutes) - MAXTIME
-	metricDaemonTimeoutMinutes = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.DaemonTimeoutMinutes = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "daemon",
 		Name: "timeout_minutes",
 		Help: "The configured maximum time running on the battery to trigger a system shutdown, in minutes.",
 	} )
 
 	// Number of transfers to battery - NUMXFERS
-	metricDaemonTransferCount = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.DaemonTransferCount = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "daemon",
 		Name: "transfer_count",
 		Help: "The number of transfers to the battery.",
 	} )
 
 	// Daemon startup time (as unix timestamp) - STARTTIME
-	metricDaemonStartTimestamp = promauto.NewGauge( prometheus.GaugeOpts {
-		Namespace: "ups",
+	metrics.DaemonStartTimestamp = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
 		Subsystem: "daemon",
 		Name: "start_timestamp",
 		Help: "The date & time the daemon was started.",
 	} )
 
-)
+	/*************************************/
+
+	// Energy consumed by the load (in kilowatt-hours) - LOADPCT & NOMPOWER
+	metrics.EnergyConsumedKilowattHours = v1Factory.NewCounter( prometheus.CounterOpts {
+		Namespace: namespace,
+		Subsystem: "energy",
+		Name: "consumed_kwh_total",
+		Help: "The energy consumed by the load, integrated by the exporter from the load in watts between each collection.",
+	} )
+
+	/*************************************/
+
+	// Number of completed outages seen by the exporter
+	metrics.OutageCount = factory.NewCounter( prometheus.CounterOpts {
+		Namespace: namespace,
+		Name: "outages_total",
+		Help: "The number of completed outages seen by the exporter.",
+	} )
+
+	// Duration of completed outages (in seconds)
+	metrics.OutageDurationSeconds = factory.NewHistogram( prometheus.HistogramOpts {
+		Namespace: namespace,
+		Subsystem: "outage",
+		Name: "duration_seconds",
+		Help: "The duration of completed outages seen by the exporter.",
+		Buckets: []float64 { 10, 30, 60, 120, 300, 600, 1800, 3600, 7200, 14400 },
+	} )
+
+	// Battery charge used by completed outages (as percentage)
+	metrics.OutageChargeUsedPercent = v1Factory.NewHistogram( prometheus.HistogramOpts {
+		Namespace: namespace,
+		Subsystem: "outage",
+		Name: "charge_used_percent",
+		Help: "The battery charge used by completed outages seen by the exporter, as a percentage.",
+		Buckets: []float64 { 1, 2, 5, 10, 20, 30, 50, 75, 100 },
+	} )
+
+	// Lowest battery charge reached during the latest outage (as percentage)
+	metrics.OutageDeepestChargePercent = v1Factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "outage",
+		Name: "deepest_charge_percent",
+		Help: "The lowest battery charge reached during the latest outage, as a percentage.",
+	} )
+
+	// Whether an outage is in progress (as boolean)
+	metrics.OutageInProgress = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "outage",
+		Name: "in_progress",
+		Help: "Whether an outage is currently in progress, including while waiting for mains power to settle.",
+	} )
+
+	// Create the metrics that are only in the version 2 schema
+	metrics.MetricsV2 = newMetricsV2( v2Factory, namespace )
+
+	return metrics
+}
 
 // Sets all of the metrics to zero
-func ResetMetrics() {
+func ( metrics *Metrics ) Reset() {
 
 	// Status
-	metricStatus.Set( 0 )
-	metricTemperature.Set( 0 )
+	metrics.Status.Set( 0 )
+	metrics.Temperature.Set( 0 )
 
 	// Power
-	metricPowerInputExpectVoltage.Set( 0 )
-	metricPowerOutputWattage.Set( 0 )
-	metricPowerLineVoltage.Set( 0 )
-	metricPowerMaximumLineVoltage.Set( 0 )
-	metricPowerMinimumLineVoltage.Set( 0 )
-	metricPowerLineFrequency.Set( 0 )
-	metricPowerOutputVoltage.Set( 0 )
-	metricPowerLoadPercent.Set( 0 )
+	metrics.PowerInputExpectVoltage.Set( 0 )
+	metrics.PowerOutputWattage.Set( 0 )
+	metrics.PowerLineVoltage.Set( 0 )
+	metrics.PowerMaximumLineVoltage.Set( 0 )
+	metrics.PowerMinimumLineVoltage.Set( 0 )
+	metrics.PowerLineFrequency.Set( 0 )
+	metrics.PowerOutputVoltage.Set( 0 )
+	metrics.PowerLoadPercent.Set( 0 )
+	metrics.PowerLoadWatts.Set( 0 )
+	metrics.PowerLoadVoltAmps.Set( 0 )
 
 	// Battery
-	metricBatteryExpectVoltage.Set( 0 )
-	metricBatteryActualVoltage.Set( 0 )
-	metricBatteryTimeSpentLatestSeconds.Set( 0 )
-	metricBatteryTimeSpentTotalSeconds.Set( 0 )
-	metricBatteryRemainingChargePercent.Set( 0 )
-	metricBatteryRemainingTimeMinutes.Set( 0 )
-	metricBatteryLowThreshold.Set( 0 )
-	metricBatteryCount.Set( 0 )
+	metrics.BatteryExpectVoltage.Set( 0 )
+	metrics.BatteryActualVoltage.Set( 0 )
+	metrics.BatteryTimeSpentLatestSeconds.Set( 0 )
+	metrics.BatteryTimeSpentTotalSeconds.Set( 0 )
+	metrics.BatteryRemainingChargePercent.Set( 0 )
+	metrics.BatteryRemainingTimeMinutes.Set( 0 )
+	metrics.BatteryLowThreshold.Set( 0 )
+	metrics.BatteryCount.Set( 0 )
 
 	// Daemon
-	metricDaemonRemainingChargePercent.Set( 0 )
-	metricDaemonRemainingTimeMinutes.Set( 0 )
-	metricDaemonTimeoutMinutes.Set( 0 )
-	metricDaemonTransferCount.Set( 0 )
-	metricDaemonStartTimestamp.Set( 0 )
+	metrics.DaemonRemainingChargePercent.Set( 0 )
+	metrics.DaemonRemainingTimeMinutes.Set( 0 )
+	metrics.DaemonTimeoutMinutes.Set( 0 )
+	metrics.DaemonTransferCount.Set( 0 )
+	metrics.DaemonStartTimestamp.Set( 0 )
+
+	// Outage
+	metrics.OutageDeepestChargePercent.Set( 0 )
+	metrics.OutageInProgress.Set( 0 )
+
+	// Version 2 schema
+	metrics.MetricsV2.Reset()
 
 }
 
-// Serves the metrics page over HTTP
-func ServeMetrics( address net.IP, port int, path string ) ( err error ) {
+// Sets the load in volt-amps, registering the metric the first time
+func ( metrics *Metrics ) SetPowerLoadVoltAmps( voltAmps float64 ) {
+	metrics.powerLoadVoltAmpsRegister.Do( func() { metrics.registerer.MustRegister( metrics.PowerLoadVoltAmps ) } )
+	metrics.PowerLoadVoltAmps.Set( voltAmps )
+}
 
-	// Handle requests to the metrics path using the Prometheus HTTP handler
-	http.Handle( path, promhttp.Handler() )
+// Gathers metrics, only keeping those with names that match the include pattern & do not match the exclude pattern
+type FilteredGatherer struct {
+	Gatherer prometheus.Gatherer
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+}
+
+// Gathers the metrics & removes any that are filtered out
+func ( filter FilteredGatherer ) Gather() ( families []*dto.MetricFamily, err error ) {
+
+	// Gather all the metrics, keeping any partial result if there was an error
+	allFamilies, gatherError := filter.Gatherer.Gather()
+
+	// Only keep the metrics that pass the filters
+	for _, family := range allFamilies {
+		if ( filter.Include != nil && !filter.Include.MatchString( family.GetName() ) ) { continue }
+		if ( filter.Exclude != nil && filter.Exclude.MatchString( family.GetName() ) ) { continue }
+
+		families = append( families, family )
+	}
+
+	return families, gatherError
+
+}
+
+// Gathers metrics, stamping each sample with the time the daemon last got data from the UPS instead of the scrape time
+type TimestampedGatherer struct {
+	Gatherer prometheus.Gatherer
+
+	// When the daemon last got data from the UPS (as unix milliseconds), or zero if unknown
+	Timestamp *atomic.Int64
+}
+
+// Gathers the metrics & adds the timestamp to them, if it is known
+func ( stamper TimestampedGatherer ) Gather() ( families []*dto.MetricFamily, err error ) {
+
+	// Gather all the metrics, keeping any partial result if there was an error
+	families, gatherError := stamper.Gatherer.Gather()
+
+	// Do not add the timestamp if we have not fetched a status yet
+	timestamp := stamper.Timestamp.Load()
+	if ( timestamp == 0 ) { return families, gatherError }
 
-	// Listen for HTTP requests
-	listenError := http.ListenAndServe( fmt.Sprintf( "%s:%d" , address, port ), nil )
-	if listenError != nil { return listenError }
+	// Add the timestamp to every sample
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			metric.TimestampMs = &timestamp
+		}
+	}
+
+	return families, gatherError
+
+}
+
+// Compiles a metric name filter, anchored to match the entire name like Prometheus relabelling does
+func CompileMetricFilter( pattern string ) ( expression *regexp.Regexp, err error ) {
+	if ( pattern == "" ) { return nil, nil }
+	return regexp.Compile( "^(?:" + pattern + ")$" )
+}
+
+// Opens the sockets to serve the metrics page on, which are those passed in by systemd if there are any, or the address & port with the Unix domain socket if there is one
+func ListenForMetrics( address net.IP, port int, socketPath string ) ( listeners []net.Listener, err error ) {
+	systemdListeners, systemdError := getSystemdListeners()
+	if systemdError != nil { return nil, systemdError }
+	if ( len( systemdListeners ) > 0 ) { return systemdListeners, nil }
+
+	listener, listenError := net.Listen( "tcp", fmt.Sprintf( "%s:%d" , address, port ) )
+	if listenError != nil { return nil, listenError }
+	listeners = append( listeners, listener )
+
+	if ( socketPath != "" ) {
+
+		// Remove the socket left behind if we were not shutdown gracefully, but never anything else
+		if info, statError := os.Lstat( socketPath ); ( statError == nil && info.Mode().Type() == os.ModeSocket ) { os.Remove( socketPath ) }
+
+		socketListener, socketError := net.Listen( "unix", socketPath ) // Removed again when closed
+		if socketError != nil {
+			listener.Close()
+			return nil, socketError
+		}
+		listeners = append( listeners, socketListener )
+
+		// Allow the group to connect too (e.g., a reverse proxy)
+		if chmodError := os.Chmod( socketPath, 0660 ); chmodError != nil { slog.Warn( "Failed to change the permissions of the Unix domain socket", "path", socketPath, "error", chmodError ) }
+	}
+
+	return listeners, nil
+}
+
+// Serves the metrics page over HTTP on all the sockets, or HTTPS & with authentication if there is a web configuration file, until the context is cancelled
+func ServeMetrics( ctx context.Context, listeners []net.Listener, path string, gatherer prometheus.Gatherer, webConfig *WebConfigServer ) ( err error ) {
+
+	// Handle requests to the metrics path using the Prometheus HTTP handler
+	http.Handle( path, promhttp.InstrumentMetricHandler( prometheus.DefaultRegisterer, promhttp.HandlerFor( gatherer, promhttp.HandlerOpts {
+		EnableOpenMetrics: true,
+	} ) ) )
+
+	// Serve over TLS & with authentication if configured
+	var handler http.Handler = http.DefaultServeMux
+	if ( webConfig != nil ) {
+		if webConfig.IsTLS() {
+			for index, listener := range listeners { listeners[ index ] = tls.NewListener( listener, webConfig.TLSConfig() ) }
+		}
+		handler = webConfig.Handler( handler )
+	}
+
+	// Requests use the context, so long-lived ones like the live stream end when it is cancelled
+	server := &http.Server {
+		Handler: handler,
+		ReadHeaderTimeout: 30 * time.Second,
+		BaseContext: func( net.Listener ) context.Context { return ctx },
+	}
+
+	serveErrors := make( chan error, len( listeners ) )
+	for _, listener := range listeners {
+		go func() { serveErrors <- server.Serve( listener ) }()
+	}
+
+	select {
+		case serveError := <-serveErrors: return serveError
+		case <-ctx.Done():
+	}
+
+	// Stop accepting requests & wait for those in progress to finish
+	shutdownContext, cancelShutdown := context.WithTimeout( context.Background(), METRICS_SHUTDOWN_TIMEOUT )
+	defer cancelShutdown()
+	shutdownError := server.Shutdown( shutdownContext )
+	if shutdownError != nil { return shutdownError }
 
 	// No error, all was good
 	return nil
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// A counter that is set to a running total reported by the daemon, rather than incremented by us
+// The daemon starts its totals again from zero when it restarts, so they are added on to the totals from before, as a counter must never go down
+type SettableCounter struct {
+	prometheus.CounterFunc
+
+	mutex sync.Mutex
+	total daemonTotal
+}
+
+// A total from the daemon that never goes down, as the daemon starts counting from zero again whenever it restarts
+type daemonTotal struct {
+
+	// The latest total from the daemon, and the sum of its totals from before it last restarted
+	latest float64
+	offset float64
+}
+
+// Sets the latest total from the daemon, carrying on from the previous total if it has gone down (as the daemon restarted)
+// Unknown (negative) totals are ignored
+func ( total *daemonTotal ) Set( value float64 ) {
+	if ( value < 0 ) { return }
+
+	if ( value < total.latest ) { total.offset += total.latest }
+	total.latest = value
+}
+
+// Gets the total, including those from before the daemon restarted
+func ( total *daemonTotal ) Value() float64 {
+	return total.offset + total.latest
+}
+
+// Creates a counter that can be set
+func newSettableCounter( factory promauto.Factory, opts prometheus.CounterOpts ) *SettableCounter {
+	counter := &SettableCounter {}
+	counter.CounterFunc = factory.NewCounterFunc( opts, func() float64 {
+		counter.mutex.Lock()
+		defer counter.mutex.Unlock()
+
+		return counter.total.Value()
+	} )
+	return counter
+}
+
+// Sets the counter to the latest total from the daemon, carrying on from the previous total if it has gone down (as the daemon restarted)
+func ( counter *SettableCounter ) Set( value float64 ) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	counter.total.Set( value )
+}
+
+// Sets the counter back to zero, forgetting any previous totals
+func ( counter *SettableCounter ) Reset() {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	counter.total = daemonTotal {}
+}
+
+// The metrics that are only in the version 2 schema, which uses base units (seconds, volts, ratios, etc.)
+// NOTE: Metrics that are already in base units are shared with the version 1 schema, so they are not repeated here
+type MetricsV2 struct {
+	V2PowerInputNominalVolts prometheus.Gauge
+	V2PowerOutputNominalWatts prometheus.Gauge
+	V2PowerLineVolts prometheus.Gauge
+	V2PowerLineMaximumVolts prometheus.Gauge
+	V2PowerLineMinimumVolts prometheus.Gauge
+	V2PowerOutputVolts prometheus.Gauge
+	V2PowerLoadRatio prometheus.Gauge
+
+	V2BatteryNominalVolts prometheus.Gauge
+	V2BatteryVolts prometheus.Gauge
+	V2BatteryTimeSpentSecondsTotal *SettableCounter
+	V2BatteryChargeRatio prometheus.Gauge
+	V2BatteryRuntimeRemainingSeconds prometheus.Gauge
+	V2BatteryLowThresholdSeconds prometheus.Gauge
+	V2BatteryExternalPacks prometheus.Gauge
+
+	V2DaemonShutdownChargeRatio prometheus.Gauge
+	V2DaemonShutdownRuntimeSeconds prometheus.Gauge
+	V2DaemonShutdownTimeoutSeconds prometheus.Gauge
+	V2DaemonTransfersTotal *SettableCounter
+	V2DaemonStartTimestampSeconds prometheus.Gauge
+
+	V2EnergyConsumedJoulesTotal prometheus.Counter
+
+	V2OutageChargeUsedRatio prometheus.Histogram
+	V2OutageDeepestChargeRatio prometheus.Gauge
+}
+
+// Creates the metrics that are only in the version 2 schema
+func newMetricsV2( factory promauto.Factory, namespace string ) ( metrics MetricsV2 ) {
+
+	// Nominal input voltage (as volts) - NOMINV
+	metrics.V2PowerInputNominalVolts = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "power",
+		Name: "input_nominal_volts",
+		Help: "The input voltage that the UPS is configured to expect.",
+	} )
+
+	// Nominal power output (as watts) - NOMPOWER
+	metrics.V2PowerOutputNominalWatts = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "power",
+		Name: "output_nominal_watts",
+		Help: "The maximum power the UPS is designed to output.",
+	} )
+
+	// Current line voltage (as volts) - LINEV
+	metrics.V2PowerLineVolts = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "power",
+		Name: "line_volts",
+		Help: "The current line voltage as returned by the UPS.",
+	} )
+
+	// Maximum line voltage (as volts) - MAXLINEV - SmartUPS X 3000
+	metrics.V2PowerLineMaximumVolts = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "power",
+		Name: "line_maximum_volts",
+		Help: "The maximum line voltage since the last status, as returned by the UPS.",
+	} )
+
+	// Minimum line voltage (as volts) - MINLINEV - SmartUPS X 3000
+	metrics.V2PowerLineMinimumVolts = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "power",
+		Name: "line_minimum_volts",
+		Help: "The minimum line voltage since the last status, as returned by the UPS.",
+	} )
+
+	// Current output voltage (as volts) - OUTPUTV - SmartUPS X 3000
+	metrics.V2PowerOutputVolts = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "power",
+		Name: "output_volts",
+		Help: "The current output voltage as returned by the UPS.",
+	} )
+
+	// Current load capacity (as ratio) - LOADPCT
+	metrics.V2PowerLoadRatio = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "power",
+		Name: "load_ratio",
+		Help: "The current load capacity as estimated by the UPS, from 0 to 1.",
+	} )
+
+	/*************************************/
+
+	// Nominal battery voltage (as volts) - NOMBATTV
+	metrics.V2BatteryNominalVolts = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "battery",
+		Name: "nominal_volts",
+		Help: "The expected output voltage of the battery.",
+	} )
+
+	// Actual battery voltage (as volts) - BATTV
+	metrics.V2BatteryVolts = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "battery",
+		Name: "volts",
+		Help: "The actual output voltage of the battery.",
+	} )
+
+	// Total time spent on battery since the daemon started (in seconds) - CUMONBATT
+	metrics.V2BatteryTimeSpentSecondsTotal = newSettableCounter( factory, prometheus.CounterOpts {
+		Namespace: namespace,
+		Subsystem: "battery",
+		Name: "time_spent_seconds_total",
+		Help: "The total time spent on battery since the daemon started.",
+	} )
+
+	// Remaining charge of the battery (as ratio) - BCHARGE
+	metrics.V2BatteryChargeRatio = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "battery",
+		Name: "charge_ratio",
+		Help: "The remaining charge on the battery, from 0 to 1.",
+	} )
+
+	// Remaining runtime of the battery (in seconds) - TIMELEFT
+	metrics.V2BatteryRuntimeRemainingSeconds = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "battery",
+		Name: "runtime_remaining_seconds",
+		Help: "The remaining runtime left on the battery as estimated by the UPS.",
+	} )
+
+	// Low battery threshold (in seconds) - DLOWBATT - SmartUPS X 3000
+	metrics.V2BatteryLowThresholdSeconds = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "battery",
+		Name: "low_threshold_seconds",
+		Help: "The remaining runtime below which the UPS sends the low battery signal.",
+	} )
+
+	// Number of external battery packs - EXTBATTS - SmartUPS X 3000
+	metrics.V2BatteryExternalPacks = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "battery",
+		Name: "external_packs",
+		Help: "The number of external battery packs in the UPS.",
+	} )
+
+	/*************************************/
+
+	// Configured minimum battery charge (as ratio) - MBATTCHG
+	metrics.V2DaemonShutdownChargeRatio = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "daemon",
+		Name: "shutdown_charge_ratio",
+		Help: "The configured minimum remaining charge on the battery to trigger a system shutdown, from 0 to 1.",
+	} )
+
+	// Configured minimum battery remaining runtime (in seconds) - MINTIMEL
+	metrics.V2DaemonShutdownRuntimeSeconds = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "daemon",
+		Name: "shutdown_runtime_seconds",
+		Help: "The configured minimum remaining runtime left on the battery to trigger a system shutdown.",
+	} )
+
+	// Configured maximum timeout (in seconds) - MAXTIME
+	metrics.V2DaemonShutdownTimeoutSeconds = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "daemon",
+		Name: "shutdown_timeout_seconds",
+		Help: "The configured maximum time running on the battery to trigger a system shutdown, or 0 if disabled.",
+	} )
+
+	// Number of transfers to battery since the daemon started - NUMXFERS
+	metrics.V2DaemonTransfersTotal = newSettableCounter( factory, prometheus.CounterOpts {
+		Namespace: namespace,
+		Subsystem: "daemon",
+		Name: "transfers_total",
+		Help: "The number of transfers to the battery since the daemon started.",
+	} )
+
+	// Daemon startup time (as unix timestamp) - STARTTIME
+	metrics.V2DaemonStartTimestampSeconds = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "daemon",
+		Name: "start_timestamp_seconds",
+		Help: "The date & time the daemon was started.",
+	} )
+
+	/*************************************/
+
+	// Energy consumed by the load (in joules) - LOADPCT & NOMPOWER
+	metrics.V2EnergyConsumedJoulesTotal = factory.NewCounter( prometheus.CounterOpts {
+		Namespace: namespace,
+		Subsystem: "energy",
+		Name: "consumed_joules_total",
+		Help: "The energy consumed by the load, integrated by the exporter from the load in watts between each collection.",
+	} )
+
+	/*************************************/
+
+	// Battery charge used by completed outages (as ratio)
+	metrics.V2OutageChargeUsedRatio = factory.NewHistogram( prometheus.HistogramOpts {
+		Namespace: namespace,
+		Subsystem: "outage",
+		Name: "charge_used_ratio",
+		Help: "The battery charge used by completed outages seen by the exporter, from 0 to 1.",
+		Buckets: []float64 { 0.01, 0.02, 0.05, 0.1, 0.2, 0.3, 0.5, 0.75, 1 },
+	} )
+
+	// Lowest battery charge reached during the latest outage (as ratio)
+	metrics.V2OutageDeepestChargeRatio = factory.NewGauge( prometheus.GaugeOpts {
+		Namespace: namespace,
+		Subsystem: "outage",
+		Name: "deepest_charge_ratio",
+		Help: "The lowest battery charge reached during the latest outage, from 0 to 1.",
+	} )
+
+	return metrics
+}
+
+// Sets all of the version 2 schema metrics to zero
+func ( metrics *MetricsV2 ) Reset() {
+
+	// Power
+	metrics.V2PowerInputNominalVolts.Set( 0 )
+	metrics.V2PowerOutputNominalWatts.Set( 0 )
+	metrics.V2PowerLineVolts.Set( 0 )
+	metrics.V2PowerLineMaximumVolts.Set( 0 )
+	metrics.V2PowerLineMinimumVolts.Set( 0 )
+	metrics.V2PowerOutputVolts.Set( 0 )
+	metrics.V2PowerLoadRatio.Set( 0 )
+
+	// Battery
+	metrics.V2BatteryNominalVolts.Set( 0 )
+	metrics.V2BatteryVolts.Set( 0 )
+	metrics.V2BatteryTimeSpentSecondsTotal.Reset()
+	metrics.V2BatteryChargeRatio.Set( 0 )
+	metrics.V2BatteryRuntimeRemainingSeconds.Set( 0 )
+	metrics.V2BatteryLowThresholdSeconds.Set( 0 )
+	metrics.V2BatteryExternalPacks.Set( 0 )
+
+	// Daemon
+	metrics.V2DaemonShutdownChargeRatio.Set( 0 )
+	metrics.V2DaemonShutdownRuntimeSeconds.Set( 0 )
+	metrics.V2DaemonShutdownTimeoutSeconds.Set( 0 )
+	metrics.V2DaemonTransfersTotal.Reset()
+	metrics.V2DaemonStartTimestampSeconds.Set( 0 )
+
+	// Outage
+	metrics.V2OutageDeepestChargeRatio.Set( 0 )
+
+}
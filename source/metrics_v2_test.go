@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSettableCounterCarriesOnAfterDaemonRestarts( t *testing.T ) {
+	counter := newSettableCounter( promauto.With( prometheus.NewRegistry() ), prometheus.CounterOpts { Name: "ups_daemon_transfers_total", Help: "Transfers." } )
+
+	for _, test := range []struct {
+		value float64
+		expected float64
+	} {
+		{ 3, 3 },
+		{ 5, 5 },
+		{ -1, 5 }, // Unknown
+		{ 0, 5 }, // The daemon restarted
+		{ 2, 7 },
+		{ 2, 7 },
+		{ 1, 8 }, // Restarted again
+	} {
+		counter.Set( test.value )
+		if value := testutil.ToFloat64( counter ); ( value != test.expected ) { t.Errorf( "after setting %v, expected %v, got %v", test.value, test.expected, value ) }
+	}
+
+	counter.Reset()
+	if value := testutil.ToFloat64( counter ); ( value != 0 ) { t.Errorf( "expected 0 after resetting, got %v", value ) }
+}
+
+func TestParseMaximumTimeoutInSeconds( t *testing.T ) {
+	status, err := ParseStatusText( "MAXTIME  : 600 Seconds\n" )
+	if err != nil { t.Fatal( err ) }
+	if ( status.Daemon.Configuration.MaximumTimeoutSeconds != 600 ) { t.Errorf( "expected 600 seconds, got %v", status.Daemon.Configuration.MaximumTimeoutSeconds ) }
+}
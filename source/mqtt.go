@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// How Home Assistant should show a field - home-assistant.io/integrations/sensor.mqtt/
+type homeAssistantSensor struct {
+	Name string
+	DeviceClass string
+	Unit string
+	StateClass string
+	Icon string
+}
+
+// The fields that are announced to Home Assistant, with their device classes & units
+var homeAssistantSensors = map[ string ]homeAssistantSensor {
+	"status": { Name: "Status", Icon: "mdi:power-plug" },
+	"load_percent": { Name: "Load", Unit: "%", StateClass: "measurement", Icon: "mdi:gauge" },
+	"load_watts": { Name: "Load power", DeviceClass: "power", Unit: "W", StateClass: "measurement" },
+	"line_voltage": { Name: "Input voltage", DeviceClass: "voltage", Unit: "V", StateClass: "measurement" },
+	"output_voltage": { Name: "Output voltage", DeviceClass: "voltage", Unit: "V", StateClass: "measurement" },
+	"line_frequency_hertz": { Name: "Input frequency", DeviceClass: "frequency", Unit: "Hz", StateClass: "measurement" },
+	"temperature_celsius": { Name: "Internal temperature", DeviceClass: "temperature", Unit: "°C", StateClass: "measurement" },
+	"battery_charge_percent": { Name: "Battery", DeviceClass: "battery", Unit: "%", StateClass: "measurement" },
+	"battery_remaining_runtime_minutes": { Name: "Battery runtime", DeviceClass: "duration", Unit: "min", StateClass: "measurement" },
+	"battery_voltage": { Name: "Battery voltage", DeviceClass: "voltage", Unit: "V", StateClass: "measurement" },
+	"time_on_battery_seconds": { Name: "Time on battery", DeviceClass: "duration", Unit: "s", StateClass: "measurement" },
+	"transfer_count": { Name: "Transfers to battery", StateClass: "total_increasing", Icon: "mdi:transfer" },
+	"last_transfer_reason": { Name: "Last transfer reason", Icon: "mdi:information-outline" },
+	"battery_replaced_date": { Name: "Battery replaced", DeviceClass: "date" },
+}
+
+// Characters that are not allowed in a single level of a topic, or in a discovery object ID
+var mqttTopicLevelSanitiser = strings.NewReplacer( "/", "_", "+", "_", "#", "_", " ", "_" )
+
+// Publishes each field of the status to an MQTT broker, and announces them to Home Assistant
+type MQTTOutput struct {
+	client mqtt.Client
+
+	// The first level of every topic (e.g., 'apcups'), and the prefix for Home Assistant discovery (empty to disable)
+	BaseTopic string
+	DiscoveryPrefix string
+
+	// The UPSs that have been announced to Home Assistant on this connection, and whether their battery replacement date was known
+	announcedMutex sync.Mutex
+	announced map[ string ]bool
+}
+
+// Creates an output for an MQTT broker & connects to it in the background
+// The exporter's availability is published to '<base topic>/availability', with a Last Will so it becomes 'offline' if we disappear
+func NewMQTTOutput( brokerURL string, baseTopic string, clientID string, username string, password string, discoveryPrefix string ) *MQTTOutput {
+	output := &MQTTOutput {
+		BaseTopic: baseTopic,
+		DiscoveryPrefix: discoveryPrefix,
+		announced: map[ string ]bool {},
+	}
+
+	// Setup the client to reconnect forever, & say we are online whenever it connects
+	availabilityTopic := output.availabilityTopic()
+	options := mqtt.NewClientOptions().
+		AddBroker( brokerURL ).
+		SetClientID( clientID ).
+		SetUsername( username ).
+		SetPassword( password ).
+		SetWill( availabilityTopic, "offline", 1, true ).
+		SetAutoReconnect( true ).
+		SetConnectRetry( true ).
+		SetConnectTimeout( 10 * time.Second ).
+		SetOnConnectHandler( func( client mqtt.Client ) {
+			client.Publish( availabilityTopic, 1, true, "online" )
+
+			// The broker may have lost retained discovery messages, so announce everything again
+			output.announcedMutex.Lock()
+			output.announced = map[ string ]bool {}
+			output.announcedMutex.Unlock()
+		} ).
+		SetConnectionLostHandler( func( client mqtt.Client, connectionError error ) {
+			slog.Warn( "Lost connection to the MQTT broker", "error", connectionError )
+		} )
+
+	// Give the first connection a moment to succeed, after which it keeps retrying in the background
+	output.client = mqtt.NewClient( options )
+	output.client.Connect().WaitTimeout( 5 * time.Second )
+
+	return output
+}
+
+// Gets a short name for display purposes
+func ( output *MQTTOutput ) Name() string {
+	return "MQTT"
+}
+
+// Publishes every field as a retained message under '<base topic>/<UPS name>/<field>'
+func ( output *MQTTOutput ) Publish( status Status ) error {
+
+	// Do not queue up messages while the broker is unreachable, the next collection will have fresher values
+	if !output.client.IsConnectionOpen() { return fmt.Errorf( "not connected to the MQTT broker" ) }
+
+	// Announce this UPS to Home Assistant, if we have not already or the battery replacement date has become known (or unknown)
+	upsName := getMQTTDeviceName( status )
+	if ( output.DiscoveryPrefix != "" ) {
+		hasReplacedDate := !status.UPS.Battery.LastReplacementDate.IsZero()
+
+		output.announcedMutex.Lock()
+		hadReplacedDate, isAnnounced := output.announced[ upsName ]
+		output.announcedMutex.Unlock()
+
+		if ( !isAnnounced || hadReplacedDate != hasReplacedDate ) {
+			announceError := output.announce( upsName, status )
+			if announceError != nil { return announceError }
+
+			output.announcedMutex.Lock()
+			output.announced[ upsName ] = hasReplacedDate
+			output.announcedMutex.Unlock()
+		}
+	}
+
+	// Collect all the values to publish, including the derived load in watts
+	values := map[ string ]string {}
+	for _, field := range status.NumericFields() { values[ field.Name ] = strconv.FormatFloat( field.Value, 'f', -1, 64 ) }
+	for _, field := range status.TextFields() { values[ field.Name ] = field.Value }
+	if loadWatts, ok := calculateLoadWatts( status ); ok { values[ "load_watts" ] = strconv.FormatFloat( loadWatts, 'f', 1, 64 ) }
+
+	// Leave out the battery replacement date if it is unknown, as Home Assistant rejects anything that is not a date
+	if ( values[ "battery_replaced_date" ] == "" ) { delete( values, "battery_replaced_date" ) }
+
+	// Publish them all, then wait for the broker to acknowledge them
+	tokens := make( []mqtt.Token, 0, len( values ) )
+	for name, value := range values {
+		tokens = append( tokens, output.client.Publish( fmt.Sprintf( "%s/%s/%s", output.BaseTopic, upsName, name ), 1, true, value ) )
+	}
+
+	return waitForMQTTTokens( tokens )
+
+}
+
+// Says we are offline & disconnects from the broker
+func ( output *MQTTOutput ) Close() error {
+	token := output.client.Publish( output.availabilityTopic(), 1, true, "offline" )
+	token.WaitTimeout( 5 * time.Second )
+
+	output.client.Disconnect( 1000 )
+
+	return token.Error()
+}
+
+// Gets the topic for the availability of the exporter
+func ( output *MQTTOutput ) availabilityTopic() string {
+	return output.BaseTopic + "/availability"
+}
+
+// Publishes Home Assistant discovery configurations for the fields of a UPS - home-assistant.io/integrations/mqtt/#mqtt-discovery
+func ( output *MQTTOutput ) announce( upsName string, status Status ) error {
+
+	// Group the sensors under one device, identified by serial number if possible
+	deviceID := mqttTopicLevelSanitiser.Replace( status.UPS.SerialNumber )
+	if ( deviceID == "" ) { deviceID = upsName }
+	device := map[ string ]any {
+		"identifiers": []string { "apcups_" + deviceID },
+		"name": upsName,
+		"manufacturer": "APC",
+		"model": status.UPS.ModelName,
+		"sw_version": status.UPS.FirmwareRevision,
+		"serial_number": status.UPS.SerialNumber,
+	}
+
+	tokens := make( []mqtt.Token, 0, len( homeAssistantSensors ) )
+	for field, sensor := range homeAssistantSensors {
+		discoveryTopic := fmt.Sprintf( "%s/sensor/apcups_%s/%s/config", output.DiscoveryPrefix, deviceID, field )
+
+		// Remove the battery replacement date if it is unknown, in case it was announced while the date was known
+		if ( field == "battery_replaced_date" && status.UPS.Battery.LastReplacementDate.IsZero() ) {
+			tokens = append( tokens, output.client.Publish( discoveryTopic, 1, true, "" ) )
+			continue
+		}
+
+		// Build the configuration, leaving out anything that is not relevant to this sensor
+		config := map[ string ]any {
+			"name": sensor.Name,
+			"unique_id": fmt.Sprintf( "apcups_%s_%s", deviceID, field ),
+			"object_id": fmt.Sprintf( "%s_%s", upsName, field ),
+			"state_topic": fmt.Sprintf( "%s/%s/%s", output.BaseTopic, upsName, field ),
+			"availability_topic": output.availabilityTopic(),
+			"device": device,
+		}
+		if ( sensor.DeviceClass != "" ) { config[ "device_class" ] = sensor.DeviceClass }
+		if ( sensor.Unit != "" ) { config[ "unit_of_measurement" ] = sensor.Unit }
+		if ( sensor.StateClass != "" ) { config[ "state_class" ] = sensor.StateClass }
+		if ( sensor.Icon != "" ) { config[ "icon" ] = sensor.Icon }
+
+		payload, encodeError := json.Marshal( config )
+		if encodeError != nil { return encodeError }
+
+		tokens = append( tokens, output.client.Publish( discoveryTopic, 1, true, payload ) )
+
+	}
+
+	return waitForMQTTTokens( tokens )
+
+}
+
+// Gets the name of the UPS for use in topics, with anything that has a meaning in topics replaced
+func getMQTTDeviceName( status Status ) string {
+	return mqttTopicLevelSanitiser.Replace( getUPSName( status ) )
+}
+
+// Waits for the broker to acknowledge messages, giving the first error if any failed
+func waitForMQTTTokens( tokens []mqtt.Token ) error {
+	for _, token := range tokens {
+		if !token.WaitTimeout( 10 * time.Second ) { return fmt.Errorf( "timed out waiting for the MQTT broker" ) }
+		if token.Error() != nil { return token.Error() }
+	}
+
+	return nil
+}
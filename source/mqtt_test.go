@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	broker "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// Starts an MQTT broker in this process, giving its address
+func startTestMQTTBroker( t *testing.T ) string {
+	t.Helper()
+
+	server := broker.New( &broker.Options { Logger: slog.New( slog.NewTextHandler( io.Discard, nil ) ) } )
+	if hookError := server.AddHook( new( auth.AllowHook ), nil ); hookError != nil { t.Fatal( hookError ) }
+
+	listener := listeners.NewTCP( listeners.Config { ID: "test", Address: "127.0.0.1:0" } )
+	if listenerError := server.AddListener( listener ); listenerError != nil { t.Fatal( listenerError ) }
+	if serveError := server.Serve(); serveError != nil { t.Fatal( serveError ) }
+	t.Cleanup( func() { server.Close() } )
+
+	return listener.Address()
+}
+
+// Subscribes to topics on the broker, giving the latest retained messages it sends for each topic
+func subscribeToTestMQTTBroker( t *testing.T, address string, filter string, wait time.Duration ) map[ string ]string {
+	t.Helper()
+
+	var mutex sync.Mutex
+	messages := map[ string ]string {}
+	client := mqtt.NewClient( mqtt.NewClientOptions().AddBroker( "tcp://" + address ).SetClientID( "test-subscriber" ) )
+	if token := client.Connect(); ( !token.WaitTimeout( 5 * time.Second ) || token.Error() != nil ) { t.Fatalf( "failed to connect: %v", token.Error() ) }
+	defer client.Disconnect( 100 )
+
+	token := client.Subscribe( filter, 1, func( client mqtt.Client, message mqtt.Message ) {
+		if !message.Retained() { return }
+
+		mutex.Lock()
+		messages[ message.Topic() ] = string( message.Payload() )
+		mutex.Unlock()
+	} )
+	if ( !token.WaitTimeout( 5 * time.Second ) || token.Error() != nil ) { t.Fatalf( "failed to subscribe: %v", token.Error() ) }
+	time.Sleep( wait )
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return messages
+}
+
+// Gets a status for a named target
+func newTestMQTTStatus() Status {
+	status := Status { Target: "rack1" }
+	status.UPS.Name = "ups1"
+	status.UPS.SerialNumber = "3B1234X56789"
+	status.UPS.ModelName = "Back-UPS XS 850G2"
+	status.UPS.StatusText = "ONLINE"
+	status.UPS.LoadPercent = 25
+	status.UPS.LineVoltage = 238
+	status.UPS.Battery.ChargePercent = 100
+	status.UPS.Expect.PowerOutputWattage = 510
+
+	return status
+}
+
+func TestMQTTPublishesRetainedFields( t *testing.T ) {
+	address := startTestMQTTBroker( t )
+
+	output := NewMQTTOutput( "tcp://" + address, "apcups", "test-exporter", "", "", "" )
+	defer output.Close()
+	if publishError := output.Publish( newTestMQTTStatus() ); publishError != nil { t.Fatal( publishError ) }
+
+	messages := subscribeToTestMQTTBroker( t, address, "apcups/#", 500 * time.Millisecond )
+	for topic, expected := range map[ string ]string {
+		"apcups/availability": "online",
+		"apcups/rack1/load_percent": "25",
+		"apcups/rack1/line_voltage": "238",
+		"apcups/rack1/battery_charge_percent": "100",
+		"apcups/rack1/load_watts": "127.5",
+		"apcups/rack1/status": "ONLINE",
+	} {
+		if ( messages[ topic ] != expected ) { t.Errorf( "expected %q to be retained as %q, got %q", topic, expected, messages[ topic ] ) }
+	}
+}
+
+func TestMQTTAnnouncesToHomeAssistant( t *testing.T ) {
+	address := startTestMQTTBroker( t )
+
+	output := NewMQTTOutput( "tcp://" + address, "apcups", "test-exporter", "", "", "homeassistant" )
+	defer output.Close()
+	if publishError := output.Publish( newTestMQTTStatus() ); publishError != nil { t.Fatal( publishError ) }
+
+	messages := subscribeToTestMQTTBroker( t, address, "homeassistant/#", 500 * time.Millisecond )
+	if ( len( messages ) != len( homeAssistantSensors ) - 1 ) { t.Errorf( "expected %d sensors without the unknown battery replacement date, got %d", len( homeAssistantSensors ) - 1, len( messages ) ) }
+
+	for field, expected := range map[ string ]map[ string ]string {
+		"load_watts": { "device_class": "power", "unit_of_measurement": "W", "state_topic": "apcups/rack1/load_watts" },
+		"battery_charge_percent": { "device_class": "battery", "unit_of_measurement": "%", "state_class": "measurement" },
+		"temperature_celsius": { "device_class": "temperature", "unit_of_measurement": "°C" },
+	} {
+		var config map[ string ]any
+		payload := messages[ "homeassistant/sensor/apcups_3B1234X56789/" + field + "/config" ]
+		if decodeError := json.Unmarshal( []byte( payload ), &config ); decodeError != nil { t.Errorf( "invalid configuration for %s: %q", field, payload ); continue }
+
+		for key, value := range expected {
+			if ( config[ key ] != value ) { t.Errorf( "expected %s of %s to be %q, got %v", key, field, value, config[ key ] ) }
+		}
+		if ( config[ "availability_topic" ] != "apcups/availability" ) { t.Errorf( "unexpected availability topic for %s: %v", field, config[ "availability_topic" ] ) }
+	}
+}
+
+func TestMQTTBatteryReplacedDateOnlyWhenKnown( t *testing.T ) {
+	address := startTestMQTTBroker( t )
+
+	output := NewMQTTOutput( "tcp://" + address, "apcups", "test-exporter", "", "", "homeassistant" )
+	defer output.Close()
+	configTopic, stateTopic := "homeassistant/sensor/apcups_3B1234X56789/battery_replaced_date/config", "apcups/rack1/battery_replaced_date"
+
+	// Unknown, so neither announced nor published
+	if publishError := output.Publish( newTestMQTTStatus() ); publishError != nil { t.Fatal( publishError ) }
+	messages := subscribeToTestMQTTBroker( t, address, "#", 500 * time.Millisecond )
+	if _, isRetained := messages[ configTopic ]; isRetained { t.Errorf( "expected the unknown date not to be announced, got %q", messages[ configTopic ] ) }
+	if _, isRetained := messages[ stateTopic ]; isRetained { t.Errorf( "expected the unknown date not to be published, got %q", messages[ stateTopic ] ) }
+
+	// Announced once known
+	status := newTestMQTTStatus()
+	status.UPS.Battery.LastReplacementDate = time.Date( 2023, 5, 1, 0, 0, 0, 0, time.UTC )
+	if publishError := output.Publish( status ); publishError != nil { t.Fatal( publishError ) }
+	messages = subscribeToTestMQTTBroker( t, address, "#", 500 * time.Millisecond )
+	var config map[ string ]any
+	if decodeError := json.Unmarshal( []byte( messages[ configTopic ] ), &config ); ( decodeError != nil || config[ "device_class" ] != "date" ) { t.Errorf( "expected the date to be announced, got %q", messages[ configTopic ] ) }
+	if ( messages[ stateTopic ] != "2023-05-01" ) { t.Errorf( "expected the date to be published, got %q", messages[ stateTopic ] ) }
+
+	// And removed if it becomes unknown again
+	if publishError := output.Publish( newTestMQTTStatus() ); publishError != nil { t.Fatal( publishError ) }
+	messages = subscribeToTestMQTTBroker( t, address, "homeassistant/#", 500 * time.Millisecond )
+	if _, isRetained := messages[ configTopic ]; isRetained { t.Errorf( "expected the date to be removed, got %q", messages[ configTopic ] ) }
+}
+
+func TestMQTTLastWillOnUncleanDisconnect( t *testing.T ) {
+	address := startTestMQTTBroker( t )
+
+	// Connect through a proxy, so the connection can be cut without the client saying goodbye
+	proxy, proxyError := net.Listen( "tcp", "127.0.0.1:0" )
+	if proxyError != nil { t.Fatal( proxyError ) }
+	connections := make( chan net.Conn, 2 )
+	go func() {
+		clientConnection, acceptError := proxy.Accept()
+		if acceptError != nil { return }
+		brokerConnection, dialError := net.Dial( "tcp", address )
+		if dialError != nil { clientConnection.Close(); return }
+
+		connections <- clientConnection
+		connections <- brokerConnection
+		go io.Copy( brokerConnection, clientConnection )
+		io.Copy( clientConnection, brokerConnection )
+	}()
+
+	output := NewMQTTOutput( "tcp://" + proxy.Addr().String(), "apcups", "test-exporter", "", "", "" )
+	if publishError := output.Publish( newTestMQTTStatus() ); publishError != nil { t.Fatal( publishError ) }
+	if messages := subscribeToTestMQTTBroker( t, address, "apcups/availability", 200 * time.Millisecond ); ( messages[ "apcups/availability" ] != "online" ) { t.Fatalf( "expected to be online, got %q", messages[ "apcups/availability" ] ) }
+
+	// Cut the connection & stop any reconnection
+	proxy.Close()
+	( <-connections ).Close()
+	( <-connections ).Close()
+	defer output.client.Disconnect( 0 )
+
+	if messages := subscribeToTestMQTTBroker( t, address, "apcups/availability", 500 * time.Millisecond ); ( messages[ "apcups/availability" ] != "offline" ) { t.Errorf( "expected the last will to say offline, got %q", messages[ "apcups/availability" ] ) }
+}
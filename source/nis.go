@@ -3,27 +3,81 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"time"
 )
 
+// The steps of fetching the status, for saying which one failed
+const (
+	FETCH_STAGE_CONNECT = "connect"
+	FETCH_STAGE_SEND = "send"
+	FETCH_STAGE_RECEIVE = "receive"
+	FETCH_STAGE_PARSE = "parse"
+)
+
+// How long a whole fetch from the Network Information Server can take, from connecting to receiving the last line, so one that stops responding cannot hold up collection
+const NIS_FETCH_TIMEOUT = 10 * time.Second
+
+// An error from one of the steps of fetching the status
+// NOTE: The message is the same as the underlying error, so the step is only shown where it is logged
+type FetchError struct {
+	Stage string
+	Err error
+}
+
+// Gets the message of the underlying error
+func ( fetchError *FetchError ) Error() string {
+	return fetchError.Err.Error()
+}
+
+// Gets the underlying error
+func ( fetchError *FetchError ) Unwrap() error {
+	return fetchError.Err
+}
+
+// Gets which step of fetching the status failed, if known
+func getFetchStage( err error ) string {
+	var fetchError *FetchError
+	if errors.As( err, &fetchError ) { return fetchError.Stage }
+
+	return "unknown"
+}
+
 // Structure to hold the TCP connection and functions
 type NetworkInformationServer struct {
 	Connection net.Conn
+
+	// Stops watching the context for cancellation
+	stopWatchingContext func() bool
 }
 
 // Connects to a Network Information Server
 func ( networkInformationServer *NetworkInformationServer ) Connect( address net.IP, port int, timeout int ) ( err error ) {
-	
+	return networkInformationServer.ConnectContext( context.Background(), address, port, timeout )
+}
+
+// Connects to a Network Information Server, aborting the connection & anything in-flight on it if the context is cancelled or its deadline passes
+func ( networkInformationServer *NetworkInformationServer ) ConnectContext( ctx context.Context, address net.IP, port int, timeout int ) ( err error ) {
+
 	// Try to connect using TCP
-	connection, connectError := net.DialTimeout( "tcp4", fmt.Sprintf( "%s:%d", address, port ), time.Duration( timeout ) * time.Millisecond )
+	dialer := &net.Dialer { Timeout: time.Duration( timeout ) * time.Millisecond }
+	connection, connectError := dialer.DialContext( ctx, "tcp4", fmt.Sprintf( "%s:%d", address, port ) )
 	if connectError != nil { return connectError }
 
 	// Update the structure property
 	networkInformationServer.Connection = connection
 
+	// Give up on reads or writes that are still blocked at the deadline of the context
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline { connection.SetDeadline( deadline ) }
+
+	// Unblock any reads or writes once the context is cancelled
+	networkInformationServer.stopWatchingContext = context.AfterFunc( ctx, func() { connection.SetDeadline( time.Now() ) } )
+
 	// Return no errors
 	return nil
 
@@ -32,6 +86,9 @@ func ( networkInformationServer *NetworkInformationServer ) Connect( address net
 // Disconnects from a Network Information Server
 func ( networkInformationServer *NetworkInformationServer ) Disconnect() ( err error ) {
 
+	// Stop watching the context
+	if ( networkInformationServer.stopWatchingContext != nil ) { networkInformationServer.stopWatchingContext() }
+
 	// Try to close the connection
 	disconnectError := networkInformationServer.Connection.Close()
 	if disconnectError != nil { return disconnectError }
@@ -56,6 +113,7 @@ func ( networkInformationServer *NetworkInformationServer ) SendCommand( command
 	if writeCommandError != nil { return 0, writeCommandError }
 
 	// Send the command to the server
+	slog.Debug( "Sending frame to the Network Information Server", "length", len( command ), "data", command )
 	bytesSent, sendError := networkInformationServer.Connection.Write( buffer.Bytes() )
 	if sendError != nil { return 0, sendError }
 
@@ -83,7 +141,10 @@ func ( networkInformationServer *NetworkInformationServer ) ReceiveResponse() (
 		dataLength := binary.BigEndian.Uint16( lengthBytes )
 
 		// Stop if we reached the end of the response
-		if dataLength == 0 { break }
+		if dataLength == 0 {
+			slog.Debug( "Received end of response from the Network Information Server", "length", buffer.Len() )
+			break
+		}
 
 		// Extract the remaining data
 		dataBytes := make( []byte, binary.BigEndian.Uint16( lengthBytes ) )
@@ -91,6 +152,7 @@ func ( networkInformationServer *NetworkInformationServer ) ReceiveResponse() (
 		if readDataError != nil { return "", readDataError }
 
 		// Add data to the end of the buffer
+		slog.Debug( "Received frame from the Network Information Server", "length", len( dataBytes ), "data", string( dataBytes ) )
 		_, appendError := buffer.Write( dataBytes )
 		if appendError != nil { return "", appendError }
 
@@ -106,15 +168,15 @@ func ( networkInformationServer *NetworkInformationServer ) FetchStatus() ( stat
 
 	// Send the status command
 	_, sendError := networkInformationServer.SendCommand( "status" )
-	if sendError != nil { return Status{}, sendError }
+	if sendError != nil { return Status{}, &FetchError { Stage: FETCH_STAGE_SEND, Err: sendError } }
 
 	// Receive the response
 	statusResponse, receiveError := networkInformationServer.ReceiveResponse()
-	if receiveError != nil { return Status{}, receiveError }
+	if receiveError != nil { return Status{}, &FetchError { Stage: FETCH_STAGE_RECEIVE, Err: receiveError } }
 
 	// Parse the response
 	status, parseError := ParseStatusText( statusResponse )
-	if parseError != nil { return Status{}, parseError }
+	if parseError != nil { return Status{}, &FetchError { Stage: FETCH_STAGE_PARSE, Err: parseError } }
 
 	// Return the status structure
 	return status, nil
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The version of the NUT network protocol that is emulated - networkupstools.org/docs/developer-guide.chunked/net-protocol.html
+const NUT_PROTOCOL_VERSION = "1.3"
+
+// The longest command that a client can send, the same as upsd
+const NUT_MAXIMUM_LINE_LENGTH = 512
+
+// How long a client can go without sending a command before it is disconnected, which is far longer than upsmon & others poll
+const NUT_IDLE_TIMEOUT = 5 * time.Minute
+
+// The flags in apcupsd's status text, and the flags in 'ups.status' that they become
+var nutStatusFlags = []struct{ apcupsd, nut string } {
+	{ "ONLINE", "OL" },
+	{ "ONBATT", "OB" },
+	{ "LOWBATT", "LB" },
+	{ "REPLACEBATT", "RB" },
+	{ "OVERLOAD", "OVER" },
+	{ "TRIM", "TRIM" },
+	{ "BOOST", "BOOST" },
+	{ "CAL", "CAL" },
+}
+
+// Gets the NUT variables for the status, leaving out those the UPS did not report - networkupstools.org/docs/user-manual.chunked/apcs01.html
+func getNUTVariables( status Status, forcedShutdown bool ) map[ string ]string {
+	variables := map[ string ]string {}
+
+	// Adds a value, unless it is unknown
+	addText := func( name string, value string ) {
+		if ( value != "" ) { variables[ name ] = value }
+	}
+	addNumber := func( name string, value float64 ) {
+		if ( value >= 0 ) { variables[ name ] = strconv.FormatFloat( value, 'f', -1, 64 ) }
+	}
+
+	// Adds a value that only some models report, which is zero when it was not reported
+	addOptionalNumber := func( name string, value float64 ) {
+		if ( value > 0 ) { addNumber( name, value ) }
+	}
+	addOptionalDate := func( name string, value time.Time ) {
+		if !value.IsZero() { variables[ name ] = value.Format( "2006/01/02" ) }
+	}
+
+	// The status flags, with forced shutdown if the daemon is shutting down or a primary has asked the secondaries to
+	var statusFlags []string
+	for _, flag := range nutStatusFlags {
+		if hasStatusFlag( status.UPS.StatusText, flag.apcupsd ) { statusFlags = append( statusFlags, flag.nut ) }
+	}
+	if ( forcedShutdown || hasStatusFlag( status.UPS.StatusText, "SHUTTING" ) || status.UPS.StatusFlag & 0x200 != 0 ) { statusFlags = append( statusFlags, "FSD" ) } // UPS_shutdown in apcupsd's statflag.h
+	variables[ "ups.status" ] = strings.Join( statusFlags, " " )
+
+	// The UPS
+	variables[ "device.type" ] = "ups"
+	variables[ "device.mfr" ] = "APC"
+	variables[ "ups.mfr" ] = "APC"
+	addText( "device.model", status.UPS.ModelName )
+	addText( "ups.model", status.UPS.ModelName )
+	addText( "device.serial", status.UPS.SerialNumber )
+	addText( "ups.serial", status.UPS.SerialNumber )
+	addText( "ups.id", status.UPS.Name )
+	addText( "ups.firmware", status.UPS.FirmwareRevision )
+	addOptionalDate( "ups.mfr.date", status.UPS.ManufacturedAt )
+	addNumber( "ups.load", status.UPS.LoadPercent )
+	addOptionalNumber( "ups.temperature", status.UPS.Temperature )
+	addOptionalNumber( "ups.realpower.nominal", status.UPS.Expect.PowerOutputWattage )
+	addOptionalNumber( "ups.power.nominal", status.UPS.Expect.PowerOutputVoltAmps )
+	if loadWatts, ok := calculateLoadWatts( status ); ok { addNumber( "ups.realpower", loadWatts ) }
+	if loadVoltAmps, ok := calculateLoadVoltAmps( status ); ok { addNumber( "ups.power", loadVoltAmps ) }
+	addText( "ups.test.result", status.UPS.SelfTestResult )
+	addOptionalNumber( "ups.test.interval", status.UPS.SelfTestInterval * 3600 ) // Hours to seconds
+
+	// The battery, with runtimes in seconds instead of minutes
+	addNumber( "battery.charge", status.UPS.Battery.ChargePercent )
+	addOptionalNumber( "battery.charge.low", status.Daemon.Configuration.MinimumBatteryChargePercent )
+	addNumber( "battery.runtime", status.UPS.Battery.RemainingRuntimeMinutes * 60 )
+	addOptionalNumber( "battery.runtime.low", status.Daemon.Configuration.MinimumBatteryRemainingRuntimeMinutes * 60 )
+	addOptionalNumber( "battery.voltage", status.UPS.Battery.OutputVoltage )
+	addOptionalNumber( "battery.voltage.nominal", status.UPS.Expect.BatteryOutputVoltage )
+	addOptionalNumber( "battery.packs.external", status.UPS.Battery.ExternalCount )
+	addOptionalDate( "battery.date", status.UPS.Battery.LastReplacementDate )
+
+	// The mains input & the output
+	addNumber( "input.voltage", status.UPS.LineVoltage )
+	addOptionalNumber( "input.voltage.maximum", status.UPS.MaximumLineVoltage )
+	addOptionalNumber( "input.voltage.minimum", status.UPS.MinimumLineVoltage )
+	addOptionalNumber( "input.voltage.nominal", status.UPS.Expect.MainsInputVoltage )
+	addOptionalNumber( "input.frequency", status.UPS.LineFrequency )
+	addOptionalNumber( "input.transfer.low", status.Daemon.Battery.Transfer.LowLineVoltage )
+	addOptionalNumber( "input.transfer.high", status.Daemon.Battery.Transfer.HighLineVoltage )
+	addText( "input.transfer.reason", status.Daemon.Battery.Transfer.LastReason )
+	addText( "input.sensitivity", status.UPS.LineVoltageFluctuationSensitivity )
+	addOptionalNumber( "output.voltage", status.UPS.OutputVoltage )
+
+	// The "driver", which is this exporter
+	variables[ "driver.name" ] = "apc-ups-exporter"
+	variables[ "driver.version" ] = PROJECT_VERSION
+
+	return variables
+}
+
+// Splits a command into its words, which can be quoted & contain escaped characters (e.g., 'PASSWORD "a \"b\""')
+func splitNUTCommand( line string ) ( words []string, err error ) {
+	var word strings.Builder
+	inWord, inQuotes, isEscaped := false, false, false
+
+	for _, character := range line {
+		switch {
+			case isEscaped: {
+				word.WriteRune( character )
+				isEscaped = false
+			}
+			case character == '\\': inWord, isEscaped = true, true
+			case character == '"': inWord, inQuotes = true, !inQuotes
+			case ( ( character == ' ' || character == '\t' ) && !inQuotes ): {
+				if inWord { words = append( words, word.String() ) }
+				word.Reset()
+				inWord = false
+			}
+			default: {
+				word.WriteRune( character )
+				inWord = true
+			}
+		}
+	}
+
+	if ( inQuotes || isEscaped ) { return nil, fmt.Errorf( "unterminated quote or escape" ) }
+	if inWord { words = append( words, word.String() ) }
+
+	return words, nil
+}
+
+// Quotes a value for a response, escaping any quotes & backslashes within it
+func quoteNUTValue( value string ) string {
+	return "\"" + strings.NewReplacer( "\\", "\\\\", "\"", "\\\"" ).Replace( value ) + "\""
+}
+
+/*************************************/
+
+// A client connected to the NUT server
+type nutClient struct {
+	connection net.Conn
+	username string
+	password string
+
+	// The UPS the client logged in to & is the primary of, or empty if it has not
+	loggedInUPSName string
+	primaryUPSName string
+}
+
+// What is known about one UPS on the NUT server
+type nutUPS struct {
+	latestStatus *Status
+
+	// Whether a primary has set forced shutdown, and the one that did
+	forcedShutdown bool
+	forcedShutdownClient *nutClient
+}
+
+// Emulates a Network UPS Tools server (upsd) for each UPS, so NUT clients (e.g., upsmon, Synology NAS) can monitor them & shutdown from the same apcupsd data
+// Each target is a UPS named after it, and the variables are read-only. A primary can only set forced shutdown, which is cleared once mains power returns after an outage,
+// or once the primary that set it has disconnected if it was set while on mains power.
+type NUTServer struct {
+
+	// The name of the UPS that clients use for the target without a name (e.g., 'ups' in 'ups@127.0.0.1')
+	UPSName string
+
+	// The usernames & passwords allowed to log in, or nothing to allow anyone to log in as a secondary
+	users map[ string ]string
+
+	listener net.Listener
+
+	// How long a client can be idle for before it is disconnected
+	idleTimeout time.Duration
+
+	// Each UPS that has had a status, by the name clients use, and the connected clients
+	mutex sync.Mutex
+	upses map[ string ]*nutUPS
+	clients map[ *nutClient ]struct{}
+
+	waitGroup sync.WaitGroup
+}
+
+// Creates a NUT server & starts accepting clients on the address & port
+func NewNUTServer( address net.IP, port int, upsName string, users map[ string ]string ) ( *NUTServer, error ) {
+	listener, listenError := net.Listen( "tcp", fmt.Sprintf( "%s:%d", address, port ) )
+	if listenError != nil { return nil, listenError }
+
+	server := &NUTServer {
+		UPSName: upsName,
+		users: users,
+		listener: listener,
+		idleTimeout: NUT_IDLE_TIMEOUT,
+		upses: map[ string ]*nutUPS {},
+		clients: map[ *nutClient ]struct{} {},
+	}
+
+	server.waitGroup.Add( 1 )
+	go server.acceptClients()
+
+	return server, nil
+}
+
+// Gets a short name for display purposes
+func ( server *NUTServer ) Name() string {
+	return "NUT server"
+}
+
+// Remembers the status for clients of its UPS, clearing forced shutdown once the UPS goes from battery back to mains power,
+// or once it is on mains power & the primary that set it has gone (e.g., it was set while on mains, and the primary has shutdown)
+func ( server *NUTServer ) Publish( status Status ) error {
+	upsName := server.getUPSName( status.Target )
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	ups, exists := server.upses[ upsName ]
+	if !exists {
+		ups = &nutUPS {}
+		server.upses[ upsName ] = ups
+	}
+
+	wasOnBattery := ( ups.latestStatus != nil && isOnBattery( ups.latestStatus.UPS.StatusText ) )
+	ups.latestStatus = &status
+	if ( !ups.forcedShutdown || isOnBattery( status.UPS.StatusText ) ) { return nil }
+
+	if wasOnBattery {
+		ups.forcedShutdown, ups.forcedShutdownClient = false, nil
+		slog.Info( "Cleared forced shutdown for NUT clients, as the UPS is back on mains power", "ups", upsName )
+	} else if _, isConnected := server.clients[ ups.forcedShutdownClient ]; !isConnected {
+		ups.forcedShutdown, ups.forcedShutdownClient = false, nil
+		slog.Info( "Cleared forced shutdown for NUT clients, as the UPS is on mains power & the primary that set it has disconnected", "ups", upsName )
+	}
+
+	return nil
+}
+
+// Gets the name clients use for the UPS of a target
+func ( server *NUTServer ) getUPSName( target string ) string {
+	if ( target == "" ) { return server.UPSName }
+	return target
+}
+
+// Gets the names of the UPSes of every target in the configuration, sorted
+func ( server *NUTServer ) getUPSNames() ( upsNames []string ) {
+	for _, collector := range getCollectors() { upsNames = append( upsNames, server.getUPSName( collector.Name ) ) }
+
+	slices.Sort( upsNames )
+	return upsNames
+}
+
+// Checks if there is a UPS with the name, for a target in the configuration
+func ( server *NUTServer ) hasUPS( upsName string ) bool {
+	return slices.Contains( server.getUPSNames(), upsName )
+}
+
+// Stops accepting clients & disconnects those that are connected
+func ( server *NUTServer ) Close() error {
+	closeError := server.listener.Close()
+
+	server.mutex.Lock()
+	for client := range server.clients { client.connection.Close() }
+	server.mutex.Unlock()
+
+	server.waitGroup.Wait()
+
+	return closeError
+}
+
+// Accepts clients until the listener is closed
+func ( server *NUTServer ) acceptClients() {
+	defer server.waitGroup.Done()
+
+	for {
+		connection, acceptError := server.listener.Accept()
+		if acceptError != nil { return }
+
+		client := &nutClient { connection: connection }
+		server.mutex.Lock()
+		server.clients[ client ] = struct{}{}
+		server.mutex.Unlock()
+
+		server.waitGroup.Add( 1 )
+		go server.serveClient( client )
+	}
+}
+
+// Responds to each command from the client, until it logs out or disconnects
+func ( server *NUTServer ) serveClient( client *nutClient ) {
+	defer server.waitGroup.Done()
+	defer func() {
+		server.mutex.Lock()
+		delete( server.clients, client )
+		server.mutex.Unlock()
+
+		client.connection.Close()
+	}()
+
+	scanner := bufio.NewScanner( client.connection )
+	scanner.Buffer( make( []byte, NUT_MAXIMUM_LINE_LENGTH ), NUT_MAXIMUM_LINE_LENGTH )
+
+	for {
+
+		// Disconnected if idle for too long, which also limits how long writing the response can take
+		client.connection.SetDeadline( time.Now().Add( server.idleTimeout ) )
+		if !scanner.Scan() { return }
+
+		line := strings.TrimSuffix( scanner.Text(), "\r" )
+		if ( strings.TrimSpace( line ) == "" ) { continue }
+
+		words, splitError := splitNUTCommand( line )
+		if ( splitError != nil || len( words ) == 0 ) {
+			fmt.Fprint( client.connection, "ERR INVALID-ARGUMENT\n" )
+			continue
+		}
+
+		// Never log passwords
+		if ( strings.ToUpper( words[ 0 ] ) == "PASSWORD" ) {
+			slog.Debug( "Received NUT command", "client", client.connection.RemoteAddr(), "command", "PASSWORD" )
+		} else {
+			slog.Debug( "Received NUT command", "client", client.connection.RemoteAddr(), "command", line )
+		}
+
+		response, isLoggingOut := server.respond( client, words )
+		if _, writeError := fmt.Fprint( client.connection, response ); writeError != nil { return }
+		if isLoggingOut { return }
+	}
+}
+
+// Gets the response to a command, which is one or more lines, and whether the client is logging out
+func ( server *NUTServer ) respond( client *nutClient, words []string ) ( response string, isLoggingOut bool ) {
+	command, arguments := strings.ToUpper( words[ 0 ] ), words[ 1 : ]
+
+	switch command {
+		case "VER": return fmt.Sprintf( "%s v%s - NUT protocol emulation\n", PROJECT_NAME, PROJECT_VERSION ), false
+		case "NETVER", "PROTVER": return NUT_PROTOCOL_VERSION + "\n", false
+		case "HELP": return "Commands: HELP VER GET LIST SET INSTCMD LOGIN LOGOUT USERNAME PASSWORD STARTTLS\n", false
+		case "STARTTLS": return "ERR FEATURE-NOT-CONFIGURED\n", false
+		case "LOGOUT": return "OK Goodbye\n", true
+
+		case "USERNAME": {
+			if ( len( arguments ) != 1 ) { return "ERR INVALID-ARGUMENT\n", false }
+			if ( client.username != "" ) { return "ERR ALREADY-SET-USERNAME\n", false }
+			client.username = arguments[ 0 ]
+			return "OK\n", false
+		}
+
+		case "PASSWORD": {
+			if ( len( arguments ) != 1 ) { return "ERR INVALID-ARGUMENT\n", false }
+			if ( client.password != "" ) { return "ERR ALREADY-SET-PASSWORD\n", false }
+			client.password = arguments[ 0 ]
+			return "OK\n", false
+		}
+
+		case "LOGIN": {
+			if ( len( arguments ) != 1 ) { return "ERR INVALID-ARGUMENT\n", false }
+			if ( client.username == "" ) { return "ERR USERNAME-REQUIRED\n", false }
+			if ( client.password == "" ) { return "ERR PASSWORD-REQUIRED\n", false }
+			if !server.hasUPS( arguments[ 0 ] ) { return "ERR UNKNOWN-UPS\n", false }
+			if ( client.loggedInUPSName != "" ) { return "ERR ALREADY-LOGGED-IN\n", false }
+			if ( len( server.users ) > 0 && !server.isAllowed( client ) ) { return "ERR ACCESS-DENIED\n", false }
+
+			server.mutex.Lock()
+			client.loggedInUPSName = arguments[ 0 ]
+			server.mutex.Unlock()
+
+			slog.Info( "NUT client logged in", "client", client.connection.RemoteAddr(), "username", client.username, "ups", arguments[ 0 ] )
+			return "OK\n", false
+		}
+
+		// Older clients ask to be the master instead of the primary
+		case "PRIMARY", "MASTER": {
+			if ( len( arguments ) != 1 ) { return "ERR INVALID-ARGUMENT\n", false }
+			if !server.hasUPS( arguments[ 0 ] ) { return "ERR UNKNOWN-UPS\n", false }
+			if !server.isAllowed( client ) { return "ERR ACCESS-DENIED\n", false }
+
+			client.primaryUPSName = arguments[ 0 ]
+			return fmt.Sprintf( "OK %s-GRANTED\n", command ), false
+		}
+
+		// The primary is shutting down, so tell the secondaries to as well
+		case "FSD": {
+			if ( len( arguments ) != 1 ) { return "ERR INVALID-ARGUMENT\n", false }
+			if !server.hasUPS( arguments[ 0 ] ) { return "ERR UNKNOWN-UPS\n", false }
+			if ( client.primaryUPSName != arguments[ 0 ] ) { return "ERR ACCESS-DENIED\n", false }
+
+			server.mutex.Lock()
+			ups, exists := server.upses[ arguments[ 0 ] ]
+			if !exists {
+				ups = &nutUPS {}
+				server.upses[ arguments[ 0 ] ] = ups
+			}
+			ups.forcedShutdown, ups.forcedShutdownClient = true, client
+			server.mutex.Unlock()
+
+			slog.Warn( "NUT primary set forced shutdown", "client", client.connection.RemoteAddr(), "username", client.username, "ups", arguments[ 0 ] )
+			return "OK FSD-SET\n", false
+		}
+
+		case "GET": return server.respondToGet( arguments ), false
+		case "LIST": return server.respondToList( arguments ), false
+
+		// The variables are read-only, and there is nothing to control the UPS with
+		case "SET": return "ERR READONLY\n", false
+		case "INSTCMD": return "ERR CMD-NOT-SUPPORTED\n", false
+
+		default: return "ERR UNKNOWN-COMMAND\n", false
+	}
+}
+
+// Checks if the client gave the username & password of an allowed user
+func ( server *NUTServer ) isAllowed( client *nutClient ) bool {
+	password, isUser := server.users[ client.username ]
+	return ( isUser && client.username != "" && subtle.ConstantTimeCompare( []byte( client.password ), []byte( password ) ) == 1 )
+}
+
+// Gets the variables of a UPS, unless the latest status is too old or the daemon has lost communication with the UPS
+func ( server *NUTServer ) getVariables( upsName string ) ( variables map[ string ]string, isStale bool ) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	ups, exists := server.upses[ upsName ]
+	if ( !exists || ups.latestStatus == nil || hasStatusFlag( ups.latestStatus.UPS.StatusText, "COMMLOST" ) ) { return nil, true }
+
+	// The target may have been removed since, or not been fetched from for too long
+	collector := getCollector( ups.latestStatus.Target )
+	if ( collector == nil ) { return nil, true }
+	if isReady, _ := collector.Health.Ready(); !isReady { return nil, true }
+
+	return getNUTVariables( *ups.latestStatus, ups.forcedShutdown ), false
+}
+
+// Gets the description of a UPS, from its model & name in apcupsd (e.g., 'Back-UPS XS 850G2 (rack1)')
+func ( server *NUTServer ) getDescription( upsName string ) string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	ups, exists := server.upses[ upsName ]
+	if ( !exists || ups.latestStatus == nil ) { return "Unavailable" }
+	modelName, apcupsdName := ups.latestStatus.UPS.ModelName, ups.latestStatus.UPS.Name
+	if ( modelName == "" || apcupsdName == "" ) { return modelName + apcupsdName }
+	return fmt.Sprintf( "%s (%s)", modelName, apcupsdName )
+}
+
+// Gets the addresses of the clients logged in to a UPS
+func ( server *NUTServer ) getLoggedInAddresses( upsName string ) ( addresses []string ) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for client := range server.clients {
+		if ( client.loggedInUPSName != upsName ) { continue }
+
+		host, _, splitError := net.SplitHostPort( client.connection.RemoteAddr().String() )
+		if splitError != nil { host = client.connection.RemoteAddr().String() }
+		addresses = append( addresses, host )
+	}
+
+	slices.Sort( addresses )
+	return addresses
+}
+
+// Responds to 'GET VAR', 'GET TYPE', 'GET DESC', 'GET UPSDESC', 'GET NUMLOGINS' & 'GET CMDDESC'
+func ( server *NUTServer ) respondToGet( arguments []string ) string {
+	if ( len( arguments ) < 2 ) { return "ERR INVALID-ARGUMENT\n" }
+	subcommand, upsName := strings.ToUpper( arguments[ 0 ] ), arguments[ 1 ]
+	if !server.hasUPS( upsName ) { return "ERR UNKNOWN-UPS\n" }
+
+	switch subcommand {
+		case "UPSDESC": return fmt.Sprintf( "UPSDESC %s %s\n", upsName, quoteNUTValue( server.getDescription( upsName ) ) )
+		case "NUMLOGINS": return fmt.Sprintf( "NUMLOGINS %s %d\n", upsName, len( server.getLoggedInAddresses( upsName ) ) )
+		case "CMDDESC": return "ERR CMD-NOT-SUPPORTED\n"
+
+		case "VAR", "TYPE", "DESC": {
+			if ( len( arguments ) != 3 ) { return "ERR INVALID-ARGUMENT\n" }
+			variableName := arguments[ 2 ]
+
+			variables, isStale := server.getVariables( upsName )
+			if isStale { return "ERR DATA-STALE\n" }
+			value, isSupported := variables[ variableName ]
+			if !isSupported { return "ERR VAR-NOT-SUPPORTED\n" }
+
+			switch subcommand {
+				case "VAR": return fmt.Sprintf( "VAR %s %s %s\n", upsName, variableName, quoteNUTValue( value ) )
+				case "DESC": return fmt.Sprintf( "DESC %s %s %s\n", upsName, variableName, quoteNUTValue( "Description unavailable" ) )
+			}
+
+			if _, parseError := strconv.ParseFloat( value, 64 ); parseError == nil { return fmt.Sprintf( "TYPE %s %s NUMBER\n", upsName, variableName ) }
+			return fmt.Sprintf( "TYPE %s %s STRING:%d\n", upsName, variableName, len( value ) )
+		}
+
+		default: return "ERR INVALID-ARGUMENT\n"
+	}
+}
+
+// Responds to 'LIST UPS', 'LIST VAR', 'LIST CLIENT', and the empty lists of writable variables & commands
+func ( server *NUTServer ) respondToList( arguments []string ) string {
+	if ( len( arguments ) == 0 ) { return "ERR INVALID-ARGUMENT\n" }
+	subcommand := strings.ToUpper( arguments[ 0 ] )
+
+	if ( subcommand == "UPS" ) {
+		if ( len( arguments ) != 1 ) { return "ERR INVALID-ARGUMENT\n" }
+
+		response := "BEGIN LIST UPS\n"
+		for _, upsName := range server.getUPSNames() { response += fmt.Sprintf( "UPS %s %s\n", upsName, quoteNUTValue( server.getDescription( upsName ) ) ) }
+		return response + "END LIST UPS\n"
+	}
+
+	if ( len( arguments ) < 2 ) { return "ERR INVALID-ARGUMENT\n" }
+	upsName := arguments[ 1 ]
+	if !server.hasUPS( upsName ) { return "ERR UNKNOWN-UPS\n" }
+
+	var lines []string
+	switch subcommand {
+		case "VAR": {
+			if ( len( arguments ) != 2 ) { return "ERR INVALID-ARGUMENT\n" }
+			variables, isStale := server.getVariables( upsName )
+			if isStale { return "ERR DATA-STALE\n" }
+
+			for name, value := range variables { lines = append( lines, fmt.Sprintf( "VAR %s %s %s", upsName, name, quoteNUTValue( value ) ) ) }
+			slices.Sort( lines )
+		}
+
+		case "CLIENT": {
+			if ( len( arguments ) != 2 ) { return "ERR INVALID-ARGUMENT\n" }
+			for _, address := range server.getLoggedInAddresses( upsName ) { lines = append( lines, fmt.Sprintf( "CLIENT %s %s", upsName, address ) ) }
+		}
+
+		// There are no writable variables or commands
+		case "RW", "CMD": if ( len( arguments ) != 2 ) { return "ERR INVALID-ARGUMENT\n" }
+
+		default: return "ERR INVALID-ARGUMENT\n"
+	}
+
+	// The list is named by the arguments that asked for it (e.g., 'BEGIN LIST VAR ups')
+	listName := fmt.Sprintf( "%s %s", subcommand, upsName )
+	response := fmt.Sprintf( "BEGIN LIST %s\n", listName )
+	for _, line := range lines { response += line + "\n" }
+	return response + fmt.Sprintf( "END LIST %s\n", listName )
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitNUTCommand( t *testing.T ) {
+	for _, test := range []struct {
+		line string
+		expected []string
+	} {
+		{ "LIST UPS", []string { "LIST", "UPS" } },
+		{ "  GET\tVAR   ups  ups.status ", []string { "GET", "VAR", "ups", "ups.status" } },
+		{ `PASSWORD "two words"`, []string { "PASSWORD", "two words" } },
+		{ `PASSWORD "a \"b\""`, []string { "PASSWORD", `a "b"` } },
+		{ `PASSWORD a\ b\\c`, []string { "PASSWORD", `a b\c` } },
+		{ `PASSWORD ""`, []string { "PASSWORD", "" } },
+		{ `USERNAME mon"user"`, []string { "USERNAME", "monuser" } },
+		{ "", nil },
+	} {
+		words, err := splitNUTCommand( test.line )
+		if err != nil { t.Errorf( "%q: unexpected error %v", test.line, err ); continue }
+		if !slices.Equal( words, test.expected ) { t.Errorf( "%q: expected %q, got %q", test.line, test.expected, words ) }
+	}
+
+	for _, line := range []string { `PASSWORD "secret`, `PASSWORD secret\` } {
+		if _, err := splitNUTCommand( line ); err == nil { t.Errorf( "%q: expected an error", line ) }
+	}
+}
+
+// Creates a NUT server without a listener, for a ready target without a name that has had a status
+func newTestNUTServer( t *testing.T, users map[ string ]string ) *NUTServer {
+	t.Helper()
+
+	collector := NewCollector( NISTarget {}, MetricsSettings { Namespace: "ups", Schema: METRICS_SCHEMA_V1 } )
+	collector.Health.Configure( "", time.Hour, 0 )
+	collector.Health.Succeeded( Status {} )
+
+	collectorsMutex.Lock()
+	previousCollectors := collectors
+	collectors = []*Collector { collector }
+	collectorsMutex.Unlock()
+	t.Cleanup( func() {
+		collectorsMutex.Lock()
+		collectors = previousCollectors
+		collectorsMutex.Unlock()
+	} )
+
+	server := &NUTServer {
+		UPSName: "ups",
+		users: users,
+		idleTimeout: NUT_IDLE_TIMEOUT,
+		upses: map[ string ]*nutUPS {},
+		clients: map[ *nutClient ]struct{} {},
+	}
+	publishTestNUTStatus( t, server, "ONLINE" )
+
+	return server
+}
+
+// Publishes a status of the UPS to the server
+func publishTestNUTStatus( t *testing.T, server *NUTServer, statusText string ) {
+	t.Helper()
+
+	status := Status { Date: time.Now() }
+	status.UPS.ModelName, status.UPS.Name, status.UPS.StatusText, status.UPS.LoadPercent = "Back-UPS XS 850G2", "rack1", statusText, 25
+	if publishError := server.Publish( status ); publishError != nil { t.Fatal( publishError ) }
+}
+
+// A client connected to a NUT server over a pipe
+type testNUTClient struct {
+	connection net.Conn
+	reader *bufio.Reader
+}
+
+// Connects a client to the server
+func connectTestNUTClient( t *testing.T, server *NUTServer ) *testNUTClient {
+	t.Helper()
+
+	clientConnection, serverConnection := net.Pipe()
+	t.Cleanup( func() { clientConnection.Close() } )
+
+	client := &nutClient { connection: serverConnection }
+	server.mutex.Lock()
+	server.clients[ client ] = struct{}{}
+	server.mutex.Unlock()
+
+	server.waitGroup.Add( 1 )
+	go server.serveClient( client )
+
+	return &testNUTClient { connection: clientConnection, reader: bufio.NewReader( clientConnection ) }
+}
+
+// Sends a command & reads the response, until the end of the list if it is one
+func ( client *testNUTClient ) send( t *testing.T, command string ) string {
+	t.Helper()
+
+	client.connection.SetDeadline( time.Now().Add( 2 * time.Second ) )
+	if _, writeError := io.WriteString( client.connection, command + "\n" ); writeError != nil { t.Fatal( writeError ) }
+
+	var response strings.Builder
+	for {
+		line, readError := client.reader.ReadString( '\n' )
+		if readError != nil { t.Fatalf( "%q: %v", command, readError ) }
+		response.WriteString( line )
+		if ( !strings.HasPrefix( response.String(), "BEGIN LIST " ) || strings.HasPrefix( line, "END LIST " ) ) { return response.String() }
+	}
+}
+
+// Waits for the server to notice that every client has disconnected
+func waitForTestNUTClients( t *testing.T, server *NUTServer ) {
+	t.Helper()
+
+	for deadline := time.Now().Add( 2 * time.Second ); time.Now().Before( deadline ); time.Sleep( 10 * time.Millisecond ) {
+		server.mutex.Lock()
+		count := len( server.clients )
+		server.mutex.Unlock()
+
+		if ( count == 0 ) { return }
+	}
+
+	t.Fatal( "expected every client to have disconnected" )
+}
+
+func TestNUTServerResponses( t *testing.T ) {
+	server := newTestNUTServer( t, map[ string ]string { "monuser": "secret" } )
+	clients := []*testNUTClient { connectTestNUTClient( t, server ), connectTestNUTClient( t, server ) }
+
+	for _, test := range []struct {
+		client int
+		command string
+		expected string
+	} {
+		{ 0, "NETVER", "1.3\n" },
+		{ 0, "LIST UPS", "BEGIN LIST UPS\nUPS ups \"Back-UPS XS 850G2 (rack1)\"\nEND LIST UPS\n" },
+		{ 0, "LIST UPS ups", "ERR INVALID-ARGUMENT\n" },
+		{ 0, "LIST VAR", "ERR INVALID-ARGUMENT\n" },
+		{ 0, "LIST VAR rack2", "ERR UNKNOWN-UPS\n" },
+		{ 0, "LIST RW ups", "BEGIN LIST RW ups\nEND LIST RW ups\n" },
+		{ 0, "GET VAR ups ups.load", "VAR ups ups.load \"25\"\n" },
+		{ 0, "GET VAR ups ups.status", "VAR ups ups.status \"OL\"\n" },
+		{ 0, "GET VAR ups ups.colour", "ERR VAR-NOT-SUPPORTED\n" },
+		{ 0, "GET VAR rack2 ups.load", "ERR UNKNOWN-UPS\n" },
+		{ 0, `GET VAR ups "ups.load`, "ERR INVALID-ARGUMENT\n" },
+		{ 0, "GET TYPE ups ups.load", "TYPE ups ups.load NUMBER\n" },
+		{ 0, "GET TYPE ups ups.model", "TYPE ups ups.model STRING:17\n" },
+		{ 0, "GET UPSDESC ups", "UPSDESC ups \"Back-UPS XS 850G2 (rack1)\"\n" },
+		{ 0, "SET VAR ups ups.id rack2", "ERR READONLY\n" },
+
+		// Logging in with the wrong password
+		{ 0, "LOGIN ups", "ERR USERNAME-REQUIRED\n" },
+		{ 0, "USERNAME monuser", "OK\n" },
+		{ 0, "LOGIN ups", "ERR PASSWORD-REQUIRED\n" },
+		{ 0, "PASSWORD secre", "OK\n" },
+		{ 0, "PASSWORD secret", "ERR ALREADY-SET-PASSWORD\n" },
+		{ 0, "LOGIN ups", "ERR ACCESS-DENIED\n" },
+		{ 0, "PRIMARY ups", "ERR ACCESS-DENIED\n" },
+
+		// Logging in as the primary & setting forced shutdown
+		{ 1, "USERNAME monuser", "OK\n" },
+		{ 1, `PASSWORD "secret"`, "OK\n" },
+		{ 1, "LOGIN rack2", "ERR UNKNOWN-UPS\n" },
+		{ 1, "LOGIN ups", "OK\n" },
+		{ 1, "LOGIN ups", "ERR ALREADY-LOGGED-IN\n" },
+		{ 1, "GET NUMLOGINS ups", "NUMLOGINS ups 1\n" },
+		{ 1, "LIST CLIENT ups", "BEGIN LIST CLIENT ups\nCLIENT ups pipe\nEND LIST CLIENT ups\n" },
+		{ 1, "FSD ups", "ERR ACCESS-DENIED\n" },
+		{ 1, "PRIMARY ups", "OK PRIMARY-GRANTED\n" },
+		{ 1, "MASTER ups", "OK MASTER-GRANTED\n" },
+		{ 1, "FSD ups", "OK FSD-SET\n" },
+		{ 0, "GET VAR ups ups.status", "VAR ups ups.status \"OL FSD\"\n" },
+		{ 1, "LOGOUT", "OK Goodbye\n" },
+	} {
+		if response := clients[ test.client ].send( t, test.command ); ( response != test.expected ) { t.Errorf( "%q: expected %q, got %q", test.command, test.expected, response ) }
+	}
+}
+
+func TestNUTServerDataStale( t *testing.T ) {
+	server := newTestNUTServer( t, nil )
+	client := connectTestNUTClient( t, server )
+
+	// Not fetched from for too long
+	getCollector( "" ).Health.Configure( "", time.Nanosecond, 0 )
+	if response := client.send( t, "GET VAR ups ups.load" ); ( response != "ERR DATA-STALE\n" ) { t.Errorf( "expected the data to be stale, got %q", response ) }
+
+	// Or the daemon lost communication with the UPS
+	getCollector( "" ).Health.Configure( "", time.Hour, 0 )
+	publishTestNUTStatus( t, server, "COMMLOST" )
+	if response := client.send( t, "LIST VAR ups" ); ( response != "ERR DATA-STALE\n" ) { t.Errorf( "expected the data to be stale, got %q", response ) }
+}
+
+func TestNUTForcedShutdownCleared( t *testing.T ) {
+	server := newTestNUTServer( t, map[ string ]string { "monuser": "secret" } )
+
+	// Logs in as the primary & sets forced shutdown
+	setForcedShutdown := func() *testNUTClient {
+		client := connectTestNUTClient( t, server )
+		for _, command := range []string { "USERNAME monuser", "PASSWORD secret", "PRIMARY ups", "FSD ups" } { client.send( t, command ) }
+		return client
+	}
+	isForcedShutdown := func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+
+		return server.upses[ "ups" ].forcedShutdown
+	}
+
+	// Set while on battery, so kept until mains power returns, even once the primary has gone
+	publishTestNUTStatus( t, server, "ONBATT" )
+	setForcedShutdown().send( t, "LOGOUT" )
+	waitForTestNUTClients( t, server )
+	publishTestNUTStatus( t, server, "ONBATT LOWBATT" )
+	if !isForcedShutdown() { t.Error( "expected forced shutdown to be kept while on battery" ) }
+	publishTestNUTStatus( t, server, "ONLINE" )
+	if isForcedShutdown() { t.Error( "expected forced shutdown to be cleared once mains power returned" ) }
+
+	// Set while on mains power, so kept until the primary that set it has gone
+	primary := setForcedShutdown()
+	publishTestNUTStatus( t, server, "ONLINE" )
+	if !isForcedShutdown() { t.Error( "expected forced shutdown to be kept while the primary is connected" ) }
+	primary.send( t, "LOGOUT" )
+	waitForTestNUTClients( t, server )
+	if !isForcedShutdown() { t.Error( "expected forced shutdown to be kept until the next status" ) }
+	publishTestNUTStatus( t, server, "ONLINE" )
+	if isForcedShutdown() { t.Error( "expected forced shutdown to be cleared once the primary had gone" ) }
+}
+
+func TestNUTServerDisconnectsIdleClients( t *testing.T ) {
+	server := newTestNUTServer( t, nil )
+	server.idleTimeout = 100 * time.Millisecond
+	client := connectTestNUTClient( t, server )
+
+	// Commands keep the connection open
+	for index := 0; index < 3; index++ {
+		time.Sleep( 50 * time.Millisecond )
+		if response := client.send( t, "VER" ); !strings.HasPrefix( response, PROJECT_NAME ) { t.Fatalf( "unexpected response %q", response ) }
+	}
+
+	startedAt := time.Now()
+	client.connection.SetDeadline( time.Now().Add( 2 * time.Second ) )
+	if _, readError := client.reader.ReadString( '\n' ); ( readError != io.EOF ) { t.Errorf( "expected to be disconnected, got %v", readError ) }
+	if elapsed := time.Since( startedAt ); ( elapsed > time.Second ) { t.Errorf( "expected to be disconnected once idle, took %s", elapsed ) }
+	waitForTestNUTClients( t, server )
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// An OpenTelemetry instrument for a value of the status, with its unit in UCUM notation - ucum.org/ucum
+type otlpInstrument struct {
+	Name string
+	Unit string
+	Description string
+	Cumulative bool // Counter of a total from the daemon instead of gauge, which carries on from before the daemon restarted
+	Value func( status Status ) float64
+}
+
+// The instruments exported over OTLP, in base units where the daemon does not already use them
+var otlpInstruments = []otlpInstrument {
+
+	// Status & load
+	{ "ups.status", "1", "The status flag of the UPS (STATFLAG).", false, func( status Status ) float64 { return float64( status.UPS.StatusFlag ) } },
+	{ "ups.load.utilization", "1", "The load of the UPS, as a ratio of the nominal power.", false, func( status Status ) float64 { return status.UPS.LoadPercent / 100 } },
+	{ "ups.load.power", "W", "The load of the UPS, from the load ratio & nominal power.", false, func( status Status ) float64 { watts, ok := calculateLoadWatts( status ); if !ok { return -1 }; return watts } },
+
+	// Line & output
+	{ "ups.line.voltage", "V", "The voltage of the mains input.", false, func( status Status ) float64 { return status.UPS.LineVoltage } },
+	{ "ups.line.voltage.max", "V", "The highest voltage of the mains input since the last status.", false, func( status Status ) float64 { return status.UPS.MaximumLineVoltage } },
+	{ "ups.line.voltage.min", "V", "The lowest voltage of the mains input since the last status.", false, func( status Status ) float64 { return status.UPS.MinimumLineVoltage } },
+	{ "ups.line.frequency", "Hz", "The frequency of the mains input.", false, func( status Status ) float64 { return status.UPS.LineFrequency } },
+	{ "ups.output.voltage", "V", "The voltage supplied to the load.", false, func( status Status ) float64 { return status.UPS.OutputVoltage } },
+	{ "ups.temperature", "Cel", "The internal temperature of the UPS.", false, func( status Status ) float64 { return status.UPS.Temperature } },
+
+	// Battery
+	{ "ups.battery.charge", "1", "The charge of the battery, as a ratio.", false, func( status Status ) float64 { return status.UPS.Battery.ChargePercent / 100 } },
+	{ "ups.battery.time_left", "s", "The estimated runtime remaining on battery.", false, func( status Status ) float64 { return status.UPS.Battery.RemainingRuntimeMinutes * 60 } },
+	{ "ups.battery.voltage", "V", "The voltage of the battery.", false, func( status Status ) float64 { return status.UPS.Battery.OutputVoltage } },
+	{ "ups.battery.low_threshold", "s", "The remaining runtime at which the UPS signals a low battery.", false, func( status Status ) float64 { return status.UPS.Battery.LowBatterySignalThreshold * 60 } },
+	{ "ups.battery.external", "{pack}", "The number of external battery packs.", false, func( status Status ) float64 { return status.UPS.Battery.ExternalCount } },
+	{ "ups.battery.time_on", "s", "The time spent on battery in the current outage.", false, func( status Status ) float64 { return status.Daemon.Battery.TimeSpent.Current } },
+	{ "ups.battery.time_on.total", "s", "The total time spent on battery since the daemon started.", true, func( status Status ) float64 { return status.Daemon.Battery.TimeSpent.Total } },
+
+	// Nominal values
+	{ "ups.line.voltage.nominal", "V", "The nominal voltage of the mains input.", false, func( status Status ) float64 { return status.UPS.Expect.MainsInputVoltage } },
+	{ "ups.battery.voltage.nominal", "V", "The nominal voltage of the battery.", false, func( status Status ) float64 { return status.UPS.Expect.BatteryOutputVoltage } },
+	{ "ups.power.nominal", "W", "The nominal real power of the UPS.", false, func( status Status ) float64 { return status.UPS.Expect.PowerOutputWattage } },
+	{ "ups.apparent_power.nominal", "VA", "The nominal apparent power of the UPS.", false, func( status Status ) float64 { return status.UPS.Expect.PowerOutputVoltAmps } },
+
+	// Daemon configuration & transfers
+	{ "ups.shutdown.charge", "1", "The battery charge at which the daemon shuts down the system, as a ratio.", false, func( status Status ) float64 { return status.Daemon.Configuration.MinimumBatteryChargePercent / 100 } },
+	{ "ups.shutdown.time_left", "s", "The remaining runtime at which the daemon shuts down the system.", false, func( status Status ) float64 { return status.Daemon.Configuration.MinimumBatteryRemainingRuntimeMinutes * 60 } },
+	{ "ups.shutdown.timeout", "s", "The time on battery after which the daemon shuts down the system.", false, func( status Status ) float64 { return status.Daemon.Configuration.MaximumTimeoutSeconds } },
+	{ "ups.transfers", "{transfer}", "The number of transfers to battery since the daemon started.", true, func( status Status ) float64 { return status.Daemon.Battery.Transfer.Total } },
+	{ "ups.transfer.voltage.low", "V", "The mains input voltage below which the UPS transfers to battery.", false, func( status Status ) float64 { return status.Daemon.Battery.Transfer.LowLineVoltage } },
+	{ "ups.transfer.voltage.high", "V", "The mains input voltage above which the UPS transfers to battery.", false, func( status Status ) float64 { return status.Daemon.Battery.Transfer.HighLineVoltage } },
+
+}
+
+// Sends the status to an OpenTelemetry Collector (or anything else that speaks OTLP) after every collection
+// The identity of each UPS becomes a resource, so the meter provider for a target is only created once its first status arrives
+type OTLPOutput struct {
+	exporter sdkmetric.Exporter
+
+	// The meter provider of each target, by its name
+	mutex sync.Mutex
+	upses map[ string ]*otlpUPS
+}
+
+// The meter provider & reader for the UPS a target is currently reporting on
+type otlpUPS struct {
+	provider *sdkmetric.MeterProvider
+	reader *sdkmetric.ManualReader
+	identity [ 3 ]string
+
+	// The latest status & the totals of the cumulative instruments (by their index), read by the instrument callbacks
+	latestMutex sync.Mutex
+	latest Status
+	totals []daemonTotal
+}
+
+// Creates an output for an OTLP endpoint, using gRPC or HTTP
+// The scheme of the URL decides whether to use TLS, and the headers are sent with every export (e.g., for authentication)
+func NewOTLPOutput( endpointURL string, useGRPC bool, headers map[ string ]string ) ( *OTLPOutput, error ) {
+	var exporter sdkmetric.Exporter
+	var exporterError error
+
+	if useGRPC {
+		exporter, exporterError = otlpmetricgrpc.New( context.Background(),
+			otlpmetricgrpc.WithEndpointURL( endpointURL ),
+			otlpmetricgrpc.WithHeaders( headers ),
+			otlpmetricgrpc.WithTimeout( 10 * time.Second ),
+		)
+	} else {
+
+		// Default to the standard path for metrics, as the URL path is otherwise used as-is
+		parsedURL, parseError := url.Parse( endpointURL )
+		if parseError != nil { return nil, parseError }
+		if ( parsedURL.Path == "" || parsedURL.Path == "/" ) { endpointURL = parsedURL.JoinPath( "v1", "metrics" ).String() }
+
+		exporter, exporterError = otlpmetrichttp.New( context.Background(),
+			otlpmetrichttp.WithEndpointURL( endpointURL ),
+			otlpmetrichttp.WithHeaders( headers ),
+			otlpmetrichttp.WithTimeout( 10 * time.Second ),
+		)
+	}
+	if exporterError != nil { return nil, exporterError }
+
+	return &OTLPOutput { exporter: exporter, upses: map[ string ]*otlpUPS {} }, nil
+}
+
+// Gets a short name for display purposes
+func ( output *OTLPOutput ) Name() string {
+	return "OTLP"
+}
+
+// Records the status in the instruments & exports them straight away
+func ( output *OTLPOutput ) Publish( status Status ) error {
+	ctx, cancel := context.WithTimeout( context.Background(), 15 * time.Second )
+	defer cancel()
+
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	ups, exists := output.upses[ status.Target ]
+	if !exists {
+		ups = &otlpUPS {}
+		output.upses[ status.Target ] = ups
+	}
+
+	// Create a new meter provider if this is the first status, or the daemon is now reporting on a different UPS, which starts the totals again
+	identity := [ 3 ]string { status.UPS.SerialNumber, status.UPS.ModelName, status.UPS.Name }
+	if ( ups.provider == nil || identity != ups.identity ) {
+		if ups.provider != nil { ups.provider.Shutdown( ctx ) }
+
+		providerError := ups.createProvider( output.exporter, status )
+		if providerError != nil { return providerError }
+		ups.identity = identity
+	}
+
+	// Store the status for the instrument callbacks, with the totals carrying on if the daemon restarted
+	ups.latestMutex.Lock()
+	ups.latest = status
+	for index, instrument := range otlpInstruments {
+		if instrument.Cumulative { ups.totals[ index ].Set( instrument.Value( status ) ) }
+	}
+	ups.latestMutex.Unlock()
+
+	// Collect from the instruments & export the result
+	var resourceMetrics metricdata.ResourceMetrics
+	collectError := ups.reader.Collect( ctx, &resourceMetrics )
+	if collectError != nil { return collectError }
+
+	return output.exporter.Export( ctx, &resourceMetrics )
+}
+
+// Shuts down the meter providers & the exporter
+func ( output *OTLPOutput ) Close() error {
+	ctx, cancel := context.WithTimeout( context.Background(), 15 * time.Second )
+	defer cancel()
+
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	for _, ups := range output.upses {
+		if ( ups.provider != nil ) { ups.provider.Shutdown( ctx ) } // Creating it may have failed
+	}
+
+	return output.exporter.Shutdown( ctx )
+}
+
+// Creates the meter provider with the identity of the UPS as the resource, and registers the instruments with their totals from zero
+func ( ups *otlpUPS ) createProvider( exporter sdkmetric.Exporter, status Status ) error {
+	ups.latestMutex.Lock()
+	ups.totals = make( []daemonTotal, len( otlpInstruments ) )
+	ups.latestMutex.Unlock()
+
+	// Describe the UPS & this exporter - opentelemetry.io/docs/specs/semconv/resource/
+	attributes := []attribute.KeyValue {
+		attribute.String( "service.name", "apc-ups-exporter" ),
+		attribute.String( "service.version", PROJECT_VERSION ),
+		attribute.String( "device.manufacturer", "APC" ),
+	}
+	if ( status.UPS.SerialNumber != "" ) { attributes = append( attributes, attribute.String( "device.id", status.UPS.SerialNumber ) ) }
+	if ( status.UPS.ModelName != "" ) { attributes = append( attributes, attribute.String( "device.model.name", status.UPS.ModelName ) ) }
+	if ( status.UPS.Name != "" ) { attributes = append( attributes, attribute.String( "ups.name", status.UPS.Name ) ) }
+	if ( status.UPS.FirmwareRevision != "" ) { attributes = append( attributes, attribute.String( "ups.firmware", status.UPS.FirmwareRevision ) ) }
+	if ( status.Daemon.SystemName != "" ) { attributes = append( attributes, attribute.String( "host.name", status.Daemon.SystemName ) ) }
+	if ( status.Target != "" ) { attributes = append( attributes, attribute.String( "ups.target", status.Target ) ) }
+
+	// Read on demand, with whatever temporality & aggregation the exporter wants
+	ups.reader = sdkmetric.NewManualReader(
+		sdkmetric.WithTemporalitySelector( exporter.Temporality ),
+		sdkmetric.WithAggregationSelector( exporter.Aggregation ),
+	)
+	ups.provider = sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource( resource.NewWithAttributes( "", attributes... ) ),
+		sdkmetric.WithReader( ups.reader ),
+	)
+	meter := ups.provider.Meter( "github.com/viral32111/apc-ups-exporter", metric.WithInstrumentationVersion( PROJECT_VERSION ) )
+
+	// Create the instruments
+	observables := make( []metric.Observable, 0, len( otlpInstruments ) )
+	for _, instrument := range otlpInstruments {
+		var observable metric.Observable
+		var instrumentError error
+
+		if instrument.Cumulative {
+			observable, instrumentError = meter.Float64ObservableCounter( instrument.Name, metric.WithUnit( instrument.Unit ), metric.WithDescription( instrument.Description ) )
+		} else {
+			observable, instrumentError = meter.Float64ObservableGauge( instrument.Name, metric.WithUnit( instrument.Unit ), metric.WithDescription( instrument.Description ) )
+		}
+		if instrumentError != nil { return fmt.Errorf( "create instrument %s: %w", instrument.Name, instrumentError ) }
+
+		observables = append( observables, observable )
+	}
+
+	// Observe them all from the latest status
+	_, callbackError := meter.RegisterCallback( func( ctx context.Context, observer metric.Observer ) error {
+		ups.latestMutex.Lock()
+		defer ups.latestMutex.Unlock()
+
+		for index, instrument := range otlpInstruments {
+			value := instrument.Value( ups.latest )
+			if ( value < 0 ) { continue } // Unknown to this UPS
+			if instrument.Cumulative { value = ups.totals[ index ].Value() }
+
+			observer.ObserveFloat64( observables[ index ].( metric.Float64Observable ), value )
+		}
+
+		return nil
+	}, observables... )
+
+	return callbackError
+
+}
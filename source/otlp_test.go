@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// An exporter that keeps everything exported to it
+type testOTLPExporter struct {
+	mutex sync.Mutex
+	exported []metricdata.ResourceMetrics
+}
+
+func ( exporter *testOTLPExporter ) Temporality( kind sdkmetric.InstrumentKind ) metricdata.Temporality {
+	return sdkmetric.DefaultTemporalitySelector( kind )
+}
+
+func ( exporter *testOTLPExporter ) Aggregation( kind sdkmetric.InstrumentKind ) sdkmetric.Aggregation {
+	return sdkmetric.DefaultAggregationSelector( kind )
+}
+
+func ( exporter *testOTLPExporter ) Export( ctx context.Context, resourceMetrics *metricdata.ResourceMetrics ) error {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	exporter.exported = append( exporter.exported, *resourceMetrics )
+	return nil
+}
+
+func ( exporter *testOTLPExporter ) ForceFlush( ctx context.Context ) error { return nil }
+func ( exporter *testOTLPExporter ) Shutdown( ctx context.Context ) error { return nil }
+
+// Finds the only data point of an instrument in the latest export, giving its value & when it started counting from
+func ( exporter *testOTLPExporter ) getLatestPoint( t *testing.T, name string ) ( value float64, startTime time.Time ) {
+	t.Helper()
+
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	if ( len( exporter.exported ) == 0 ) { t.Fatal( "expected something to be exported" ) }
+	for _, scopeMetrics := range exporter.exported[ len( exporter.exported ) - 1 ].ScopeMetrics {
+		for _, exportedMetric := range scopeMetrics.Metrics {
+			if ( exportedMetric.Name != name ) { continue }
+
+			switch data := exportedMetric.Data.( type ) {
+				case metricdata.Sum[ float64 ]:
+					if !data.IsMonotonic { t.Errorf( "expected %s to be monotonic", name ) }
+					return data.DataPoints[ 0 ].Value, data.DataPoints[ 0 ].StartTime
+				case metricdata.Gauge[ float64 ]: return data.DataPoints[ 0 ].Value, time.Time {}
+			}
+		}
+	}
+
+	t.Fatalf( "expected %s to be exported", name )
+	return 0, time.Time {}
+}
+
+// Creates a status with the totals from the daemon
+func newTestOTLPStatus( serialNumber string, transfers float64, secondsOnBattery float64 ) Status {
+	status := Status {}
+	status.UPS.SerialNumber, status.UPS.LoadPercent = serialNumber, 25
+	status.Daemon.Battery.Transfer.Total, status.Daemon.Battery.TimeSpent.Total = transfers, secondsOnBattery
+
+	return status
+}
+
+func TestOTLPTotalsCarryOnAfterDaemonRestarts( t *testing.T ) {
+	exporter := &testOTLPExporter {}
+	output := &OTLPOutput { exporter: exporter, upses: map[ string ]*otlpUPS {} }
+	defer output.Close()
+
+	var firstStartTime time.Time
+	for index, test := range []struct {
+		serialNumber string
+		transfers float64
+		secondsOnBattery float64
+		expectedTransfers float64
+		expectedSecondsOnBattery float64
+	} {
+		{ "3B1234X56789", 3, 60, 3, 60 },
+		{ "3B1234X56789", 5, 90, 5, 90 },
+		{ "3B1234X56789", 0, 0, 5, 90 }, // The daemon restarted
+		{ "3B1234X56789", 1, 30, 6, 120 },
+		{ "9Z9999X99999", 2, 10, 2, 10 }, // A different UPS starts again
+	} {
+		if publishError := output.Publish( newTestOTLPStatus( test.serialNumber, test.transfers, test.secondsOnBattery ) ); publishError != nil { t.Fatal( publishError ) }
+
+		if transfers, _ := exporter.getLatestPoint( t, "ups.transfers" ); ( transfers != test.expectedTransfers ) { t.Errorf( "%d: expected %v transfers, got %v", index, test.expectedTransfers, transfers ) }
+		secondsOnBattery, startTime := exporter.getLatestPoint( t, "ups.battery.time_on.total" )
+		if ( secondsOnBattery != test.expectedSecondsOnBattery ) { t.Errorf( "%d: expected %v seconds on battery, got %v", index, test.expectedSecondsOnBattery, secondsOnBattery ) }
+		if load, _ := exporter.getLatestPoint( t, "ups.load.utilization" ); ( load != 0.25 ) { t.Errorf( "%d: expected a load of 0.25, got %v", index, load ) }
+
+		// Counting from the same time until the UPS changes
+		if ( index == 0 ) { firstStartTime = startTime }
+		if ( test.serialNumber == "3B1234X56789" && !startTime.Equal( firstStartTime ) ) { t.Errorf( "%d: expected the start time to stay the same, got %s", index, startTime ) }
+		if ( test.serialNumber != "3B1234X56789" && !startTime.After( firstStartTime ) ) { t.Errorf( "%d: expected a new start time for a different UPS, got %s", index, startTime ) }
+	}
+}
+
+func TestOTLPPublishWhileClosing( t *testing.T ) {
+	output := &OTLPOutput { exporter: &testOTLPExporter {}, upses: map[ string ]*otlpUPS {} }
+
+	// Each target publishes at once, as they may do while the output is closed by a reload
+	var waitGroup sync.WaitGroup
+	for _, target := range []string { "rack1", "rack2", "rack3" } {
+		waitGroup.Add( 1 )
+		go func() {
+			defer waitGroup.Done()
+
+			status := newTestOTLPStatus( target, 1, 1 )
+			status.Target = target
+			if publishError := output.Publish( status ); publishError != nil { t.Error( publishError ) }
+		}()
+	}
+	if closeError := output.Close(); closeError != nil { t.Error( closeError ) }
+	waitGroup.Wait()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Structure to follow power outages across successive status fetches
+type OutageTracker struct {
+
+	// How long mains power must be restored before an outage is considered over
+	DebounceDuration time.Duration
+
+	// Whether an outage is currently in progress
+	InProgress bool
+
+	// When the current outage started, and the battery charge at the time
+	StartedAt time.Time
+	StartChargePercent float64
+
+	// The lowest battery charge seen during the current outage
+	LowestChargePercent float64
+
+	// When mains power was restored, if waiting for the debounce duration to pass
+	RestoredAt time.Time
+
+	// The battery charge as of the latest status while on mains power
+	lastOnlineChargePercent float64
+
+}
+
+// Checks if a status text says the UPS is running on battery (e.g., 'ONBATT LOWBATT')
+func isOnBattery( statusText string ) bool {
+	for _, flag := range strings.Fields( statusText ) {
+		if flag == "ONBATT" { return true }
+	}
+
+	return false
+}
+
+// Gets the time the status was obtained from the UPS, falling back to now if the daemon did not say
+func statusTime( status Status ) time.Time {
+	if status.Date.IsZero() { return time.Now() }
+	return status.Date
+}
+
+// Updates the tracker with the latest status, & records completed outages in the metrics
+func ( tracker *OutageTracker ) Update( status Status, metrics *Metrics ) {
+
+	// Get when this status is from, and the charge at that time
+	now := statusTime( status )
+	charge := status.UPS.Battery.ChargePercent
+
+	// Running on battery...
+	if isOnBattery( status.UPS.StatusText ) {
+
+		// Start a new outage, backdated to when the daemon says the UPS went on battery
+		if !tracker.InProgress {
+			tracker.InProgress = true
+			tracker.StartedAt = now.Add( -time.Duration( status.Daemon.Battery.TimeSpent.Current * float64( time.Second ) ) )
+			tracker.StartChargePercent = tracker.lastOnlineChargePercent
+			if ( tracker.StartChargePercent <= 0 ) { tracker.StartChargePercent = charge }
+			tracker.LowestChargePercent = charge
+		}
+
+		// Mains power flapped back off before the debounce duration passed, so continue the same outage
+		tracker.RestoredAt = time.Time{}
+
+		// Keep track of the deepest discharge
+		if ( charge >= 0 && charge < tracker.LowestChargePercent ) { tracker.LowestChargePercent = charge }
+
+		// Update the metrics for the in-progress outage
+		metrics.OutageInProgress.Set( 1 )
+		metrics.OutageDeepestChargePercent.Set( tracker.LowestChargePercent )
+		metrics.V2OutageDeepestChargeRatio.Set( tracker.LowestChargePercent / 100 )
+
+		return
+
+	}
+
+	// Communication with the UPS has been lost, so it is unknown whether mains power is back, and any outage carries on until it is known
+	if hasStatusFlag( status.UPS.StatusText, "COMMLOST" ) { return }
+
+	// Running on mains power, so remember the charge in case the next status is on battery
+	if ( charge >= 0 ) { tracker.lastOnlineChargePercent = charge }
+
+	// Nothing more to do if there is no outage
+	if !tracker.InProgress { return }
+
+	// Mains power has just been restored, so wait for it to settle
+	if tracker.RestoredAt.IsZero() { tracker.RestoredAt = now }
+	if ( now.Sub( tracker.RestoredAt ) < tracker.DebounceDuration ) { return }
+
+	// Record the completed outage
+	metrics.OutageCount.Inc()
+	metrics.OutageDurationSeconds.Observe( tracker.RestoredAt.Sub( tracker.StartedAt ).Seconds() )
+	metrics.OutageChargeUsedPercent.Observe( max( tracker.StartChargePercent - tracker.LowestChargePercent, 0 ) )
+	metrics.V2OutageChargeUsedRatio.Observe( max( tracker.StartChargePercent - tracker.LowestChargePercent, 0 ) / 100 )
+	metrics.OutageDeepestChargePercent.Set( tracker.LowestChargePercent )
+	metrics.V2OutageDeepestChargeRatio.Set( tracker.LowestChargePercent / 100 )
+	metrics.OutageInProgress.Set( 0 )
+
+	// Reset for the next outage
+	tracker.InProgress = false
+	tracker.StartedAt = time.Time{}
+	tracker.RestoredAt = time.Time{}
+
+}
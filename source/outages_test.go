@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Creates the metrics in both schemas, without exporting them anywhere
+func newTestMetrics() *Metrics {
+	return NewMetrics( prometheus.NewRegistry(), "ups", nil, METRICS_SCHEMA_BOTH )
+}
+
+// Gets the number & sum of the observations of a histogram
+func getTestHistogram( t *testing.T, histogram prometheus.Histogram ) ( count uint64, sum float64 ) {
+	t.Helper()
+
+	var metric dto.Metric
+	if writeError := histogram.Write( &metric ); writeError != nil { t.Fatal( writeError ) }
+
+	return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+}
+
+// Creates a status from the daemon at a time, with how long it says the UPS has been on battery
+func newTestOutageStatus( at time.Time, statusText string, chargePercent float64, secondsOnBattery float64 ) Status {
+	status := Status { Date: at }
+	status.UPS.StatusText, status.UPS.Battery.ChargePercent = statusText, chargePercent
+	status.Daemon.Battery.TimeSpent.Current = secondsOnBattery
+
+	return status
+}
+
+func TestOutageTracker( t *testing.T ) {
+	metrics := newTestMetrics()
+	tracker := &OutageTracker { DebounceDuration: time.Minute }
+	start := time.Date( 2024, 3, 1, 12, 0, 0, 0, time.UTC )
+
+	for index, test := range []struct {
+		offset time.Duration
+		statusText string
+		chargePercent float64
+		secondsOnBattery float64
+		expectedInProgress bool
+		expectedCount float64
+	} {
+		{ 0, "ONLINE", 100, 0, false, 0 },
+
+		// Went on battery 20 seconds before the status was fetched
+		{ 30 * time.Second, "ONBATT", 95, 20, true, 0 },
+		{ 60 * time.Second, "ONBATT", 80, 50, true, 0 },
+
+		// A short blip of mains power is part of the same outage
+		{ 90 * time.Second, "ONLINE", 81, 0, true, 0 },
+		{ 120 * time.Second, "ONBATT", 78, 5, true, 0 },
+
+		// Communication lost while on battery, then again after mains power returns, never ends the outage
+		{ 150 * time.Second, "COMMLOST", 0, 0, true, 0 },
+		{ 180 * time.Second, "ONLINE", 79, 0, true, 0 },
+		{ 210 * time.Second, "COMMLOST", 0, 0, true, 0 },
+		{ 300 * time.Second, "COMMLOST", 0, 0, true, 0 },
+
+		// Over once mains power has been back for the debounce duration
+		{ 330 * time.Second, "ONLINE", 85, 0, false, 1 },
+		{ 360 * time.Second, "ONLINE", 86, 0, false, 1 },
+	} {
+		tracker.Update( newTestOutageStatus( start.Add( test.offset ), test.statusText, test.chargePercent, test.secondsOnBattery ), metrics )
+
+		if ( tracker.InProgress != test.expectedInProgress ) { t.Errorf( "%d: expected in progress to be %t, got %t", index, test.expectedInProgress, tracker.InProgress ) }
+		if count := testutil.ToFloat64( metrics.OutageCount ); ( count != test.expectedCount ) { t.Errorf( "%d: expected %v outages, got %v", index, test.expectedCount, count ) }
+		if inProgress := testutil.ToFloat64( metrics.OutageInProgress ); ( ( inProgress == 1 ) != test.expectedInProgress ) { t.Errorf( "%d: expected the in progress metric to be %t, got %v", index, test.expectedInProgress, inProgress ) }
+	}
+
+	// From when the UPS went on battery until mains power was restored for good, using the charge from before it started
+	if count, sum := getTestHistogram( t, metrics.OutageDurationSeconds ); ( count != 1 || sum != 170 ) { t.Errorf( "expected an outage of 170 seconds, got %d lasting %v", count, sum ) }
+	if count, sum := getTestHistogram( t, metrics.OutageChargeUsedPercent ); ( count != 1 || sum != 22 ) { t.Errorf( "expected 22%% of the charge to be used, got %d using %v", count, sum ) }
+	if deepest := testutil.ToFloat64( metrics.OutageDeepestChargePercent ); ( deepest != 78 ) { t.Errorf( "expected the deepest charge to be 78%%, got %v", deepest ) }
+}
+
+func TestOutageTrackerWithoutDebounce( t *testing.T ) {
+	metrics := newTestMetrics()
+	tracker := &OutageTracker {}
+	start := time.Date( 2024, 3, 1, 12, 0, 0, 0, time.UTC )
+
+	// Without a charge from before the outage, the first on battery is used
+	tracker.Update( newTestOutageStatus( start, "ONBATT", 90, 0 ), metrics )
+	tracker.Update( newTestOutageStatus( start.Add( 10 * time.Second ), "ONBATT LOWBATT", 70, 10 ), metrics )
+	tracker.Update( newTestOutageStatus( start.Add( 20 * time.Second ), "ONLINE", 71, 0 ), metrics )
+
+	if tracker.InProgress { t.Error( "expected the outage to be over straight away" ) }
+	if count, sum := getTestHistogram( t, metrics.OutageDurationSeconds ); ( count != 1 || sum != 20 ) { t.Errorf( "expected an outage of 20 seconds, got %d lasting %v", count, sum ) }
+	if count, sum := getTestHistogram( t, metrics.V2OutageChargeUsedRatio ); ( count != 1 || sum != 0.2 ) { t.Errorf( "expected 0.2 of the charge to be used, got %d using %v", count, sum ) }
+}
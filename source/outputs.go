@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Something that is sent the latest status after every collection, such as a Pushgateway
+type Output interface {
+
+	// Gets a short name for display purposes
+	Name() string
+
+	// Sends the latest status (and/or the metrics derived from it)
+	Publish( status Status ) error
+
+	// Sends anything still pending & releases any resources
+	Close() error
+
+}
+
+// An output that sends the metrics of every target at once (e.g., gathered from the registries), so it only needs publishing to once per collection
+type MetricsOutput interface {
+	Output
+
+	// Sends the latest metrics
+	PublishMetrics() error
+}
+
+// The outputs used by the background metrics collection
+// NOTE: This is replaced when the configuration is reloaded, so use getOutputs() instead
+var outputs []Output
+
+// Gets the current outputs
+func getOutputs() []Output {
+	targetsMutex.RLock()
+	defer targetsMutex.RUnlock()
+
+	return outputs
+}
+
+// Gets the current outputs for a collection, which are not closed by a reload until the function that is given is called
+func useOutputs() ( currentOutputs []Output, release func() ) {
+	targetsMutex.RLock()
+	defer targetsMutex.RUnlock()
+
+	inUse := targetsInUse
+	inUse.Add( 1 )
+	return outputs, inUse.Done
+}
+
+// Splits the value of an output flag into the type of output & where it should go (e.g., 'pushgateway:http://127.0.0.1:9091')
+func ParseOutputFlag( value string ) ( kind string, target string, err error ) {
+	kind, target, hasSeparator := strings.Cut( value, ":" )
+	if ( !hasSeparator || kind == "" || target == "" ) { return "", "", errors.New( "output must be in the format type:target" ) }
+
+	return kind, target, nil
+}
+
+// Sends the latest status of each target that was fetched from to all of the outputs, giving how many failed
+// NOTE: Outputs of metrics are only published to once, as they send those of every target together
+func publishToOutputs( statuses []Status ) ( failedCount int ) {
+	if ( len( statuses ) == 0 ) { return 0 }
+
+	currentOutputs, release := useOutputs()
+	defer release()
+
+	for _, output := range currentOutputs {
+		var publishError error
+		if metricsOutput, isMetricsOutput := output.( MetricsOutput ); isMetricsOutput {
+			publishError = metricsOutput.PublishMetrics()
+		} else {
+			for _, status := range statuses { publishError = errors.Join( publishError, output.Publish( status ) ) }
+		}
+
+		if publishError != nil {
+			slog.Error( "Failed to publish to output", "output", output.Name(), "error", publishError )
+			failedCount++
+			continue
+		}
+
+		slog.Debug( "Published to output", "output", output.Name() )
+	}
+
+	return failedCount
+}
+
+// Sends anything still pending to all of the outputs & closes them, giving how many failed
+func closeOutputs() ( failedCount int ) {
+	for _, output := range getOutputs() {
+		closeError := output.Close()
+		if closeError != nil {
+			slog.Error( "Failed to close output", "output", output.Name(), "error", closeError )
+			failedCount++
+		}
+	}
+
+	return failedCount
+}
+
+// Calls a function until it succeeds, waiting twice as long after each failed attempt
+func retryWithBackoff( attempts int, delay time.Duration, function func() error ) ( err error ) {
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = function()
+		if ( err == nil || attempt == attempts ) { break }
+
+		time.Sleep( delay )
+		delay *= 2
+	}
+
+	return err
+}
+
+// Calls a function until it succeeds like retryWithBackoff(), but gives up early once the context is done (e.g., its deadline has passed)
+func retryWithBackoffContext( ctx context.Context, attempts int, delay time.Duration, function func( ctx context.Context ) error ) ( err error ) {
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = function( ctx )
+		if ( err == nil || attempt == attempts || ctx.Err() != nil ) { break }
+
+		select {
+			case <-ctx.Done(): return err
+			case <-time.After( delay ):
+		}
+		delay *= 2
+	}
+
+	return err
+}
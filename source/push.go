@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Pushes the metrics to a Prometheus Pushgateway, for when Prometheus cannot scrape us
+type PushgatewayOutput struct {
+	pusher *push.Pusher
+
+	// How many times to try pushing before giving up until the next collection
+	Attempts int
+
+	// The most time to spend on every attempt together, so a slow or failing Pushgateway cannot stall collection for longer than its interval
+	Timeout time.Duration
+}
+
+// Creates an output for a Pushgateway, grouped by the job name & any extra labels
+func NewPushgatewayOutput( url string, job string, grouping map[ string ] string, username string, password string, attempts int, timeout time.Duration, gatherer prometheus.Gatherer ) *PushgatewayOutput {
+
+	// Setup the pusher with a timeout so a slow Pushgateway cannot stall collection
+	pusher := push.New( url, job ).Gatherer( gatherer ).Client( &http.Client { Timeout: 10 * time.Second } )
+	for name, value := range grouping { pusher = pusher.Grouping( name, value ) }
+	if ( username != "" ) { pusher = pusher.BasicAuth( username, password ) }
+
+	return &PushgatewayOutput {
+		pusher: pusher,
+		Attempts: attempts,
+		Timeout: timeout,
+	}
+
+}
+
+// Gets a short name for display purposes
+func ( output *PushgatewayOutput ) Name() string {
+	return "Pushgateway"
+}
+
+// Does the same as PublishMetrics(), as the metrics are gathered from the registries instead of the status
+func ( output *PushgatewayOutput ) Publish( status Status ) error {
+	return output.PublishMetrics()
+}
+
+// Replaces the metrics on the Pushgateway with the latest ones, giving up once the timeout has passed even if there are attempts left
+// NOTE: The metrics of every target are gathered from their registries, so this is only called once per collection
+func ( output *PushgatewayOutput ) PublishMetrics() error {
+	ctx, cancel := context.WithTimeout( context.Background(), output.Timeout )
+	defer cancel()
+
+	return retryWithBackoffContext( ctx, output.Attempts, time.Second, func( ctx context.Context ) error {
+		pushError := output.pusher.PushContext( ctx )
+		if pushError != nil { return fmt.Errorf( "push to Pushgateway: %w", pushError ) }
+
+		return nil
+	} )
+}
+
+// Nothing to do, as every push is sent straight away
+func ( output *PushgatewayOutput ) Close() error {
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Pushgateway that records every push, failing the first few
+type testPushgateway struct {
+	mutex sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies []string
+}
+
+func ( gateway *testPushgateway ) ServeHTTP( response http.ResponseWriter, request *http.Request ) {
+	body, _ := io.ReadAll( request.Body )
+
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+
+	gateway.requests = append( gateway.requests, request )
+	gateway.bodies = append( gateway.bodies, string( body ) )
+	if ( len( gateway.requests ) <= gateway.failures ) {
+		response.WriteHeader( http.StatusServiceUnavailable )
+		return
+	}
+
+	response.WriteHeader( http.StatusOK )
+}
+
+// Creates a registry with a single gauge, for the output to gather
+func newTestPushRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge( prometheus.GaugeOpts { Name: "ups_load_percent", Help: "The load." } )
+	gauge.Set( 25 )
+	registry.MustRegister( gauge )
+
+	return registry
+}
+
+func TestPushgatewayGroupingAndAuthentication( t *testing.T ) {
+	gateway := &testPushgateway {}
+	server := httptest.NewServer( gateway )
+	defer server.Close()
+
+	output := NewPushgatewayOutput( server.URL, "apc_ups_exporter", map[ string ]string { "instance": "nas" }, "user", "secret", 3, 10 * time.Second, newTestPushRegistry() )
+	if publishError := output.Publish( Status {} ); publishError != nil { t.Fatal( publishError ) }
+
+	if ( len( gateway.requests ) != 1 ) { t.Fatalf( "expected 1 push, got %d", len( gateway.requests ) ) }
+	request := gateway.requests[ 0 ]
+	if ( request.Method != http.MethodPut || request.URL.Path != "/metrics/job/apc_ups_exporter/instance/nas" ) { t.Errorf( "unexpected push %s %s", request.Method, request.URL.Path ) }
+	if username, password, ok := request.BasicAuth(); ( !ok || username != "user" || password != "secret" ) { t.Errorf( "unexpected basic authentication %q %q %v", username, password, ok ) }
+	if !strings.Contains( gateway.bodies[ 0 ], "ups_load_percent" ) { t.Error( "expected the metrics to be pushed" ) }
+}
+
+func TestPushgatewayRetriesServerErrors( t *testing.T ) {
+	gateway := &testPushgateway { failures: 2 }
+	server := httptest.NewServer( gateway )
+	defer server.Close()
+
+	output := NewPushgatewayOutput( server.URL, "apc_ups_exporter", nil, "", "", 3, 10 * time.Second, newTestPushRegistry() )
+	if publishError := output.Publish( Status {} ); publishError != nil { t.Fatalf( "expected the third attempt to succeed, got %v", publishError ) }
+	if ( len( gateway.requests ) != 3 ) { t.Errorf( "expected 3 pushes, got %d", len( gateway.requests ) ) }
+	if _, _, ok := gateway.requests[ 0 ].BasicAuth(); ok { t.Error( "expected no basic authentication without a username" ) }
+}
+
+func TestPushgatewayGivesUpAfterTimeout( t *testing.T ) {
+	gateway := &testPushgateway { failures: 100 }
+	server := httptest.NewServer( gateway )
+	defer server.Close()
+
+	// Waiting between all of the attempts would take over a minute
+	output := NewPushgatewayOutput( server.URL, "apc_ups_exporter", nil, "", "", 10, 1500 * time.Millisecond, newTestPushRegistry() )
+	startedAt := time.Now()
+	publishError := output.Publish( Status {} )
+	if ( publishError == nil || !strings.Contains( publishError.Error(), "push to Pushgateway" ) ) { t.Errorf( "expected the push to fail, got %v", publishError ) }
+	if elapsed := time.Since( startedAt ); ( elapsed > 3 * time.Second ) { t.Errorf( "expected to give up after the timeout, took %s", elapsed ) }
+	if ( len( gateway.requests ) != 2 ) { t.Errorf( "expected 2 pushes before the timeout, got %d", len( gateway.requests ) ) }
+}
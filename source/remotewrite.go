@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// A single sample for a series, as sent over the remote write protocol
+type remoteWriteSample struct {
+	Labels []*dto.LabelPair // Sorted by name, including __name__
+	Value float64
+	Timestamp int64 // Unix milliseconds
+}
+
+// Sends the metrics to a Prometheus remote write endpoint (e.g., Mimir, Thanos, VictoriaMetrics), for when there is no local Prometheus
+// Samples are held in a bounded queue & sent in batches by a background routine, so they survive short network outages
+type RemoteWriteOutput struct {
+	url string
+	client *http.Client
+	gatherer prometheus.Gatherer
+	extraLabels map[ string ]string
+	username string
+	password string
+
+	// The most samples to send in one request, and to hold while the endpoint is unreachable
+	BatchSize int
+	QueueCapacity int
+
+	// How long to wait before first trying to send again, which doubles after each failure
+	retryDelay time.Duration
+
+	// The queue of samples waiting to be sent, oldest first, and how many have been dropped from it for being full
+	queueMutex sync.Mutex
+	queue []remoteWriteSample
+	droppedCount int
+
+	// Signals for the background routine
+	wake chan struct{}
+	stop chan struct{}
+	stopped chan struct{}
+}
+
+// Creates an output for a remote write endpoint & starts sending in the background
+func NewRemoteWriteOutput( url string, extraLabels map[ string ]string, username string, password string, batchSize int, queueCapacity int, gatherer prometheus.Gatherer ) *RemoteWriteOutput {
+	output := &RemoteWriteOutput {
+		url: url,
+		client: &http.Client { Timeout: 30 * time.Second },
+		gatherer: gatherer,
+		extraLabels: extraLabels,
+		username: username,
+		password: password,
+
+		BatchSize: batchSize,
+		QueueCapacity: queueCapacity,
+
+		retryDelay: time.Second,
+
+		wake: make( chan struct{}, 1 ),
+		stop: make( chan struct{} ),
+		stopped: make( chan struct{} ),
+	}
+
+	go output.sendInBackground()
+
+	return output
+}
+
+// Gets a short name for display purposes
+func ( output *RemoteWriteOutput ) Name() string {
+	return "remote write"
+}
+
+// Does the same as PublishMetrics(), as the metrics are gathered from the registries instead of the status
+func ( output *RemoteWriteOutput ) Publish( status Status ) error {
+	return output.PublishMetrics()
+}
+
+// Adds the latest metrics to the queue, to be sent by the background routine
+// NOTE: The metrics of every target are gathered from their registries, so this is only called once per collection
+func ( output *RemoteWriteOutput ) PublishMetrics() error {
+
+	// Gather the metrics, timestamped with now as that is when they were collected
+	families, gatherError := output.gatherer.Gather()
+	if gatherError != nil { return gatherError }
+	samples := convertToRemoteWriteSamples( families, output.extraLabels, time.Now().UnixMilli() )
+
+	// Add them to the queue, dropping the oldest samples if it is full
+	output.queueMutex.Lock()
+	output.queue = append( output.queue, samples... )
+	droppedCount := len( output.queue ) - output.QueueCapacity
+	if ( droppedCount > 0 ) {
+		output.queue = output.queue[ droppedCount : ]
+		output.droppedCount += droppedCount
+	}
+	queueLength := len( output.queue )
+	output.queueMutex.Unlock()
+
+	// Wake the background routine, unless it is already awake
+	select {
+		case output.wake <- struct{}{}:
+		default:
+	}
+
+	if ( droppedCount > 0 ) { return fmt.Errorf( "queue is full, dropped the %d oldest samples", droppedCount ) }
+	if ( queueLength > len( samples ) ) { slog.Debug( "Samples are waiting to be sent to the remote write endpoint", "count", queueLength ) }
+
+	return nil
+
+}
+
+// Stops the background routine, after trying to send whatever is left in the queue once more
+func ( output *RemoteWriteOutput ) Close() error {
+	close( output.stop )
+
+	select {
+		case <-output.stopped: return nil
+		case <-time.After( 30 * time.Second ): return fmt.Errorf( "gave up waiting for the queue to be sent" )
+	}
+}
+
+// Sends batches from the queue until it is empty, retrying with backoff if the endpoint is unreachable
+func ( output *RemoteWriteOutput ) sendInBackground() {
+	defer close( output.stopped )
+
+	for {
+
+		// Wait to be woken by a new collection, or stopped
+		stopping := false
+		select {
+			case <-output.wake:
+			case <-output.stop: stopping = true
+		}
+
+		// Send everything in the queue, one batch at a time
+		delay := output.retryDelay
+		for {
+
+			// Take the oldest batch from the queue, without removing it in case sending fails
+			output.queueMutex.Lock()
+			batch := output.queue[ : min( output.BatchSize, len( output.queue ) ) ]
+			droppedBefore := output.droppedCount
+			output.queueMutex.Unlock()
+			if ( len( batch ) == 0 ) { break }
+
+			// Try to send it
+			retry, sendError := output.send( batch )
+			if ( sendError != nil && retry ) {
+				slog.Warn( "Failed to send samples to the remote write endpoint, trying again", "count", len( batch ), "delay", delay, "error", sendError )
+
+				// Give up on the rest of the queue if we are stopping, otherwise wait a while before trying again
+				if stopping { return }
+				select {
+					case <-time.After( delay ):
+					case <-output.stop: stopping = true
+				}
+
+				delay = min( delay * 2, time.Minute )
+				continue
+			}
+
+			// The endpoint refused the batch outright, so there is no point sending it again
+			if ( sendError != nil ) { slog.Error( "Remote write endpoint rejected samples, dropping them", "count", len( batch ), "error", sendError ) }
+
+			// Remove the batch from the queue
+			// NOTE: Samples may have been dropped from the front of the queue while we were sending, so only remove what is still there
+			output.queueMutex.Lock()
+			remainingCount := max( len( batch ) - ( output.droppedCount - droppedBefore ), 0 )
+			output.queue = output.queue[ min( remainingCount, len( output.queue ) ) : ]
+			output.queueMutex.Unlock()
+
+			delay = output.retryDelay
+
+		}
+
+		if stopping { return }
+
+	}
+}
+
+// Sends a batch of samples, returning whether it is worth trying again if it failed
+func ( output *RemoteWriteOutput ) send( batch []remoteWriteSample ) ( retry bool, err error ) {
+
+	// Encode & compress the batch
+	body := snappy.Encode( nil, encodeRemoteWriteRequest( batch ) )
+
+	// Create the request - prometheus.io/docs/specs/remote_write_spec/
+	request, requestError := http.NewRequest( http.MethodPost, output.url, bytes.NewReader( body ) )
+	if requestError != nil { return false, requestError }
+	request.Header.Set( "Content-Encoding", "snappy" )
+	request.Header.Set( "Content-Type", "application/x-protobuf" )
+	request.Header.Set( "User-Agent", fmt.Sprintf( "apc-ups-exporter/%s", PROJECT_VERSION ) )
+	request.Header.Set( "X-Prometheus-Remote-Write-Version", "0.1.0" )
+	if ( output.username != "" ) { request.SetBasicAuth( output.username, output.password ) }
+
+	// Send the request
+	response, responseError := output.client.Do( request )
+	if responseError != nil { return true, responseError }
+	defer response.Body.Close()
+
+	// Success
+	if ( response.StatusCode >= 200 && response.StatusCode < 300 ) { return false, nil }
+
+	// Server errors & rate limiting are temporary, but anything else is not
+	responseBody, _ := io.ReadAll( io.LimitReader( response.Body, 512 ) )
+	return response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests, fmt.Errorf( "%s: %s", response.Status, bytes.TrimSpace( responseBody ) )
+
+}
+
+// Converts gathered metrics into individual samples, expanding histograms into their bucket, sum & count series
+func convertToRemoteWriteSamples( families []*dto.MetricFamily, extraLabels map[ string ]string, timestamp int64 ) ( samples []remoteWriteSample ) {
+
+	// Creates a sample with the metric's labels, the extra labels & any labels specific to this series
+	createSample := func( name string, metric *dto.Metric, value float64, seriesLabels ...*dto.LabelPair ) remoteWriteSample {
+		labels := []*dto.LabelPair { { Name: stringPointer( "__name__" ), Value: stringPointer( name ) } }
+		for labelName, labelValue := range extraLabels { labels = append( labels, &dto.LabelPair { Name: stringPointer( labelName ), Value: stringPointer( labelValue ) } ) }
+		labels = append( labels, metric.GetLabel()... )
+		labels = append( labels, seriesLabels... )
+		sort.Slice( labels, func( a, b int ) bool { return labels[ a ].GetName() < labels[ b ].GetName() } )
+
+		return remoteWriteSample { Labels: labels, Value: value, Timestamp: timestamp }
+	}
+
+	for _, family := range families {
+		name := family.GetName()
+
+		for _, metric := range family.GetMetric() {
+			switch family.GetType() {
+				case dto.MetricType_GAUGE: samples = append( samples, createSample( name, metric, metric.GetGauge().GetValue() ) )
+				case dto.MetricType_COUNTER: samples = append( samples, createSample( name, metric, metric.GetCounter().GetValue() ) )
+				case dto.MetricType_UNTYPED: samples = append( samples, createSample( name, metric, metric.GetUntyped().GetValue() ) )
+
+				case dto.MetricType_HISTOGRAM: {
+					histogram := metric.GetHistogram()
+					for _, bucket := range histogram.GetBucket() {
+						upperBound := stringPointer( strconv.FormatFloat( bucket.GetUpperBound(), 'g', -1, 64 ) )
+						samples = append( samples, createSample( name + "_bucket", metric, float64( bucket.GetCumulativeCount() ), &dto.LabelPair { Name: stringPointer( "le" ), Value: upperBound } ) )
+					}
+					samples = append( samples, createSample( name + "_bucket", metric, float64( histogram.GetSampleCount() ), &dto.LabelPair { Name: stringPointer( "le" ), Value: stringPointer( "+Inf" ) } ) )
+					samples = append( samples, createSample( name + "_sum", metric, histogram.GetSampleSum() ) )
+					samples = append( samples, createSample( name + "_count", metric, float64( histogram.GetSampleCount() ) ) )
+				}
+			}
+		}
+	}
+
+	return samples
+
+}
+
+// Encodes samples as a remote write request protocol buffer, with one series per sample
+// NOTE: This is hand-encoded to avoid depending on all of Prometheus for three tiny messages - github.com/prometheus/prometheus/blob/main/prompb/remote.proto
+func encodeRemoteWriteRequest( samples []remoteWriteSample ) []byte {
+	var request []byte
+
+	for _, sample := range samples {
+
+		// TimeSeries.labels (1)
+		var series []byte
+		for _, label := range sample.Labels {
+			var encodedLabel []byte
+			encodedLabel = protowire.AppendTag( encodedLabel, 1, protowire.BytesType )
+			encodedLabel = protowire.AppendString( encodedLabel, label.GetName() )
+			encodedLabel = protowire.AppendTag( encodedLabel, 2, protowire.BytesType )
+			encodedLabel = protowire.AppendString( encodedLabel, label.GetValue() )
+
+			series = protowire.AppendTag( series, 1, protowire.BytesType )
+			series = protowire.AppendBytes( series, encodedLabel )
+		}
+
+		// TimeSeries.samples (2)
+		var encodedSample []byte
+		encodedSample = protowire.AppendTag( encodedSample, 1, protowire.Fixed64Type )
+		encodedSample = protowire.AppendFixed64( encodedSample, math.Float64bits( sample.Value ) )
+		encodedSample = protowire.AppendTag( encodedSample, 2, protowire.VarintType )
+		encodedSample = protowire.AppendVarint( encodedSample, uint64( sample.Timestamp ) )
+		series = protowire.AppendTag( series, 2, protowire.BytesType )
+		series = protowire.AppendBytes( series, encodedSample )
+
+		// WriteRequest.timeseries (1)
+		request = protowire.AppendTag( request, 1, protowire.BytesType )
+		request = protowire.AppendBytes( request, series )
+
+	}
+
+	return request
+}
+
+// Gets a pointer to a copy of a string, as the metric structures need them
+func stringPointer( value string ) *string {
+	return &value
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// A series sent to a remote write endpoint, with its only sample
+type testRemoteWriteSeries struct {
+	Labels [][ 2 ]string // In the order they were sent
+	Value float64
+	Timestamp int64
+}
+
+// Gets the value of a label of the series, or nothing if it does not have it
+func ( series testRemoteWriteSeries ) getLabel( name string ) string {
+	for _, label := range series.Labels {
+		if ( label[ 0 ] == name ) { return label[ 1 ] }
+	}
+
+	return ""
+}
+
+// Consumes every field of a protocol buffer message, calling the function with the number & value of each
+func consumeTestProtobufFields( t *testing.T, message []byte, function func( number protowire.Number, value []byte, fixed64 uint64, varint uint64 ) ) {
+	t.Helper()
+
+	for len( message ) > 0 {
+		number, wireType, tagLength := protowire.ConsumeTag( message )
+		if ( tagLength < 0 ) { t.Fatalf( "invalid tag: %v", protowire.ParseError( tagLength ) ) }
+		message = message[ tagLength : ]
+
+		var value []byte
+		var fixed64, varint uint64
+		var valueLength int
+		switch wireType {
+			case protowire.BytesType: value, valueLength = protowire.ConsumeBytes( message )
+			case protowire.Fixed64Type: fixed64, valueLength = protowire.ConsumeFixed64( message )
+			case protowire.VarintType: varint, valueLength = protowire.ConsumeVarint( message )
+			default: t.Fatalf( "unexpected wire type %v for field %d", wireType, number )
+		}
+		if ( valueLength < 0 ) { t.Fatalf( "invalid value for field %d: %v", number, protowire.ParseError( valueLength ) ) }
+		message = message[ valueLength : ]
+
+		function( number, value, fixed64, varint )
+	}
+}
+
+// Decompresses & decodes a remote write request back into its series
+func decodeTestRemoteWriteRequest( t *testing.T, body []byte ) ( seriesList []testRemoteWriteSeries ) {
+	t.Helper()
+
+	request, decodeError := snappy.Decode( nil, body )
+	if decodeError != nil { t.Fatal( decodeError ) }
+
+	// WriteRequest.timeseries (1)
+	consumeTestProtobufFields( t, request, func( number protowire.Number, encodedSeries []byte, _ uint64, _ uint64 ) {
+		if ( number != 1 ) { t.Fatalf( "unexpected field %d of the request", number ) }
+
+		var series testRemoteWriteSeries
+		consumeTestProtobufFields( t, encodedSeries, func( number protowire.Number, value []byte, _ uint64, _ uint64 ) {
+			switch number {
+
+				// TimeSeries.labels (1), with the name (1) & value (2)
+				case 1: {
+					var label [ 2 ]string
+					consumeTestProtobufFields( t, value, func( number protowire.Number, text []byte, _ uint64, _ uint64 ) { label[ number - 1 ] = string( text ) } )
+					series.Labels = append( series.Labels, label )
+				}
+
+				// TimeSeries.samples (2), with the value (1) & timestamp (2)
+				case 2: consumeTestProtobufFields( t, value, func( number protowire.Number, _ []byte, fixed64 uint64, varint uint64 ) {
+					if ( number == 1 ) { series.Value = math.Float64frombits( fixed64 ) }
+					if ( number == 2 ) { series.Timestamp = int64( varint ) }
+				} )
+
+				default: t.Fatalf( "unexpected field %d of a series", number )
+			}
+		} )
+
+		seriesList = append( seriesList, series )
+	} )
+
+	return seriesList
+}
+
+// A remote write endpoint that responds with each of the status codes in turn (then OK), keeping the body of every request
+type testRemoteWriteEndpoint struct {
+	server *httptest.Server
+
+	mutex sync.Mutex
+	statusCodes []int
+	bodies [][]byte
+	requests []*http.Request
+}
+
+// Starts a remote write endpoint
+func startTestRemoteWriteEndpoint( t *testing.T, statusCodes ...int ) *testRemoteWriteEndpoint {
+	t.Helper()
+
+	endpoint := &testRemoteWriteEndpoint { statusCodes: statusCodes }
+	endpoint.server = httptest.NewServer( http.HandlerFunc( func( response http.ResponseWriter, request *http.Request ) {
+		body, _ := io.ReadAll( request.Body )
+
+		endpoint.mutex.Lock()
+		defer endpoint.mutex.Unlock()
+
+		endpoint.bodies = append( endpoint.bodies, body )
+		endpoint.requests = append( endpoint.requests, request )
+		if ( len( endpoint.statusCodes ) > 0 ) {
+			http.Error( response, http.StatusText( endpoint.statusCodes[ 0 ] ), endpoint.statusCodes[ 0 ] )
+			endpoint.statusCodes = endpoint.statusCodes[ 1 : ]
+		}
+	} ) )
+	t.Cleanup( endpoint.server.Close )
+
+	return endpoint
+}
+
+// Gets the bodies of the requests received so far
+func ( endpoint *testRemoteWriteEndpoint ) getBodies() [][]byte {
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+
+	return append( [][]byte {}, endpoint.bodies... )
+}
+
+// Creates a registry with a gauge & a histogram for a UPS, giving the gauge
+func newTestRemoteWriteRegistry() ( *prometheus.Registry, prometheus.Gauge ) {
+	registry := prometheus.NewRegistry()
+	factory := promauto.With( registry )
+	labels := prometheus.Labels { "ups": "rack1" }
+
+	gauge := factory.NewGauge( prometheus.GaugeOpts { Name: "ups_load_percent", Help: "Load.", ConstLabels: labels } )
+	gauge.Set( 25 )
+	histogram := factory.NewHistogram( prometheus.HistogramOpts { Name: "ups_outage_seconds", Help: "Outages.", ConstLabels: labels, Buckets: []float64 { 60, 300 } } )
+	histogram.Observe( 90 )
+
+	return registry, gauge
+}
+
+// Waits for the queue of the output to be empty
+func waitForTestRemoteWriteQueue( t *testing.T, output *RemoteWriteOutput ) {
+	t.Helper()
+
+	for deadline := time.Now().Add( 2 * time.Second ); time.Now().Before( deadline ); time.Sleep( 10 * time.Millisecond ) {
+		output.queueMutex.Lock()
+		queueLength := len( output.queue )
+		output.queueMutex.Unlock()
+
+		if ( queueLength == 0 ) { return }
+	}
+
+	t.Fatal( "expected the queue to be sent" )
+}
+
+func TestRemoteWriteRequest( t *testing.T ) {
+	endpoint := startTestRemoteWriteEndpoint( t )
+	registry, _ := newTestRemoteWriteRegistry()
+	output := NewRemoteWriteOutput( endpoint.server.URL, map[ string ]string { "site": "london" }, "prometheus", "secret", 100, 1000, registry )
+
+	publishedAt := time.Now().UnixMilli()
+	if publishError := output.PublishMetrics(); publishError != nil { t.Fatal( publishError ) }
+	if closeError := output.Close(); closeError != nil { t.Fatal( closeError ) }
+
+	bodies := endpoint.getBodies()
+	if ( len( bodies ) != 1 ) { t.Fatalf( "expected 1 request, got %d", len( bodies ) ) }
+	request := endpoint.requests[ 0 ]
+	if ( request.Header.Get( "Content-Encoding" ) != "snappy" || request.Header.Get( "Content-Type" ) != "application/x-protobuf" || request.Header.Get( "X-Prometheus-Remote-Write-Version" ) != "0.1.0" ) { t.Errorf( "unexpected headers %v", request.Header ) }
+	if username, password, ok := request.BasicAuth(); ( !ok || username != "prometheus" || password != "secret" ) { t.Errorf( "expected basic authentication, got %q & %q", username, password ) }
+
+	// The gauge, then each bucket of the histogram with its sum & count
+	expected := []struct {
+		name string
+		le string
+		value float64
+	} {
+		{ "ups_load_percent", "", 25 },
+		{ "ups_outage_seconds_bucket", "60", 0 },
+		{ "ups_outage_seconds_bucket", "300", 1 },
+		{ "ups_outage_seconds_bucket", "+Inf", 1 },
+		{ "ups_outage_seconds_sum", "", 90 },
+		{ "ups_outage_seconds_count", "", 1 },
+	}
+	seriesList := decodeTestRemoteWriteRequest( t, bodies[ 0 ] )
+	if ( len( seriesList ) != len( expected ) ) { t.Fatalf( "expected %d series, got %+v", len( expected ), seriesList ) }
+	for index, series := range seriesList {
+		if ( series.getLabel( "__name__" ) != expected[ index ].name || series.getLabel( "le" ) != expected[ index ].le || series.Value != expected[ index ].value ) { t.Errorf( "expected %+v, got %+v", expected[ index ], series ) }
+		if ( series.getLabel( "ups" ) != "rack1" || series.getLabel( "site" ) != "london" ) { t.Errorf( "expected the labels of the metric & the extra labels, got %v", series.Labels ) }
+		if ( series.Timestamp < publishedAt || series.Timestamp > time.Now().UnixMilli() ) { t.Errorf( "expected the time it was published, got %d", series.Timestamp ) }
+
+		for labelIndex := 1; labelIndex < len( series.Labels ); labelIndex++ {
+			if ( series.Labels[ labelIndex - 1 ][ 0 ] >= series.Labels[ labelIndex ][ 0 ] ) { t.Errorf( "expected the labels to be sorted by name, got %v", series.Labels ) }
+		}
+	}
+}
+
+func TestRemoteWriteQueueDropsOldest( t *testing.T ) {
+	registry, gauge := newTestRemoteWriteRegistry()
+
+	// Without sending in the background, so everything stays in the queue
+	output := &RemoteWriteOutput { gatherer: registry, BatchSize: 6, QueueCapacity: 8, wake: make( chan struct{}, 1 ) }
+	if publishError := output.PublishMetrics(); publishError != nil { t.Fatal( publishError ) }
+	gauge.Set( 50 )
+	if publishError := output.PublishMetrics(); ( publishError == nil || publishError.Error() != "queue is full, dropped the 4 oldest samples" ) { t.Errorf( "expected the oldest samples to be dropped, got %v", publishError ) }
+
+	// The last two of the first collection, then all of the second
+	if ( len( output.queue ) != 8 || output.droppedCount != 4 ) { t.Fatalf( "expected 8 samples after dropping 4, got %d after dropping %d", len( output.queue ), output.droppedCount ) }
+	if ( output.queue[ 0 ].Value != 90 || output.queue[ 2 ].Value != 50 ) { t.Errorf( "expected the oldest samples to be dropped, got %+v", output.queue ) }
+}
+
+func TestRemoteWriteRetries( t *testing.T ) {
+	registry, _ := newTestRemoteWriteRegistry()
+
+	// Server errors & rate limiting are sent again
+	endpoint := startTestRemoteWriteEndpoint( t, http.StatusServiceUnavailable, http.StatusTooManyRequests )
+	output := NewRemoteWriteOutput( endpoint.server.URL, nil, "", "", 100, 1000, registry )
+	output.retryDelay = 10 * time.Millisecond
+	if publishError := output.PublishMetrics(); publishError != nil { t.Fatal( publishError ) }
+	waitForTestRemoteWriteQueue( t, output )
+	output.Close()
+
+	bodies := endpoint.getBodies()
+	if ( len( bodies ) != 3 ) { t.Fatalf( "expected 3 attempts, got %d", len( bodies ) ) }
+	if ( string( bodies[ 0 ] ) != string( bodies[ 2 ] ) ) { t.Error( "expected the same batch to be sent again" ) }
+
+	// Anything else is dropped
+	endpoint = startTestRemoteWriteEndpoint( t, http.StatusBadRequest )
+	output = NewRemoteWriteOutput( endpoint.server.URL, nil, "", "", 100, 1000, registry )
+	output.retryDelay = 10 * time.Millisecond
+	if publishError := output.PublishMetrics(); publishError != nil { t.Fatal( publishError ) }
+	waitForTestRemoteWriteQueue( t, output )
+	time.Sleep( 50 * time.Millisecond )
+	output.Close()
+
+	if bodies := endpoint.getBodies(); ( len( bodies ) != 1 ) { t.Errorf( "expected a rejected batch not to be sent again, got %d attempts", len( bodies ) ) }
+}
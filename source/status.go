@@ -11,6 +11,9 @@ import (
 // NOTE: Integer values are stored as floats because Prometheus requires floats
 type Status struct {
 
+	// The name of the target it was fetched from, or empty if the target has no name (this is set by us, not the daemon)
+	Target string
+
 	// When information was last obtained from the UPS
 	Date time.Time // DATE
 
@@ -66,6 +69,7 @@ type Status struct {
 			MainsInputVoltage float64 // NOMINV
 			BatteryOutputVoltage float64 // NOMBATTV
 			PowerOutputWattage float64 // NOMPOWER
+			PowerOutputVoltAmps float64 // NOMAPNT
 		}
 
 	}
@@ -95,8 +99,8 @@ type Status struct {
 			MinimumBatteryChargePercent float64 // MBATTCHG
 			MinimumBatteryRemainingRuntimeMinutes float64 // MINTIMEL
 
-			// Timeout
-			MaximumTimeoutMinutes float64 // MAXTIME
+			// Time on battery before shutting down, which the daemon reports in seconds (unlike its configuration file)
+			MaximumTimeoutSeconds float64 // MAXTIME
 
 			// UPS operating mode
 			OperatingMode string // UPSMODE
@@ -134,6 +138,126 @@ type Status struct {
 
 }
 
+// Gets what the UPS is called, from the name of its target, otherwise the name or serial number the daemon reports, otherwise just 'ups'
+func getUPSName( status Status ) string {
+	if ( status.Target != "" ) { return status.Target }
+	if ( status.UPS.Name != "" ) { return status.UPS.Name }
+	if ( status.UPS.SerialNumber != "" ) { return status.UPS.SerialNumber }
+	return "ups"
+}
+
+// A numeric value from the status, with a name for use by outputs
+type NumericField struct {
+	Name string
+	Value float64
+}
+
+// A text value from the status, with a name for use by outputs
+type TextField struct {
+	Name string
+	Value string
+}
+
+// Gets all the numeric values, with names for use by outputs (e.g., InfluxDB fields, MQTT topics)
+func ( status Status ) NumericFields() []NumericField {
+	return []NumericField {
+
+		// Load & line voltage
+		{ "load_percent", status.UPS.LoadPercent },
+		{ "line_voltage", status.UPS.LineVoltage },
+		{ "line_maximum_voltage", status.UPS.MaximumLineVoltage },
+		{ "line_minimum_voltage", status.UPS.MinimumLineVoltage },
+		{ "line_frequency_hertz", status.UPS.LineFrequency },
+		{ "output_voltage", status.UPS.OutputVoltage },
+
+		// Miscellaneous
+		{ "alarm_interval_seconds", status.UPS.AlarmIntervalSeconds },
+		{ "self_test_interval_hours", status.UPS.SelfTestInterval },
+		{ "temperature_celsius", status.UPS.Temperature },
+
+		// Battery
+		{ "battery_charge_percent", status.UPS.Battery.ChargePercent },
+		{ "battery_remaining_runtime_minutes", status.UPS.Battery.RemainingRuntimeMinutes },
+		{ "battery_voltage", status.UPS.Battery.OutputVoltage },
+		{ "battery_low_threshold_minutes", status.UPS.Battery.LowBatterySignalThreshold },
+		{ "battery_external_count", status.UPS.Battery.ExternalCount },
+
+		// Nominal values
+		{ "nominal_input_voltage", status.UPS.Expect.MainsInputVoltage },
+		{ "nominal_battery_voltage", status.UPS.Expect.BatteryOutputVoltage },
+		{ "nominal_power_watts", status.UPS.Expect.PowerOutputWattage },
+		{ "nominal_apparent_power_voltamps", status.UPS.Expect.PowerOutputVoltAmps },
+
+		// Daemon configuration
+		{ "shutdown_charge_percent", status.Daemon.Configuration.MinimumBatteryChargePercent },
+		{ "shutdown_runtime_minutes", status.Daemon.Configuration.MinimumBatteryRemainingRuntimeMinutes },
+		{ "shutdown_timeout_seconds", status.Daemon.Configuration.MaximumTimeoutSeconds },
+
+		// Transfers to battery
+		{ "transfer_count", status.Daemon.Battery.Transfer.Total },
+		{ "transfer_low_line_voltage", status.Daemon.Battery.Transfer.LowLineVoltage },
+		{ "transfer_high_line_voltage", status.Daemon.Battery.Transfer.HighLineVoltage },
+		{ "time_on_battery_seconds", status.Daemon.Battery.TimeSpent.Current },
+		{ "cumulative_time_on_battery_seconds", status.Daemon.Battery.TimeSpent.Total },
+
+	}
+}
+
+// Gets all the text values (including dates), with names for use by outputs
+func ( status Status ) TextFields() []TextField {
+	return []TextField {
+
+		// Status of the UPS
+		{ "status", status.UPS.StatusText },
+		{ "date", formatStatusTime( status.Date ) },
+
+		// Information about the UPS
+		{ "name", status.UPS.Name },
+		{ "model", status.UPS.ModelName },
+		{ "firmware", status.UPS.FirmwareRevision },
+		{ "serial", status.UPS.SerialNumber },
+		{ "manufactured_date", formatStatusDate( status.UPS.ManufacturedAt ) },
+		{ "sensitivity", status.UPS.LineVoltageFluctuationSensitivity },
+		{ "self_test_result", status.UPS.SelfTestResult },
+		{ "battery_replaced_date", formatStatusDate( status.UPS.Battery.LastReplacementDate ) },
+
+		// Information about the daemon
+		{ "hostname", status.Daemon.SystemName },
+		{ "version", status.Daemon.Version },
+		{ "start_time", formatStatusTime( status.Daemon.StartupTime ) },
+		{ "driver", status.Daemon.Driver },
+		{ "cable", status.Daemon.Configuration.ManagementCable },
+		{ "mode", status.Daemon.Configuration.OperatingMode },
+
+		// Transfers to battery
+		{ "last_transfer_reason", status.Daemon.Battery.Transfer.LastReason },
+		{ "last_transfer_off_battery_time", formatStatusTime( status.Daemon.Battery.Transfer.LastAt ) },
+
+	}
+}
+
+// Gets every value (including the derived load in watts) by name, for encoding as JSON
+func ( status Status ) Fields() map[ string ]any {
+	fields := map[ string ]any { "status_flag": status.UPS.StatusFlag }
+	for _, field := range status.NumericFields() { fields[ field.Name ] = field.Value }
+	for _, field := range status.TextFields() { fields[ field.Name ] = field.Value }
+	if loadWatts, ok := calculateLoadWatts( status ); ok { fields[ "load_watts" ] = loadWatts }
+
+	return fields
+}
+
+// Formats a date & time from the status in RFC 3339, or empty if it was not reported
+func formatStatusTime( value time.Time ) string {
+	if ( value.IsZero() || value.Unix() == 0 ) { return "" }
+	return value.Format( time.RFC3339 )
+}
+
+// Formats a date from the status as YYYY-MM-DD, or empty if it was not reported
+func formatStatusDate( value time.Time ) string {
+	if value.IsZero() { return "" }
+	return value.Format( time.DateOnly )
+}
+
 // Parses the status response into a structure
 func ParseStatusText( text string ) ( status Status, err error ) {
 
@@ -157,6 +281,7 @@ func ParseStatusText( text string ) ( status Status, err error ) {
 		value = strings.TrimSuffix( value, " Minutes" ) // e.g., TIMELEFT
 		value = strings.TrimSuffix( value, " Percent" ) // e.g., LOADPCT
 		value = strings.TrimSuffix( value, " Watts" )
+		value = strings.TrimSuffix( value, " VA" ) // e.g., NOMAPNT
 		value = strings.TrimSuffix( value, " Hz" ) // e.g., LINEFREQ
 		value = strings.TrimSuffix( value, " C" ) // e.g., ITEMP
 
@@ -254,7 +379,7 @@ func ParseStatusText( text string ) ( status Status, err error ) {
 				parsedFloat, floatParseError := parseAsFloat( value, -1 )
 				if floatParseError != nil { return Status{}, floatParseError }
 
-				status.Daemon.Configuration.MaximumTimeoutMinutes = parsedFloat
+				status.Daemon.Configuration.MaximumTimeoutSeconds = parsedFloat
 			}
 
 			// SmartUPS X 3000 - "The maximum line voltage since the last STATUS as returned by the UPS."
@@ -458,6 +583,14 @@ func ParseStatusText( text string ) ( status Status, err error ) {
 				status.UPS.Expect.PowerOutputWattage = parsedFloat
 			}
 
+			// "The maximum apparent power in Volt-Amps that the UPS is designed to supply"
+			case "NOMAPNT": {
+				parsedFloat, floatParseError := parseAsFloat( value, -1 )
+				if floatParseError != nil { return Status{}, floatParseError }
+
+				status.UPS.Expect.PowerOutputVoltAmps = parsedFloat
+			}
+
 			// "The firmware revision number as reported by the UPS"
 			case "FIRMWARE": status.UPS.FirmwareRevision = value
 
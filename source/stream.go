@@ -0,0 +1,242 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The most messages to hold for a subscriber that is not keeping up, after which it is disconnected
+const STREAM_SUBSCRIBER_BUFFER = 32
+
+// How often to send something on idle connections, well within the usual 60 second timeout of proxies
+const STREAM_HEARTBEAT_INTERVAL = 15 * time.Second
+
+// How long writing a message to a WebSocket can take before the subscriber is disconnected
+const STREAM_WRITE_TIMEOUT = 10 * time.Second
+
+// A single message for subscribers, already encoded as JSON
+type streamMessage struct {
+	ID uint64
+	Type string // 'status' or 'event'
+	Data json.RawMessage
+}
+
+// Sends each new status & power event to any number of subscribers, as Server-Sent Events or over a WebSocket
+// Messages are handed to each subscriber without waiting, so a slow subscriber never holds up collection
+type StatusStream struct {
+
+	// How often to send something on idle connections, so proxies do not drop them
+	HeartbeatInterval time.Duration
+
+	// How long writing to a WebSocket can take
+	writeTimeout time.Duration
+
+	// The subscribers, the latest status of each target for new subscribers, and the ID of the latest message
+	mutex sync.Mutex
+	subscribers map[ chan streamMessage ]struct{}
+	latestStatuses map[ string ]streamMessage
+	latestID uint64
+
+	upgrader websocket.Upgrader
+}
+
+// Creates a stream with no subscribers
+func NewStatusStream( heartbeatInterval time.Duration ) *StatusStream {
+	return &StatusStream {
+		HeartbeatInterval: heartbeatInterval,
+		writeTimeout: STREAM_WRITE_TIMEOUT,
+		subscribers: map[ chan streamMessage ]struct{} {},
+		latestStatuses: map[ string ]streamMessage {},
+
+		// The stream is read-only, so allow pages on other origins (e.g., a wall display) to use it
+		upgrader: websocket.Upgrader { CheckOrigin: func( request *http.Request ) bool { return true } },
+	}
+}
+
+// Gets a short name for display purposes
+func ( stream *StatusStream ) Name() string {
+	return "stream"
+}
+
+// Sends the status to all subscribers, with the name of its target if it has one
+func ( stream *StatusStream ) Publish( status Status ) error {
+	value := map[ string ]any { "time": status.Date, "fields": status.Fields() }
+	if ( status.Target != "" ) { value[ "target" ] = status.Target }
+
+	return stream.broadcast( "status", status.Target, value )
+}
+
+// Sends the power event to all subscribers
+func ( stream *StatusStream ) Notify( event PowerEvent ) error {
+	return stream.broadcast( "event", "", event.Record( event.Summary() ) )
+}
+
+// Disconnects all subscribers
+func ( stream *StatusStream ) Close() error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	for subscriber := range stream.subscribers {
+		delete( stream.subscribers, subscriber )
+		close( subscriber )
+	}
+
+	return nil
+}
+
+// Encodes a message & hands it to every subscriber, disconnecting any that have fallen too far behind
+// NOTE: The target is only used to keep the latest status of each one
+func ( stream *StatusStream ) broadcast( messageType string, target string, value any ) error {
+	data, encodeError := json.Marshal( value )
+	if encodeError != nil { return encodeError }
+
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	stream.latestID++
+	message := streamMessage { ID: stream.latestID, Type: messageType, Data: data }
+	if ( messageType == "status" ) { stream.latestStatuses[ target ] = message }
+
+	for subscriber := range stream.subscribers {
+		select {
+			case subscriber <- message:
+			default: {
+				delete( stream.subscribers, subscriber )
+				close( subscriber )
+			}
+		}
+	}
+
+	return nil
+}
+
+// Adds a subscriber, starting it off with the latest status of each target in the order they were sent
+func ( stream *StatusStream ) subscribe() chan streamMessage {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	latestStatuses := []streamMessage {}
+	for _, message := range stream.latestStatuses { latestStatuses = append( latestStatuses, message ) }
+	slices.SortFunc( latestStatuses, func( a streamMessage, b streamMessage ) int { return cmp.Compare( a.ID, b.ID ) } )
+	subscriber := make( chan streamMessage, STREAM_SUBSCRIBER_BUFFER + len( latestStatuses ) )
+	stream.subscribers[ subscriber ] = struct{}{}
+	for _, message := range latestStatuses { subscriber <- message }
+
+	return subscriber
+}
+
+// Removes a subscriber, unless it was already disconnected
+func ( stream *StatusStream ) unsubscribe( subscriber chan streamMessage ) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	if _, ok := stream.subscribers[ subscriber ]; !ok { return }
+	delete( stream.subscribers, subscriber )
+	close( subscriber )
+}
+
+// Serves the stream over a WebSocket if the client asks to upgrade, or as Server-Sent Events otherwise
+func ( stream *StatusStream ) ServeHTTP( response http.ResponseWriter, request *http.Request ) {
+	if websocket.IsWebSocketUpgrade( request ) {
+		stream.serveWebSocket( response, request )
+		return
+	}
+
+	stream.serveEvents( response, request )
+}
+
+// Sends messages as Server-Sent Events, with comments as heartbeats - html.spec.whatwg.org/multipage/server-sent-events.html
+func ( stream *StatusStream ) serveEvents( response http.ResponseWriter, request *http.Request ) {
+	flusher, ok := response.( http.Flusher )
+	if !ok {
+		http.Error( response, "Streaming is not supported.", http.StatusInternalServerError )
+		return
+	}
+
+	response.Header().Set( "Content-Type", "text/event-stream" )
+	response.Header().Set( "Cache-Control", "no-cache" )
+	response.Header().Set( "X-Accel-Buffering", "no" ) // Stop nginx buffering the stream
+	response.WriteHeader( http.StatusOK )
+	fmt.Fprintf( response, "retry: %d\n\n", 5000 )
+	flusher.Flush()
+
+	subscriber := stream.subscribe()
+	defer stream.unsubscribe( subscriber )
+	heartbeat := time.NewTicker( stream.HeartbeatInterval )
+	defer heartbeat.Stop()
+
+	for {
+		select {
+			case message, ok := <-subscriber: {
+				if !ok { return }
+				fmt.Fprintf( response, "id: %d\nevent: %s\ndata: %s\n\n", message.ID, message.Type, message.Data )
+			}
+
+			case <-heartbeat.C: fmt.Fprintf( response, ": heartbeat %d\n\n", time.Now().Unix() )
+
+			case <-request.Context().Done(): return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// Sends messages as JSON text messages over a WebSocket, with pings as heartbeats
+func ( stream *StatusStream ) serveWebSocket( response http.ResponseWriter, request *http.Request ) {
+	connection, upgradeError := stream.upgrader.Upgrade( response, request, nil )
+	if upgradeError != nil { return } // The upgrader has already responded with an error
+	defer connection.Close()
+
+	// Read in the background, which handles pongs & notices when the client goes away
+	closed := make( chan struct{} )
+	connection.SetReadLimit( 512 )
+	connection.SetReadDeadline( time.Now().Add( stream.HeartbeatInterval * 2 ) )
+	connection.SetPongHandler( func( string ) error { return connection.SetReadDeadline( time.Now().Add( stream.HeartbeatInterval * 2 ) ) } )
+	go func() {
+		defer close( closed )
+		for {
+			if _, _, readError := connection.NextReader(); readError != nil { return }
+		}
+	}()
+
+	subscriber := stream.subscribe()
+	defer stream.unsubscribe( subscriber )
+	heartbeat := time.NewTicker( stream.HeartbeatInterval )
+	defer heartbeat.Stop()
+
+	for {
+		var writeError error
+
+		// NOTE: The write deadline is only set once there is something to write, as messages can be far apart
+		select {
+			case message, ok := <-subscriber: {
+				connection.SetWriteDeadline( time.Now().Add( stream.writeTimeout ) )
+				if !ok {
+					connection.WriteMessage( websocket.CloseMessage, websocket.FormatCloseMessage( websocket.CloseTryAgainLater, "" ) )
+					return
+				}
+				writeError = connection.WriteJSON( map[ string ]any { "id": message.ID, "type": message.Type, "data": message.Data } )
+			}
+
+			case <-heartbeat.C: writeError = connection.WriteControl( websocket.PingMessage, nil, time.Now().Add( stream.writeTimeout ) )
+
+			case <-closed: return
+
+			// The exporter is shutting down
+			case <-request.Context().Done(): {
+				connection.SetWriteDeadline( time.Now().Add( stream.writeTimeout ) )
+				connection.WriteMessage( websocket.CloseMessage, websocket.FormatCloseMessage( websocket.CloseGoingAway, "" ) )
+				return
+			}
+		}
+
+		if writeError != nil { return }
+	}
+}
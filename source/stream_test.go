@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Publishes a status for a target to the stream
+func publishTestStreamStatus( t *testing.T, stream *StatusStream, target string ) {
+	t.Helper()
+
+	status := Status { Target: target, Date: time.Now() }
+	status.UPS.LoadPercent = 25
+	if publishError := stream.Publish( status ); publishError != nil { t.Fatal( publishError ) }
+}
+
+func TestStreamServerSentEvents( t *testing.T ) {
+	stream := NewStatusStream( 50 * time.Millisecond )
+	server := httptest.NewServer( stream )
+	defer server.Close()
+
+	// The latest status of each target is sent straight away, in the order they were published
+	publishTestStreamStatus( t, stream, "rack1" )
+	publishTestStreamStatus( t, stream, "rack2" )
+	publishTestStreamStatus( t, stream, "rack1" )
+
+	response, getError := http.Get( server.URL )
+	if getError != nil { t.Fatal( getError ) }
+	defer response.Body.Close()
+	if contentType := response.Header.Get( "Content-Type" ); ( contentType != "text/event-stream" ) { t.Errorf( "unexpected content type %q", contentType ) }
+
+	// Reads lines until a blank one, giving the lines of the event or comment
+	reader := bufio.NewReader( response.Body )
+	readEvent := func() string {
+		t.Helper()
+
+		var lines []string
+		for {
+			line, readError := reader.ReadString( '\n' )
+			if readError != nil { t.Fatal( readError ) }
+			if ( line == "\n" ) { return strings.Join( lines, "\n" ) }
+			lines = append( lines, strings.TrimSuffix( line, "\n" ) )
+		}
+	}
+
+	if event := readEvent(); ( event != "retry: 5000" ) { t.Errorf( "expected the retry interval first, got %q", event ) }
+	for _, expected := range []string { "id: 2\nevent: status\ndata: {\"fields\":", "id: 3\nevent: status\ndata: {\"fields\":" } {
+		if event := readEvent(); !strings.HasPrefix( event, expected ) { t.Errorf( "expected %q, got %q", expected, event ) }
+	}
+
+	// Heartbeats while idle, then power events as they happen
+	if event := readEvent(); !strings.HasPrefix( event, ": heartbeat " ) { t.Errorf( "expected a heartbeat, got %q", event ) }
+	stream.Notify( newTestPowerEvent( EVENT_ON_BATTERY ) )
+	for event := readEvent(); !strings.HasPrefix( event, "id: 4\nevent: event\ndata: {" ); event = readEvent() {
+		if !strings.HasPrefix( event, ": heartbeat " ) { t.Fatalf( "expected the power event, got %q", event ) }
+	}
+}
+
+func TestStreamWebSocket( t *testing.T ) {
+	stream := NewStatusStream( 200 * time.Millisecond )
+	stream.writeTimeout = 100 * time.Millisecond
+	server := httptest.NewServer( stream )
+	defer server.Close()
+
+	publishTestStreamStatus( t, stream, "" )
+	connection, _, dialError := websocket.DefaultDialer.Dial( "ws" + strings.TrimPrefix( server.URL, "http" ), nil )
+	if dialError != nil { t.Fatal( dialError ) }
+	defer connection.Close()
+
+	// Read in the background, answering the pings
+	var pings atomic.Int32
+	connection.SetPingHandler( func( data string ) error {
+		pings.Add( 1 )
+		return connection.WriteControl( websocket.PongMessage, []byte( data ), time.Now().Add( time.Second ) )
+	} )
+	type message struct {
+		ID uint64 `json:"id"`
+		Type string `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	messages := make( chan message )
+	closeErrors := make( chan error, 1 )
+	go func() {
+		for {
+			var received message
+			if readError := connection.ReadJSON( &received ); readError != nil { closeErrors <- readError; return }
+			messages <- received
+		}
+	}()
+
+	// Reads the next message, failing if the connection is closed
+	readMessage := func() message {
+		t.Helper()
+
+		select {
+			case received := <-messages: return received
+			case closeError := <-closeErrors: t.Fatalf( "expected a message, got %v", closeError )
+			case <-time.After( 2 * time.Second ): t.Fatal( "expected a message" )
+		}
+		return message {}
+	}
+
+	if received := readMessage(); ( received.ID != 1 || received.Type != "status" ) { t.Errorf( "expected the latest status, got %+v", received ) }
+
+	// Still connected after being idle for longer than writing can take, before any heartbeat
+	time.Sleep( 150 * time.Millisecond )
+	publishTestStreamStatus( t, stream, "" )
+	if received := readMessage(); ( received.ID != 2 || received.Type != "status" ) { t.Errorf( "expected the next status, got %+v", received ) }
+
+	// And with heartbeats meanwhile
+	time.Sleep( 500 * time.Millisecond )
+	publishTestStreamStatus( t, stream, "" )
+	if received := readMessage(); ( received.ID != 3 || received.Type != "status" ) { t.Errorf( "expected the next status, got %+v", received ) }
+	if ( pings.Load() == 0 ) { t.Error( "expected heartbeats while idle" ) }
+
+	// Told to reconnect later when the stream is closed
+	stream.Close()
+	select {
+		case closeError := <-closeErrors: if !websocket.IsCloseError( closeError, websocket.CloseTryAgainLater ) { t.Errorf( "expected to be told to try again later, got %v", closeError ) }
+		case received := <-messages: t.Errorf( "unexpected message %+v", received )
+		case <-time.After( 2 * time.Second ): t.Error( "expected to be disconnected" )
+	}
+}
+
+func TestStreamDropsSlowSubscribers( t *testing.T ) {
+	stream := NewStatusStream( time.Hour )
+	slowSubscriber, subscriber := stream.subscribe(), stream.subscribe()
+
+	// The slow subscriber never reads, while the other keeps up
+	for index := 0; index <= STREAM_SUBSCRIBER_BUFFER; index++ {
+		publishTestStreamStatus( t, stream, "" )
+		<-subscriber
+	}
+
+	// Given what was held for it, then disconnected
+	for index := 0; index < STREAM_SUBSCRIBER_BUFFER; index++ {
+		if _, ok := <-slowSubscriber; !ok { t.Fatalf( "expected %d messages to be held, got %d", STREAM_SUBSCRIBER_BUFFER, index ) }
+	}
+	if _, ok := <-slowSubscriber; ok { t.Error( "expected the slow subscriber to be disconnected" ) }
+
+	stream.mutex.Lock()
+	_, isSubscribed := stream.subscribers[ subscriber ]
+	subscriberCount := len( stream.subscribers )
+	stream.mutex.Unlock()
+	if ( !isSubscribed || subscriberCount != 1 ) { t.Errorf( "expected only the subscriber keeping up to remain, got %d", subscriberCount ) }
+
+	// Unsubscribing after being disconnected does nothing
+	stream.unsubscribe( slowSubscriber )
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The first file descriptor of the sockets passed in by systemd, after the standard input, output & error streams
+const SYSTEMD_LISTEN_FDS_START = 3
+
+// The longest path of a Unix domain socket, including the terminating null byte - man7.org/linux/man-pages/man7/unix.7.html
+const UNIX_SOCKET_PATH_MAXIMUM_LENGTH = 108
+
+// Gets the sockets that systemd passed in for socket activation, if any - man7.org/linux/man-pages/man3/sd_listen_fds.3.html
+// NOTE: The environment variables are removed so they are not mistaken as being for any other process
+func getSystemdListeners() ( listeners []net.Listener, err error ) {
+	processID, count := os.Getenv( "LISTEN_PID" ), os.Getenv( "LISTEN_FDS" )
+	os.Unsetenv( "LISTEN_PID" )
+	os.Unsetenv( "LISTEN_FDS" )
+	os.Unsetenv( "LISTEN_FDNAMES" )
+
+	// The sockets are only for us if systemd passed them to this process
+	if ( processID == "" || count == "" ) { return nil, nil }
+	if ( processID != strconv.Itoa( os.Getpid() ) ) { return nil, nil }
+
+	socketCount, parseError := strconv.Atoi( count )
+	if ( parseError != nil || socketCount < 0 ) { return nil, fmt.Errorf( "invalid number of sockets '%s' from systemd", count ) }
+
+	for descriptor := SYSTEMD_LISTEN_FDS_START; descriptor < SYSTEMD_LISTEN_FDS_START + socketCount; descriptor++ {
+		file := os.NewFile( uintptr( descriptor ), fmt.Sprintf( "systemd socket %d", descriptor ) )
+		listener, listenerError := net.FileListener( file ) // Duplicates the descriptor, so the file is not needed afterwards
+		file.Close()
+		if listenerError != nil {
+			for _, listener := range listeners { listener.Close() }
+			return nil, fmt.Errorf( "systemd socket %d is not a listening stream socket: %s", descriptor, listenerError.Error() )
+		}
+
+		listeners = append( listeners, listener )
+	}
+
+	return listeners, nil
+}
+
+/*************************************/
+
+// Structure to tell systemd about the state of the exporter, when it is a notify service - man7.org/linux/man-pages/man3/sd_notify.3.html
+type SystemdNotifier struct {
+
+	// The socket that systemd listens on, or nothing if not run by systemd
+	address *net.UnixAddr
+
+	// How often systemd expects a keep-alive ping, or zero if the watchdog is disabled
+	WatchdogTimeout time.Duration
+
+	// When the background metrics collection started its current collection, or zero while it is waiting for the next one
+	collectionStartedAt atomic.Int64
+
+	// Ensures startup is only announced once
+	readyOnce sync.Once
+}
+
+// The notifier used by the background metrics collection
+var systemdNotifier = NewSystemdNotifier()
+
+// Creates a notifier from the environment variables that systemd sets for the service
+func NewSystemdNotifier() *SystemdNotifier {
+	notifier := &SystemdNotifier {}
+
+	// Sockets in the abstract namespace begin with an at sign instead of a null byte
+	socketPath := os.Getenv( "NOTIFY_SOCKET" )
+	if ( socketPath == "" ) { return notifier }
+	if strings.HasPrefix( socketPath, "@" ) { socketPath = "\x00" + socketPath[ 1 : ] }
+	notifier.address = &net.UnixAddr { Name: socketPath, Net: "unixgram" }
+
+	// The watchdog is only for us if it is not meant for another process
+	processID := os.Getenv( "WATCHDOG_PID" )
+	if ( processID != "" && processID != strconv.Itoa( os.Getpid() ) ) { return notifier }
+	if microseconds, parseError := strconv.ParseInt( os.Getenv( "WATCHDOG_USEC" ), 10, 64 ); ( parseError == nil && microseconds > 0 ) {
+		notifier.WatchdogTimeout = time.Duration( microseconds ) * time.Microsecond
+	}
+
+	return notifier
+}
+
+// Checks if the exporter was started by systemd as a notify service
+func ( notifier *SystemdNotifier ) IsEnabled() bool {
+	return notifier.address != nil
+}
+
+// Sends the state (e.g., 'READY=1') to systemd as one datagram, doing nothing if not run by systemd
+func ( notifier *SystemdNotifier ) Notify( state string ) error {
+	if !notifier.IsEnabled() { return nil }
+
+	connection, dialError := net.DialUnix( "unixgram", nil, notifier.address )
+	if dialError != nil { return dialError }
+	defer connection.Close()
+
+	_, writeError := connection.Write( []byte( state ) )
+	return writeError
+}
+
+// Tells systemd that startup has finished, only the first time a status has been fetched
+func ( notifier *SystemdNotifier ) Ready( status Status ) {
+	notifier.readyOnce.Do( func() {
+		notifyError := notifier.Notify( fmt.Sprintf( "READY=1\nSTATUS=Collecting metrics for %s", status.UPS.Name ) )
+		if notifyError != nil { slog.Warn( "Failed to tell systemd that startup has finished", "error", notifyError ) }
+	} )
+}
+
+// Tells systemd that the exporter is shutting down
+func ( notifier *SystemdNotifier ) Stopping() {
+	notifyError := notifier.Notify( "STOPPING=1" )
+	if notifyError != nil { slog.Warn( "Failed to tell systemd that shutdown has begun", "error", notifyError ) }
+}
+
+// Records that the background metrics collection has started a collection
+func ( notifier *SystemdNotifier ) CollectionStarted() {
+	notifier.collectionStartedAt.Store( time.Now().UnixNano() )
+}
+
+// Records that the background metrics collection has finished a collection & is waiting for the next one
+func ( notifier *SystemdNotifier ) CollectionFinished() {
+	notifier.collectionStartedAt.Store( 0 )
+}
+
+// Checks if the background metrics collection is stuck in a collection that has taken longer than the watchdog timeout
+func ( notifier *SystemdNotifier ) IsCollectionStuck() bool {
+	startedAt := notifier.collectionStartedAt.Load()
+	if ( startedAt == 0 ) { return false }
+
+	return time.Since( time.Unix( 0, startedAt ) ) > notifier.WatchdogTimeout
+}
+
+// Sends keep-alive pings to systemd at half the watchdog timeout, but only while the background metrics collection is not stuck, until the context is cancelled
+// NOTE: Once the pings stop, systemd considers the exporter to have failed & restarts it, if the service is configured to
+func ( notifier *SystemdNotifier ) WatchOverCollection( ctx context.Context ) {
+	if ( notifier.WatchdogTimeout <= 0 ) { return }
+
+	ticker := time.NewTicker( notifier.WatchdogTimeout / 2 )
+	defer ticker.Stop()
+
+	wasStuck := false
+	for {
+		select {
+			case <-ctx.Done(): return
+			case <-ticker.C:
+		}
+
+		// Log once when the pings stop & start again, so the logs explain any restart
+		isStuck := notifier.IsCollectionStuck()
+		if ( isStuck && !wasStuck ) { slog.Error( "Stopped sending keep-alive pings to systemd, as metrics collection is stuck", "timeout", notifier.WatchdogTimeout ) }
+		if ( !isStuck && wasStuck ) { slog.Info( "Resumed sending keep-alive pings to systemd, as metrics collection is no longer stuck" ) }
+		wasStuck = isStuck
+		if isStuck { continue }
+
+		notifyError := notifier.Notify( "WATCHDOG=1" )
+		if notifyError != nil { slog.Warn( "Failed to send a keep-alive ping to systemd", "error", notifyError ) }
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Listens on a datagram socket like systemd does for notifications, pointing NOTIFY_SOCKET at it
+func listenForTestNotifications( t *testing.T ) *net.UnixConn {
+	t.Helper()
+	if ( runtime.GOOS == "windows" ) { t.Skip( "datagram Unix domain sockets are not supported" ) }
+
+	socketPath := filepath.Join( t.TempDir(), "notify.sock" )
+	connection, listenError := net.ListenUnixgram( "unixgram", &net.UnixAddr { Name: socketPath, Net: "unixgram" } )
+	if listenError != nil { t.Fatal( listenError ) }
+	t.Cleanup( func() { connection.Close() } )
+
+	t.Setenv( "NOTIFY_SOCKET", socketPath )
+	return connection
+}
+
+// Reads the next notification, or nothing if none arrives in time
+func readTestNotification( t *testing.T, connection *net.UnixConn, timeout time.Duration ) ( state string, isReceived bool ) {
+	t.Helper()
+
+	buffer := make( []byte, 1024 )
+	connection.SetReadDeadline( time.Now().Add( timeout ) )
+	length, readError := connection.Read( buffer )
+	if readError != nil { return "", false }
+
+	return string( buffer[ : length ] ), true
+}
+
+func TestSystemdNotifierFromEnvironment( t *testing.T ) {
+	listenForTestNotifications( t )
+
+	// Not for us
+	t.Setenv( "WATCHDOG_USEC", "2000000" )
+	t.Setenv( "WATCHDOG_PID", strconv.Itoa( os.Getpid() + 1 ) )
+	notifier := NewSystemdNotifier()
+	if ( !notifier.IsEnabled() || notifier.WatchdogTimeout != 0 ) { t.Errorf( "expected notifications without the watchdog, got %+v", notifier ) }
+
+	// For us
+	t.Setenv( "WATCHDOG_PID", strconv.Itoa( os.Getpid() ) )
+	if notifier := NewSystemdNotifier(); ( notifier.WatchdogTimeout != 2 * time.Second ) { t.Errorf( "expected a watchdog timeout of 2s, got %s", notifier.WatchdogTimeout ) }
+
+	// Abstract sockets
+	t.Setenv( "NOTIFY_SOCKET", "@systemd/notify" )
+	if notifier := NewSystemdNotifier(); ( notifier.address.Name != "\x00systemd/notify" ) { t.Errorf( "expected an abstract socket, got %q", notifier.address.Name ) }
+
+	// Not run by systemd
+	t.Setenv( "NOTIFY_SOCKET", "" )
+	if notifier := NewSystemdNotifier(); notifier.IsEnabled() { t.Error( "expected notifications to be disabled" ) }
+}
+
+func TestSystemdNotifierReadyOnce( t *testing.T ) {
+	connection := listenForTestNotifications( t )
+	notifier := NewSystemdNotifier()
+
+	status := Status {}
+	status.UPS.Name = "rack1"
+	notifier.Ready( status )
+	notifier.Ready( status )
+
+	state, isReceived := readTestNotification( t, connection, time.Second )
+	if ( !isReceived || state != "READY=1\nSTATUS=Collecting metrics for rack1" ) { t.Errorf( "unexpected first notification %q", state ) }
+	if state, isReceived := readTestNotification( t, connection, 100 * time.Millisecond ); isReceived { t.Errorf( "expected startup to be announced only once, got %q", state ) }
+}
+
+func TestSystemdWatchdogStopsWhileCollectionIsStuck( t *testing.T ) {
+	connection := listenForTestNotifications( t )
+	notifier := NewSystemdNotifier()
+	notifier.WatchdogTimeout = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel( context.Background() )
+	defer cancel()
+
+	// Stuck in a collection that started longer ago than the timeout
+	notifier.collectionStartedAt.Store( time.Now().Add( -time.Second ).UnixNano() )
+	if !notifier.IsCollectionStuck() { t.Fatal( "expected the collection to be stuck" ) }
+	go notifier.WatchOverCollection( ctx )
+	if state, isReceived := readTestNotification( t, connection, 300 * time.Millisecond ); isReceived { t.Errorf( "expected no pings while stuck, got %q", state ) }
+
+	// Pings resume once the collection finishes
+	notifier.CollectionFinished()
+	if state, isReceived := readTestNotification( t, connection, time.Second ); ( !isReceived || state != "WATCHDOG=1" ) { t.Errorf( "expected a ping once no longer stuck, got %q", state ) }
+
+	// A collection that has only just started is not stuck
+	notifier.CollectionStarted()
+	if notifier.IsCollectionStuck() { t.Error( "expected a new collection not to be stuck" ) }
+}
+
+func TestGetSystemdListenersIgnoresOrRejects( t *testing.T ) {
+	for _, test := range []struct {
+		processID string
+		count string
+		isError bool
+	} {
+		{ "", "", false }, // Not socket activated
+		{ strconv.Itoa( os.Getpid() + 1 ), "1", false }, // For another process
+		{ strconv.Itoa( os.Getpid() ), "0", false },
+		{ strconv.Itoa( os.Getpid() ), "abc", true },
+		{ strconv.Itoa( os.Getpid() ), "-1", true },
+	} {
+		t.Setenv( "LISTEN_PID", test.processID )
+		t.Setenv( "LISTEN_FDS", test.count )
+
+		listeners, err := getSystemdListeners()
+		if ( len( listeners ) != 0 || ( err != nil ) != test.isError ) { t.Errorf( "LISTEN_PID=%q LISTEN_FDS=%q: unexpected %d listeners & error %v", test.processID, test.count, len( listeners ), err ) }
+		if _, isSet := os.LookupEnv( "LISTEN_FDS" ); isSet { t.Error( "expected the environment variables to be removed" ) }
+	}
+}
+
+// Run by TestListenForMetricsFromSystemd in a process of its own, which has the socket as its first passed descriptor
+func TestListenForMetricsSystemdHelper( t *testing.T ) {
+	if ( os.Getenv( "APC_UPS_EXPORTER_TEST_SYSTEMD_HELPER" ) == "" ) { t.Skip( "only run by TestListenForMetricsFromSystemd" ) }
+
+	os.Setenv( "LISTEN_PID", strconv.Itoa( os.Getpid() ) )
+	listeners, err := ListenForMetrics( net.ParseIP( "127.0.0.1" ), 1, "" ) // The port would fail, so it must not be used
+	if err != nil { t.Fatal( err ) }
+	if ( len( listeners ) != 1 ) { t.Fatalf( "expected 1 listener, got %d", len( listeners ) ) }
+
+	os.Stdout.WriteString( "LISTENING ON " + listeners[ 0 ].Addr().String() + "\n" )
+}
+
+func TestListenForMetricsFromSystemd( t *testing.T ) {
+	if ( runtime.GOOS == "windows" ) { t.Skip( "socket activation is not supported" ) }
+
+	listener, listenError := net.Listen( "tcp", "127.0.0.1:0" )
+	if listenError != nil { t.Fatal( listenError ) }
+	defer listener.Close()
+	file, fileError := listener.( *net.TCPListener ).File()
+	if fileError != nil { t.Fatal( fileError ) }
+	defer file.Close()
+
+	command := exec.Command( os.Args[ 0 ], "-test.run=^TestListenForMetricsSystemdHelper$", "-test.v" )
+	command.Env = append( os.Environ(), "APC_UPS_EXPORTER_TEST_SYSTEMD_HELPER=1", "LISTEN_FDS=1" )
+	command.ExtraFiles = []*os.File { file } // Becomes descriptor 3
+	output, runError := command.CombinedOutput()
+	if runError != nil { t.Fatalf( "helper failed: %s\n%s", runError, output ) }
+
+	if !strings.Contains( string( output ), "LISTENING ON " + listener.Addr().String() ) { t.Errorf( "expected the passed socket to be used, got:\n%s", output ) }
+}
+
+func TestListenForMetricsUnixSocket( t *testing.T ) {
+	if ( runtime.GOOS == "windows" ) { t.Skip( "socket permissions are not supported" ) }
+
+	// A socket left behind by an exporter that was not shutdown gracefully
+	socketPath := filepath.Join( t.TempDir(), "metrics.sock" )
+	staleListener, staleError := net.Listen( "unix", socketPath )
+	if staleError != nil { t.Fatal( staleError ) }
+	staleListener.( *net.UnixListener ).SetUnlinkOnClose( false )
+	staleListener.Close()
+
+	listeners, err := ListenForMetrics( net.ParseIP( "127.0.0.1" ), 0, socketPath )
+	if err != nil { t.Fatal( err ) }
+	defer func() { for _, listener := range listeners { listener.Close() } }()
+	if ( len( listeners ) != 2 ) { t.Fatalf( "expected 2 listeners, got %d", len( listeners ) ) }
+
+	info, statError := os.Stat( socketPath )
+	if statError != nil { t.Fatal( statError ) }
+	if ( info.Mode().Perm() != 0660 ) { t.Errorf( "expected the socket to be 0660, got %o", info.Mode().Perm() ) }
+
+	// Anything other than a socket is never removed
+	regularPath := filepath.Join( t.TempDir(), "metrics.txt" )
+	os.WriteFile( regularPath, []byte( "keep" ), 0644 )
+	if _, err := ListenForMetrics( net.ParseIP( "127.0.0.1" ), 0, regularPath ); err == nil { t.Error( "expected listening over a regular file to fail" ) }
+	if content, _ := os.ReadFile( regularPath ); ( string( content ) != "keep" ) { t.Error( "expected the regular file to be kept" ) }
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An output and/or notifier created from the configuration, which is kept across reloads if none of its settings changed
+type target struct {
+	key string
+	output Output
+	notifier Notifier
+}
+
+// How to create a target, so it is only created if it is new or its settings changed
+type targetSpec struct {
+	key string // Every setting the target is created with
+	create func() ( Output, Notifier, error )
+}
+
+// Guards the outputs & notifiers, as the configuration can be reloaded while they are in use
+var targetsMutex sync.RWMutex
+
+// The targets created from the configuration, and the outputs & notifiers that last for the lifetime of the exporter (e.g., the dashboard)
+var targets []target
+var permanentOutputs []Output
+var permanentNotifiers []Notifier
+
+// The collections & notification passes still using the current outputs & notifiers, so those removed by a reload are only closed once nothing is using them
+// NOTE: This is replaced along with the outputs & notifiers, so only the passes using the previous ones are waited for
+var targetsInUse = &sync.WaitGroup {}
+
+// Creates a key that changes whenever any of the given settings do
+func createTargetKey( settings ...any ) string {
+	return fmt.Sprintf( "%q", settings )
+}
+
+// Gets every output, from the output flags if any were given (or their environment variable), otherwise from the configuration file
+func ( configuration *Configuration ) getOutputConfigurations() ( outputConfigurations []OutputConfiguration, err error ) {
+	if !configuration.overridden[ "output" ] { return configuration.OutputConfigurations, nil }
+
+	for _, flagOutput := range configuration.Outputs {
+		outputType, outputTarget, outputError := ParseOutputFlag( flagOutput )
+		if outputError != nil { return nil, configuration.invalidSetting( "output", fmt.Sprintf( "Invalid output '%s': %s", flagOutput, outputError.Error() ) ) }
+
+		// The settings for every type, as only those for this type are used
+		output := OutputConfiguration {
+			Type: outputType,
+			URL: outputTarget,
+			Path: outputTarget,
+			Job: configuration.PushJob,
+			Attempts: configuration.PushAttempts,
+			QueueSize: configuration.RemoteWriteQueueSize,
+			Organisation: configuration.InfluxOrganisation,
+			Bucket: configuration.InfluxBucket,
+			Token: configuration.InfluxToken,
+			Topic: configuration.MQTTTopic,
+			ClientID: configuration.MQTTClientID,
+			DiscoveryPrefix: configuration.MQTTDiscoveryPrefix,
+			Headers: configuration.OTLPHeaders,
+		}
+
+		switch outputType {
+			case "pushgateway": output.Labels, output.Username, output.Password = configuration.PushLabels, configuration.PushUsername, configuration.PushPassword
+			case "remote-write": output.Labels, output.Username, output.Password, output.BatchSize = configuration.RemoteWriteLabels, configuration.RemoteWriteUsername, configuration.RemoteWritePassword, configuration.RemoteWriteBatchSize
+			case "influxdb": output.BatchSize = configuration.InfluxBatchSize
+			case "mqtt": output.Username, output.Password = configuration.MQTTUsername, configuration.MQTTPassword
+		}
+
+		outputConfigurations = append( outputConfigurations, output )
+	}
+
+	return outputConfigurations, nil
+}
+
+// Gets every notifier, from the configuration file except for the types that their flags were given for (or their environment variables)
+func ( configuration *Configuration ) getNotifierConfigurations() ( notifierConfigurations []NotifierConfiguration, err error ) {
+	replacedTypes := map[ string ]bool {
+		"webhook": configuration.overridden[ "webhook" ],
+		"email": configuration.overridden[ "smtp-address" ],
+		"syslog": configuration.overridden[ "event-log" ],
+		"journald": configuration.overridden[ "event-log" ],
+		"file": configuration.overridden[ "event-log" ],
+	}
+	for _, notifier := range configuration.NotifierConfigurations {
+		if !replacedTypes[ notifier.Type ] { notifierConfigurations = append( notifierConfigurations, notifier ) }
+	}
+
+	// Webhooks
+	for _, flagWebhook := range configuration.Webhooks {
+		webhookPreset, webhookURL, _ := strings.Cut( flagWebhook, ":" )
+		notifierConfigurations = append( notifierConfigurations, NotifierConfiguration {
+			Type: "webhook",
+			Preset: webhookPreset,
+			URL: webhookURL,
+			Template: configuration.WebhookTemplate,
+			Attempts: configuration.WebhookAttempts,
+			Dedupe: configuration.WebhookDedupe,
+		} )
+	}
+
+	// Emails
+	if ( configuration.SMTPAddress != "" ) {
+		notifierConfigurations = append( notifierConfigurations, NotifierConfiguration {
+			Type: "email",
+			SMTPAddress: configuration.SMTPAddress,
+			SMTPTLS: configuration.SMTPTLS,
+			SMTPUsername: configuration.SMTPUsername,
+			SMTPPassword: configuration.SMTPPassword,
+			From: configuration.EmailFrom,
+			To: configuration.EmailTo,
+			Interval: configuration.EmailInterval,
+		} )
+	}
+
+	// Event logs, which only have the one setting after the type
+	for _, flagEventLog := range configuration.EventLogs {
+		eventLogType, eventLogTarget, _ := strings.Cut( flagEventLog, ":" )
+		if !slices.Contains( []string { "syslog", "journald", "file" }, eventLogType ) { return nil, configuration.invalidSetting( "event-log", fmt.Sprintf( "Unknown event log type '%s'.", eventLogType ) ) }
+
+		notifierConfigurations = append( notifierConfigurations, NotifierConfiguration {
+			Type: eventLogType,
+			URL: eventLogTarget,
+			Socket: eventLogTarget,
+			Path: eventLogTarget,
+			MaximumSize: configuration.EventLogMaximumSize,
+			MaximumFiles: configuration.EventLogMaximumFiles,
+		} )
+	}
+
+	return notifierConfigurations, nil
+}
+
+// Gets how to create every output & notifier in the configuration, checking their settings
+// NOTE: Invalid settings point to the line of the block in the configuration file, or the flag if they are from the flags
+func getTargetSpecs( configuration *Configuration ) ( specs []targetSpec, err error ) {
+
+	// Metrics sent to outputs are filtered the same as the metrics page
+	filteredGatherer := FilteredGatherer {
+		Gatherer: CollectorsGatherer {},
+		Include: configuration.metricsInclude,
+		Exclude: configuration.metricsExclude,
+	}
+	filterKey := createTargetKey( configuration.MetricsInclude, configuration.MetricsExclude )
+
+	// Outputs
+	outputConfigurations, outputsError := configuration.getOutputConfigurations()
+	if outputsError != nil { return nil, outputsError }
+	for _, output := range outputConfigurations {
+		invalid := func( flagName string, message string ) error {
+			if ( output.line == 0 ) { return configuration.invalidSetting( flagName, message ) }
+			return fmt.Errorf( "%s: line %d: %s", configuration.ConfigFile, output.line, message )
+		}
+
+		var spec targetSpec
+		outputTarget := output.URL
+		switch output.Type {
+
+			// Push to a Prometheus Pushgateway
+			case "pushgateway": {
+				if !isHTTPURL( output.URL ) { return nil, invalid( "output", "Invalid URL for the Pushgateway, must be an absolute HTTP or HTTPS URL." ) }
+				if ( output.Job == "" ) { return nil, invalid( "push-job", "Invalid job name for the Pushgateway, must not be empty." ) }
+				if ( output.Attempts <= 0 ) { return nil, invalid( "push-attempts", "Invalid number of attempts for the Pushgateway, must be greater than 0." ) }
+
+				pushGrouping, pushLabelsError := parseLabelFlags( output.Labels )
+				if pushLabelsError != nil { return nil, invalid( "push-label", fmt.Sprintf( "Invalid grouping label for the Pushgateway: %s", pushLabelsError.Error() ) ) }
+
+				// Stop retrying once the next collection is due, so pushes never pile up
+				pushTimeout := time.Duration( configuration.MetricsInterval ) * time.Second
+				spec.key = createTargetKey( output.Type, output.URL, output.Job, output.Labels, output.Username, output.Password, output.Attempts, pushTimeout, filterKey )
+				spec.create = func() ( Output, Notifier, error ) {
+					return NewPushgatewayOutput( output.URL, output.Job, pushGrouping, output.Username, output.Password, output.Attempts, pushTimeout, filteredGatherer ), nil, nil
+				}
+			}
+
+			// Send to a Prometheus remote write endpoint
+			case "remote-write": {
+				if !isHTTPURL( output.URL ) { return nil, invalid( "output", "Invalid URL for the remote write endpoint, must be an absolute HTTP or HTTPS URL." ) }
+				if ( output.BatchSize <= 0 ) { return nil, invalid( "remote-write-batch-size", "Invalid batch size for the remote write endpoint, must be greater than 0." ) }
+				if ( output.QueueSize < output.BatchSize ) { return nil, invalid( "remote-write-queue-size", "Invalid queue size for the remote write endpoint, must be at least the batch size." ) }
+
+				remoteWriteLabels, remoteWriteLabelsError := parseLabelFlags( output.Labels )
+				if remoteWriteLabelsError != nil { return nil, invalid( "remote-write-label", fmt.Sprintf( "Invalid extra label for the remote write endpoint: %s", remoteWriteLabelsError.Error() ) ) }
+
+				// A series cannot have the same label twice, so the extra labels must not be any that are already on the metrics
+				for name := range remoteWriteLabels {
+					isOnMetrics := ( name == "ups" && configuration.nisTargets[ 0 ].Name != "" )
+					if _, isConstant := configuration.metricsConstantLabels[ name ]; isConstant { isOnMetrics = true }
+					for _, target := range configuration.nisTargets {
+						if _, isTargetLabel := target.Labels[ name ]; isTargetLabel { isOnMetrics = true }
+					}
+					if isOnMetrics { return nil, invalid( "remote-write-label", fmt.Sprintf( "Invalid extra label '%s' for the remote write endpoint, it is already on the metrics.", name ) ) }
+				}
+
+				spec.key = createTargetKey( output.Type, output.URL, output.Labels, output.Username, output.Password, output.BatchSize, output.QueueSize, filterKey )
+				spec.create = func() ( Output, Notifier, error ) {
+					return NewRemoteWriteOutput( output.URL, remoteWriteLabels, output.Username, output.Password, output.BatchSize, output.QueueSize, filteredGatherer ), nil, nil
+				}
+			}
+
+			// Write to InfluxDB
+			case "influxdb": {
+				if !isHTTPURL( output.URL ) { return nil, invalid( "output", "Invalid URL for InfluxDB, must be an absolute HTTP or HTTPS URL." ) }
+				if ( output.Organisation == "" || output.Bucket == "" ) { return nil, invalid( "influxdb-org", "Invalid organisation or bucket for InfluxDB, both must be set." ) }
+				if ( output.BatchSize <= 0 ) { return nil, invalid( "influxdb-batch-size", "Invalid batch size for InfluxDB, must be greater than 0." ) }
+
+				// Stop retrying once the next collection is due, so writes never pile up
+				influxTimeout := time.Duration( configuration.MetricsInterval ) * time.Second
+				spec.key = createTargetKey( output.Type, output.URL, output.Organisation, output.Bucket, output.Token, output.BatchSize, influxTimeout )
+				spec.create = func() ( Output, Notifier, error ) {
+					influxOutput, influxError := NewInfluxOutput( output.URL, output.Organisation, output.Bucket, output.Token, output.BatchSize, influxTimeout )
+					if influxError != nil { return nil, nil, fmt.Errorf( "Invalid URL for InfluxDB: %s", influxError.Error() ) }
+					return influxOutput, nil, nil
+				}
+			}
+
+			// Write InfluxDB line protocol to a file or the standard output stream
+			case "influxdb-file": {
+				if ( output.Path == "" ) { return nil, invalid( "output", "Missing the path to the file for InfluxDB line protocol." ) }
+
+				outputTarget = output.Path
+				spec.key = createTargetKey( output.Type, output.Path )
+				spec.create = func() ( Output, Notifier, error ) {
+					influxFileOutput, influxFileError := NewInfluxFileOutput( output.Path )
+					if influxFileError != nil { return nil, nil, fmt.Errorf( "Unable to open file for InfluxDB line protocol: %s", influxFileError.Error() ) }
+					return influxFileOutput, nil, nil
+				}
+			}
+
+			// Publish to an MQTT broker
+			case "mqtt": {
+				if ( output.URL == "" ) { return nil, invalid( "output", "Missing the URL of the MQTT broker." ) }
+				if ( output.Topic == "" || strings.ContainsAny( output.Topic, "+#" ) ) { return nil, invalid( "mqtt-topic", "Invalid topic for the MQTT broker, must not be empty or contain wildcards." ) }
+
+				// Default to a client identifier that is unique to this host, as brokers disconnect duplicates
+				mqttClientID := output.ClientID
+				if ( mqttClientID == "" ) {
+					hostname, _ := os.Hostname()
+					mqttClientID = fmt.Sprintf( "apc-ups-exporter-%s", hostname )
+				}
+
+				spec.key = createTargetKey( output.Type, output.URL, output.Topic, mqttClientID, output.Username, output.Password, output.DiscoveryPrefix )
+				spec.create = func() ( Output, Notifier, error ) {
+					return NewMQTTOutput( output.URL, output.Topic, mqttClientID, output.Username, output.Password, output.DiscoveryPrefix ), nil, nil
+				}
+			}
+
+			// Write to a file for the node_exporter textfile collector
+			case "textfile": {
+				if !strings.HasSuffix( output.Path, ".prom" ) { return nil, invalid( "output", "Invalid path for the textfile collector, must end with .prom." ) }
+
+				outputTarget = output.Path
+				spec.key = createTargetKey( output.Type, output.Path, filterKey )
+				spec.create = func() ( Output, Notifier, error ) {
+					return NewTextfileOutput( output.Path, filteredGatherer ), nil, nil
+				}
+			}
+
+			// Export to an OpenTelemetry Collector over gRPC or HTTP
+			case "otlp-grpc", "otlp-http": {
+				if !isHTTPURL( output.URL ) { return nil, invalid( "output", "Invalid URL for the OTLP endpoint, must be an absolute HTTP or HTTPS URL." ) }
+
+				otlpHeaders := map[ string ]string {}
+				for _, otlpHeader := range output.Headers {
+					name, value, hasSeparator := strings.Cut( otlpHeader, "=" )
+					if ( !hasSeparator || strings.TrimSpace( name ) == "" ) { return nil, invalid( "otlp-header", fmt.Sprintf( "Invalid header '%s' for the OTLP endpoint, must be name=value.", otlpHeader ) ) }
+					otlpHeaders[ strings.TrimSpace( name ) ] = value
+				}
+
+				isGRPC := output.Type == "otlp-grpc"
+				spec.key = createTargetKey( output.Type, output.URL, output.Headers )
+				spec.create = func() ( Output, Notifier, error ) {
+					otlpOutput, otlpError := NewOTLPOutput( output.URL, isGRPC, otlpHeaders )
+					if otlpError != nil { return nil, nil, fmt.Errorf( "Failed to setup the OTLP output: %s", otlpError.Error() ) }
+					return otlpOutput, nil, nil
+				}
+			}
+
+			default: return nil, invalid( "output", fmt.Sprintf( "Unknown output type '%s'.", output.Type ) )
+
+		}
+
+		// Say where metrics are going once the output is created
+		createOutput := spec.create
+		spec.create = func() ( Output, Notifier, error ) {
+			output, _, createError := createOutput()
+			if createError != nil { return nil, nil, createError }
+
+			slog.Info( "Sending metrics to output", "output", output.Name(), "target", outputTarget )
+			return output, nil, nil
+		}
+
+		specs = append( specs, spec )
+	}
+
+	// Notifiers
+	notifierConfigurations, notifiersError := configuration.getNotifierConfigurations()
+	if notifiersError != nil { return nil, notifiersError }
+	for _, notifier := range notifierConfigurations {
+		invalid := func( flagName string, message string ) error {
+			if ( notifier.line == 0 ) { return configuration.invalidSetting( flagName, message ) }
+			return fmt.Errorf( "%s: line %d: %s", configuration.ConfigFile, notifier.line, message )
+		}
+
+		var spec targetSpec
+		notifierTarget, notifierTo := notifier.URL, []string( notifier.To )
+		switch notifier.Type {
+
+			// Send to a webhook
+			case "webhook": {
+				if !isHTTPURL( notifier.URL ) { return nil, invalid( "webhook", fmt.Sprintf( "Invalid webhook '%s:%s', must be preset:url with an absolute HTTP or HTTPS URL.", notifier.Preset, notifier.URL ) ) }
+				if ( notifier.Attempts < 1 ) { return nil, invalid( "webhook-attempts", "Invalid number of attempts for webhooks, must be at least 1." ) }
+				if ( notifier.Dedupe < 0 ) { return nil, invalid( "webhook-dedupe", "Invalid dedupe window for webhooks, must not be negative." ) }
+
+				// Load the template for the messages, which is part of the key so changes to it are picked up by reloads
+				webhookTemplate := DEFAULT_WEBHOOK_TEMPLATE
+				if ( notifier.Template != "" ) {
+					templateContent, readError := os.ReadFile( notifier.Template )
+					if readError != nil { return nil, invalid( "webhook-template", fmt.Sprintf( "Failed to read the webhook template: %s", readError.Error() ) ) }
+					webhookTemplate = string( templateContent )
+				}
+
+				webhookDedupe := time.Duration( notifier.Dedupe ) * time.Second
+				spec.key = createTargetKey( notifier.Type, notifier.Preset, notifier.URL, webhookTemplate, notifier.Attempts, webhookDedupe )
+				spec.create = func() ( Output, Notifier, error ) {
+					webhookNotifier, webhookError := NewWebhookNotifier( notifier.URL, notifier.Preset, webhookTemplate, notifier.Attempts, webhookDedupe )
+					if webhookError != nil { return nil, nil, fmt.Errorf( "Invalid webhook '%s:%s': %s", notifier.Preset, notifier.URL, webhookError.Error() ) }
+					return nil, webhookNotifier, nil
+				}
+			}
+
+			// Send emails
+			case "email": {
+				if ( notifier.SMTPAddress == "" ) { return nil, invalid( "smtp-address", "Missing the address of the SMTP server." ) }
+				if ( notifier.From == "" ) { return nil, invalid( "email-from", "The addresses to send emails from & to are required when using an SMTP server." ) }
+				if ( len( notifier.To ) == 0 ) { return nil, invalid( "email-to", "The addresses to send emails from & to are required when using an SMTP server." ) }
+				if ( notifier.Interval < 0 ) { return nil, invalid( "email-interval", "Invalid interval for emails, must not be negative." ) }
+
+				notifierTarget = notifier.SMTPAddress
+				emailTo, emailInterval := []string( notifier.To ), time.Duration( notifier.Interval ) * time.Second
+				spec.key = createTargetKey( notifier.Type, notifier.SMTPAddress, notifier.SMTPTLS, notifier.SMTPUsername, notifier.SMTPPassword, notifier.From, emailTo, emailInterval )
+				spec.create = func() ( Output, Notifier, error ) {
+					emailNotifier, emailError := NewEmailNotifier( notifier.SMTPAddress, notifier.SMTPTLS, notifier.SMTPUsername, notifier.SMTPPassword, notifier.From, emailTo, emailInterval )
+					if emailError != nil { return nil, nil, fmt.Errorf( "Invalid SMTP server: %s", emailError.Error() ) }
+					return nil, emailNotifier, nil
+				}
+			}
+
+			// Log to syslog
+			case "syslog": {
+				spec.key = createTargetKey( notifier.Type, notifier.URL )
+				spec.create = func() ( Output, Notifier, error ) {
+					eventLog, eventLogError := NewSyslogEventLog( notifier.URL )
+					if eventLogError != nil { return nil, nil, fmt.Errorf( "Invalid event log 'syslog:%s': %s", notifier.URL, eventLogError.Error() ) }
+					return nil, eventLog, nil
+				}
+			}
+
+			// Log to the systemd journal
+			case "journald": {
+				notifierTarget = notifier.Socket
+				spec.key = createTargetKey( notifier.Type, notifier.Socket )
+				spec.create = func() ( Output, Notifier, error ) {
+					return nil, NewJournaldEventLog( notifier.Socket ), nil
+				}
+			}
+
+			// Log to a file that is rotated
+			case "file": {
+				if ( notifier.Path == "" ) { return nil, invalid( "event-log", "Invalid event log 'file', missing the path to the file." ) }
+				if ( notifier.MaximumSize < 1 ) { return nil, invalid( "event-log-max-size", "Invalid rotation for event log files, the size must be at least 1 MiB & the number of files must not be negative." ) }
+				if ( notifier.MaximumFiles < 0 ) { return nil, invalid( "event-log-max-files", "Invalid rotation for event log files, the size must be at least 1 MiB & the number of files must not be negative." ) }
+
+				notifierTarget = notifier.Path
+				eventLogMaximumSize := int64( notifier.MaximumSize ) * 1024 * 1024
+				spec.key = createTargetKey( notifier.Type, notifier.Path, eventLogMaximumSize, notifier.MaximumFiles )
+				spec.create = func() ( Output, Notifier, error ) {
+					eventLog, eventLogError := NewFileEventLog( notifier.Path, eventLogMaximumSize, notifier.MaximumFiles )
+					if eventLogError != nil { return nil, nil, fmt.Errorf( "Invalid event log 'file:%s': %s", notifier.Path, eventLogError.Error() ) }
+					return nil, eventLog, nil
+				}
+			}
+
+			default: return nil, invalid( "event-log", fmt.Sprintf( "Unknown event log type '%s'.", notifier.Type ) )
+
+		}
+
+		// Say where power events are going once the notifier is created
+		createNotifier := spec.create
+		spec.create = func() ( Output, Notifier, error ) {
+			_, notifier, createError := createNotifier()
+			if createError != nil { return nil, nil, createError }
+
+			if ( len( notifierTo ) > 0 ) {
+				slog.Info( "Sending power events to notifier", "notifier", notifier.Name(), "target", notifierTarget, "to", strings.Join( notifierTo, ", " ) )
+			} else {
+				slog.Info( "Sending power events to notifier", "notifier", notifier.Name(), "target", notifierTarget )
+			}
+			return nil, notifier, nil
+		}
+
+		specs = append( specs, spec )
+	}
+
+	return specs, nil
+
+}
+
+// Creates the targets that are new or changed & closes those that are no longer configured, keeping the rest as they are
+// NOTE: If any target fails to be created then the current targets are all kept
+func applyTargets( specs []targetSpec ) ( err error ) {
+	targetsMutex.RLock()
+	existingTargets := make( map[ string ]target, len( targets ) )
+	for _, existingTarget := range targets { existingTargets[ existingTarget.key ] = existingTarget }
+	targetsMutex.RUnlock()
+
+	// Create the new targets, undoing everything if one fails
+	var newTargets, createdTargets []target
+	for _, spec := range specs {
+		if existingTarget, exists := existingTargets[ spec.key ]; exists {
+			newTargets = append( newTargets, existingTarget )
+			delete( existingTargets, spec.key ) // Duplicates are created again, rather than shared
+			continue
+		}
+
+		output, notifier, createError := spec.create()
+		if createError != nil {
+			closeTargets( createdTargets )
+			return createError
+		}
+
+		createdTarget := target { key: spec.key, output: output, notifier: notifier }
+		newTargets = append( newTargets, createdTarget )
+		createdTargets = append( createdTargets, createdTarget )
+	}
+
+	// Swap them in, with the permanent outputs & notifiers after them
+	newOutputs := []Output {}
+	newNotifiers := []Notifier {}
+	for _, newTarget := range newTargets {
+		if ( newTarget.output != nil ) { newOutputs = append( newOutputs, newTarget.output ) }
+		if ( newTarget.notifier != nil ) { newNotifiers = append( newNotifiers, newTarget.notifier ) }
+	}
+
+	targetsMutex.Lock()
+	targets = newTargets
+	outputs = append( newOutputs, permanentOutputs... )
+	notifiers = append( newNotifiers, permanentNotifiers... )
+	previousTargetsInUse := targetsInUse
+	targetsInUse = &sync.WaitGroup {}
+	targetsMutex.Unlock()
+
+	// Send anything still pending from the targets that were removed, once any collection or notification pass using them has finished
+	removedTargets := []target {}
+	for _, removedTarget := range existingTargets { removedTargets = append( removedTargets, removedTarget ) }
+	if ( len( removedTargets ) > 0 ) { previousTargetsInUse.Wait() }
+	closeTargets( removedTargets )
+
+	return nil
+}
+
+// Adds an output and/or notifier that is not created from the configuration, so it is never removed by reloads
+func addPermanentTarget( output Output, notifier Notifier ) {
+	targetsMutex.Lock()
+	defer targetsMutex.Unlock()
+
+	if ( output != nil ) {
+		permanentOutputs = append( permanentOutputs, output )
+		outputs = append( outputs[ : len( outputs ) : len( outputs ) ], output ) // Copy, as the current slice may be in use
+	}
+
+	if ( notifier != nil ) {
+		permanentNotifiers = append( permanentNotifiers, notifier )
+		notifiers = append( notifiers[ : len( notifiers ) : len( notifiers ) ], notifier )
+	}
+}
+
+// Closes the outputs & notifiers of targets that are no longer used
+func closeTargets( closingTargets []target ) {
+	for _, closingTarget := range closingTargets {
+		if ( closingTarget.output != nil ) {
+			if closeError := closingTarget.output.Close(); closeError != nil { slog.Error( "Failed to close output", "output", closingTarget.output.Name(), "error", closeError ) }
+		}
+
+		if closer, isCloser := closingTarget.notifier.( io.Closer ); isCloser {
+			if closeError := closer.Close(); closeError != nil { slog.Error( "Failed to close notifier", "notifier", closingTarget.notifier.Name(), "error", closeError ) }
+		}
+	}
+}
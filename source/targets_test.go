@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// An output that holds each publish until released, recording whether it was closed while publishing
+type testBlockingOutput struct {
+	publishing chan struct{}
+	release chan struct{}
+
+	isPublishing atomic.Bool
+	isClosed atomic.Bool
+	wasClosedWhilePublishing atomic.Bool
+}
+
+func ( output *testBlockingOutput ) Name() string {
+	return "blocking"
+}
+
+func ( output *testBlockingOutput ) Publish( status Status ) error {
+	output.isPublishing.Store( true )
+	defer output.isPublishing.Store( false )
+
+	output.publishing <- struct{}{}
+	<-output.release
+	return nil
+}
+
+func ( output *testBlockingOutput ) Close() error {
+	if output.isPublishing.Load() { output.wasClosedWhilePublishing.Store( true ) }
+	output.isClosed.Store( true )
+	return nil
+}
+
+// Keeps the outputs & notifiers as they are, restoring them once the test has finished
+func keepTestTargets( t *testing.T ) {
+	t.Helper()
+
+	targetsMutex.Lock()
+	previousTargets, previousOutputs, previousNotifiers := targets, outputs, notifiers
+	targetsMutex.Unlock()
+
+	t.Cleanup( func() {
+		targetsMutex.Lock()
+		targets, outputs, notifiers, targetsInUse = previousTargets, previousOutputs, previousNotifiers, &sync.WaitGroup {}
+		targetsMutex.Unlock()
+	} )
+}
+
+func TestApplyTargetsClosesRemovedOnceUnused( t *testing.T ) {
+	keepTestTargets( t )
+
+	output := &testBlockingOutput { publishing: make( chan struct{} ), release: make( chan struct{} ) }
+	if applyError := applyTargets( []targetSpec { { key: "blocking", create: func() ( Output, Notifier, error ) { return output, nil, nil } } } ); applyError != nil { t.Fatal( applyError ) }
+
+	// A collection is publishing to it when the configuration is reloaded without it
+	published := make( chan struct{} )
+	go func() {
+		defer close( published )
+		publishToOutputs( []Status { {} } )
+	}()
+	<-output.publishing
+
+	applied := make( chan error )
+	go func() { applied <- applyTargets( nil ) }()
+	select {
+		case <-applied: t.Fatal( "expected to wait for the collection before closing the removed output" )
+		case <-time.After( 100 * time.Millisecond ):
+	}
+	if ( len( getOutputs() ) != 0 ) { t.Errorf( "expected the removed output to no longer be used, got %d outputs", len( getOutputs() ) ) }
+	if output.isClosed.Load() { t.Error( "expected the output not to be closed while in use" ) }
+
+	// Closed once the collection has finished with it
+	close( output.release )
+	<-published
+	if applyError := <-applied; applyError != nil { t.Fatal( applyError ) }
+	if ( !output.isClosed.Load() || output.wasClosedWhilePublishing.Load() ) { t.Error( "expected the output to be closed once the collection had finished" ) }
+
+	// Nothing to wait for without any collection in progress
+	if applyError := applyTargets( nil ); applyError != nil { t.Fatal( applyError ) }
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Writes the metrics to a file for the node_exporter textfile collector, for hosts where another port cannot be opened
+// NOTE: The collector rejects timestamps & metrics that clash with its own, so only the untimestamped metrics about the UPS are written
+type TextfileOutput struct {
+	path string
+	gatherer prometheus.Gatherer
+}
+
+// Creates an output for a file in the textfile collector directory (e.g., '/var/lib/node_exporter/ups.prom')
+func NewTextfileOutput( path string, gatherer prometheus.Gatherer ) *TextfileOutput {
+	return &TextfileOutput { path: path, gatherer: gatherer }
+}
+
+// Gets a short name for display purposes
+func ( output *TextfileOutput ) Name() string {
+	return "textfile"
+}
+
+// Does the same as PublishMetrics(), as the metrics are gathered from the registries instead of the status
+func ( output *TextfileOutput ) Publish( status Status ) error {
+	return output.PublishMetrics()
+}
+
+// Writes the metrics to a temporary file then renames it over the original, so the collector never reads a half-written file
+// NOTE: The metrics of every target are gathered from their registries, so this is only called once per collection
+func ( output *TextfileOutput ) PublishMetrics() error {
+	return prometheus.WriteToTextfile( output.path, output.gatherer )
+}
+
+// Nothing to release, the file is left for the collector
+func ( output *TextfileOutput ) Close() error {
+	return nil
+}
@@ -1,11 +1,33 @@
 package main
 
 import (
+	"fmt"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
+// Valid names for metrics & labels - prometheus.io/docs/concepts/data_model/#metric-names-and-labels
+var (
+	metricNamePattern = regexp.MustCompile( "^[a-zA-Z_:][a-zA-Z0-9_:]*$" )
+	labelNamePattern = regexp.MustCompile( "^[a-zA-Z_][a-zA-Z0-9_]*$" )
+)
+
+// A command-line flag that can be given multiple times
+type repeatableFlag []string
+
+// Gets the values of the flag as text
+func ( values *repeatableFlag ) String() string {
+	return strings.Join( *values, ", " )
+}
+
+// Adds another value to the flag
+func ( values *repeatableFlag ) Set( value string ) error {
+	*values = append( *values, value )
+	return nil
+}
+
 // Smartly parses a string as a float using only the numeric components.
 func parseAsFloat(value string, fallback float64) (float64, error) {
 	numericValue := regexp.MustCompile("[^0-9.]+").ReplaceAllString(value, "") // Strip any non-numeric characters (except for the decimal point)
@@ -17,3 +39,25 @@ func parseAsFloat(value string, fallback float64) (float64, error) {
 
 	return strconv.ParseFloat(numericValue, 64)
 }
+
+// Parses label flags in the format name=value into a map of names to values
+func parseLabelFlags( values []string ) ( labels map[ string ]string, err error ) {
+	labels = map[ string ]string {}
+
+	for _, value := range values {
+		name, labelValue, hasSeparator := strings.Cut( value, "=" )
+		if ( !hasSeparator || !labelNamePattern.MatchString( name ) || strings.HasPrefix( name, "__" ) ) { return nil, fmt.Errorf( "'%s' must be name=value with a valid label name", value ) }
+
+		labels[ name ] = labelValue
+	}
+
+	return labels, nil
+}
+
+// Checks if a string is an absolute HTTP or HTTPS URL
+func isHTTPURL( value string ) bool {
+	parsedURL, parseError := url.Parse( value )
+	if parseError != nil { return false }
+
+	return ( parsedURL.Scheme == "http" || parsedURL.Scheme == "https" ) && parsedURL.Host != ""
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// The web configuration file, in the same format as the Prometheus exporter toolkit
+// github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md
+type WebConfig struct {
+	TLSServerConfig *struct {
+		CertificateFile string `yaml:"cert_file"`
+		KeyFile string `yaml:"key_file"`
+		ClientAuthType string `yaml:"client_auth_type"`
+		ClientCAFile string `yaml:"client_ca_file"`
+		ClientAllowedSANs []string `yaml:"client_allowed_sans"`
+		MinimumVersion string `yaml:"min_version"`
+		MaximumVersion string `yaml:"max_version"`
+		CipherSuites []string `yaml:"cipher_suites"`
+		CurvePreferences []string `yaml:"curve_preferences"`
+		PreferServerCipherSuites bool `yaml:"prefer_server_cipher_suites"` // NOTE: Accepted for compatibility, but Go ignores it
+	} `yaml:"tls_server_config"`
+
+	HTTPServerConfig struct {
+		HTTP2 *bool `yaml:"http2"`
+		Headers map[ string ]string `yaml:"headers"`
+	} `yaml:"http_server_config"`
+
+	BasicAuthUsers map[ string ]string `yaml:"basic_auth_users"` // Username to bcrypt hash
+
+	// Built from the above when loaded
+	tlsConfig *tls.Config
+}
+
+// Names of the TLS versions in the web configuration file
+var webConfigTLSVersions = map[ string ]uint16 {
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// Names of the client authentication types in the web configuration file
+var webConfigClientAuthTypes = map[ string ]tls.ClientAuthType {
+	"": tls.NoClientCert,
+	"NoClientCert": tls.NoClientCert,
+	"RequestClientCert": tls.RequestClientCert,
+	"RequireAnyClientCert": tls.RequireAnyClientCert,
+	"RequireClientCert": tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven": tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// Names of the elliptic curves in the web configuration file
+var webConfigCurves = map[ string ]tls.CurveID {
+	"CurveP256": tls.CurveP256,
+	"CurveP384": tls.CurveP384,
+	"CurveP521": tls.CurveP521,
+	"X25519": tls.X25519,
+}
+
+// Reads, validates & prepares a web configuration file, rejecting anything unknown
+func LoadWebConfig( path string ) ( webConfig *WebConfig, err error ) {
+	content, readError := os.ReadFile( path )
+	if readError != nil { return nil, readError }
+
+	webConfig = &WebConfig {}
+	decoder := yaml.NewDecoder( bytes.NewReader( content ) )
+	decoder.KnownFields( true )
+	if decodeError := decoder.Decode( webConfig ); decodeError != nil && !errors.Is( decodeError, io.EOF ) { return nil, decodeError }
+
+	// Check every password is a bcrypt hash, so a plain password is never accepted by mistake
+	for username, hash := range webConfig.BasicAuthUsers {
+		if ( username == "" ) { return nil, fmt.Errorf( "empty username for basic authentication" ) }
+		if _, costError := bcrypt.Cost( []byte( hash ) ); costError != nil { return nil, fmt.Errorf( "password for user '%s' is not a bcrypt hash: %w", username, costError ) }
+	}
+
+	// Nothing more to do without TLS
+	if ( webConfig.TLSServerConfig == nil ) { return webConfig, nil }
+	tlsServerConfig := webConfig.TLSServerConfig
+
+	// Relative paths are relative to the web configuration file
+	directory := filepath.Dir( path )
+	for _, filePath := range []*string { &tlsServerConfig.CertificateFile, &tlsServerConfig.KeyFile, &tlsServerConfig.ClientCAFile } {
+		if ( *filePath != "" && !filepath.IsAbs( *filePath ) ) { *filePath = filepath.Join( directory, *filePath ) }
+	}
+
+	if ( tlsServerConfig.CertificateFile == "" || tlsServerConfig.KeyFile == "" ) { return nil, fmt.Errorf( "both cert_file & key_file are required for TLS" ) }
+	certificate, certificateError := tls.LoadX509KeyPair( tlsServerConfig.CertificateFile, tlsServerConfig.KeyFile )
+	if certificateError != nil { return nil, fmt.Errorf( "failed to load certificate & key: %w", certificateError ) }
+
+	webConfig.tlsConfig = &tls.Config {
+		Certificates: []tls.Certificate { certificate },
+		MinVersion: tls.VersionTLS12,
+	}
+
+	// Versions
+	if ( tlsServerConfig.MinimumVersion != "" ) {
+		version, ok := webConfigTLSVersions[ tlsServerConfig.MinimumVersion ]
+		if !ok { return nil, fmt.Errorf( "unknown min_version '%s'", tlsServerConfig.MinimumVersion ) }
+		webConfig.tlsConfig.MinVersion = version
+	}
+	if ( tlsServerConfig.MaximumVersion != "" ) {
+		version, ok := webConfigTLSVersions[ tlsServerConfig.MaximumVersion ]
+		if !ok { return nil, fmt.Errorf( "unknown max_version '%s'", tlsServerConfig.MaximumVersion ) }
+		if ( version < webConfig.tlsConfig.MinVersion ) { return nil, fmt.Errorf( "max_version is lower than min_version" ) }
+		webConfig.tlsConfig.MaxVersion = version
+	}
+
+	// Cipher suites, by their standard names
+	for _, name := range tlsServerConfig.CipherSuites {
+		index := slices.IndexFunc( tls.CipherSuites(), func( suite *tls.CipherSuite ) bool { return suite.Name == name } )
+		if ( index < 0 ) { return nil, fmt.Errorf( "unknown or insecure cipher suite '%s'", name ) }
+		webConfig.tlsConfig.CipherSuites = append( webConfig.tlsConfig.CipherSuites, tls.CipherSuites()[ index ].ID )
+	}
+
+	// Curves
+	for _, name := range tlsServerConfig.CurvePreferences {
+		curve, ok := webConfigCurves[ name ]
+		if !ok { return nil, fmt.Errorf( "unknown curve '%s'", name ) }
+		webConfig.tlsConfig.CurvePreferences = append( webConfig.tlsConfig.CurvePreferences, curve )
+	}
+
+	// Client certificates
+	clientAuthType, ok := webConfigClientAuthTypes[ tlsServerConfig.ClientAuthType ]
+	if !ok { return nil, fmt.Errorf( "unknown client_auth_type '%s'", tlsServerConfig.ClientAuthType ) }
+	webConfig.tlsConfig.ClientAuth = clientAuthType
+	if ( tlsServerConfig.ClientCAFile != "" ) {
+		caContent, caError := os.ReadFile( tlsServerConfig.ClientCAFile )
+		if caError != nil { return nil, fmt.Errorf( "failed to read client CA: %w", caError ) }
+
+		webConfig.tlsConfig.ClientCAs = x509.NewCertPool()
+		if !webConfig.tlsConfig.ClientCAs.AppendCertsFromPEM( caContent ) { return nil, fmt.Errorf( "no certificates found in client CA '%s'", tlsServerConfig.ClientCAFile ) }
+	}
+	if ( ( clientAuthType == tls.VerifyClientCertIfGiven || clientAuthType == tls.RequireAndVerifyClientCert ) && webConfig.tlsConfig.ClientCAs == nil ) { return nil, fmt.Errorf( "client_ca_file is required to verify client certificates" ) }
+	if ( webConfig.tlsConfig.ClientCAs != nil && ( clientAuthType == tls.NoClientCert || clientAuthType == tls.RequestClientCert || clientAuthType == tls.RequireAnyClientCert ) ) { return nil, fmt.Errorf( "client_ca_file is only used when client_auth_type verifies client certificates" ) }
+
+	// Only allow clients with certain names, if given
+	if ( len( tlsServerConfig.ClientAllowedSANs ) > 0 ) {
+		if ( webConfig.tlsConfig.ClientCAs == nil ) { return nil, fmt.Errorf( "client_ca_file is required for client_allowed_sans" ) }
+		allowedSANs := tlsServerConfig.ClientAllowedSANs
+		webConfig.tlsConfig.VerifyPeerCertificate = func( rawCertificates [][]byte, verifiedChains [][]*x509.Certificate ) error {
+			if ( len( verifiedChains ) == 0 ) { return nil } // Not required to give a certificate
+			certificate := verifiedChains[ 0 ][ 0 ]
+
+			var names []string
+			names = append( names, certificate.DNSNames... )
+			names = append( names, certificate.EmailAddresses... )
+			for _, address := range certificate.IPAddresses { names = append( names, address.String() ) }
+			for _, uri := range certificate.URIs { names = append( names, uri.String() ) }
+			for _, name := range names {
+				if slices.Contains( allowedSANs, name ) { return nil }
+			}
+
+			return fmt.Errorf( "client certificate is not for an allowed name" )
+		}
+	}
+
+	// Offer HTTP/2 unless it is disabled
+	if ( webConfig.HTTPServerConfig.HTTP2 == nil || *webConfig.HTTPServerConfig.HTTP2 ) {
+		webConfig.tlsConfig.NextProtos = []string { "h2", "http/1.1" }
+	} else {
+		webConfig.tlsConfig.NextProtos = []string { "http/1.1" }
+	}
+
+	return webConfig, nil
+}
+
+/*************************************/
+
+// Secures the metrics server with a web configuration file, which is reloaded whenever it or any of the files it references change
+// This means certificates can be renewed without restarting the exporter
+type WebConfigServer struct {
+	path string
+
+	// The current configuration, the contents of the files when it was loaded, and when they were last checked
+	mutex sync.Mutex
+	current *WebConfig
+	fileHashes [][ sha256.Size ]byte
+	lastChecked time.Time
+
+	// Hashes of credentials that have already been checked against bcrypt, as it is deliberately slow
+	authenticatedMutex sync.Mutex
+	authenticated map[ [ sha256.Size ]byte ]bool
+
+	// Compared against for unknown usernames, so they take as long to reject as known ones
+	dummyHash []byte
+}
+
+// Loads a web configuration file for the metrics server
+func NewWebConfigServer( path string ) ( *WebConfigServer, error ) {
+	server := &WebConfigServer { path: path, authenticated: map[ [ sha256.Size ]byte ]bool {} }
+
+	webConfig, loadError := LoadWebConfig( path )
+	if loadError != nil { return nil, loadError }
+	server.current = webConfig
+	server.fileHashes = server.getFileHashes( webConfig )
+	server.lastChecked = time.Now()
+
+	dummyHash, hashError := bcrypt.GenerateFromPassword( []byte( "apc-ups-exporter" ), bcrypt.DefaultCost )
+	if hashError != nil { return nil, hashError }
+	server.dummyHash = dummyHash
+
+	return server, nil
+}
+
+// Checks if TLS is enabled, which cannot change without a restart as the listener would need replacing
+func ( server *WebConfigServer ) IsTLS() bool {
+	return server.current.TLSServerConfig != nil
+}
+
+// Gets hashes of the configuration file & the files it references, as modification times are too coarse to notice quick successive writes
+func ( server *WebConfigServer ) getFileHashes( webConfig *WebConfig ) ( fileHashes [][ sha256.Size ]byte ) {
+	paths := []string { server.path }
+	if ( webConfig.TLSServerConfig != nil ) { paths = append( paths, webConfig.TLSServerConfig.CertificateFile, webConfig.TLSServerConfig.KeyFile, webConfig.TLSServerConfig.ClientCAFile ) }
+
+	for _, path := range paths {
+		content, _ := os.ReadFile( path ) // Missing files are just empty, so they are noticed once they appear
+		fileHashes = append( fileHashes, sha256.Sum256( content ) )
+	}
+
+	return fileHashes
+}
+
+// Gets the current configuration, reloading it first if any of the files have changed since it was loaded
+// A configuration that fails to load is reported, and the previous one kept, so a half-written certificate does not take the server down
+func ( server *WebConfigServer ) Current() *WebConfig {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	// Check at most once a second, as this happens on every connection
+	if ( time.Since( server.lastChecked ) < time.Second ) { return server.current }
+	server.lastChecked = time.Now()
+	if slices.Equal( server.getFileHashes( server.current ), server.fileHashes ) { return server.current }
+
+	webConfig, loadError := LoadWebConfig( server.path )
+	if ( loadError == nil && ( webConfig.TLSServerConfig != nil ) != server.IsTLS() ) { loadError = fmt.Errorf( "enabling or disabling TLS requires a restart" ) }
+	if loadError != nil {
+		slog.Error( "Failed to reload the web configuration file, keeping the previous one", "path", server.path, "error", loadError )
+		server.fileHashes = server.getFileHashes( server.current ) // Do not try again until something changes
+		return server.current
+	}
+
+	slog.Info( "Reloaded the web configuration file", "path", server.path )
+	server.current = webConfig
+	server.fileHashes = server.getFileHashes( webConfig )
+	server.authenticatedMutex.Lock()
+	clear( server.authenticated )
+	server.authenticatedMutex.Unlock()
+
+	return server.current
+}
+
+// Gets the TLS configuration for the listener, which fetches the current configuration for each connection
+func ( server *WebConfigServer ) TLSConfig() *tls.Config {
+	return &tls.Config {
+		GetConfigForClient: func( *tls.ClientHelloInfo ) ( *tls.Config, error ) { return server.Current().tlsConfig, nil },
+	}
+}
+
+// Paths that never require basic authentication, as orchestrators probing them rarely have credentials
+var webConfigUnauthenticatedPaths = []string { "/healthz", "/readyz" }
+
+// Wraps a handler to add the configured headers & require basic authentication, if there are any users
+func ( server *WebConfigServer ) Handler( handler http.Handler ) http.Handler {
+	return http.HandlerFunc( func( response http.ResponseWriter, request *http.Request ) {
+		webConfig := server.Current()
+
+		for name, value := range webConfig.HTTPServerConfig.Headers { response.Header().Set( name, value ) }
+
+		if ( len( webConfig.BasicAuthUsers ) > 0 && !slices.Contains( webConfigUnauthenticatedPaths, request.URL.Path ) ) {
+			username, password, ok := request.BasicAuth()
+			if ( !ok || !server.checkCredentials( webConfig, username, password ) ) {
+				response.Header().Set( "WWW-Authenticate", `Basic realm="apc-ups-exporter", charset="UTF-8"` )
+				http.Error( response, "Unauthorized.", http.StatusUnauthorized )
+				return
+			}
+		}
+
+		handler.ServeHTTP( response, request )
+	} )
+}
+
+// Checks a username & password against the bcrypt hashes, remembering ones that were correct
+func ( server *WebConfigServer ) checkCredentials( webConfig *WebConfig, username string, password string ) bool {
+	key := sha256.Sum256( []byte( username + "\x00" + password ) )
+
+	server.authenticatedMutex.Lock()
+	isAuthenticated := server.authenticated[ key ]
+	server.authenticatedMutex.Unlock()
+	if isAuthenticated { return true }
+
+	// Always compare against a hash, so unknown usernames take as long as known ones
+	hash := server.dummyHash
+	knownHash, userExists := webConfig.BasicAuthUsers[ username ]
+	if userExists { hash = []byte( knownHash ) }
+	compareError := bcrypt.CompareHashAndPassword( hash, []byte( password ) )
+	if ( compareError != nil || !userExists ) { return false }
+
+	server.authenticatedMutex.Lock()
+	server.authenticated[ key ] = true
+	server.authenticatedMutex.Unlock()
+
+	return true
+}
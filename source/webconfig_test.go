@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Writes a web configuration file & a self-signed certificate beside it, giving the path of the file
+func writeTestWebConfig( t *testing.T, content string ) string {
+	t.Helper()
+	directory := t.TempDir()
+
+	key, keyError := ecdsa.GenerateKey( elliptic.P256(), rand.Reader )
+	if keyError != nil { t.Fatal( keyError ) }
+	template := &x509.Certificate {
+		SerialNumber: big.NewInt( 1 ),
+		DNSNames: []string { "localhost" },
+		NotBefore: time.Now().Add( -time.Hour ),
+		NotAfter: time.Now().Add( time.Hour ),
+	}
+	certificate, certificateError := x509.CreateCertificate( rand.Reader, template, template, &key.PublicKey, key )
+	if certificateError != nil { t.Fatal( certificateError ) }
+	keyBytes, _ := x509.MarshalECPrivateKey( key )
+
+	os.WriteFile( filepath.Join( directory, "server.crt" ), pem.EncodeToMemory( &pem.Block { Type: "CERTIFICATE", Bytes: certificate } ), 0644 )
+	os.WriteFile( filepath.Join( directory, "server.key" ), pem.EncodeToMemory( &pem.Block { Type: "EC PRIVATE KEY", Bytes: keyBytes } ), 0600 )
+
+	path := filepath.Join( directory, "web.yml" )
+	if writeError := os.WriteFile( path, []byte( content ), 0644 ); writeError != nil { t.Fatal( writeError ) }
+
+	return path
+}
+
+// Hashes a password cheaply, as the cost does not matter for the tests
+func hashTestPassword( t *testing.T, password string ) string {
+	t.Helper()
+
+	hash, hashError := bcrypt.GenerateFromPassword( []byte( password ), bcrypt.MinCost )
+	if hashError != nil { t.Fatal( hashError ) }
+
+	return string( hash )
+}
+
+func TestWebConfigTLSSettings( t *testing.T ) {
+	webConfig, err := LoadWebConfig( writeTestWebConfig( t, `
+tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+  min_version: TLS12
+  max_version: TLS13
+  cipher_suites: [ TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 ]
+  curve_preferences: [ X25519, CurveP256 ]
+http_server_config:
+  http2: false
+` ) )
+	if err != nil { t.Fatal( err ) }
+
+	tlsConfig := webConfig.tlsConfig
+	if ( tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.MaxVersion != tls.VersionTLS13 ) { t.Errorf( "unexpected versions %x to %x", tlsConfig.MinVersion, tlsConfig.MaxVersion ) }
+	if ( len( tlsConfig.CipherSuites ) != 2 || tlsConfig.CipherSuites[ 0 ] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 || tlsConfig.CipherSuites[ 1 ] != tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 ) { t.Errorf( "unexpected cipher suites %v", tlsConfig.CipherSuites ) }
+	if ( len( tlsConfig.CurvePreferences ) != 2 || tlsConfig.CurvePreferences[ 0 ] != tls.X25519 || tlsConfig.CurvePreferences[ 1 ] != tls.CurveP256 ) { t.Errorf( "unexpected curves %v", tlsConfig.CurvePreferences ) }
+	if ( len( tlsConfig.NextProtos ) != 1 || tlsConfig.NextProtos[ 0 ] != "http/1.1" ) { t.Errorf( "expected HTTP/2 to be disabled, got %v", tlsConfig.NextProtos ) }
+	if ( tlsConfig.ClientAuth != tls.NoClientCert ) { t.Errorf( "expected no client certificates, got %v", tlsConfig.ClientAuth ) }
+
+	// Defaults to TLS 1.2 at the least
+	webConfig, err = LoadWebConfig( writeTestWebConfig( t, "tls_server_config: { cert_file: server.crt, key_file: server.key }" ) )
+	if err != nil { t.Fatal( err ) }
+	if ( webConfig.tlsConfig.MinVersion != tls.VersionTLS12 || len( webConfig.tlsConfig.NextProtos ) != 2 ) { t.Errorf( "unexpected defaults %x & %v", webConfig.tlsConfig.MinVersion, webConfig.tlsConfig.NextProtos ) }
+}
+
+func TestWebConfigErrors( t *testing.T ) {
+	for _, test := range []struct {
+		content string
+		expected string
+	} {
+		{ "basic_auth_users: { prometheus: secret }", "is not a bcrypt hash" },
+		{ "tls_server_config: { cert_file: server.crt }", "both cert_file & key_file are required" },
+		{ "tls_server_config: { cert_file: server.crt, key_file: server.key, min_version: TLS14 }", "unknown min_version 'TLS14'" },
+		{ "tls_server_config: { cert_file: server.crt, key_file: server.key, min_version: TLS13, max_version: TLS12 }", "max_version is lower than min_version" },
+		{ "tls_server_config: { cert_file: server.crt, key_file: server.key, cipher_suites: [ TLS_RSA_WITH_RC4_128_SHA ] }", "unknown or insecure cipher suite" },
+		{ "tls_server_config: { cert_file: server.crt, key_file: server.key, curve_preferences: [ CurveP128 ] }", "unknown curve" },
+		{ "tls_server_config: { cert_file: server.crt, key_file: server.key, client_auth_type: RequireAndVerifyClientCert }", "client_ca_file is required" },
+		{ "tls_server_config: { cert_file: server.crt, key_file: server.key, colour: red }", "field colour not found" },
+	} {
+		_, err := LoadWebConfig( writeTestWebConfig( t, test.content ) )
+		if ( err == nil || !strings.Contains( err.Error(), test.expected ) ) { t.Errorf( "expected error containing %q for %q, got %v", test.expected, test.content, err ) }
+	}
+}
+
+func TestWebConfigBasicAuthentication( t *testing.T ) {
+	server, err := NewWebConfigServer( writeTestWebConfig( t, `
+basic_auth_users:
+  prometheus: ` + hashTestPassword( t, "secret" ) + `
+http_server_config:
+  headers: { X-Frame-Options: deny }
+` ) )
+	if err != nil { t.Fatal( err ) }
+	handler := server.Handler( http.HandlerFunc( func( response http.ResponseWriter, request *http.Request ) { response.Write( []byte( "metrics" ) ) } ) )
+
+	for _, test := range []struct {
+		path string
+		username string
+		password string
+		status int
+	} {
+		{ "/metrics", "prometheus", "secret", http.StatusOK },
+		{ "/metrics", "prometheus", "secret", http.StatusOK }, // Remembered
+		{ "/metrics", "prometheus", "wrong", http.StatusUnauthorized },
+		{ "/metrics", "unknown", "secret", http.StatusUnauthorized },
+		{ "/metrics", "", "", http.StatusUnauthorized },
+		{ "/healthz", "", "", http.StatusOK },
+		{ "/readyz", "", "", http.StatusOK },
+	} {
+		request := httptest.NewRequest( http.MethodGet, test.path, nil )
+		if ( test.username != "" ) { request.SetBasicAuth( test.username, test.password ) }
+		response := httptest.NewRecorder()
+		handler.ServeHTTP( response, request )
+
+		if ( response.Code != test.status ) { t.Errorf( "%s as %q with %q: expected %d, got %d", test.path, test.username, test.password, test.status, response.Code ) }
+		if ( response.Header().Get( "X-Frame-Options" ) != "deny" ) { t.Errorf( "%s: expected the configured headers", test.path ) }
+		if ( response.Code == http.StatusUnauthorized && response.Header().Get( "WWW-Authenticate" ) == "" ) { t.Errorf( "%s: expected to be asked for credentials", test.path ) }
+	}
+}
+
+func TestWebConfigReloadsOnChange( t *testing.T ) {
+	path := writeTestWebConfig( t, "basic_auth_users: { prometheus: " + hashTestPassword( t, "old" ) + " }" )
+	server, err := NewWebConfigServer( path )
+	if err != nil { t.Fatal( err ) }
+	initial := server.Current()
+
+	// Only checked once a second
+	os.WriteFile( path, []byte( "basic_auth_users: { prometheus: " + hashTestPassword( t, "new" ) + " }" ), 0644 )
+	if ( server.Current() != initial ) { t.Error( "expected the change not to be noticed within a second" ) }
+	server.lastChecked = time.Time {}
+	reloaded := server.Current()
+	if ( reloaded == initial ) { t.Fatal( "expected the changed file to be reloaded" ) }
+	if !server.checkCredentials( reloaded, "prometheus", "new" ) { t.Error( "expected the new password to be accepted" ) }
+
+	// An invalid change keeps the previous configuration
+	os.WriteFile( path, []byte( "basic_auth_users: { prometheus: new }" ), 0644 )
+	server.lastChecked = time.Time {}
+	if ( server.Current() != reloaded ) { t.Error( "expected an invalid change to keep the previous configuration" ) }
+
+	// Enabling TLS needs a restart
+	os.WriteFile( path, []byte( "tls_server_config: { cert_file: server.crt, key_file: server.key }" ), 0644 )
+	server.lastChecked = time.Time {}
+	if ( server.Current() != reloaded || server.IsTLS() ) { t.Error( "expected enabling TLS to be rejected" ) }
+}
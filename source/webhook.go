@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// The formats of webhook payloads
+const (
+	WEBHOOK_PRESET_SLACK = "slack"
+	WEBHOOK_PRESET_DISCORD = "discord"
+	WEBHOOK_PRESET_TEAMS = "teams"
+	WEBHOOK_PRESET_JSON = "json"
+)
+
+// The message used when no template is given
+const DEFAULT_WEBHOOK_TEMPLATE = "{{ .Summary }}"
+
+// POSTs a JSON payload about each power event to a webhook, formatted for a chat service or as generic JSON
+type WebhookNotifier struct {
+	url string
+	preset string
+	client *http.Client
+	template *template.Template
+
+	// The number of times to try sending, and how long to suppress a repeat of the same event for
+	Attempts int
+	DedupeWindow time.Duration
+
+	// The kind of event last sent for each UPS & when, so only an event that changes nothing is suppressed
+	sentMutex sync.Mutex
+	lastSent map[ string ]webhookSentEvent
+}
+
+// The kind of an event that was sent & when
+type webhookSentEvent struct {
+	Kind string
+	Time time.Time
+}
+
+// Creates a notifier for a webhook, with a Go template for the message
+func NewWebhookNotifier( url string, preset string, messageTemplate string, attempts int, dedupeWindow time.Duration ) ( *WebhookNotifier, error ) {
+
+	// Only the presets we know how to format
+	switch preset {
+		case WEBHOOK_PRESET_SLACK, WEBHOOK_PRESET_DISCORD, WEBHOOK_PRESET_TEAMS, WEBHOOK_PRESET_JSON:
+		default: return nil, fmt.Errorf( "unknown preset '%s', must be one of slack, discord, teams or json", preset )
+	}
+
+	// Parse the template for the message
+	parsedTemplate, parseError := template.New( "webhook" ).Parse( messageTemplate )
+	if parseError != nil { return nil, parseError }
+
+	return &WebhookNotifier {
+		url: url,
+		preset: preset,
+		client: &http.Client { Timeout: 10 * time.Second },
+		template: parsedTemplate,
+
+		Attempts: attempts,
+		DedupeWindow: dedupeWindow,
+
+		lastSent: map[ string ]webhookSentEvent {},
+	}, nil
+
+}
+
+// Gets a short name for display purposes
+func ( notifier *WebhookNotifier ) Name() string {
+	return fmt.Sprintf( "%s webhook", notifier.preset )
+}
+
+// Sends the event to the webhook, unless it is the same kind as the last event sent for this UPS within the dedupe window
+func ( notifier *WebhookNotifier ) Notify( event PowerEvent ) error {
+
+	// Skip repeats, such as a low battery flag that flickers, but never an event that changes the state (e.g., back on battery after mains power returned)
+	upsName := event.UPSName()
+	notifier.sentMutex.Lock()
+	lastSent, wasSent := notifier.lastSent[ upsName ]
+	isRepeat := wasSent && lastSent.Kind == event.Kind && event.Time.Sub( lastSent.Time ) < notifier.DedupeWindow
+	notifier.sentMutex.Unlock()
+	if isRepeat {
+		slog.Debug( "Not sending power event again, as it was sent recently", "notifier", notifier.Name(), "kind", event.Kind )
+		return nil
+	}
+
+	// Render the message & format the payload
+	var message strings.Builder
+	templateError := notifier.template.Execute( &message, event )
+	if templateError != nil { return fmt.Errorf( "render template: %w", templateError ) }
+	payload, encodeError := json.Marshal( notifier.formatPayload( event, strings.TrimSpace( message.String() ) ) )
+	if encodeError != nil { return encodeError }
+
+	// Send it, trying again if it fails
+	sendError := retryWithBackoff( notifier.Attempts, 2 * time.Second, func() error { return notifier.send( payload ) } )
+	if sendError != nil { return sendError }
+
+	// Remember it, for deduplication
+	notifier.sentMutex.Lock()
+	notifier.lastSent[ upsName ] = webhookSentEvent { event.Kind, event.Time }
+	notifier.sentMutex.Unlock()
+
+	return nil
+
+}
+
+// Formats the payload for the preset of the webhook
+func ( notifier *WebhookNotifier ) formatPayload( event PowerEvent, message string ) any {
+	switch notifier.preset {
+
+		// api.slack.com/messaging/webhooks
+		case WEBHOOK_PRESET_SLACK: return map[ string ]any { "text": message }
+
+		// discord.com/developers/docs/resources/webhook#execute-webhook
+		case WEBHOOK_PRESET_DISCORD: return map[ string ]any { "content": message, "username": PROJECT_NAME }
+
+		// learn.microsoft.com/en-us/microsoftteams/platform/webhooks-and-connectors/how-to/connectors-using
+		case WEBHOOK_PRESET_TEAMS: return map[ string ]any {
+			"@type": "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary": event.Title(),
+			"title": fmt.Sprintf( "%s: %s", event.UPSName(), event.Title() ),
+			"text": message,
+		}
+
+		// Everything we know about the event
+		default: return event.Record( message )
+
+	}
+}
+
+// POSTs the payload to the webhook
+func ( notifier *WebhookNotifier ) send( payload []byte ) error {
+
+	// Create the request
+	request, requestError := http.NewRequest( http.MethodPost, notifier.url, bytes.NewReader( payload ) )
+	if requestError != nil { return requestError }
+	request.Header.Set( "Content-Type", "application/json" )
+	request.Header.Set( "User-Agent", fmt.Sprintf( "apc-ups-exporter/%s", PROJECT_VERSION ) )
+
+	// Send the request
+	response, responseError := notifier.client.Do( request )
+	if responseError != nil { return responseError }
+	defer response.Body.Close()
+
+	// Anything other than success is a failure
+	if ( response.StatusCode < 200 || response.StatusCode >= 300 ) {
+		responseBody, _ := io.ReadAll( io.LimitReader( response.Body, 512 ) )
+		return fmt.Errorf( "%s: %s", response.Status, bytes.TrimSpace( responseBody ) )
+	}
+
+	return nil
+
+}
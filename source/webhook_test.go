@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookDedupesRepeats( t *testing.T ) {
+	var mutex sync.Mutex
+	var kinds []string
+	server := httptest.NewServer( http.HandlerFunc( func( response http.ResponseWriter, request *http.Request ) {
+		var payload struct {
+			Kind string `json:"kind"`
+			UPS struct {
+				Name string `json:"name"`
+			} `json:"ups"`
+		}
+		json.NewDecoder( request.Body ).Decode( &payload )
+
+		mutex.Lock()
+		kinds = append( kinds, payload.UPS.Name + " " + payload.Kind )
+		mutex.Unlock()
+	} ) )
+	defer server.Close()
+
+	notifier, err := NewWebhookNotifier( server.URL, WEBHOOK_PRESET_JSON, DEFAULT_WEBHOOK_TEMPLATE, 1, 5 * time.Minute )
+	if err != nil { t.Fatal( err ) }
+
+	// A mains supply that flaps, with repeats of the last event sent, then fails again much later
+	startedAt := time.Now()
+	for _, test := range []struct {
+		upsName string
+		kind string
+		seconds int
+	} {
+		{ "ups1", EVENT_ON_BATTERY, 0 },
+		{ "ups1", EVENT_ON_LINE, 10 },
+		{ "ups1", EVENT_ON_BATTERY, 20 },
+		{ "ups1", EVENT_ON_LINE, 30 },
+		{ "ups1", EVENT_ON_LINE, 35 },
+		{ "ups2", EVENT_ON_BATTERY, 40 },
+		{ "ups1", EVENT_ON_LINE, 50 },
+		{ "ups1", EVENT_ON_BATTERY, 400 },
+	} {
+		event := newTestPowerEvent( test.kind )
+		event.Time = startedAt.Add( time.Duration( test.seconds ) * time.Second )
+		event.Status.UPS.Name = test.upsName
+		if notifyError := notifier.Notify( event ); notifyError != nil { t.Fatal( notifyError ) }
+	}
+
+	expected := []string { "ups1 on_battery", "ups1 on_line", "ups1 on_battery", "ups1 on_line", "ups2 on_battery", "ups1 on_battery" }
+	if ( len( kinds ) != len( expected ) ) { t.Fatalf( "expected %v, got %v", expected, kinds ) }
+	for index := range expected {
+		if ( kinds[ index ] != expected[ index ] ) { t.Errorf( "expected %v, got %v", expected, kinds ) }
+	}
+}